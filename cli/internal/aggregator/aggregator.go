@@ -1,9 +1,16 @@
 package aggregator
 
 import (
+	"cmp"
+	"fmt"
+	"math"
+	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/zhaobenny/cctop/internal/billing"
 	"github.com/zhaobenny/cctop/internal/model"
 	"github.com/zhaobenny/cctop/internal/pricing"
 )
@@ -14,25 +21,215 @@ type Options struct {
 	Until    time.Time
 	Timezone *time.Location
 	Offline  bool
+
+	// OnlyModels keeps only records whose model name contains one of these
+	// substrings (all records if empty). ExcludeModels then drops records
+	// whose model name contains any of its substrings.
+	OnlyModels    []string
+	ExcludeModels []string
+
+	// ExcludeSessions drops records whose session ID starts with any of
+	// these prefixes, so the shortened IDs shown in tables can be used
+	ExcludeSessions []string
+
+	// WeekStart is the first day of the week for weekly grouping
+	WeekStart time.Weekday
+
+	// DayStart is the hour (0-23) days begin at for daily, weekly and monthly
+	// grouping. Usage before it counts towards the previous day.
+	DayStart int
+
+	// BillingDay is the day of month (1-31) billing cycles start on, for
+	// ByBillingCycle
+	BillingDay int
+
+	// WithDays makes ByMonth attach each month's daily usage
+	WithDays bool
+
+	// WholeGroups makes FilterGroups keep every record of a session or block
+	// that overlaps the date range, not just the in-range records
+	WholeGroups bool
+
+	// ProjectDepth groups projects by the first N path segments below
+	// ProjectRoot (usually the home directory). 0 groups by basename.
+	ProjectDepth int
+	ProjectRoot  string
+
+	// ProjectAliases maps old project paths to new ones, so a project's
+	// history is grouped together after it moves. Paths below an old path
+	// move with it.
+	ProjectAliases map[string]string
 }
 
-// FilterRecords filters records based on date range
+// FilterRecords filters records based on date range, model and session filters
 func FilterRecords(records []model.UsageRecord, opts Options) []model.UsageRecord {
 	var filtered []model.UsageRecord
 	for _, r := range records {
-		ts := r.Timestamp
-		if opts.Timezone != nil {
-			ts = ts.In(opts.Timezone)
-		}
-		if !opts.Since.IsZero() && ts.Before(opts.Since) {
+		if !wanted(r, opts) || !inRange(r, opts) {
 			continue
 		}
-		if !opts.Until.IsZero() && ts.After(opts.Until) {
+		filtered = append(filtered, r)
+	}
+	return filtered
+}
+
+// FilterGroups applies the date range to whole groups (sessions or blocks)
+// instead of single records. A group is kept if any of its records fall in
+// the range. By default only its in-range records are returned; with
+// opts.WholeGroups all of them are. The returned set holds the keys of kept
+// groups that have records outside the range, so their rows can be flagged.
+func FilterGroups(records []model.UsageRecord, opts Options, key func(model.UsageRecord) string) ([]model.UsageRecord, map[string]bool) {
+	kept := make(map[string]bool)
+	for _, r := range records {
+		if wanted(r, opts) && inRange(r, opts) {
+			kept[key(r)] = true
+		}
+	}
+
+	var filtered []model.UsageRecord
+	partial := make(map[string]bool)
+	for _, r := range records {
+		k := key(r)
+		if !kept[k] || !wanted(r, opts) {
 			continue
 		}
+		if !inRange(r, opts) {
+			partial[k] = true
+			if !opts.WholeGroups {
+				continue
+			}
+		}
 		filtered = append(filtered, r)
 	}
-	return filtered
+	return filtered, partial
+}
+
+// wanted reports whether a record passes the model and session filters
+func wanted(r model.UsageRecord, opts Options) bool {
+	for _, prefix := range opts.ExcludeSessions {
+		if strings.HasPrefix(r.SessionID, prefix) {
+			return false
+		}
+	}
+	return modelWanted(r.Model, opts)
+}
+
+// modelWanted reports whether a model passes the model filters: it must
+// match OnlyModels, if given, and then not match ExcludeModels
+func modelWanted(name string, opts Options) bool {
+	if len(opts.OnlyModels) > 0 && !matchesModel(name, opts.OnlyModels) {
+		return false
+	}
+	return !matchesModel(name, opts.ExcludeModels)
+}
+
+// inRange reports whether a record falls within the date range
+func inRange(r model.UsageRecord, opts Options) bool {
+	ts := r.Timestamp
+	if opts.Timezone != nil {
+		ts = ts.In(opts.Timezone)
+	}
+	if !opts.Since.IsZero() && ts.Before(opts.Since) {
+		return false
+	}
+	if !opts.Until.IsZero() && ts.After(opts.Until) {
+		return false
+	}
+	return true
+}
+
+// SessionKey returns the session a record is grouped under in BySession
+func SessionKey(r model.UsageRecord) string {
+	if r.SessionID == "" {
+		return "unknown"
+	}
+	return r.SessionID
+}
+
+// BlockDuration is the length of a billing block
+const BlockDuration = 5 * time.Hour
+
+// BlockStart returns the start of the 5-hour block containing t
+func BlockStart(t time.Time) time.Time {
+	ts := t.UTC()
+	blockHour := (ts.Hour() / 5) * 5
+	return time.Date(ts.Year(), ts.Month(), ts.Day(), blockHour, 0, 0, 0, time.UTC)
+}
+
+// BlockKey returns the 5-hour block a record is grouped under in ByBlock
+func BlockKey(r model.UsageRecord) string {
+	return BlockStart(r.Timestamp).Format("2006-01-02 15:04")
+}
+
+// localTime returns t in the timezone periods are grouped in
+func localTime(t time.Time, opts Options) time.Time {
+	if opts.Timezone != nil {
+		return t.In(opts.Timezone)
+	}
+	return t
+}
+
+// localDay returns midnight on the day t counts towards: its local date, or
+// the day before if it's earlier than DayStart. The local hour is compared
+// rather than subtracting a duration, so days stay aligned across DST changes.
+func localDay(t time.Time, opts Options) time.Time {
+	t = localTime(t, opts)
+	year, month, day := t.Date()
+	if t.Hour() < opts.DayStart {
+		day--
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+// dayKey returns the day t is grouped under in ByDay
+func dayKey(t time.Time, opts Options) string {
+	return localDay(t, opts).Format("2006-01-02")
+}
+
+// weekKey returns the week t is grouped under in ByWeek
+func weekKey(t time.Time, opts Options) string {
+	return WeekStart(localDay(t, opts), opts.WeekStart).Format("2006-01-02")
+}
+
+// monthKey returns the month t is grouped under in ByMonth
+func monthKey(t time.Time, opts Options) string {
+	return localDay(t, opts).Format("2006-01")
+}
+
+// cycleKey returns the billing cycle t is grouped under in ByBillingCycle
+func cycleKey(t time.Time, opts Options) string {
+	start, _ := billing.PeriodFor(opts.BillingDay, localTime(t, opts))
+	return start.Format("2006-01-02")
+}
+
+// PeriodKey returns the key t is grouped under in the daily, weekly,
+// monthly, billing or blocks report, or false for reports not grouped by time
+func PeriodKey(report string, t time.Time, opts Options) (string, bool) {
+	switch report {
+	case "daily":
+		return dayKey(t, opts), true
+	case "weekly":
+		return weekKey(t, opts), true
+	case "monthly":
+		return monthKey(t, opts), true
+	case "billing":
+		return cycleKey(t, opts), true
+	case "blocks":
+		return BlockStart(t).Format("2006-01-02 15:04"), true
+	}
+	return "", false
+}
+
+// matchesModel reports whether a model name contains any of the given substrings.
+// Short names like "sonnet-4-5" are substrings of the full ID, so both forms match.
+func matchesModel(name string, substrings []string) bool {
+	name = strings.ToLower(name)
+	for _, s := range substrings {
+		if s != "" && strings.Contains(name, strings.ToLower(s)) {
+			return true
+		}
+	}
+	return false
 }
 
 // ByDay aggregates usage by day
@@ -41,11 +238,7 @@ func ByDay(records []model.UsageRecord, opts Options) []model.AggregatedUsage {
 	modelsMap := make(map[string]map[string]bool)
 
 	for _, r := range records {
-		ts := r.Timestamp
-		if opts.Timezone != nil {
-			ts = ts.In(opts.Timezone)
-		}
-		key := ts.Format("2006-01-02")
+		key := dayKey(r.Timestamp, opts)
 
 		if _, ok := grouped[key]; !ok {
 			grouped[key] = &model.AggregatedUsage{Key: key}
@@ -57,10 +250,10 @@ func ByDay(records []model.UsageRecord, opts Options) []model.AggregatedUsage {
 		agg.Usage.OutputTokens += r.Usage.OutputTokens
 		agg.Usage.CacheCreationInputTokens += r.Usage.CacheCreationInputTokens
 		agg.Usage.CacheReadInputTokens += r.Usage.CacheReadInputTokens
+		agg.Usage.WebSearchRequests += r.Usage.WebSearchRequests
 		agg.RecordCount++
 
-		p := pricing.GetPricing(r.Model, opts.Offline)
-		agg.Cost += pricing.CalculateCost(r.Usage, p)
+		agg.Cost += pricing.RecordCost(r, opts.Offline)
 
 		modelsMap[key][r.Model] = true
 	}
@@ -88,11 +281,59 @@ func ByMonth(records []model.UsageRecord, opts Options) []model.AggregatedUsage
 	modelsMap := make(map[string]map[string]bool)
 
 	for _, r := range records {
-		ts := r.Timestamp
-		if opts.Timezone != nil {
-			ts = ts.In(opts.Timezone)
+		key := monthKey(r.Timestamp, opts)
+
+		if _, ok := grouped[key]; !ok {
+			grouped[key] = &model.AggregatedUsage{Key: key}
+			modelsMap[key] = make(map[string]bool)
 		}
-		key := ts.Format("2006-01")
+
+		agg := grouped[key]
+		agg.Usage.InputTokens += r.Usage.InputTokens
+		agg.Usage.OutputTokens += r.Usage.OutputTokens
+		agg.Usage.CacheCreationInputTokens += r.Usage.CacheCreationInputTokens
+		agg.Usage.CacheReadInputTokens += r.Usage.CacheReadInputTokens
+		agg.Usage.WebSearchRequests += r.Usage.WebSearchRequests
+		agg.RecordCount++
+
+		agg.Cost += pricing.RecordCost(r, opts.Offline)
+
+		modelsMap[key][r.Model] = true
+	}
+
+	var results []model.AggregatedUsage
+	for key, agg := range grouped {
+		for m := range modelsMap[key] {
+			agg.Models = append(agg.Models, m)
+		}
+		sort.Strings(agg.Models)
+		results = append(results, *agg)
+	}
+
+	if opts.WithDays {
+		for _, day := range ByDay(records, opts) {
+			month := grouped[day.Key[:len("2006-01")]]
+			month.Days = append(month.Days, day)
+		}
+		for i := range results {
+			results[i].Days = grouped[results[i].Key].Days
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Key > results[j].Key
+	})
+
+	return results
+}
+
+// ByWeek aggregates usage by week, keyed by the date the week starts on
+func ByWeek(records []model.UsageRecord, opts Options) []model.AggregatedUsage {
+	grouped := make(map[string]*model.AggregatedUsage)
+	modelsMap := make(map[string]map[string]bool)
+
+	for _, r := range records {
+		key := weekKey(r.Timestamp, opts)
 
 		if _, ok := grouped[key]; !ok {
 			grouped[key] = &model.AggregatedUsage{Key: key}
@@ -104,10 +345,10 @@ func ByMonth(records []model.UsageRecord, opts Options) []model.AggregatedUsage
 		agg.Usage.OutputTokens += r.Usage.OutputTokens
 		agg.Usage.CacheCreationInputTokens += r.Usage.CacheCreationInputTokens
 		agg.Usage.CacheReadInputTokens += r.Usage.CacheReadInputTokens
+		agg.Usage.WebSearchRequests += r.Usage.WebSearchRequests
 		agg.RecordCount++
 
-		p := pricing.GetPricing(r.Model, opts.Offline)
-		agg.Cost += pricing.CalculateCost(r.Usage, p)
+		agg.Cost += pricing.RecordCost(r, opts.Offline)
 
 		modelsMap[key][r.Model] = true
 	}
@@ -128,6 +369,73 @@ func ByMonth(records []model.UsageRecord, opts Options) []model.AggregatedUsage
 	return results
 }
 
+// ByBillingCycle aggregates usage by billing cycle, keyed by the date the
+// cycle starts on. Cycles start on BillingDay, clamped to the end of short
+// months, exactly as the server's billing view; DayStart doesn't apply.
+func ByBillingCycle(records []model.UsageRecord, opts Options) []model.AggregatedUsage {
+	grouped := make(map[string]*model.AggregatedUsage)
+	modelsMap := make(map[string]map[string]bool)
+
+	for _, r := range records {
+		key := cycleKey(r.Timestamp, opts)
+
+		if _, ok := grouped[key]; !ok {
+			grouped[key] = &model.AggregatedUsage{Key: key}
+			modelsMap[key] = make(map[string]bool)
+		}
+
+		agg := grouped[key]
+		agg.Usage.InputTokens += r.Usage.InputTokens
+		agg.Usage.OutputTokens += r.Usage.OutputTokens
+		agg.Usage.CacheCreationInputTokens += r.Usage.CacheCreationInputTokens
+		agg.Usage.CacheReadInputTokens += r.Usage.CacheReadInputTokens
+		agg.Usage.WebSearchRequests += r.Usage.WebSearchRequests
+		agg.RecordCount++
+
+		agg.Cost += pricing.RecordCost(r, opts.Offline)
+
+		modelsMap[key][r.Model] = true
+	}
+
+	var results []model.AggregatedUsage
+	for key, agg := range grouped {
+		for m := range modelsMap[key] {
+			agg.Models = append(agg.Models, m)
+		}
+		sort.Strings(agg.Models)
+		results = append(results, *agg)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Key > results[j].Key
+	})
+
+	return results
+}
+
+// WeekStart returns midnight on the first day of the week containing t,
+// where weeks begin on the given weekday. With time.Monday this matches
+// ISO week boundaries.
+func WeekStart(t time.Time, start time.Weekday) time.Time {
+	offset := (int(t.Weekday()) - int(start) + 7) % 7
+	year, month, day := t.Date()
+	return time.Date(year, month, day-offset, 0, 0, 0, 0, t.Location())
+}
+
+// ParseWeekday parses a weekday name such as "monday" or "sun"
+func ParseWeekday(name string) (time.Weekday, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if len(name) < 3 {
+		return 0, false
+	}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.HasPrefix(strings.ToLower(d.String()), name) {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
 // BySession aggregates usage by session ID
 func BySession(records []model.UsageRecord, opts Options) []model.AggregatedUsage {
 	grouped := make(map[string]*model.AggregatedUsage)
@@ -135,10 +443,7 @@ func BySession(records []model.UsageRecord, opts Options) []model.AggregatedUsag
 	sessionTimes := make(map[string]time.Time)
 
 	for _, r := range records {
-		key := r.SessionID
-		if key == "" {
-			key = "unknown"
-		}
+		key := SessionKey(r)
 
 		if _, ok := grouped[key]; !ok {
 			grouped[key] = &model.AggregatedUsage{Key: key}
@@ -156,10 +461,10 @@ func BySession(records []model.UsageRecord, opts Options) []model.AggregatedUsag
 		agg.Usage.OutputTokens += r.Usage.OutputTokens
 		agg.Usage.CacheCreationInputTokens += r.Usage.CacheCreationInputTokens
 		agg.Usage.CacheReadInputTokens += r.Usage.CacheReadInputTokens
+		agg.Usage.WebSearchRequests += r.Usage.WebSearchRequests
 		agg.RecordCount++
 
-		p := pricing.GetPricing(r.Model, opts.Offline)
-		agg.Cost += pricing.CalculateCost(r.Usage, p)
+		agg.Cost += pricing.RecordCost(r, opts.Offline)
 
 		modelsMap[key][r.Model] = true
 	}
@@ -181,6 +486,259 @@ func BySession(records []model.UsageRecord, opts Options) []model.AggregatedUsag
 	return results
 }
 
+// AnonymizeSessions replaces the keys of BySession results with sequential
+// labels (session-1, session-2, ...) in their order of most recent activity,
+// so output can be shared without revealing session IDs
+func AnonymizeSessions(results []model.AggregatedUsage) {
+	for i := range results {
+		results[i].Key = fmt.Sprintf("session-%d", i+1)
+	}
+}
+
+// BySource aggregates usage by the data directory records were read from
+func BySource(records []model.UsageRecord, opts Options) []model.AggregatedUsage {
+	grouped := make(map[string]*model.AggregatedUsage)
+	modelsMap := make(map[string]map[string]bool)
+
+	for _, r := range records {
+		key := r.Source
+		if key == "" {
+			key = "unknown"
+		}
+
+		if _, ok := grouped[key]; !ok {
+			grouped[key] = &model.AggregatedUsage{Key: key}
+			modelsMap[key] = make(map[string]bool)
+		}
+
+		agg := grouped[key]
+		agg.Usage.InputTokens += r.Usage.InputTokens
+		agg.Usage.OutputTokens += r.Usage.OutputTokens
+		agg.Usage.CacheCreationInputTokens += r.Usage.CacheCreationInputTokens
+		agg.Usage.CacheReadInputTokens += r.Usage.CacheReadInputTokens
+		agg.Usage.WebSearchRequests += r.Usage.WebSearchRequests
+		agg.RecordCount++
+
+		agg.Cost += pricing.RecordCost(r, opts.Offline)
+
+		modelsMap[key][r.Model] = true
+	}
+
+	var results []model.AggregatedUsage
+	for key, agg := range grouped {
+		for m := range modelsMap[key] {
+			agg.Models = append(agg.Models, m)
+		}
+		sort.Strings(agg.Models)
+		results = append(results, *agg)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Key < results[j].Key
+	})
+
+	return results
+}
+
+// LocalClient is the client ByClient groups records without a client ID
+// under, which is all usage read from local logs
+const LocalClient = "local"
+
+// ByClient aggregates usage by the machine that synced it, for usage read
+// from a server export
+func ByClient(records []model.UsageRecord, opts Options) []model.AggregatedUsage {
+	grouped := make(map[string]*model.AggregatedUsage)
+	modelsMap := make(map[string]map[string]bool)
+
+	for _, r := range records {
+		key := r.ClientID
+		if key == "" {
+			key = LocalClient
+		}
+
+		if _, ok := grouped[key]; !ok {
+			grouped[key] = &model.AggregatedUsage{Key: key}
+			modelsMap[key] = make(map[string]bool)
+		}
+
+		agg := grouped[key]
+		agg.Usage.InputTokens += r.Usage.InputTokens
+		agg.Usage.OutputTokens += r.Usage.OutputTokens
+		agg.Usage.CacheCreationInputTokens += r.Usage.CacheCreationInputTokens
+		agg.Usage.CacheReadInputTokens += r.Usage.CacheReadInputTokens
+		agg.Usage.WebSearchRequests += r.Usage.WebSearchRequests
+		agg.RecordCount++
+
+		agg.Cost += pricing.RecordCost(r, opts.Offline)
+
+		modelsMap[key][r.Model] = true
+	}
+
+	var results []model.AggregatedUsage
+	for key, agg := range grouped {
+		for m := range modelsMap[key] {
+			agg.Models = append(agg.Models, m)
+		}
+		sort.Strings(agg.Models)
+		results = append(results, *agg)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Key < results[j].Key
+	})
+
+	return results
+}
+
+// ByModel aggregates usage by model
+func ByModel(records []model.UsageRecord, opts Options) []model.AggregatedUsage {
+	grouped := make(map[string]*model.AggregatedUsage)
+
+	for _, r := range records {
+		key := r.Model
+
+		if _, ok := grouped[key]; !ok {
+			grouped[key] = &model.AggregatedUsage{Key: key, Models: []string{key}}
+		}
+
+		agg := grouped[key]
+		agg.Usage.InputTokens += r.Usage.InputTokens
+		agg.Usage.OutputTokens += r.Usage.OutputTokens
+		agg.Usage.CacheCreationInputTokens += r.Usage.CacheCreationInputTokens
+		agg.Usage.CacheReadInputTokens += r.Usage.CacheReadInputTokens
+		agg.Usage.WebSearchRequests += r.Usage.WebSearchRequests
+		agg.RecordCount++
+
+		agg.Cost += pricing.RecordCost(r, opts.Offline)
+	}
+
+	var results []model.AggregatedUsage
+	for _, agg := range grouped {
+		results = append(results, *agg)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Key < results[j].Key
+	})
+
+	return results
+}
+
+// Efficiency computes the realized cost per million tokens of each model in
+// ByModel results, cheapest first
+func Efficiency(results []model.AggregatedUsage, offline bool) []model.ModelEfficiency {
+	var rows []model.ModelEfficiency
+	for _, r := range results {
+		u := r.Usage
+		tokens := u.InputTokens + u.OutputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
+		row := model.ModelEfficiency{Model: r.Key, Tokens: tokens, Cost: r.Cost}
+		if tokens > 0 {
+			row.RealizedPerMTok = r.Cost / float64(tokens) * 1e6
+		}
+		if input := u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens; input > 0 {
+			row.CacheHitRatio = float64(u.CacheReadInputTokens) / float64(input)
+		}
+		if p, ok := pricing.LookupPricing(r.Key, offline); ok {
+			row.ListInputPerMTok = p.InputCostPerToken * 1e6
+		}
+		rows = append(rows, row)
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].RealizedPerMTok < rows[j].RealizedPerMTok
+	})
+	return rows
+}
+
+// aliasProject returns path with the longest matching alias applied
+func aliasProject(path string, aliases map[string]string) string {
+	best := ""
+	for old := range aliases {
+		if len(old) <= len(best) {
+			continue
+		}
+		if path == old || strings.HasPrefix(path, old+string(filepath.Separator)) {
+			best = old
+		}
+	}
+	if best == "" {
+		return path
+	}
+	return filepath.Join(aliases[best], strings.TrimPrefix(path, best))
+}
+
+// ProjectKey returns the project a record is grouped under in ByProject
+func ProjectKey(r model.UsageRecord, opts Options) string {
+	path := filepath.Clean(r.ProjectPath)
+	if r.ProjectPath == "" || path == string(filepath.Separator) {
+		return "unknown"
+	}
+	path = aliasProject(path, opts.ProjectAliases)
+	if opts.ProjectDepth <= 0 {
+		return filepath.Base(path)
+	}
+
+	// Paths under the root are shown relative to it, e.g. ~/work/clientA
+	prefix := ""
+	if opts.ProjectRoot != "" {
+		if rel, err := filepath.Rel(opts.ProjectRoot, path); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			path = rel
+			prefix = "~" + string(filepath.Separator)
+		}
+	}
+	if prefix == "" && filepath.IsAbs(path) {
+		prefix = string(filepath.Separator)
+	}
+
+	segments := strings.Split(strings.TrimPrefix(path, string(filepath.Separator)), string(filepath.Separator))
+	if len(segments) > opts.ProjectDepth {
+		segments = segments[:opts.ProjectDepth]
+	}
+	return prefix + filepath.Join(segments...)
+}
+
+// ByProject aggregates usage by project directory, see ProjectKey
+func ByProject(records []model.UsageRecord, opts Options) []model.AggregatedUsage {
+	grouped := make(map[string]*model.AggregatedUsage)
+	modelsMap := make(map[string]map[string]bool)
+
+	for _, r := range records {
+		key := ProjectKey(r, opts)
+
+		if _, ok := grouped[key]; !ok {
+			grouped[key] = &model.AggregatedUsage{Key: key}
+			modelsMap[key] = make(map[string]bool)
+		}
+
+		agg := grouped[key]
+		agg.Usage.InputTokens += r.Usage.InputTokens
+		agg.Usage.OutputTokens += r.Usage.OutputTokens
+		agg.Usage.CacheCreationInputTokens += r.Usage.CacheCreationInputTokens
+		agg.Usage.CacheReadInputTokens += r.Usage.CacheReadInputTokens
+		agg.Usage.WebSearchRequests += r.Usage.WebSearchRequests
+		agg.RecordCount++
+
+		agg.Cost += pricing.RecordCost(r, opts.Offline)
+
+		modelsMap[key][r.Model] = true
+	}
+
+	var results []model.AggregatedUsage
+	for key, agg := range grouped {
+		for m := range modelsMap[key] {
+			agg.Models = append(agg.Models, m)
+		}
+		sort.Strings(agg.Models)
+		results = append(results, *agg)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Key < results[j].Key
+	})
+
+	return results
+}
+
 // ByBlock aggregates usage by 5-hour billing windows
 // Blocks start at midnight UTC: 00:00, 05:00, 10:00, 15:00, 20:00
 func ByBlock(records []model.UsageRecord, opts Options) []model.AggregatedUsage {
@@ -188,16 +746,11 @@ func ByBlock(records []model.UsageRecord, opts Options) []model.AggregatedUsage
 	modelsMap := make(map[string]map[string]bool)
 
 	for _, r := range records {
-		ts := r.Timestamp.UTC()
-
-		// Calculate block start time
-		hour := ts.Hour()
-		blockHour := (hour / 5) * 5
-		blockStart := time.Date(ts.Year(), ts.Month(), ts.Day(), blockHour, 0, 0, 0, time.UTC)
-		key := blockStart.Format("2006-01-02 15:04")
+		key := BlockKey(r)
 
 		if _, ok := grouped[key]; !ok {
-			grouped[key] = &model.AggregatedUsage{Key: key}
+			start := BlockStart(r.Timestamp)
+			grouped[key] = &model.AggregatedUsage{Key: key, Start: start, End: start.Add(BlockDuration)}
 			modelsMap[key] = make(map[string]bool)
 		}
 
@@ -206,10 +759,10 @@ func ByBlock(records []model.UsageRecord, opts Options) []model.AggregatedUsage
 		agg.Usage.OutputTokens += r.Usage.OutputTokens
 		agg.Usage.CacheCreationInputTokens += r.Usage.CacheCreationInputTokens
 		agg.Usage.CacheReadInputTokens += r.Usage.CacheReadInputTokens
+		agg.Usage.WebSearchRequests += r.Usage.WebSearchRequests
 		agg.RecordCount++
 
-		p := pricing.GetPricing(r.Model, opts.Offline)
-		agg.Cost += pricing.CalculateCost(r.Usage, p)
+		agg.Cost += pricing.RecordCost(r, opts.Offline)
 
 		modelsMap[key][r.Model] = true
 	}
@@ -230,6 +783,89 @@ func ByBlock(records []model.UsageRecord, opts Options) []model.AggregatedUsage
 	return results
 }
 
+// MovingAverage computes an N-day trailing average of cost for ByDay results.
+// Calendar days without usage count as zero. Days whose window reaches back
+// before the earliest day in results have no full window and are NaN.
+// The returned slice is index-aligned with results.
+func MovingAverage(results []model.AggregatedUsage, days int) []float64 {
+	averages := make([]float64, len(results))
+	if days <= 0 || len(results) == 0 {
+		for i := range averages {
+			averages[i] = math.NaN()
+		}
+		return averages
+	}
+
+	costs := make(map[string]float64)
+	var earliest time.Time
+	for _, r := range results {
+		t, err := time.Parse("2006-01-02", r.Key)
+		if err != nil {
+			continue
+		}
+		costs[r.Key] += r.Cost
+		if earliest.IsZero() || t.Before(earliest) {
+			earliest = t
+		}
+	}
+
+	for i, r := range results {
+		t, err := time.Parse("2006-01-02", r.Key)
+		if err != nil || t.AddDate(0, 0, -(days-1)).Before(earliest) {
+			averages[i] = math.NaN()
+			continue
+		}
+
+		var sum float64
+		for d := 0; d < days; d++ {
+			sum += costs[t.AddDate(0, 0, -d).Format("2006-01-02")]
+		}
+		averages[i] = sum / float64(days)
+	}
+
+	return averages
+}
+
+// CumulativeCost returns the running total cost of time-keyed results
+// (daily, weekly or monthly), summed oldest first whatever order results
+// are in. The returned slice is index-aligned with results.
+func CumulativeCost(results []model.AggregatedUsage) []float64 {
+	order := make([]int, len(results))
+	for i := range order {
+		order[i] = i
+	}
+	// Period keys sort chronologically as strings
+	sort.SliceStable(order, func(a, b int) bool {
+		return results[order[a]].Key < results[order[b]].Key
+	})
+
+	totals := make([]float64, len(results))
+	var sum float64
+	for _, i := range order {
+		sum += results[i].Cost
+		totals[i] = sum
+	}
+	return totals
+}
+
+// Newest returns the indices of the n newest time-keyed results (daily,
+// weekly, monthly or blocks), in the order results are in, whatever that
+// order is. All indices are returned if n covers every result.
+func Newest(results []model.AggregatedUsage, n int) []int {
+	order := make([]int, len(results))
+	for i := range order {
+		order[i] = i
+	}
+	// Period keys sort chronologically as strings
+	sort.SliceStable(order, func(a, b int) bool {
+		return results[order[a]].Key > results[order[b]].Key
+	})
+
+	keep := order[:min(n, len(order))]
+	sort.Ints(keep)
+	return keep
+}
+
 // CalculateTotal returns the total aggregated usage
 func CalculateTotal(results []model.AggregatedUsage) model.AggregatedUsage {
 	total := model.AggregatedUsage{Key: "Total"}
@@ -240,6 +876,7 @@ func CalculateTotal(results []model.AggregatedUsage) model.AggregatedUsage {
 		total.Usage.OutputTokens += r.Usage.OutputTokens
 		total.Usage.CacheCreationInputTokens += r.Usage.CacheCreationInputTokens
 		total.Usage.CacheReadInputTokens += r.Usage.CacheReadInputTokens
+		total.Usage.WebSearchRequests += r.Usage.WebSearchRequests
 		total.Cost += r.Cost
 		total.RecordCount += r.RecordCount
 
@@ -255,3 +892,50 @@ func CalculateTotal(results []model.AggregatedUsage) model.AggregatedUsage {
 
 	return total
 }
+
+// VersionSpan returns the oldest and newest Claude Code versions that wrote
+// records, and how many records have no version (older logs, imports).
+// oldest and newest are empty if no record has a version.
+func VersionSpan(records []model.UsageRecord) (oldest, newest string, missing int) {
+	for _, r := range records {
+		switch {
+		case r.Version == "":
+			missing++
+		case oldest == "":
+			oldest, newest = r.Version, r.Version
+		case compareVersions(r.Version, oldest) < 0:
+			oldest = r.Version
+		case compareVersions(r.Version, newest) > 0:
+			newest = r.Version
+		}
+	}
+	return oldest, newest, missing
+}
+
+// compareVersions compares dotted versions like 1.0.30 part by part,
+// numerically where both parts are numbers. Returns -1, 0 or 1.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < max(len(as), len(bs)); i++ {
+		var pa, pb string
+		if i < len(as) {
+			pa = as[i]
+		}
+		if i < len(bs) {
+			pb = bs[i]
+		}
+		na, errA := strconv.Atoi(pa)
+		nb, errB := strconv.Atoi(pb)
+		if errA == nil && errB == nil {
+			if na != nb {
+				return cmp.Compare(na, nb)
+			}
+			continue
+		}
+		if c := strings.Compare(pa, pb); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
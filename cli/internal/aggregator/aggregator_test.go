@@ -0,0 +1,302 @@
+package aggregator
+
+import (
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/zhaobenny/cctop/internal/model"
+)
+
+// at parses a "2006-01-02 15:04" time in loc
+func at(t *testing.T, s string, loc *time.Location) time.Time {
+	t.Helper()
+	ts, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+// record returns a usage record at ts with input tokens
+func record(ts time.Time, input int64) model.UsageRecord {
+	return model.UsageRecord{
+		Timestamp: ts,
+		Model:     "claude-sonnet-4-5",
+		Usage:     model.TokenUsage{InputTokens: input},
+	}
+}
+
+// inputByKey returns each result's input tokens by key
+func inputByKey(results []model.AggregatedUsage) map[string]int64 {
+	byKey := make(map[string]int64)
+	for _, r := range results {
+		byKey[r.Key] = r.Usage.InputTokens
+	}
+	return byKey
+}
+
+func TestWeekStart(t *testing.T) {
+	tests := []struct {
+		date  string
+		start time.Weekday
+		want  string
+	}{
+		// Sunday 5 January 2025 ends an ISO week and starts a Sunday week
+		{"2025-01-05", time.Monday, "2024-12-30"},
+		{"2025-01-05", time.Sunday, "2025-01-05"},
+		{"2025-01-06", time.Monday, "2025-01-06"},
+		{"2025-01-06", time.Sunday, "2025-01-05"},
+		{"2025-01-11", time.Monday, "2025-01-06"},
+		{"2025-01-11", time.Sunday, "2025-01-05"},
+		{"2024-03-01", time.Monday, "2024-02-26"},
+		{"2024-03-01", time.Sunday, "2024-02-25"},
+	}
+
+	for _, tt := range tests {
+		d, _ := time.Parse("2006-01-02", tt.date)
+		if got := WeekStart(d.Add(15*time.Hour), tt.start).Format("2006-01-02"); got != tt.want {
+			t.Errorf("WeekStart(%s, %s) = %s, want %s", tt.date, tt.start, got, tt.want)
+		}
+	}
+}
+
+func TestParseWeekday(t *testing.T) {
+	tests := []struct {
+		name string
+		want time.Weekday
+		ok   bool
+	}{
+		{"monday", time.Monday, true},
+		{"Sunday", time.Sunday, true},
+		{"sun", time.Sunday, true},
+		{" MON ", time.Monday, true},
+		{"sat", time.Saturday, true},
+		{"su", 0, false},
+		{"", 0, false},
+		{"funday", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := ParseWeekday(tt.name)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("ParseWeekday(%q) = %s, %v, want %s, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestByWeekStart(t *testing.T) {
+	// Saturday, Sunday and Monday around the new year
+	records := []model.UsageRecord{
+		record(at(t, "2025-01-04 10:00", time.UTC), 1),
+		record(at(t, "2025-01-05 10:00", time.UTC), 10),
+		record(at(t, "2025-01-06 10:00", time.UTC), 100),
+	}
+
+	tests := []struct {
+		start time.Weekday
+		want  map[string]int64
+	}{
+		{time.Monday, map[string]int64{"2024-12-30": 11, "2025-01-06": 100}},
+		{time.Sunday, map[string]int64{"2024-12-29": 1, "2025-01-05": 110}},
+	}
+
+	for _, tt := range tests {
+		got := inputByKey(ByWeek(records, Options{Offline: true, Timezone: time.UTC, WeekStart: tt.start}))
+		if !maps.Equal(got, tt.want) {
+			t.Errorf("ByWeek with weeks starting %s = %v, want %v", tt.start, got, tt.want)
+		}
+	}
+}
+
+// modelsOf returns the models of records in order
+func modelsOf(records []model.UsageRecord) []string {
+	var models []string
+	for _, r := range records {
+		models = append(models, r.Model)
+	}
+	return models
+}
+
+func TestFilterRecordsModels(t *testing.T) {
+	var records []model.UsageRecord
+	for _, name := range []string{"claude-opus-4-1", "claude-sonnet-4-5", "claude-3-5-haiku", "claude-haiku-4-5"} {
+		r := record(at(t, "2025-01-06 10:00", time.UTC), 1)
+		r.Model = name
+		records = append(records, r)
+	}
+
+	tests := []struct {
+		only    []string
+		exclude []string
+		want    []string
+	}{
+		{nil, nil, []string{"claude-opus-4-1", "claude-sonnet-4-5", "claude-3-5-haiku", "claude-haiku-4-5"}},
+		{[]string{"opus"}, nil, []string{"claude-opus-4-1"}},
+		{[]string{"OPUS", "Sonnet"}, nil, []string{"claude-opus-4-1", "claude-sonnet-4-5"}},
+		{nil, []string{"haiku"}, []string{"claude-opus-4-1", "claude-sonnet-4-5"}},
+		{[]string{"gpt"}, nil, nil},
+
+		// --only-model applies first, then --exclude-model removes from what's left
+		{[]string{"haiku"}, []string{"3-5"}, []string{"claude-haiku-4-5"}},
+		{[]string{"4-"}, []string{"opus"}, []string{"claude-sonnet-4-5", "claude-haiku-4-5"}},
+		{[]string{"opus"}, []string{"opus"}, nil},
+		{[]string{"opus"}, []string{"haiku"}, []string{"claude-opus-4-1"}},
+		{[]string{"opus", "haiku"}, []string{"claude-3"}, []string{"claude-opus-4-1", "claude-haiku-4-5"}},
+	}
+
+	for _, tt := range tests {
+		got := modelsOf(FilterRecords(records, Options{OnlyModels: tt.only, ExcludeModels: tt.exclude}))
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("FilterRecords with only %q, excluding %q = %q, want %q", tt.only, tt.exclude, got, tt.want)
+		}
+	}
+}
+
+func TestExcludeSessions(t *testing.T) {
+	var records []model.UsageRecord
+	for _, id := range []string{"3f2a9c1e-77d0-4b6a", "3f2b0000-1111-2222", "a1b2c3d4-0000-0000", ""} {
+		r := record(at(t, "2025-01-06 10:00", time.UTC), 1)
+		r.SessionID = id
+		records = append(records, r)
+	}
+
+	tests := []struct {
+		exclude []string
+		want    []string
+	}{
+		{nil, []string{"3f2a9c1e-77d0-4b6a", "3f2b0000-1111-2222", "a1b2c3d4-0000-0000", ""}},
+		{[]string{"3f2a9c1e-77d0-4b6a"}, []string{"3f2b0000-1111-2222", "a1b2c3d4-0000-0000", ""}},
+		{[]string{"3f2a9c1e"}, []string{"3f2b0000-1111-2222", "a1b2c3d4-0000-0000", ""}},
+		{[]string{"3f2"}, []string{"a1b2c3d4-0000-0000", ""}},
+		{[]string{"3f2a", "a1b2"}, []string{"3f2b0000-1111-2222", ""}},
+
+		// Prefixes only: not substrings, and case-sensitive
+		{[]string{"9c1e"}, []string{"3f2a9c1e-77d0-4b6a", "3f2b0000-1111-2222", "a1b2c3d4-0000-0000", ""}},
+		{[]string{"3F2A"}, []string{"3f2a9c1e-77d0-4b6a", "3f2b0000-1111-2222", "a1b2c3d4-0000-0000", ""}},
+		{[]string{"3f2a9c1e-77d0-4b6a-extra"}, []string{"3f2a9c1e-77d0-4b6a", "3f2b0000-1111-2222", "a1b2c3d4-0000-0000", ""}},
+	}
+
+	for _, tt := range tests {
+		opts := Options{ExcludeSessions: tt.exclude}
+		var got []string
+		for _, r := range FilterRecords(records, opts) {
+			got = append(got, r.SessionID)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("FilterRecords excluding %q = %q, want %q", tt.exclude, got, tt.want)
+		}
+
+		// Sessions are filtered the same way when grouped
+		got = nil
+		filtered, _ := FilterGroups(records, opts, SessionKey)
+		for _, r := range filtered {
+			got = append(got, r.SessionID)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("FilterGroups excluding %q = %q, want %q", tt.exclude, got, tt.want)
+		}
+	}
+}
+
+func TestDayStart(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no tzdata:", err)
+	}
+
+	tests := []struct {
+		ts       time.Time
+		loc      *time.Location
+		dayStart int
+		want     string
+	}{
+		{time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.UTC, 0, "2025-01-01"},
+
+		// Before the day start rolls back a day, across months, years and leap days
+		{time.Date(2025, 1, 1, 3, 59, 0, 0, time.UTC), time.UTC, 4, "2024-12-31"},
+		{time.Date(2025, 1, 1, 4, 0, 0, 0, time.UTC), time.UTC, 4, "2025-01-01"},
+		{time.Date(2024, 3, 1, 2, 0, 0, 0, time.UTC), time.UTC, 4, "2024-02-29"},
+		{time.Date(2025, 3, 1, 2, 0, 0, 0, time.UTC), time.UTC, 4, "2025-02-28"},
+		{time.Date(2025, 6, 15, 22, 59, 0, 0, time.UTC), time.UTC, 23, "2025-06-14"},
+		{time.Date(2025, 6, 15, 23, 0, 0, 0, time.UTC), time.UTC, 23, "2025-06-15"},
+
+		// The local hour counts, not the UTC one
+		{time.Date(2025, 1, 1, 6, 0, 0, 0, time.UTC), ny, 4, "2024-12-31"}, // 01:00 EST
+		{time.Date(2025, 1, 1, 9, 0, 0, 0, time.UTC), ny, 4, "2025-01-01"}, // 04:00 EST
+		{time.Date(2025, 1, 1, 3, 0, 0, 0, time.UTC), ny, 0, "2024-12-31"}, // 22:00 EST
+
+		// Spring forward: 02:00 to 03:00 EST doesn't happen on 9 March 2025
+		{time.Date(2025, 3, 9, 6, 59, 0, 0, time.UTC), ny, 3, "2025-03-08"},  // 01:59 EST
+		{time.Date(2025, 3, 9, 7, 0, 0, 0, time.UTC), ny, 3, "2025-03-09"},   // 03:00 EDT
+		{time.Date(2025, 3, 9, 7, 0, 0, 0, time.UTC), ny, 2, "2025-03-09"},   // 03:00 EDT
+		{time.Date(2025, 3, 10, 6, 59, 0, 0, time.UTC), ny, 3, "2025-03-09"}, // 02:59 EDT
+		{time.Date(2025, 3, 10, 7, 0, 0, 0, time.UTC), ny, 3, "2025-03-10"},  // 03:00 EDT
+
+		// Fall back: 01:00 to 02:00 happens twice on 2 November 2025
+		{time.Date(2025, 11, 2, 5, 30, 0, 0, time.UTC), ny, 2, "2025-11-01"}, // 01:30 EDT
+		{time.Date(2025, 11, 2, 6, 30, 0, 0, time.UTC), ny, 2, "2025-11-01"}, // 01:30 EST
+		{time.Date(2025, 11, 2, 7, 0, 0, 0, time.UTC), ny, 2, "2025-11-02"},  // 02:00 EST
+		{time.Date(2025, 11, 3, 6, 59, 0, 0, time.UTC), ny, 2, "2025-11-02"}, // 01:59 EST
+	}
+
+	for _, tt := range tests {
+		opts := Options{Timezone: tt.loc, DayStart: tt.dayStart}
+		if got := dayKey(tt.ts, opts); got != tt.want {
+			t.Errorf("dayKey(%s in %s, day start %d) = %s, want %s", tt.ts.Format(time.RFC3339), tt.loc, tt.dayStart, got, tt.want)
+		}
+	}
+}
+
+func TestDayStartReports(t *testing.T) {
+	// Just before and after a 4am day start on New Year's Day
+	records := []model.UsageRecord{
+		record(at(t, "2025-01-01 03:00", time.UTC), 1),
+		record(at(t, "2025-01-01 05:00", time.UTC), 10),
+	}
+	opts := Options{Offline: true, Timezone: time.UTC, WeekStart: time.Monday, DayStart: 4}
+
+	tests := []struct {
+		report string
+		got    []model.AggregatedUsage
+		want   map[string]int64
+	}{
+		{"ByDay", ByDay(records, opts), map[string]int64{"2024-12-31": 1, "2025-01-01": 10}},
+		{"ByWeek", ByWeek(records, opts), map[string]int64{"2024-12-30": 11}},
+		{"ByMonth", ByMonth(records, opts), map[string]int64{"2024-12": 1, "2025-01": 10}},
+	}
+
+	for _, tt := range tests {
+		if got := inputByKey(tt.got); !maps.Equal(got, tt.want) {
+			t.Errorf("%s with a 4am day start = %v, want %v", tt.report, got, tt.want)
+		}
+	}
+}
+
+func TestNewest(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []string
+		n    int
+		want []int
+	}{
+		{"newest first", []string{"2025-03", "2025-02", "2025-01"}, 2, []int{0, 1}},
+		{"oldest first", []string{"2025-01", "2025-02", "2025-03"}, 2, []int{1, 2}},
+		{"unordered", []string{"2025-02", "2025-04", "2025-01", "2025-03"}, 2, []int{1, 3}},
+		{"n equals len", []string{"2025-01", "2025-02"}, 2, []int{0, 1}},
+		{"n over len", []string{"2025-02", "2025-01"}, 5, []int{0, 1}},
+		{"n zero", []string{"2025-01", "2025-02"}, 0, []int{}},
+		{"empty", nil, 3, []int{}},
+	}
+
+	for _, tt := range tests {
+		results := make([]model.AggregatedUsage, len(tt.keys))
+		for i, key := range tt.keys {
+			results[i].Key = key
+		}
+		if got := Newest(results, tt.n); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: Newest(%q, %d) = %v, want %v", tt.name, tt.keys, tt.n, got, tt.want)
+		}
+	}
+}
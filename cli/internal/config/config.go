@@ -3,6 +3,7 @@ package config
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"io"
 	"os"
 	"path/filepath"
 
@@ -11,36 +12,88 @@ import (
 
 // Config holds the CLI configuration
 type Config struct {
-	Server   string `yaml:"server"`
-	APIKey   string `yaml:"api_key"`
-	ClientID string `yaml:"client_id"`
+	Server     string `yaml:"server"`
+	APIKey     string `yaml:"api_key"`
+	ClientID   string `yaml:"client_id"`
+	AuthHeader string `yaml:"auth_header,omitempty"` // AuthHeaderAPIKey (default) or AuthHeaderBearer
+	Tag        string `yaml:"tag,omitempty"`         // Sent with syncs to group this machine's usage, e.g. "work"
+	BillingDay int    `yaml:"billing_day,omitempty"` // Day of month (1-31) billing cycles start on, for the billing report
 }
 
-// configPath returns the path to the config file
-func configPath() (string, error) {
-	// When running with sudo, use the original user's config
-	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
-		// Get the original user's home directory
-		homeDir := os.Getenv("SUDO_USER_HOME")
-		if homeDir == "" {
-			homeDir = "/home/" + sudoUser
-		}
-		return filepath.Join(homeDir, ".config", "cctop", "config.yaml"), nil
+// Ways of sending the API key to the server
+const (
+	AuthHeaderAPIKey = "x-api-key" // X-API-Key: <key>
+	AuthHeaderBearer = "bearer"    // Authorization: Bearer <key>
+)
+
+// sudoHome returns the original user's home directory when running with
+// sudo, so their files are used rather than root's
+func sudoHome() (string, bool) {
+	sudoUser := os.Getenv("SUDO_USER")
+	if sudoUser == "" {
+		return "", false
+	}
+	if homeDir := os.Getenv("SUDO_USER_HOME"); homeDir != "" {
+		return homeDir, true
+	}
+	return "/home/" + sudoUser, true
+}
+
+// Dir returns the directory holding cctop's local files
+func Dir() (string, error) {
+	if homeDir, ok := sudoHome(); ok {
+		return filepath.Join(homeDir, ".config", "cctop"), nil
 	}
 
 	configDir, err := os.UserConfigDir()
 	if err != nil {
 		return "", err
 	}
-	return filepath.Join(configDir, "cctop", "config.yaml"), nil
+	return filepath.Join(configDir, "cctop"), nil
+}
+
+// configPath returns the path the config file is saved to: $CCTOP_CONFIG if
+// set, otherwise config.yaml in Dir
+func configPath() (string, error) {
+	if path := os.Getenv("CCTOP_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.yaml"), nil
+}
+
+// legacyConfigPath returns ~/.cctop.yaml, where older versions kept the config
+func legacyConfigPath() (string, error) {
+	homeDir, ok := sudoHome()
+	if !ok {
+		var err error
+		if homeDir, err = os.UserHomeDir(); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(homeDir, ".cctop.yaml"), nil
 }
 
-// Load loads the configuration from disk
+// Load loads the configuration from disk. Without $CCTOP_CONFIG, a
+// ~/.cctop.yaml from an older version is read until the config is next
+// saved, which writes it to configPath instead.
 func Load() (*Config, error) {
 	path, err := configPath()
 	if err != nil {
 		return nil, err
 	}
+	if os.Getenv("CCTOP_CONFIG") == "" {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if legacy, err := legacyConfigPath(); err == nil {
+				if _, err := os.Stat(legacy); err == nil {
+					path = legacy
+				}
+			}
+		}
+	}
 
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -50,11 +103,33 @@ func Load() (*Config, error) {
 		return nil, err
 	}
 
+	return parse(data)
+}
+
+// Import reads a configuration written by Export
+func Import(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parse(data)
+}
+
+// Export writes cfg as YAML, API key included, for Import on another machine
+func Export(w io.Writer, cfg *Config) error {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func parse(data []byte) (*Config, error) {
 	var cfg Config
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
-
 	return &cfg, nil
 }
 
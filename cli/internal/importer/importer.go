@@ -0,0 +1,297 @@
+// Package importer converts usage exports from cctop or ccusage into usage
+// records, and keeps imported records on disk so they show up in local reports.
+//
+// The import schema matches the output of `cctop <report> --json`:
+//
+//	{
+//	  "results": [
+//	    {
+//	      "key": "2025-01-15",
+//	      "input_tokens": 1200,
+//	      "output_tokens": 3400,
+//	      "cache_creation_input_tokens": 0,
+//	      "cache_read_input_tokens": 56000,
+//	      "models": ["claude-sonnet-4-5"],
+//	      "breakdown": [
+//	        {"model": "claude-sonnet-4-5", "input_tokens": 1200, "output_tokens": 3400, ...}
+//	      ]
+//	    }
+//	  ]
+//	}
+//
+// "key" is a day (YYYY-MM-DD), a month (YYYY-MM) or an RFC 3339 timestamp.
+// When "breakdown" is present each entry becomes one record per model;
+// otherwise the totals are attributed to the first of "models". Costs are
+// not imported - they are recalculated from the token counts.
+//
+// ccusage's `daily --json` and `monthly --json` exports are accepted as well.
+package importer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/zhaobenny/cctop/cli/internal/config"
+	"github.com/zhaobenny/cctop/internal/model"
+)
+
+// SessionID is the session imported records are grouped under
+const SessionID = "imported"
+
+// Source is the source imported records are tagged with
+const Source = "import"
+
+// Entry is one aggregated period in an import file
+type Entry struct {
+	Key                      string   `json:"key"`
+	InputTokens              int64    `json:"input_tokens"`
+	OutputTokens             int64    `json:"output_tokens"`
+	CacheCreationInputTokens int64    `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64    `json:"cache_read_input_tokens"`
+	Models                   []string `json:"models,omitempty"`
+	Breakdown                []Model  `json:"breakdown,omitempty"`
+}
+
+// Model is the usage of a single model within an entry
+type Model struct {
+	Model                    string `json:"model"`
+	InputTokens              int64  `json:"input_tokens"`
+	OutputTokens             int64  `json:"output_tokens"`
+	CacheCreationInputTokens int64  `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64  `json:"cache_read_input_tokens"`
+}
+
+// File is the top-level import document
+type File struct {
+	Results []Entry `json:"results"`
+}
+
+// ccusageEntry is a day or month in a ccusage JSON export
+type ccusageEntry struct {
+	Date                string   `json:"date"`
+	Month               string   `json:"month"`
+	InputTokens         int64    `json:"inputTokens"`
+	OutputTokens        int64    `json:"outputTokens"`
+	CacheCreationTokens int64    `json:"cacheCreationTokens"`
+	CacheReadTokens     int64    `json:"cacheReadTokens"`
+	ModelsUsed          []string `json:"modelsUsed"`
+	ModelBreakdowns     []struct {
+		ModelName           string `json:"modelName"`
+		InputTokens         int64  `json:"inputTokens"`
+		OutputTokens        int64  `json:"outputTokens"`
+		CacheCreationTokens int64  `json:"cacheCreationTokens"`
+		CacheReadTokens     int64  `json:"cacheReadTokens"`
+	} `json:"modelBreakdowns"`
+}
+
+// ccusageFile is the top-level ccusage export
+type ccusageFile struct {
+	Daily   []ccusageEntry `json:"daily"`
+	Monthly []ccusageEntry `json:"monthly"`
+}
+
+// Read parses an import file into usage records
+func Read(path string) ([]model.UsageRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file File
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid import file: %w", err)
+	}
+
+	if len(file.Results) == 0 {
+		var cc ccusageFile
+		if err := json.Unmarshal(data, &cc); err != nil {
+			return nil, fmt.Errorf("invalid import file: %w", err)
+		}
+		for _, e := range append(cc.Daily, cc.Monthly...) {
+			file.Results = append(file.Results, e.toEntry())
+		}
+	}
+
+	var records []model.UsageRecord
+	for _, e := range file.Results {
+		ts, err := parseKey(e.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		breakdown := e.Breakdown
+		if len(breakdown) == 0 {
+			name := "unknown"
+			if len(e.Models) > 0 {
+				name = e.Models[0]
+			}
+			breakdown = []Model{{
+				Model:                    name,
+				InputTokens:              e.InputTokens,
+				OutputTokens:             e.OutputTokens,
+				CacheCreationInputTokens: e.CacheCreationInputTokens,
+				CacheReadInputTokens:     e.CacheReadInputTokens,
+			}}
+		}
+
+		for _, m := range breakdown {
+			records = append(records, model.UsageRecord{
+				Timestamp: ts,
+				SessionID: SessionID,
+				Model:     m.Model,
+				Usage: model.TokenUsage{
+					InputTokens:              m.InputTokens,
+					OutputTokens:             m.OutputTokens,
+					CacheCreationInputTokens: m.CacheCreationInputTokens,
+					CacheReadInputTokens:     m.CacheReadInputTokens,
+				},
+				Source: Source,
+			})
+		}
+	}
+
+	return records, nil
+}
+
+// toEntry converts a ccusage entry to the import schema
+func (e ccusageEntry) toEntry() Entry {
+	key := e.Date
+	if key == "" {
+		key = e.Month
+	}
+
+	entry := Entry{
+		Key:                      key,
+		InputTokens:              e.InputTokens,
+		OutputTokens:             e.OutputTokens,
+		CacheCreationInputTokens: e.CacheCreationTokens,
+		CacheReadInputTokens:     e.CacheReadTokens,
+		Models:                   e.ModelsUsed,
+	}
+	for _, b := range e.ModelBreakdowns {
+		entry.Breakdown = append(entry.Breakdown, Model{
+			Model:                    b.ModelName,
+			InputTokens:              b.InputTokens,
+			OutputTokens:             b.OutputTokens,
+			CacheCreationInputTokens: b.CacheCreationTokens,
+			CacheReadInputTokens:     b.CacheReadTokens,
+		})
+	}
+	return entry
+}
+
+// parseKey converts an entry key to a timestamp. Days and months are placed
+// at local noon so they stay on the same date across nearby timezones.
+func parseKey(key string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, key); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", key, time.Local); err == nil {
+		return t.Add(12 * time.Hour), nil
+	}
+	if t, err := time.ParseInLocation("2006-01", key, time.Local); err == nil {
+		return t.Add(12 * time.Hour), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid key %q: expected YYYY-MM-DD, YYYY-MM or an RFC 3339 timestamp", key)
+}
+
+// storedRecord is an imported record as kept on disk
+type storedRecord struct {
+	Timestamp time.Time        `json:"timestamp"`
+	Model     string           `json:"model"`
+	Usage     model.TokenUsage `json:"usage"`
+}
+
+// storePath returns the path to the imported records file
+func storePath() (string, error) {
+	dir, err := config.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "imported.json"), nil
+}
+
+// Load returns previously imported records
+func Load() ([]model.UsageRecord, error) {
+	path, err := storePath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var stored []storedRecord
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+
+	records := make([]model.UsageRecord, len(stored))
+	for i, s := range stored {
+		records[i] = model.UsageRecord{
+			Timestamp: s.Timestamp,
+			SessionID: SessionID,
+			Model:     s.Model,
+			Usage:     s.Usage,
+			Source:    Source,
+		}
+	}
+	return records, nil
+}
+
+// Merge adds records to the imported records file. A record for the same
+// time and model as an existing one replaces it, so re-importing a file
+// doesn't double count. Returns the total number of stored records.
+func Merge(records []model.UsageRecord) (int, error) {
+	existing, err := Load()
+	if err != nil {
+		return 0, err
+	}
+
+	type key struct {
+		ts    int64
+		model string
+	}
+	byKey := make(map[key]storedRecord)
+	for _, r := range append(existing, records...) {
+		byKey[key{r.Timestamp.Unix(), r.Model}] = storedRecord{
+			Timestamp: r.Timestamp,
+			Model:     r.Model,
+			Usage:     r.Usage,
+		}
+	}
+
+	stored := make([]storedRecord, 0, len(byKey))
+	for _, s := range byKey {
+		stored = append(stored, s)
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		if stored[i].Timestamp.Equal(stored[j].Timestamp) {
+			return stored[i].Model < stored[j].Model
+		}
+		return stored[i].Timestamp.Before(stored[j].Timestamp)
+	})
+
+	path, err := storePath()
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	return len(stored), os.WriteFile(path, data, 0600)
+}
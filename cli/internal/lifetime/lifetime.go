@@ -0,0 +1,220 @@
+// Package lifetime keeps running totals of all usage ever parsed, so the
+// lifetime stat can be shown without re-aggregating the whole history.
+//
+// The cache records the size and modification time of every file read, and
+// a high-water mark for each (the newest record counted from it). On update
+// only files that changed since then are parsed: all records of new files
+// are added, and only records newer than the file's mark of files that grew.
+// Log files are append-only, so anything else - a file that shrank,
+// disappeared, or was modified with a time before its mark - means the
+// totals can't be trusted and they are rebuilt from scratch.
+package lifetime
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/zhaobenny/cctop/cli/internal/config"
+	"github.com/zhaobenny/cctop/cli/internal/parser"
+	"github.com/zhaobenny/cctop/internal/model"
+	"github.com/zhaobenny/cctop/internal/pricing"
+)
+
+// cacheVersion is bumped whenever the cache format changes, so caches
+// written by an older cctop are rebuilt
+const cacheVersion = 2
+
+// Summary is the lifetime total of usage from a set of data directories
+type Summary struct {
+	Version   int                  `json:"version"`
+	Key       string               `json:"key"` // Format and data directories the totals cover
+	Offline   bool                 `json:"offline"`
+	First     time.Time            `json:"first"`      // Oldest record counted
+	HighWater time.Time            `json:"high_water"` // Newest record counted
+	Usage     model.TokenUsage     `json:"usage"`
+	Cost      float64              `json:"cost"`
+	Records   int                  `json:"records"`
+	Files     map[string]fileState `json:"files"`
+}
+
+// fileState is what a file looked like when it was last read
+type fileState struct {
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+	HighWater time.Time `json:"high_water,omitempty"` // Newest record counted from the file
+}
+
+// Tokens returns the total number of tokens of all kinds
+func (s *Summary) Tokens() int64 {
+	return s.Usage.InputTokens + s.Usage.OutputTokens +
+		s.Usage.CacheCreationInputTokens + s.Usage.CacheReadInputTokens
+}
+
+// cachePath returns the path to the lifetime cache file
+func cachePath() (string, error) {
+	dir, err := config.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "lifetime.json"), nil
+}
+
+// load reads the cached summary, returning nil if there is none
+func load() (*Summary, error) {
+	path, err := cachePath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var s Summary
+	if err := json.Unmarshal(data, &s); err != nil {
+		// A corrupt cache is just rebuilt
+		return nil, nil
+	}
+	return &s, nil
+}
+
+// save writes the summary to the cache file
+func save(s *Summary) error {
+	path, err := cachePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// Update brings the cached lifetime summary for the given data directories
+// up to date and returns it. key identifies the format and directories; a
+// cache for a different key or pricing mode is discarded.
+func Update(format parser.Format, key string, dirs []string, offline bool) (*Summary, error) {
+	var files []string
+	for _, dir := range dirs {
+		found, err := format.FindFiles(dir)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, found...)
+	}
+
+	current := make(map[string]fileState, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		current[file] = fileState{Size: info.Size(), ModTime: info.ModTime()}
+	}
+
+	s, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	if s != nil && s.Version == cacheVersion && s.Key == key && s.Offline == offline {
+		changed = changedFiles(s, current)
+	}
+	if changed == nil {
+		// No usable cache: count everything
+		s = &Summary{Version: cacheVersion, Key: key, Offline: offline}
+		changed = files
+	}
+
+	if len(changed) == 0 {
+		return s, nil
+	}
+
+	// Unchanged files keep their marks; new files have none, so all their
+	// records are counted
+	for file, now := range current {
+		now.HighWater = s.Files[file].HighWater
+		current[file] = now
+	}
+	for _, file := range changed {
+		records, err := format.ParseFile(file, parser.ParseOptions{}, nil)
+		if err != nil {
+			continue
+		}
+		state, tracked := current[file]
+		mark := state.HighWater
+		for _, r := range records {
+			if !r.Timestamp.After(mark) {
+				continue
+			}
+			s.Add(r)
+			if r.Timestamp.After(state.HighWater) {
+				state.HighWater = r.Timestamp
+			}
+		}
+		if tracked {
+			current[file] = state
+		}
+	}
+	s.Files = current
+
+	if err := save(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// changedFiles returns the files that need parsing to bring s up to date,
+// an empty slice if none do, or nil if the cache has to be rebuilt
+func changedFiles(s *Summary, current map[string]fileState) []string {
+	for file, cached := range s.Files {
+		now, ok := current[file]
+		if !ok || now.Size < cached.Size {
+			return nil
+		}
+	}
+
+	changed := []string{}
+	for file, now := range current {
+		cached, ok := s.Files[file]
+		if ok && now.Size == cached.Size && now.ModTime.Equal(cached.ModTime) {
+			continue
+		}
+		// A change stamped before the file's mark may hold records we'd skip
+		if ok && !now.ModTime.After(cached.HighWater) {
+			return nil
+		}
+		changed = append(changed, file)
+	}
+	return changed
+}
+
+// Add counts a record towards the totals
+func (s *Summary) Add(r model.UsageRecord) {
+	s.Usage.InputTokens += r.Usage.InputTokens
+	s.Usage.OutputTokens += r.Usage.OutputTokens
+	s.Usage.CacheCreationInputTokens += r.Usage.CacheCreationInputTokens
+	s.Usage.CacheReadInputTokens += r.Usage.CacheReadInputTokens
+	s.Usage.WebSearchRequests += r.Usage.WebSearchRequests
+	s.Cost += pricing.RecordCost(r, s.Offline)
+	s.Records++
+
+	if s.First.IsZero() || r.Timestamp.Before(s.First) {
+		s.First = r.Timestamp
+	}
+	if r.Timestamp.After(s.HighWater) {
+		s.HighWater = r.Timestamp
+	}
+}
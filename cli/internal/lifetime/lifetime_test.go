@@ -0,0 +1,64 @@
+package lifetime
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zhaobenny/cctop/cli/internal/parser"
+)
+
+// line returns a Claude Code assistant line at the given day of September
+// 2025 with as many input tokens
+func line(day int, tokens int64) string {
+	return fmt.Sprintf(`{"type":"assistant","sessionId":"s","timestamp":"2025-09-%02dT10:00:00Z","message":{"role":"assistant","model":"claude-sonnet-4-5","usage":{"input_tokens":%d,"output_tokens":0}}}`+"\n", day, tokens)
+}
+
+func TestUpdate(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("SUDO_USER", "")
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	dir := t.TempDir()
+
+	write := func(name string, mtime time.Time, lines ...string) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		var data []byte
+		for _, l := range lines {
+			data = append(data, l...)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	update := func(want int64) {
+		t.Helper()
+		s, err := Update(parser.ClaudeCode, "test", []string{dir}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Usage.InputTokens != want {
+			t.Errorf("input tokens = %d, want %d", s.Usage.InputTokens, want)
+		}
+	}
+
+	write("a.jsonl", time.Date(2025, 9, 20, 0, 0, 0, 0, time.UTC), line(10, 1), line(20, 2))
+	update(3)
+
+	// A new file counts in full, though its records are older than a.jsonl's
+	write("b.jsonl", time.Date(2025, 9, 25, 0, 0, 0, 0, time.UTC), line(5, 10), line(6, 20))
+	update(33)
+
+	// A grown file counts only what's past its own mark
+	write("b.jsonl", time.Date(2025, 9, 26, 0, 0, 0, 0, time.UTC), line(5, 10), line(6, 20), line(7, 100))
+	update(133)
+
+	// Unchanged files aren't counted again
+	update(133)
+}
@@ -0,0 +1,87 @@
+package notes
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zhaobenny/cctop/cli/internal/config"
+	"gopkg.in/yaml.v3"
+)
+
+// Notes maps session IDs (or ID prefixes) to user annotations
+type Notes map[string]string
+
+// notesPath returns the path to the notes file
+func notesPath() (string, error) {
+	dir, err := config.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "notes.yaml"), nil
+}
+
+// Load loads session notes from disk
+func Load() (Notes, error) {
+	path, err := notesPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Notes{}, nil
+		}
+		return nil, err
+	}
+
+	notes := Notes{}
+	if err := yaml.Unmarshal(data, &notes); err != nil {
+		return nil, err
+	}
+
+	return notes, nil
+}
+
+// Save saves session notes to disk
+func Save(notes Notes) error {
+	path, err := notesPath()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	data, err := yaml.Marshal(notes)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0600)
+}
+
+// Set annotates a session, removing the note when it is empty
+func (n Notes) Set(sessionID, note string) {
+	if note == "" {
+		delete(n, sessionID)
+		return
+	}
+	n[sessionID] = note
+}
+
+// Lookup returns the note for a session ID. Notes may be keyed by a
+// shortened ID (as shown in the session table), so prefixes match too.
+func (n Notes) Lookup(sessionID string) string {
+	if note, ok := n[sessionID]; ok {
+		return note
+	}
+	for id, note := range n {
+		if id != "" && strings.HasPrefix(sessionID, id) {
+			return note
+		}
+	}
+	return ""
+}
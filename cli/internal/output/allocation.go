@@ -0,0 +1,104 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/zhaobenny/cctop/internal/model"
+)
+
+// AllocationProject is one project's line in a cost allocation
+type AllocationProject struct {
+	Project                  string  `json:"project"`
+	InputTokens              int64   `json:"input_tokens"`
+	OutputTokens             int64   `json:"output_tokens"`
+	CacheCreationInputTokens int64   `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64   `json:"cache_read_input_tokens"`
+	Cost                     float64 `json:"cost"`   // API cost in USD
+	Billed                   float64 `json:"billed"` // Cost times the multiplier
+}
+
+// Allocation is the JSON output of the allocate report
+type Allocation struct {
+	Since      string              `json:"since,omitempty"` // YYYYMMDD, as given
+	Until      string              `json:"until,omitempty"`
+	Multiplier float64             `json:"multiplier"`
+	Projects   []AllocationProject `json:"projects"`
+	Total      AllocationProject   `json:"total"`
+}
+
+// NewAllocation builds a cost allocation from per-project results, marking
+// each project's cost up by multiplier. Projects keep the order of results.
+func NewAllocation(results []model.AggregatedUsage, multiplier float64, since, until string) Allocation {
+	a := Allocation{
+		Since:      since,
+		Until:      until,
+		Multiplier: multiplier,
+		Projects:   make([]AllocationProject, 0, len(results)),
+		Total:      AllocationProject{Project: "total"},
+	}
+	for _, r := range results {
+		p := AllocationProject{
+			Project:                  r.Key,
+			InputTokens:              r.Usage.InputTokens,
+			OutputTokens:             r.Usage.OutputTokens,
+			CacheCreationInputTokens: r.Usage.CacheCreationInputTokens,
+			CacheReadInputTokens:     r.Usage.CacheReadInputTokens,
+			Cost:                     r.Cost,
+			Billed:                   r.Cost * multiplier,
+		}
+		a.Projects = append(a.Projects, p)
+
+		a.Total.InputTokens += p.InputTokens
+		a.Total.OutputTokens += p.OutputTokens
+		a.Total.CacheCreationInputTokens += p.CacheCreationInputTokens
+		a.Total.CacheReadInputTokens += p.CacheReadInputTokens
+		a.Total.Cost += p.Cost
+		a.Total.Billed += p.Billed
+	}
+	return a
+}
+
+// PrintAllocationJSON outputs a cost allocation as JSON
+func PrintAllocationJSON(a Allocation) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(a)
+}
+
+// PrintAllocation prints a cost allocation as a table
+func PrintAllocation(a Allocation) {
+	keyWidth := len("Project")
+	for _, p := range a.Projects {
+		keyWidth = max(keyWidth, len(p.Project))
+	}
+	keyWidth = max(keyWidth, 10)
+
+	billed := fmt.Sprintf("Billed (x%g)", a.Multiplier)
+	costWidth := 12
+	billedWidth := max(costWidth, len(billed))
+	tokensWidth := 16
+
+	rule := strings.Repeat("─", keyWidth+2+tokensWidth+2+costWidth+2+billedWidth)
+
+	fmt.Println()
+	fmt.Printf("%-*s  %*s  %*s  %*s\n", keyWidth, "Project", tokensWidth, "Tokens", costWidth, "Cost", billedWidth, billed)
+	fmt.Println(rule)
+	for _, p := range a.Projects {
+		fmt.Printf("%-*s  %*s  %*s  %*s\n", keyWidth, p.Project,
+			tokensWidth, FormatNumber(allocationTokens(p)),
+			costWidth, FormatCost(p.Cost), billedWidth, FormatCost(p.Billed))
+	}
+	fmt.Println(rule)
+	fmt.Printf("%-*s  %*s  %*s  %*s\n", keyWidth, "Total",
+		tokensWidth, FormatNumber(allocationTokens(a.Total)),
+		costWidth, FormatCost(a.Total.Cost), billedWidth, FormatCost(a.Total.Billed))
+	fmt.Println()
+}
+
+// allocationTokens returns a project's tokens of all kinds
+func allocationTokens(p AllocationProject) int64 {
+	return p.InputTokens + p.OutputTokens + p.CacheCreationInputTokens + p.CacheReadInputTokens
+}
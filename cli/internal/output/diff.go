@@ -0,0 +1,151 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/zhaobenny/cctop/internal/model"
+)
+
+// DiffPeriod is one side of a period comparison
+type DiffPeriod struct {
+	Period                   string  `json:"period"`
+	InputTokens              int64   `json:"input_tokens"`
+	OutputTokens             int64   `json:"output_tokens"`
+	CacheCreationInputTokens int64   `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64   `json:"cache_read_input_tokens"`
+	TotalTokens              int64   `json:"total_tokens"`
+	Cost                     float64 `json:"cost"`
+	HasData                  bool    `json:"has_data"`
+}
+
+// Diff is the JSON output of the diff report. Change is To minus From.
+type Diff struct {
+	From   DiffPeriod `json:"from"`
+	To     DiffPeriod `json:"to"`
+	Change DiffPeriod `json:"change"`
+}
+
+// NewDiff compares usage in two periods. A period without data compares as
+// zero usage.
+func NewDiff(fromKey string, from model.AggregatedUsage, toKey string, to model.AggregatedUsage) Diff {
+	a, b := diffPeriod(fromKey, from), diffPeriod(toKey, to)
+	return Diff{
+		From: a,
+		To:   b,
+		Change: DiffPeriod{
+			Period:                   "change",
+			InputTokens:              b.InputTokens - a.InputTokens,
+			OutputTokens:             b.OutputTokens - a.OutputTokens,
+			CacheCreationInputTokens: b.CacheCreationInputTokens - a.CacheCreationInputTokens,
+			CacheReadInputTokens:     b.CacheReadInputTokens - a.CacheReadInputTokens,
+			TotalTokens:              b.TotalTokens - a.TotalTokens,
+			Cost:                     b.Cost - a.Cost,
+			HasData:                  a.HasData || b.HasData,
+		},
+	}
+}
+
+// diffPeriod converts a period's usage, which is empty if it had no data
+func diffPeriod(key string, u model.AggregatedUsage) DiffPeriod {
+	return DiffPeriod{
+		Period:                   key,
+		InputTokens:              u.Usage.InputTokens,
+		OutputTokens:             u.Usage.OutputTokens,
+		CacheCreationInputTokens: u.Usage.CacheCreationInputTokens,
+		CacheReadInputTokens:     u.Usage.CacheReadInputTokens,
+		TotalTokens: u.Usage.InputTokens + u.Usage.OutputTokens +
+			u.Usage.CacheCreationInputTokens + u.Usage.CacheReadInputTokens,
+		Cost:    u.Cost,
+		HasData: u.RecordCount > 0,
+	}
+}
+
+// PrintDiffJSON outputs a period comparison as JSON
+func PrintDiffJSON(d Diff) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(d)
+}
+
+// PrintDiff prints a period comparison as a table with a row per metric
+func PrintDiff(d Diff) {
+	defer SetCostPrecision(costPrecision)
+	SetCostPrecision(autoCostPrecision([]model.AggregatedUsage{{Cost: d.From.Cost}, {Cost: d.To.Cost}}))
+
+	type row struct {
+		metric   string
+		from, to string
+		change   string
+		percent  string
+	}
+	tokenRow := func(metric string, a, b int64) row {
+		return row{metric, FormatNumber(a), FormatNumber(b), signedNumber(b - a), percentChange(float64(a), float64(b))}
+	}
+	rows := []row{
+		tokenRow("Input", d.From.InputTokens, d.To.InputTokens),
+		tokenRow("Output", d.From.OutputTokens, d.To.OutputTokens),
+		tokenRow("Cache Create", d.From.CacheCreationInputTokens, d.To.CacheCreationInputTokens),
+		tokenRow("Cache Read", d.From.CacheReadInputTokens, d.To.CacheReadInputTokens),
+		tokenRow("Total Tokens", d.From.TotalTokens, d.To.TotalTokens),
+	}
+	rows = append(rows, row{"Cost", FormatCost(d.From.Cost), FormatCost(d.To.Cost),
+		signedCost(d.To.Cost - d.From.Cost), percentChange(d.From.Cost, d.To.Cost)})
+
+	metricWidth := len("Total Tokens")
+	fromWidth, toWidth := max(16, len(d.From.Period)), max(16, len(d.To.Period))
+	const (
+		changeWidth  = 16
+		percentWidth = 9
+	)
+	rule := strings.Repeat("─", metricWidth+2+fromWidth+2+toWidth+2+changeWidth+2+percentWidth)
+
+	fmt.Println()
+	fmt.Printf("%-*s  %*s  %*s  %*s  %*s\n", metricWidth, "Metric", fromWidth, d.From.Period,
+		toWidth, d.To.Period, changeWidth, "Change", percentWidth, "%")
+	fmt.Println(rule)
+	for _, r := range rows {
+		fmt.Printf("%-*s  %*s  %*s  %*s  %*s\n", metricWidth, r.metric, fromWidth, r.from,
+			toWidth, r.to, changeWidth, r.change, percentWidth, r.percent)
+	}
+	fmt.Println()
+
+	for _, p := range []DiffPeriod{d.From, d.To} {
+		if !p.HasData {
+			fmt.Printf("No usage found for %s.\n", p.Period)
+		}
+	}
+}
+
+// signedNumber formats a token change with an explicit sign
+func signedNumber(n int64) string {
+	switch {
+	case n > 0:
+		return "+" + FormatNumber(n)
+	case n < 0:
+		return "-" + FormatNumber(-n)
+	}
+	return "0"
+}
+
+// signedCost formats a cost change with an explicit sign
+func signedCost(c float64) string {
+	switch {
+	case c > 0:
+		return "+" + FormatCost(c)
+	case c < 0:
+		return "-" + FormatCost(-c)
+	}
+	return FormatCost(0)
+}
+
+// percentChange formats the change from a to b as a percentage of a, or "-"
+// when a is zero
+func percentChange(a, b float64) string {
+	if a == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%+.1f%%", (b-a)/a*100)
+}
@@ -0,0 +1,74 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/zhaobenny/cctop/internal/model"
+)
+
+// JSONEfficiency is one model's line in the efficiency report
+type JSONEfficiency struct {
+	Model               string  `json:"model"`
+	Tokens              int64   `json:"tokens"`
+	Cost                float64 `json:"cost"`
+	RealizedCostPerMTok float64 `json:"realized_cost_per_mtok"`
+	ListInputPerMTok    float64 `json:"list_input_cost_per_mtok,omitempty"`
+	CacheHitRatio       float64 `json:"cache_hit_ratio"`
+}
+
+// PrintEfficiencyJSON outputs the efficiency report as JSON
+func PrintEfficiencyJSON(rows []model.ModelEfficiency) {
+	out := make([]JSONEfficiency, len(rows))
+	for i, r := range rows {
+		out[i] = JSONEfficiency{
+			Model:               r.Model,
+			Tokens:              r.Tokens,
+			Cost:                r.Cost,
+			RealizedCostPerMTok: r.RealizedPerMTok,
+			ListInputPerMTok:    r.ListInputPerMTok,
+			CacheHitRatio:       r.CacheHitRatio,
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(out)
+}
+
+// PrintEfficiency prints the efficiency report as a table
+func PrintEfficiency(rows []model.ModelEfficiency) {
+	keyWidth := len("Model")
+	for _, r := range rows {
+		keyWidth = max(keyWidth, len(r.Model))
+	}
+
+	const (
+		tokensWidth = 16
+		costWidth   = 12
+		perMTok     = 14
+		ratioWidth  = 10
+	)
+	rule := strings.Repeat("─", keyWidth+2+tokensWidth+2+costWidth+2+perMTok+2+perMTok+2+ratioWidth)
+
+	fmt.Println()
+	fmt.Printf("%-*s  %*s  %*s  %*s  %*s  %*s\n", keyWidth, "Model", tokensWidth, "Tokens",
+		costWidth, "Cost", perMTok, "Realized/MTok", perMTok, "List In/MTok", ratioWidth, "Cache Hit")
+	fmt.Println(rule)
+	for _, r := range rows {
+		list := "-"
+		if r.ListInputPerMTok > 0 {
+			list = FormatCost(r.ListInputPerMTok)
+		}
+		fmt.Printf("%-*s  %*s  %*s  %*s  %*s  %*s\n", keyWidth, r.Model,
+			tokensWidth, FormatNumber(r.Tokens),
+			costWidth, FormatCost(r.Cost),
+			perMTok, fmt.Sprintf("$%.3f", r.RealizedPerMTok),
+			perMTok, list,
+			ratioWidth, fmt.Sprintf("%.1f%%", r.CacheHitRatio*100))
+	}
+	fmt.Println()
+	fmt.Println("Realized cost covers all tokens, so heavy cache reads pull it below list price.")
+}
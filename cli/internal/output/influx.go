@@ -0,0 +1,43 @@
+package output
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zhaobenny/cctop/internal/model"
+)
+
+// influxMeasurement is the measurement usage lines are written under
+const influxMeasurement = "cctop"
+
+// influxTagEscaper escapes tag values per the line protocol
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// PrintInflux prints results as InfluxDB line protocol, one line per period:
+//
+//	cctop,report=daily,period=2025-01-15 cost=1.23,input_tokens=1000i,... 1736899200000000000
+//
+// Timestamps are the period start in nanoseconds: Start if set (blocks),
+// otherwise the key parsed with layout in loc.
+func PrintInflux(results []model.AggregatedUsage, report, layout string, loc *time.Location) error {
+	for _, r := range results {
+		start := r.Start
+		if start.IsZero() {
+			t, err := time.ParseInLocation(layout, r.Key, loc)
+			if err != nil {
+				return fmt.Errorf("period %q has no start time: %w", r.Key, err)
+			}
+			start = t
+		}
+
+		fmt.Printf("%s,report=%s,period=%s cost=%s,input_tokens=%di,output_tokens=%di,cache_creation_input_tokens=%di,cache_read_input_tokens=%di,records=%di %d\n",
+			influxMeasurement, influxTagEscaper.Replace(report), influxTagEscaper.Replace(r.Key),
+			strconv.FormatFloat(r.Cost, 'f', -1, 64),
+			r.Usage.InputTokens, r.Usage.OutputTokens,
+			r.Usage.CacheCreationInputTokens, r.Usage.CacheReadInputTokens,
+			r.RecordCount, start.UnixNano())
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package output
+
+import (
+	"fmt"
+
+	"github.com/zhaobenny/cctop/internal/model"
+)
+
+// PrintSummary prints usage as a single line for status bars and scripts:
+//
+//	This month: $42.17 (1.2M tokens)
+func PrintSummary(label string, usage model.AggregatedUsage) {
+	defer SetCostPrecision(costPrecision)
+	SetCostPrecision(autoCostPrecision([]model.AggregatedUsage{usage}))
+
+	tokens := usage.Usage.InputTokens + usage.Usage.OutputTokens +
+		usage.Usage.CacheCreationInputTokens + usage.Usage.CacheReadInputTokens
+	fmt.Printf("%s: %s (%s tokens)\n", label, FormatCost(usage.Cost), FormatTokensShort(tokens))
+}
+
+// FormatTokensShort formats a token count compactly, e.g. 1.2M or 950K
+func FormatTokensShort(n int64) string {
+	switch {
+	case n >= 1_000_000_000:
+		return fmt.Sprintf("%.1fB", float64(n)/1e9)
+	case n >= 1_000_000:
+		return fmt.Sprintf("%.1fM", float64(n)/1e6)
+	case n >= 1_000:
+		return fmt.Sprintf("%.1fK", float64(n)/1e3)
+	}
+	return fmt.Sprintf("%d", n)
+}
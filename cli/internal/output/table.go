@@ -3,22 +3,197 @@ package output
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"os"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/zhaobenny/cctop/internal/model"
+	"github.com/zhaobenny/cctop/internal/pricing"
 )
 
 const (
-	compactThreshold = 100 // Terminal width below which compact mode kicks in
-	defaultWidth     = 120
+	DefaultCompactThreshold = 100 // Terminal width below which compact mode kicks in
+	defaultWidth            = 120
 )
 
 // TableOptions controls table display behavior
 type TableOptions struct {
 	ForceCompact bool
+
+	// Width overrides the detected terminal width (0 = $CCTOP_WIDTH or detect)
+	Width int
+	// CompactThreshold is the width below which compact mode kicks in
+	// (0 = DefaultCompactThreshold)
+	CompactThreshold int
+
+	// MovingAverage holds a trailing average cost per row (index-aligned with
+	// results); NaN marks rows without a full window. Nil hides the column.
+	MovingAverage     []float64
+	MovingAverageDays int
+
+	// Cumulative holds a running total cost per row (index-aligned with
+	// results). Nil hides the column.
+	Cumulative []float64
+
+	// CombineCacheCreation and CombineCacheRead fold those tokens into the
+	// input column, to match tools that count them as input
+	CombineCacheCreation bool
+	CombineCacheRead     bool
+
+	// ShowTurns adds a column with the number of assistant turns per row
+	ShowTurns bool
+
+	// Plan shows costs as included in a flat-fee subscription, with the
+	// API-equivalent total printed once below the table
+	Plan bool
+}
+
+// planCost is shown in place of each cost in plan mode
+const planCost = "$0.00 (incl.)"
+
+// costCell formats a row's or total's cost for display, as set in opts
+func costCell(cost float64, opts TableOptions) string {
+	if opts.Plan {
+		return planCost
+	}
+	return FormatCost(cost)
+}
+
+// combineCache returns a copy of results with cache tokens folded into
+// input as set in opts
+func combineCache(results []model.AggregatedUsage, opts TableOptions) []model.AggregatedUsage {
+	if !opts.CombineCacheCreation && !opts.CombineCacheRead {
+		return results
+	}
+
+	combined := make([]model.AggregatedUsage, len(results))
+	for i, r := range results {
+		if opts.CombineCacheCreation {
+			r.Usage.InputTokens += r.Usage.CacheCreationInputTokens
+			r.Usage.CacheCreationInputTokens = 0
+		}
+		if opts.CombineCacheRead {
+			r.Usage.InputTokens += r.Usage.CacheReadInputTokens
+			r.Usage.CacheReadInputTokens = 0
+		}
+		combined[i] = r
+	}
+	return combined
+}
+
+// cacheCell formats a cache column value, or "-" if it was folded into input
+func cacheCell(n int64, combined bool) string {
+	if combined {
+		return "-"
+	}
+	return FormatNumber(n)
+}
+
+// combineNote returns the footer explaining combined columns, or "" if none are
+func combineNote(opts TableOptions) string {
+	switch {
+	case opts.CombineCacheCreation && opts.CombineCacheRead:
+		return "Input includes cache creation and cache read tokens."
+	case opts.CombineCacheCreation:
+		return "Input includes cache creation tokens."
+	case opts.CombineCacheRead:
+		return "Input includes cache read tokens."
+	}
+	return ""
+}
+
+// movingAvgWidth is the width of the optional moving-average column
+const movingAvgWidth = 12
+
+// noteWidth returns the width of the note column, or 0 when no result has a note.
+// It scans every result, so tables compute it once and pass it along.
+func noteWidth(results []model.AggregatedUsage) int {
+	width := 0
+	for _, r := range results {
+		if n := utf8.RuneCountInString(r.Note); n > width {
+			width = n
+		}
+	}
+	if width > 0 && width < len("Note") {
+		width = len("Note")
+	}
+	return width
+}
+
+// turnsWidth is the width of the optional turns column
+const turnsWidth = 8
+
+// cumulativeWidth is the width of the optional cumulative cost column
+const cumulativeWidth = 12
+
+// extraHeader returns the headers of optional trailing columns, given the
+// note column's width
+func extraHeader(opts TableOptions, notes int) string {
+	var header string
+	if opts.ShowTurns {
+		header += fmt.Sprintf("  %*s", turnsWidth, "Turns")
+	}
+	if opts.MovingAverage != nil {
+		header += fmt.Sprintf("  %*s", movingAvgWidth, fmt.Sprintf("Avg %dd", opts.MovingAverageDays))
+	}
+	if opts.Cumulative != nil {
+		header += fmt.Sprintf("  %*s", cumulativeWidth, "Cumulative")
+	}
+	if notes > 0 {
+		header += "  Note"
+	}
+	return header
+}
+
+// extraCells returns the optional trailing cells for row i, given the note
+// column's width
+func extraCells(results []model.AggregatedUsage, opts TableOptions, i, notes int) string {
+	var cells string
+	if opts.ShowTurns {
+		cells += fmt.Sprintf("  %*s", turnsWidth, FormatNumber(int64(results[i].RecordCount)))
+	}
+	if opts.MovingAverage != nil {
+		value := "-"
+		if i < len(opts.MovingAverage) && !math.IsNaN(opts.MovingAverage[i]) {
+			value = FormatCost(opts.MovingAverage[i])
+		}
+		cells += fmt.Sprintf("  %*s", movingAvgWidth, value)
+	}
+	if opts.Cumulative != nil {
+		value := "-"
+		if i < len(opts.Cumulative) {
+			value = FormatCost(opts.Cumulative[i])
+		}
+		cells += fmt.Sprintf("  %*s", cumulativeWidth, value)
+	}
+	if notes > 0 && results[i].Note != "" {
+		cells += "  " + results[i].Note
+	}
+	return cells
+}
+
+// extraWidth returns the total width of optional trailing columns, given the
+// note column's width
+func extraWidth(opts TableOptions, notes int) int {
+	width := 0
+	if opts.ShowTurns {
+		width += 2 + turnsWidth
+	}
+	if opts.MovingAverage != nil {
+		width += 2 + movingAvgWidth
+	}
+	if opts.Cumulative != nil {
+		width += 2 + cumulativeWidth
+	}
+	if notes > 0 {
+		width += 2 + notes
+	}
+	return width
 }
 
 // shouldUseCompact determines if compact mode should be used
@@ -26,7 +201,28 @@ func shouldUseCompact(opts TableOptions) bool {
 	if opts.ForceCompact {
 		return true
 	}
-	return getTerminalWidth() < compactThreshold
+
+	threshold := opts.CompactThreshold
+	if threshold <= 0 {
+		threshold = DefaultCompactThreshold
+	}
+	return tableWidth(opts) < threshold
+}
+
+// tableWidth returns the width to lay tables out for. Output that isn't a
+// terminal, such as a pipe or file, has no width to fit, so it gets the
+// full layout unless a width is set.
+func tableWidth(opts TableOptions) int {
+	if opts.Width > 0 {
+		return opts.Width
+	}
+	if width, err := strconv.Atoi(os.Getenv("CCTOP_WIDTH")); err == nil && width > 0 {
+		return width
+	}
+	if width, ok := getTerminalWidth(); ok {
+		return width
+	}
+	return math.MaxInt
 }
 
 // FormatNumber formats a number with thousand separators
@@ -55,9 +251,62 @@ func FormatNumber(n int64) string {
 	return result
 }
 
-// FormatCost formats a cost value as currency
+// DefaultCostPrecision is the number of decimals costs are shown with
+const DefaultCostPrecision = 2
+
+// maxCostPrecision bounds how far autoCostPrecision goes for tiny costs
+const maxCostPrecision = 8
+
+// costPrecision is the number of decimals FormatCost shows
+var costPrecision = DefaultCostPrecision
+
+// SetCostPrecision sets the number of decimals costs are shown with
+func SetCostPrecision(decimals int) {
+	costPrecision = min(max(decimals, 0), maxCostPrecision)
+}
+
+// displayLocation is set by SetDisplayLocation
+var displayLocation *time.Location
+
+// SetDisplayLocation shows the start times of fixed windows (blocks) in loc,
+// rather than as their keys. Results are still grouped as before. Nil
+// restores the keys.
+func SetDisplayLocation(loc *time.Location) {
+	displayLocation = loc
+}
+
+// rowLabel returns the label a result is shown under: its key, or its start
+// time in the display location if one is set and it has a start time
+func rowLabel(r model.AggregatedUsage) string {
+	if displayLocation == nil || r.Start.IsZero() {
+		return r.Key
+	}
+	return r.Start.In(displayLocation).Format("2006-01-02 15:04")
+}
+
+// FormatCost formats a cost value as currency. Negative costs, such as
+// credits, show as -$5.00 rather than $-5.00.
 func FormatCost(cost float64) string {
-	return fmt.Sprintf("$%.2f", cost)
+	if cost < 0 {
+		return fmt.Sprintf("-$%.*f", costPrecision, -cost)
+	}
+	return fmt.Sprintf("$%.*f", costPrecision, cost)
+}
+
+// autoCostPrecision returns the precision to show results' costs with: the
+// set precision, or more if every nonzero cost would otherwise show as zero,
+// so light usage doesn't look like none (e.g. $0.0034 rather than $0.00)
+func autoCostPrecision(results []model.AggregatedUsage) int {
+	var largest float64
+	for _, r := range results {
+		largest = max(largest, math.Abs(r.Cost))
+	}
+	if largest == 0 || largest >= 0.5*math.Pow(10, -float64(costPrecision)) {
+		return costPrecision
+	}
+	// Two significant digits of the largest cost
+	decimals := int(math.Ceil(-math.Log10(largest))) + 1
+	return min(max(decimals, costPrecision), maxCostPrecision)
 }
 
 // shortenModelName converts full model names to short form
@@ -88,9 +337,10 @@ func shortenModelName(name string) string {
 	return name
 }
 
-// shortenSessionID truncates session UUID to first 8 chars
+// shortenSessionID truncates a session UUID to its first 8 chars. Other IDs,
+// such as anonymized labels, are left alone.
 func shortenSessionID(id string) string {
-	if len(id) > 8 {
+	if len(id) == 36 && id[8] == '-' {
 		return id[:8]
 	}
 	return id
@@ -101,6 +351,39 @@ func PrintTable(results []model.AggregatedUsage, title string, showTotal bool) {
 	PrintTableWithOptions(results, title, showTotal, TableOptions{})
 }
 
+// columnWidths holds the widths of the numeric columns
+type columnWidths struct {
+	input, output, cacheCreate, cacheRead, cost int
+}
+
+// numericWidths sizes the numeric columns to fit every row and the total,
+// never narrower than the default layout
+func numericWidths(results []model.AggregatedUsage, total model.AggregatedUsage, opts TableOptions) columnWidths {
+	w := columnWidths{input: 12, output: 12, cacheCreate: 14, cacheRead: 14, cost: 10}
+	for _, r := range append(results, total) {
+		w.input = max(w.input, len(FormatNumber(r.Usage.InputTokens)))
+		w.output = max(w.output, len(FormatNumber(r.Usage.OutputTokens)))
+		w.cacheCreate = max(w.cacheCreate, len(FormatNumber(r.Usage.CacheCreationInputTokens)))
+		w.cacheRead = max(w.cacheRead, len(FormatNumber(r.Usage.CacheReadInputTokens)))
+		w.cost = max(w.cost, len(costCell(r.Cost, opts)))
+	}
+	return w
+}
+
+// sumResults returns the totals of all results
+func sumResults(results []model.AggregatedUsage) model.AggregatedUsage {
+	var total model.AggregatedUsage
+	for _, r := range results {
+		total.Usage.InputTokens += r.Usage.InputTokens
+		total.Usage.OutputTokens += r.Usage.OutputTokens
+		total.Usage.CacheCreationInputTokens += r.Usage.CacheCreationInputTokens
+		total.Usage.CacheReadInputTokens += r.Usage.CacheReadInputTokens
+		total.Usage.WebSearchRequests += r.Usage.WebSearchRequests
+		total.Cost += r.Cost
+	}
+	return total
+}
+
 // PrintTableWithOptions prints table with display options
 func PrintTableWithOptions(results []model.AggregatedUsage, title string, showTotal bool, opts TableOptions) {
 	if len(results) == 0 {
@@ -109,6 +392,10 @@ func PrintTableWithOptions(results []model.AggregatedUsage, title string, showTo
 	}
 
 	compact := shouldUseCompact(opts)
+	results = combineCache(results, opts)
+
+	defer SetCostPrecision(costPrecision)
+	SetCostPrecision(autoCostPrecision(results))
 
 	// Determine if this is a session view (UUIDs need shortening)
 	isSessionView := title == "Session"
@@ -116,10 +403,13 @@ func PrintTableWithOptions(results []model.AggregatedUsage, title string, showTo
 	// Calculate key column width
 	keyWidth := len(title)
 	for _, r := range results {
-		key := r.Key
+		key := rowLabel(r)
 		if isSessionView && compact {
 			key = shortenSessionID(key)
 		}
+		if r.Partial {
+			key += "*"
+		}
 		if len(key) > keyWidth {
 			keyWidth = len(key)
 		}
@@ -132,93 +422,100 @@ func PrintTableWithOptions(results []model.AggregatedUsage, title string, showTo
 		keyWidth = 12
 	}
 
+	total := sumResults(results)
+	w := numericWidths(results, total, opts)
+	notes := noteWidth(results)
+
 	fmt.Println()
 
 	if compact {
 		// Compact: Key, Input, Output, Cost
-		fmt.Printf("%-*s  %12s  %12s  %10s\n",
-			keyWidth, title, "Input", "Output", "Cost")
-		fmt.Println(strings.Repeat("─", keyWidth+2+12+2+12+2+10))
+		rule := strings.Repeat("─", keyWidth+2+w.input+2+w.output+2+w.cost+extraWidth(opts, notes))
+		fmt.Printf("%-*s  %*s  %*s  %*s%s\n",
+			keyWidth, title, w.input, "Input", w.output, "Output", w.cost, "Cost", extraHeader(opts, notes))
+		fmt.Println(rule)
 
-		for _, r := range results {
-			key := r.Key
+		for i, r := range results {
+			key := rowLabel(r)
 			if isSessionView {
 				key = shortenSessionID(key)
 			}
-			if len(key) > keyWidth {
+			if r.Partial {
+				if len(key) >= keyWidth {
+					key = key[:keyWidth-1]
+				}
+				key += "*"
+			} else if len(key) > keyWidth {
 				key = key[:keyWidth]
 			}
-			fmt.Printf("%-*s  %12s  %12s  %10s\n",
+			fmt.Printf("%-*s  %*s  %*s  %*s%s\n",
 				keyWidth, key,
-				FormatNumber(r.Usage.InputTokens),
-				FormatNumber(r.Usage.OutputTokens),
-				FormatCost(r.Cost))
+				w.input, FormatNumber(r.Usage.InputTokens),
+				w.output, FormatNumber(r.Usage.OutputTokens),
+				w.cost, costCell(r.Cost, opts),
+				extraCells(results, opts, i, notes))
 		}
 
 		if showTotal && len(results) > 1 {
-			fmt.Println(strings.Repeat("─", keyWidth+2+12+2+12+2+10))
-
-			var total model.TokenUsage
-			var totalCost float64
-			for _, r := range results {
-				total.InputTokens += r.Usage.InputTokens
-				total.OutputTokens += r.Usage.OutputTokens
-				totalCost += r.Cost
-			}
-
-			fmt.Printf("%-*s  %12s  %12s  %10s\n",
+			fmt.Println(rule)
+			fmt.Printf("%-*s  %*s  %*s  %*s\n",
 				keyWidth, "Total",
-				FormatNumber(total.InputTokens),
-				FormatNumber(total.OutputTokens),
-				FormatCost(totalCost))
+				w.input, FormatNumber(total.Usage.InputTokens),
+				w.output, FormatNumber(total.Usage.OutputTokens),
+				w.cost, costCell(total.Cost, opts))
 		}
 
 		fmt.Println()
 		fmt.Println("(Compact mode - expand terminal for full view)")
 	} else {
 		// Full: Key, Input, Output, Cache Create, Cache Read, Cost
-		fmt.Printf("%-*s  %12s  %12s  %14s  %14s  %10s\n",
-			keyWidth, title, "Input", "Output", "Cache Create", "Cache Read", "Cost")
-		fmt.Println(strings.Repeat("─", keyWidth+2+12+2+12+2+14+2+14+2+10))
-
-		for _, r := range results {
-			key := r.Key
+		rule := strings.Repeat("─", keyWidth+2+w.input+2+w.output+2+w.cacheCreate+2+w.cacheRead+2+w.cost+extraWidth(opts, notes))
+		fmt.Printf("%-*s  %*s  %*s  %*s  %*s  %*s%s\n",
+			keyWidth, title, w.input, "Input", w.output, "Output",
+			w.cacheCreate, "Cache Create", w.cacheRead, "Cache Read", w.cost, "Cost", extraHeader(opts, notes))
+		fmt.Println(rule)
+
+		for i, r := range results {
+			key := rowLabel(r)
 			if isSessionView {
 				key = shortenSessionID(key)
 			}
-			fmt.Printf("%-*s  %12s  %12s  %14s  %14s  %10s\n",
+			if r.Partial {
+				key += "*"
+			}
+			fmt.Printf("%-*s  %*s  %*s  %*s  %*s  %*s%s\n",
 				keyWidth, key,
-				FormatNumber(r.Usage.InputTokens),
-				FormatNumber(r.Usage.OutputTokens),
-				FormatNumber(r.Usage.CacheCreationInputTokens),
-				FormatNumber(r.Usage.CacheReadInputTokens),
-				FormatCost(r.Cost))
+				w.input, FormatNumber(r.Usage.InputTokens),
+				w.output, FormatNumber(r.Usage.OutputTokens),
+				w.cacheCreate, cacheCell(r.Usage.CacheCreationInputTokens, opts.CombineCacheCreation),
+				w.cacheRead, cacheCell(r.Usage.CacheReadInputTokens, opts.CombineCacheRead),
+				w.cost, costCell(r.Cost, opts),
+				extraCells(results, opts, i, notes))
 		}
 
 		if showTotal && len(results) > 1 {
-			fmt.Println(strings.Repeat("─", keyWidth+2+12+2+12+2+14+2+14+2+10))
-
-			var total model.TokenUsage
-			var totalCost float64
-			for _, r := range results {
-				total.InputTokens += r.Usage.InputTokens
-				total.OutputTokens += r.Usage.OutputTokens
-				total.CacheCreationInputTokens += r.Usage.CacheCreationInputTokens
-				total.CacheReadInputTokens += r.Usage.CacheReadInputTokens
-				totalCost += r.Cost
-			}
-
-			fmt.Printf("%-*s  %12s  %12s  %14s  %14s  %10s\n",
+			fmt.Println(rule)
+			fmt.Printf("%-*s  %*s  %*s  %*s  %*s  %*s\n",
 				keyWidth, "Total",
-				FormatNumber(total.InputTokens),
-				FormatNumber(total.OutputTokens),
-				FormatNumber(total.CacheCreationInputTokens),
-				FormatNumber(total.CacheReadInputTokens),
-				FormatCost(totalCost))
+				w.input, FormatNumber(total.Usage.InputTokens),
+				w.output, FormatNumber(total.Usage.OutputTokens),
+				w.cacheCreate, cacheCell(total.Usage.CacheCreationInputTokens, opts.CombineCacheCreation),
+				w.cacheRead, cacheCell(total.Usage.CacheReadInputTokens, opts.CombineCacheRead),
+				w.cost, costCell(total.Cost, opts))
 		}
 
 		fmt.Println()
 	}
+
+	if n := total.Usage.WebSearchRequests; n > 0 {
+		fmt.Printf("Costs include %s web searches (%s).\n", FormatNumber(n), FormatCost(float64(n)*pricing.WebSearchCostPerRequest))
+	}
+	if opts.Plan {
+		fmt.Printf("API-equivalent cost: %s (included in your plan)\n", FormatCost(total.Cost))
+	}
+	if note := combineNote(opts); note != "" {
+		fmt.Println(note)
+	}
 }
 
 // PrintTableWithBreakdown prints table with per-model breakdown
@@ -261,13 +558,73 @@ type JSONOutput struct {
 
 // JSONResult represents a single result in JSON format
 type JSONResult struct {
-	Key                      string   `json:"key"`
-	InputTokens              int64    `json:"input_tokens"`
-	OutputTokens             int64    `json:"output_tokens"`
-	CacheCreationInputTokens int64    `json:"cache_creation_input_tokens"`
-	CacheReadInputTokens     int64    `json:"cache_read_input_tokens"`
-	Cost                     float64  `json:"cost"`
-	Models                   []string `json:"models,omitempty"`
+	Key                      string       `json:"key"`
+	InputTokens              int64        `json:"input_tokens"`
+	OutputTokens             int64        `json:"output_tokens"`
+	CacheCreationInputTokens int64        `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64        `json:"cache_read_input_tokens"`
+	WebSearchRequests        int64        `json:"web_search_requests,omitempty"`
+	Cost                     float64      `json:"cost"`
+	Models                   []string     `json:"models,omitempty"`
+	Note                     string       `json:"note,omitempty"`
+	Partial                  bool         `json:"partial,omitempty"`
+	Turns                    int          `json:"turns"`
+	Days                     []JSONResult `json:"days,omitempty"`
+
+	// Set only for fixed windows (blocks)
+	BlockStart      *time.Time `json:"block_start,omitempty"`
+	BlockEnd        *time.Time `json:"block_end,omitempty"`
+	BlockStartUTC   *time.Time `json:"block_start_utc,omitempty"`
+	BlockStartLocal *time.Time `json:"block_start_local,omitempty"` // In --display-timezone, or the system timezone
+	IsActive        *bool      `json:"is_active,omitempty"`
+	ElapsedPct      *float64   `json:"elapsed_pct,omitempty"`
+}
+
+// jsonResult converts an aggregated result, and any days within it, to JSON
+func jsonResult(r model.AggregatedUsage) JSONResult {
+	result := JSONResult{
+		Key:                      r.Key,
+		InputTokens:              r.Usage.InputTokens,
+		OutputTokens:             r.Usage.OutputTokens,
+		CacheCreationInputTokens: r.Usage.CacheCreationInputTokens,
+		CacheReadInputTokens:     r.Usage.CacheReadInputTokens,
+		WebSearchRequests:        r.Usage.WebSearchRequests,
+		Cost:                     r.Cost,
+		Models:                   r.Models,
+		Note:                     r.Note,
+		Partial:                  r.Partial,
+		Turns:                    r.RecordCount,
+	}
+	for _, day := range r.Days {
+		result.Days = append(result.Days, jsonResult(day))
+	}
+
+	if !r.Start.IsZero() {
+		now := time.Now()
+		start, end := r.Start, r.End
+		if displayLocation != nil {
+			start, end = start.In(displayLocation), end.In(displayLocation)
+		}
+		active := !now.Before(start) && now.Before(end)
+		elapsed := 100.0
+		if now.Before(start) {
+			elapsed = 0
+		} else if active {
+			elapsed = math.Round(float64(now.Sub(start))/float64(end.Sub(start))*1000) / 10
+		}
+		local := time.Local
+		if displayLocation != nil {
+			local = displayLocation
+		}
+		startUTC, startLocal := r.Start.UTC(), r.Start.In(local)
+		result.BlockStart = &start
+		result.BlockEnd = &end
+		result.BlockStartUTC = &startUTC
+		result.BlockStartLocal = &startLocal
+		result.IsActive = &active
+		result.ElapsedPct = &elapsed
+	}
+	return result
 }
 
 // PrintJSON outputs results as JSON
@@ -278,24 +635,19 @@ func PrintJSON(results []model.AggregatedUsage) {
 
 	var total model.TokenUsage
 	var totalCost float64
+	var turns int
 	modelsMap := make(map[string]bool)
 
 	for i, r := range results {
-		output.Results[i] = JSONResult{
-			Key:                      r.Key,
-			InputTokens:              r.Usage.InputTokens,
-			OutputTokens:             r.Usage.OutputTokens,
-			CacheCreationInputTokens: r.Usage.CacheCreationInputTokens,
-			CacheReadInputTokens:     r.Usage.CacheReadInputTokens,
-			Cost:                     r.Cost,
-			Models:                   r.Models,
-		}
+		output.Results[i] = jsonResult(r)
 
 		total.InputTokens += r.Usage.InputTokens
 		total.OutputTokens += r.Usage.OutputTokens
 		total.CacheCreationInputTokens += r.Usage.CacheCreationInputTokens
 		total.CacheReadInputTokens += r.Usage.CacheReadInputTokens
+		total.WebSearchRequests += r.Usage.WebSearchRequests
 		totalCost += r.Cost
+		turns += r.RecordCount
 
 		for _, m := range r.Models {
 			modelsMap[m] = true
@@ -313,8 +665,10 @@ func PrintJSON(results []model.AggregatedUsage) {
 		OutputTokens:             total.OutputTokens,
 		CacheCreationInputTokens: total.CacheCreationInputTokens,
 		CacheReadInputTokens:     total.CacheReadInputTokens,
+		WebSearchRequests:        total.WebSearchRequests,
 		Cost:                     totalCost,
 		Models:                   models,
+		Turns:                    turns,
 	}
 
 	encoder := json.NewEncoder(os.Stdout)
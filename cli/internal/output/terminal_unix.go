@@ -17,13 +17,14 @@ type winsize struct {
 	Ypixel uint16
 }
 
-// getTerminalWidth returns the current terminal width
-func getTerminalWidth() int {
+// getTerminalWidth returns the current terminal width. ok is false when
+// stdout isn't a terminal, e.g. when piped or redirected to a file.
+func getTerminalWidth() (width int, ok bool) {
 	// Check COLUMNS env var first
 	if cols := os.Getenv("COLUMNS"); cols != "" {
 		var width int
 		if _, err := fmt.Sscanf(cols, "%d", &width); err == nil && width > 0 {
-			return width
+			return width, true
 		}
 	}
 
@@ -33,9 +34,12 @@ func getTerminalWidth() int {
 		uintptr(syscall.Stdout),
 		uintptr(syscall.TIOCGWINSZ),
 		uintptr(unsafe.Pointer(ws)))
+	if errno == syscall.ENOTTY {
+		return 0, false
+	}
 	if errno == 0 && ws.Col > 0 {
-		return int(ws.Col)
+		return int(ws.Col), true
 	}
 
-	return defaultWidth
+	return defaultWidth, true
 }
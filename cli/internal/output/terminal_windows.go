@@ -34,32 +34,34 @@ type consoleScreenBufferInfo struct {
 	maximumWindowSize coord
 }
 
-// getTerminalWidth returns the current terminal width
-func getTerminalWidth() int {
+// getTerminalWidth returns the current terminal width. ok is false when
+// stdout isn't a console, e.g. when piped or redirected to a file.
+func getTerminalWidth() (width int, ok bool) {
 	// Check COLUMNS env var first
 	if cols := os.Getenv("COLUMNS"); cols != "" {
 		var width int
 		if _, err := fmt.Sscanf(cols, "%d", &width); err == nil && width > 0 {
-			return width
+			return width, true
 		}
 	}
 
 	// Try to get console width via Windows API
 	handle, err := syscall.GetStdHandle(syscall.STD_OUTPUT_HANDLE)
 	if err != nil {
-		return defaultWidth
+		return defaultWidth, true
 	}
 
 	var info consoleScreenBufferInfo
 	ret, _, _ := procGetConsoleScreenBufferInfo.Call(
 		uintptr(handle),
 		uintptr(unsafe.Pointer(&info)))
-	if ret != 0 {
-		width := int(info.window.right - info.window.left + 1)
-		if width > 0 {
-			return width
-		}
+	if ret == 0 {
+		// Pipes and files have no screen buffer
+		return 0, false
+	}
+	if width := int(info.window.right - info.window.left + 1); width > 0 {
+		return width, true
 	}
 
-	return defaultWidth
+	return defaultWidth, true
 }
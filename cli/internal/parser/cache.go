@@ -0,0 +1,145 @@
+package parser
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/zhaobenny/cctop/cli/internal/config"
+	"github.com/zhaobenny/cctop/internal/model"
+)
+
+// recordCacheVersion is bumped whenever parsing changes, so records cached
+// by an older cctop are re-parsed
+const recordCacheVersion = 5
+
+// recordCache holds the records parsed from each file, so files that haven't
+// changed since the last run needn't be parsed again
+type recordCache struct {
+	Version int
+	Options ParseOptions
+	Files   map[string]cachedFile
+
+	path  string
+	dirty bool
+}
+
+// cachedFile is a file's records and what the file looked like when read
+type cachedFile struct {
+	Size    int64
+	ModTime time.Time
+	Offset  int64 // End of the last complete line parsed, for appenders
+	Records []model.UsageRecord
+}
+
+// formatName returns the name format is registered under
+func formatName(format Format) string {
+	for name, f := range formats {
+		if f == format {
+			return name
+		}
+	}
+	return ""
+}
+
+// loadRecordCache reads the record cache for a format. A missing, corrupt or
+// outdated cache, or one made with different options, starts out empty.
+// Returns nil if the cache can't be used at all.
+func loadRecordCache(format Format, opts ParseOptions) *recordCache {
+	name := formatName(format)
+	if name == "" {
+		return nil
+	}
+	dir, err := config.Dir()
+	if err != nil {
+		return nil
+	}
+
+	// Only options that change which records are kept belong in the key
+	opts.Cache = false
+	empty := &recordCache{
+		Version: recordCacheVersion,
+		Options: opts,
+		Files:   make(map[string]cachedFile),
+		path:    filepath.Join(dir, "records-"+name+".gob"),
+	}
+
+	file, err := os.Open(empty.path)
+	if err != nil {
+		return empty
+	}
+	defer file.Close()
+
+	var c recordCache
+	if err := gob.NewDecoder(file).Decode(&c); err != nil || c.Version != recordCacheVersion || c.Options != opts || c.Files == nil {
+		return empty
+	}
+	c.path = empty.path
+	return &c
+}
+
+// lookup returns the cached records for path if the file is unchanged
+func (c *recordCache) lookup(path string, info os.FileInfo) ([]model.UsageRecord, bool) {
+	cached, ok := c.Files[path]
+	if !ok || cached.Size != info.Size() || !cached.ModTime.Equal(info.ModTime()) {
+		return nil, false
+	}
+	return slices.Clone(cached.Records), true
+}
+
+// grown returns the cached records for path if the file has grown since
+// they were parsed, so only what was appended needs parsing
+func (c *recordCache) grown(path string, info os.FileInfo) (cachedFile, bool) {
+	cached, ok := c.Files[path]
+	if !ok || cached.Offset == 0 || info.Size() <= cached.Size {
+		return cachedFile{}, false
+	}
+	cached.Records = slices.Clone(cached.Records)
+	return cached, true
+}
+
+// store caches the records parsed from path, up to offset for appenders
+func (c *recordCache) store(path string, info os.FileInfo, records []model.UsageRecord, offset int64) {
+	c.Files[path] = cachedFile{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Offset:  offset,
+		Records: slices.Clone(records),
+	}
+	c.dirty = true
+}
+
+// save writes the cache if it changed, dropping files that no longer exist.
+// It's written to a temporary file first so concurrent runs never see a
+// partial cache.
+func (c *recordCache) save() error {
+	for path := range c.Files {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			delete(c.Files, path)
+			c.dirty = true
+		}
+	}
+	if !c.dirty {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := gob.NewEncoder(tmp).Encode(c); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
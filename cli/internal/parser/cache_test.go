@@ -0,0 +1,181 @@
+package parser
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhaobenny/cctop/internal/model"
+)
+
+// useTempConfigDir points config.Dir, and so the record cache, at a
+// temporary directory for the rest of the test
+func useTempConfigDir(t *testing.T) {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("SUDO_USER", "")
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+}
+
+// assistantLine returns a Claude Code assistant line with as many input and
+// output tokens, kept to one digit so lines can be rewritten at the same
+// size. A line with none is an empty turn.
+func assistantLine(second int, tokens int64) string {
+	return fmt.Sprintf(`{"type":"assistant","sessionId":"s","timestamp":"2025-09-01T10:00:%02dZ","message":{"role":"assistant","model":"claude-sonnet-4-5","usage":{"input_tokens":%d,"output_tokens":%d}}}`+"\n", second, tokens, tokens)
+}
+
+// writeLines writes lines to path, setting its modification time to mtime
+// unless it's zero
+func writeLines(t *testing.T, path string, mtime time.Time, lines ...string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !mtime.IsZero() {
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// inputTokens returns each record's input tokens in order
+func inputTokens(records []model.UsageRecord) []int64 {
+	var tokens []int64
+	for _, r := range records {
+		tokens = append(tokens, r.Usage.InputTokens)
+	}
+	return tokens
+}
+
+func TestRecordCacheInvalidation(t *testing.T) {
+	mtime := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		change func(t *testing.T, path, cachePath string)
+		opts   ParseOptions // Options of the second parse, besides Cache
+		want   []int64
+	}{
+		{
+			// Same size and time: the edit goes unseen, showing the cache was used
+			name: "unchanged",
+			change: func(t *testing.T, path, cachePath string) {
+				writeLines(t, path, mtime, assistantLine(1, 7), assistantLine(2, 2), assistantLine(3, 0))
+			},
+			want: []int64{1, 2},
+		},
+		{
+			name: "rewritten at the same size",
+			change: func(t *testing.T, path, cachePath string) {
+				writeLines(t, path, mtime.Add(time.Hour), assistantLine(1, 7), assistantLine(2, 2), assistantLine(3, 0))
+			},
+			want: []int64{7, 2},
+		},
+		{
+			// Only the appended line is parsed, so the earlier edit goes unseen
+			name: "appended",
+			change: func(t *testing.T, path, cachePath string) {
+				writeLines(t, path, time.Time{}, assistantLine(1, 7), assistantLine(2, 2), assistantLine(3, 0), assistantLine(4, 3))
+			},
+			want: []int64{1, 2, 3},
+		},
+		{
+			name: "truncated",
+			change: func(t *testing.T, path, cachePath string) {
+				writeLines(t, path, time.Time{}, assistantLine(1, 1))
+			},
+			want: []int64{1},
+		},
+		{
+			// Lines no longer end where the cached parse did
+			name: "rewritten larger",
+			change: func(t *testing.T, path, cachePath string) {
+				writeLines(t, path, time.Time{}, `{"type":"summary"}`+"\n", assistantLine(1, 5), assistantLine(2, 6), assistantLine(3, 0))
+			},
+			want: []int64{5, 6},
+		},
+		{
+			name: "options changed",
+			change: func(t *testing.T, path, cachePath string) {
+				writeLines(t, path, mtime, assistantLine(1, 7), assistantLine(2, 2), assistantLine(3, 0))
+			},
+			opts: ParseOptions{CountEmpty: true},
+			want: []int64{7, 2, 0},
+		},
+		{
+			name: "corrupt cache",
+			change: func(t *testing.T, path, cachePath string) {
+				writeLines(t, path, mtime, assistantLine(1, 7), assistantLine(2, 2), assistantLine(3, 0))
+				if err := os.WriteFile(cachePath, []byte("not a cache"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []int64{7, 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempConfigDir(t)
+			dataDir := t.TempDir()
+			path := filepath.Join(dataDir, "session.jsonl")
+			writeLines(t, path, mtime, assistantLine(1, 1), assistantLine(2, 2), assistantLine(3, 0))
+
+			records, err := ParseWithOptions(ClaudeCode, ParseOptions{Cache: true}, nil, dataDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := inputTokens(records); !slices.Equal(got, []int64{1, 2}) {
+				t.Fatalf("first parse = %v, want [1 2]", got)
+			}
+
+			cache := loadRecordCache(ClaudeCode, ParseOptions{})
+			if _, ok := cache.Files[path]; !ok {
+				t.Fatalf("first parse didn't cache %s", path)
+			}
+
+			tt.change(t, path, cache.path)
+			opts := tt.opts
+			opts.Cache = true
+			records, err = ParseWithOptions(ClaudeCode, opts, nil, dataDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := inputTokens(records); !slices.Equal(got, tt.want) {
+				t.Errorf("second parse = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordCacheDropsRemovedFiles(t *testing.T) {
+	useTempConfigDir(t)
+	dataDir := t.TempDir()
+	kept := filepath.Join(dataDir, "kept.jsonl")
+	removed := filepath.Join(dataDir, "removed.jsonl")
+	writeLines(t, kept, time.Time{}, assistantLine(1, 1))
+	writeLines(t, removed, time.Time{}, assistantLine(2, 2))
+
+	if _, err := ParseWithOptions(ClaudeCode, ParseOptions{Cache: true}, nil, dataDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(removed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseWithOptions(ClaudeCode, ParseOptions{Cache: true}, nil, dataDir); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := loadRecordCache(ClaudeCode, ParseOptions{})
+	if _, ok := cache.Files[kept]; !ok {
+		t.Errorf("cache lost %s", kept)
+	}
+	if _, ok := cache.Files[removed]; ok {
+		t.Errorf("cache kept removed file %s", removed)
+	}
+}
@@ -0,0 +1,237 @@
+package parser
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zhaobenny/cctop/internal/model"
+)
+
+// consoleFormat reads Anthropic Console usage exports: the CSV download from
+// the usage page, or the JSON returned by the Admin API usage report
+// (/v1/organizations/usage_report/messages grouped by model).
+type consoleFormat struct{}
+
+// Console is the Anthropic Console usage export format
+var Console Format = consoleFormat{}
+
+// ConsoleSessionID is the session console usage is grouped under, since
+// exports have no sessions
+const ConsoleSessionID = "console"
+
+// consoleColumns lists accepted column names for each field, in order of
+// preference. Names are matched case-insensitively with spaces as underscores.
+var consoleColumns = struct {
+	time, model, input, output, workspace []string
+}{
+	time:      []string{"usage_date_utc", "starting_at", "date", "timestamp"},
+	model:     []string{"model_version", "model"},
+	input:     []string{"uncached_input_tokens", "input_tokens"},
+	output:    []string{"output_tokens"},
+	workspace: []string{"workspace", "workspace_id", "workspace_name"},
+}
+
+func (consoleFormat) FindFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	var files []string
+	err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if ext := strings.ToLower(filepath.Ext(p)); !info.IsDir() && (ext == ".csv" || ext == ".json") {
+			files = append(files, p)
+		}
+		return nil
+	})
+	return files, err
+}
+
+func (consoleFormat) ParseFile(path string, opts ParseOptions, read func(n int64)) ([]model.UsageRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := withProgress(file, read)
+	var rows []map[string]string
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		rows, err = readConsoleJSON(r)
+	} else {
+		rows, err = readConsoleCSV(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []model.UsageRecord
+	for _, row := range rows {
+		r, ok := consoleRecord(row)
+		if ok {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+// readConsoleCSV reads a CSV export into rows keyed by normalized column name
+func readConsoleCSV(r io.Reader) ([]map[string]string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range header {
+		header[i] = normalizeColumn(name)
+	}
+
+	var rows []map[string]string
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		row := make(map[string]string, len(header))
+		for i, value := range fields {
+			if i < len(header) {
+				row[header[i]] = value
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// readConsoleJSON reads an Admin API usage report into rows, one per result,
+// flattening nested objects such as cache_creation into prefixed columns
+func readConsoleJSON(r io.Reader) ([]map[string]string, error) {
+	var report struct {
+		Data []struct {
+			StartingAt string                   `json:"starting_at"`
+			Results    []map[string]interface{} `json:"results"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(r).Decode(&report); err != nil {
+		return nil, fmt.Errorf("invalid usage report: %w", err)
+	}
+
+	var rows []map[string]string
+	for _, bucket := range report.Data {
+		for _, result := range bucket.Results {
+			row := map[string]string{"starting_at": bucket.StartingAt}
+			flattenJSON(row, "", result)
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+// flattenJSON copies scalar values from v into row, joining nested keys with "_"
+func flattenJSON(row map[string]string, prefix string, v map[string]interface{}) {
+	for key, value := range v {
+		name := normalizeColumn(prefix + key)
+		switch value := value.(type) {
+		case map[string]interface{}:
+			flattenJSON(row, name+"_", value)
+		case string:
+			row[name] = value
+		case float64:
+			row[name] = strconv.FormatFloat(value, 'f', -1, 64)
+		}
+	}
+}
+
+// consoleRecord converts an export row into a usage record
+func consoleRecord(row map[string]string) (model.UsageRecord, bool) {
+	timestamp, ok := parseConsoleTime(column(row, consoleColumns.time))
+	if !ok {
+		return model.UsageRecord{}, false
+	}
+
+	usage := model.TokenUsage{
+		InputTokens:  parseTokens(column(row, consoleColumns.input)),
+		OutputTokens: parseTokens(column(row, consoleColumns.output)),
+	}
+	// Cache writes may be split by TTL (e.g. cache_creation_ephemeral_5m_input_tokens)
+	for name, value := range row {
+		switch {
+		case strings.HasPrefix(name, "cache_creation"), strings.HasPrefix(name, "cache_write"):
+			usage.CacheCreationInputTokens += parseTokens(value)
+		case strings.HasPrefix(name, "cache_read"):
+			usage.CacheReadInputTokens += parseTokens(value)
+		}
+	}
+	if usage == (model.TokenUsage{}) {
+		return model.UsageRecord{}, false
+	}
+
+	modelName := column(row, consoleColumns.model)
+	if modelName == "" {
+		modelName = "unknown"
+	}
+
+	return model.UsageRecord{
+		Timestamp:   timestamp,
+		SessionID:   ConsoleSessionID,
+		ProjectPath: column(row, consoleColumns.workspace),
+		Model:       modelName,
+		Usage:       usage,
+	}, true
+}
+
+// column returns the first non-empty value among the given column names
+func column(row map[string]string, names []string) string {
+	for _, name := range names {
+		if value := strings.TrimSpace(row[name]); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// normalizeColumn lowercases a column name and replaces spaces with underscores
+func normalizeColumn(name string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), " ", "_")
+}
+
+// parseConsoleTime parses the date formats used in console exports
+func parseConsoleTime(value string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseTokens parses a token count, tolerating thousands separators
+func parseTokens(value string) int64 {
+	value = strings.ReplaceAll(strings.TrimSpace(value), ",", "")
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return n
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return int64(f)
+	}
+	return 0
+}
@@ -0,0 +1,110 @@
+package parser
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zhaobenny/cctop/internal/model"
+)
+
+// serverExportFormat reads usage downloaded from a cctop server: the JSON
+// Lines from /api/export, or the takeout document from the dashboard, which
+// holds the same records in a "records" array
+type serverExportFormat struct{}
+
+// ServerExport is the cctop server export format
+var ServerExport Format = serverExportFormat{}
+
+// exportedRecord is a record as the server exports it
+type exportedRecord struct {
+	Timestamp           time.Time `json:"timestamp"`
+	ClientID            string    `json:"client_id"`
+	SessionID           string    `json:"session_id"`
+	ProjectPath         string    `json:"project_path"`
+	Model               string    `json:"model"`
+	InputTokens         int64     `json:"input_tokens"`
+	OutputTokens        int64     `json:"output_tokens"`
+	CacheCreationTokens int64     `json:"cache_creation_tokens"`
+	CacheReadTokens     int64     `json:"cache_read_tokens"`
+	Cost                float64   `json:"cost"`
+}
+
+func (serverExportFormat) FindFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	var files []string
+	err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(p)) {
+		case ".json", ".jsonl", ".ndjson":
+			if !info.IsDir() {
+				files = append(files, p)
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+func (serverExportFormat) ParseFile(path string, opts ParseOptions, read func(n int64)) ([]model.UsageRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Each top-level value is either one exported record or a takeout
+	var records []model.UsageRecord
+	decoder := json.NewDecoder(withProgress(file, read))
+	for {
+		var value struct {
+			exportedRecord
+			Records []exportedRecord `json:"records"`
+		}
+		err := decoder.Decode(&value)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid server export: %w", err)
+		}
+
+		if value.Records == nil {
+			value.Records = []exportedRecord{value.exportedRecord}
+		}
+		for _, e := range value.Records {
+			if e.Timestamp.IsZero() || e.Model == "" {
+				continue
+			}
+			records = append(records, model.UsageRecord{
+				Timestamp:   e.Timestamp,
+				SessionID:   e.SessionID,
+				ProjectPath: e.ProjectPath,
+				Model:       e.Model,
+				Usage: model.TokenUsage{
+					InputTokens:              e.InputTokens,
+					OutputTokens:             e.OutputTokens,
+					CacheCreationInputTokens: e.CacheCreationTokens,
+					CacheReadInputTokens:     e.CacheReadTokens,
+				},
+				LoggedCost: e.Cost,
+				ClientID:   e.ClientID,
+			})
+		}
+	}
+	return records, nil
+}
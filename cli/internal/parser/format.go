@@ -0,0 +1,212 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/zhaobenny/cctop/internal/model"
+)
+
+// Format reads one kind of usage log into usage records
+type Format interface {
+	// FindFiles lists the files to parse under path
+	FindFiles(path string) ([]string, error)
+	// ParseFile parses a single file. If read is non-nil it is called as the
+	// file is consumed with the number of bytes read since the last call.
+	ParseFile(path string, opts ParseOptions, read func(n int64)) ([]model.UsageRecord, error)
+}
+
+// appender is implemented by formats whose files only change by having
+// lines appended, like Claude Code's transcripts. parseFrom parses a file
+// from offset (0, or an offset it returned before) and returns the offset
+// just past the last complete line, so a grown file needn't be parsed again
+// from the start.
+type appender interface {
+	parseFrom(path string, offset int64, opts ParseOptions, read func(n int64)) ([]model.UsageRecord, int64, error)
+}
+
+// ParseOptions controls which records parsing keeps
+type ParseOptions struct {
+	// CountEmpty keeps assistant messages with no input or output tokens
+	// (cache-only or empty turns), so activity can be counted. Formats
+	// without per-message records ignore it.
+	CountEmpty bool
+
+	// Cache reuses the records of files unchanged since the last parse from
+	// an on-disk cache, and updates it
+	Cache bool
+}
+
+// ProgressStats describes how far parsing has got
+type ProgressStats struct {
+	Files      int   // Files fully parsed
+	TotalFiles int   // Files found
+	Records    int   // Records parsed so far
+	Bytes      int64 // Bytes read so far, including the file in progress
+}
+
+// ProgressFunc receives parse progress. It is called often (after every
+// read), so implementations should throttle their own output.
+type ProgressFunc func(ProgressStats)
+
+// progressReader reports bytes read through it
+type progressReader struct {
+	r    io.Reader
+	read func(n int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 && p.read != nil {
+		p.read(int64(n))
+	}
+	return n, err
+}
+
+// withProgress wraps r to report reads, or returns r unchanged if read is nil
+func withProgress(r io.Reader, read func(n int64)) io.Reader {
+	if read == nil {
+		return r
+	}
+	return &progressReader{r: r, read: read}
+}
+
+// formats maps --source names to formats
+var formats = map[string]Format{
+	"claude-code":   ClaudeCode,
+	"console":       Console,
+	"server-export": ServerExport,
+}
+
+// LookupFormat returns the format registered under name
+func LookupFormat(name string) (Format, error) {
+	if f, ok := formats[name]; ok {
+		return f, nil
+	}
+	return nil, fmt.Errorf("unknown source %q (expected %s)", name, strings.Join(FormatNames(), ", "))
+}
+
+// FormatNames returns the registered format names, sorted
+func FormatNames() []string {
+	var names []string
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Parse parses every file the format finds under the given paths.
+// Records are tagged with the path they were found under.
+func Parse(format Format, paths ...string) ([]model.UsageRecord, error) {
+	return ParseWithOptions(format, ParseOptions{}, nil, paths...)
+}
+
+// ParseWithOptions is Parse with options and progress reported to progress (may be nil)
+func ParseWithOptions(format Format, opts ParseOptions, progress ProgressFunc, paths ...string) ([]model.UsageRecord, error) {
+	// Find every file up front so progress can show a total
+	type source struct{ path, file string }
+	var sources []source
+	for _, path := range paths {
+		files, err := format.FindFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			sources = append(sources, source{path, file})
+		}
+	}
+
+	stats := ProgressStats{TotalFiles: len(sources)}
+	var read func(n int64)
+	if progress != nil {
+		read = func(n int64) {
+			stats.Bytes += n
+			progress(stats)
+		}
+	}
+
+	var cache *recordCache
+	if opts.Cache {
+		cache = loadRecordCache(format, opts)
+	}
+
+	var allRecords []model.UsageRecord
+	for _, src := range sources {
+		records, err := parseCached(format, cache, src.file, opts, read)
+		stats.Files++
+		if err != nil {
+			// Log error but continue with other files
+			continue
+		}
+		for i := range records {
+			records[i].Source = src.path
+		}
+		allRecords = append(allRecords, records...)
+
+		stats.Records = len(allRecords)
+		if progress != nil {
+			progress(stats)
+		}
+	}
+
+	if cache != nil {
+		// A cache that can't be written only costs speed next time
+		cache.save()
+	}
+
+	return allRecords, nil
+}
+
+// parseCached parses a file, or takes its records from cache (may be nil)
+// if it hasn't changed since it was cached
+func parseCached(format Format, cache *recordCache, path string, opts ParseOptions, read func(n int64)) ([]model.UsageRecord, error) {
+	if cache == nil {
+		return format.ParseFile(path, opts, read)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if records, ok := cache.lookup(path, info); ok {
+		if read != nil {
+			read(info.Size())
+		}
+		return records, nil
+	}
+
+	a, ok := format.(appender)
+	if !ok {
+		records, err := format.ParseFile(path, opts, read)
+		if err != nil {
+			return nil, err
+		}
+		cache.store(path, info, records, 0)
+		return records, nil
+	}
+
+	// A file that has only grown is parsed from where its cached records end
+	var records []model.UsageRecord
+	var offset int64
+	if cached, ok := cache.grown(path, info); ok {
+		records, offset = cached.Records, cached.Offset
+	}
+	more, end, err := a.parseFrom(path, offset, opts, read)
+	if errors.Is(err, errNotAppended) {
+		records = nil
+		more, end, err = a.parseFrom(path, 0, opts, read)
+	} else if offset > 0 && read != nil {
+		read(offset)
+	}
+	if err != nil {
+		return nil, err
+	}
+	records = append(records, more...)
+	cache.store(path, info, records, end)
+	return records, nil
+}
@@ -2,42 +2,157 @@ package parser
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/zhaobenny/cctop/internal/model"
 )
 
-// rawMessage represents the raw JSON structure from Claude Code JSONL files
+// rawMessage represents the raw JSON structure from Claude Code JSONL files.
+// Older Claude Code versions wrote a few fields differently, so each has
+// fallbacks; see assistant, model, usage and sessionID.
 type rawMessage struct {
-	Type      string `json:"type"`
-	SessionID string `json:"sessionId"`
-	Timestamp string `json:"timestamp"`
-	CWD       string `json:"cwd"`
-	Message   struct {
-		Model string `json:"model"`
-		Usage struct {
-			InputTokens              int64 `json:"input_tokens"`
-			OutputTokens             int64 `json:"output_tokens"`
-			CacheCreationInputTokens int64 `json:"cache_creation_input_tokens"`
-			CacheReadInputTokens     int64 `json:"cache_read_input_tokens"`
-		} `json:"usage"`
+	Type         string    `json:"type"`
+	SessionID    string    `json:"sessionId"`
+	SessionIDAlt string    `json:"session_id"`
+	Timestamp    string    `json:"timestamp"`
+	CWD          string    `json:"cwd"`
+	Version      string    `json:"version"`
+	CostUSD      float64   `json:"costUSD"`
+	Model        string    `json:"model"` // Older logs: top level rather than in message
+	Usage        *rawUsage `json:"usage"` // Older logs: top level rather than in message
+	Message      struct {
+		Type  string   `json:"type"` // "message" for API responses
+		Role  string   `json:"role"`
+		Model string   `json:"model"`
+		Usage rawUsage `json:"usage"`
 	} `json:"message"`
 }
 
-// FindUsageFiles finds all JSONL files in the Claude projects directory
-func FindUsageFiles() ([]string, error) {
+// rawUsage is the token usage of an API response
+type rawUsage struct {
+	InputTokens              int64 `json:"input_tokens"`
+	OutputTokens             int64 `json:"output_tokens"`
+	CacheCreationInputTokens int64 `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64 `json:"cache_read_input_tokens"`
+	// Cache writes split by TTL, written alone by some versions
+	CacheCreation struct {
+		Ephemeral5m int64 `json:"ephemeral_5m_input_tokens"`
+		Ephemeral1h int64 `json:"ephemeral_1h_input_tokens"`
+	} `json:"cache_creation"`
+	// Server tools the API ran for the response. Web fetches are only billed
+	// as tokens, so just searches are counted.
+	ServerToolUse struct {
+		WebSearchRequests int64 `json:"web_search_requests"`
+	} `json:"server_tool_use"`
+}
+
+// assistant reports whether the line is an assistant response. Older
+// versions only marked the role on the nested API message.
+func (raw *rawMessage) assistant() bool {
+	switch raw.Type {
+	case "assistant":
+		return true
+	case "", "message":
+		return raw.Message.Role == "assistant"
+	}
+	return false
+}
+
+// model returns the model that produced the response
+func (raw *rawMessage) model() string {
+	if raw.Message.Model != "" {
+		return raw.Message.Model
+	}
+	return raw.Model
+}
+
+// sessionID returns the session the line belongs to
+func (raw *rawMessage) sessionID() string {
+	if raw.SessionID != "" {
+		return raw.SessionID
+	}
+	return raw.SessionIDAlt
+}
+
+// usage returns the response's token usage
+func (raw *rawMessage) usage() model.TokenUsage {
+	u := raw.Message.Usage
+	if u.InputTokens == 0 && u.OutputTokens == 0 && raw.Usage != nil {
+		u = *raw.Usage
+	}
+
+	cacheCreation := u.CacheCreationInputTokens
+	if cacheCreation == 0 {
+		cacheCreation = u.CacheCreation.Ephemeral5m + u.CacheCreation.Ephemeral1h
+	}
+
+	return model.TokenUsage{
+		InputTokens:              u.InputTokens,
+		OutputTokens:             u.OutputTokens,
+		CacheCreationInputTokens: cacheCreation,
+		CacheReadInputTokens:     u.CacheReadInputTokens,
+		WebSearchRequests:        u.ServerToolUse.WebSearchRequests,
+	}
+}
+
+// DefaultDataDirs returns the Claude data directories to read when none are given.
+// CLAUDE_CONFIG_DIR and CLAUDE_HOME (comma-separated) take precedence over ~/.claude.
+func DefaultDataDirs() ([]string, error) {
+	var dirs []string
+	for _, env := range []string{"CLAUDE_CONFIG_DIR", "CLAUDE_HOME"} {
+		dirs = append(dirs, SplitDirs(os.Getenv(env))...)
+	}
+	if len(dirs) > 0 {
+		return dirs, nil
+	}
+
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		return nil, err
 	}
+	return []string{filepath.Join(homeDir, ".claude")}, nil
+}
+
+// SplitDirs splits a comma-separated directory list, dropping empty entries
+func SplitDirs(value string) []string {
+	var dirs []string
+	for _, dir := range strings.Split(value, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// projectsDir returns the projects directory for a Claude data directory.
+// The projects directory itself is also accepted.
+func projectsDir(dataDir string) string {
+	projects := filepath.Join(dataDir, "projects")
+	if info, err := os.Stat(projects); err == nil && info.IsDir() {
+		return projects
+	}
+	return dataDir
+}
+
+// FindUsageFiles finds all JSONL files in a Claude data directory. If the
+// directory doesn't exist the error wraps fs.ErrNotExist; unreadable entries
+// below it are skipped.
+func FindUsageFiles(dataDir string) ([]string, error) {
+	root := projectsDir(dataDir)
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
 
-	projectsDir := filepath.Join(homeDir, ".claude", "projects")
 	var files []string
 
-	err = filepath.Walk(projectsDir, func(path string, info os.FileInfo, err error) error {
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return nil
 		}
@@ -52,80 +167,131 @@ func FindUsageFiles() ([]string, error) {
 
 // ParseFile parses a single JSONL file and returns usage records
 func ParseFile(path string) ([]model.UsageRecord, error) {
+	records, _, err := parseJSONL(path, 0, ParseOptions{}, nil)
+	return records, err
+}
+
+// errNotAppended means a file changed other than by appending lines, so it
+// can't be parsed from where an earlier parse ended
+var errNotAppended = errors.New("file was rewritten since it was last parsed")
+
+// parseJSONL parses a JSONL file from offset, which must be the end of a
+// line, reporting bytes read to read (may be nil). It returns the offset
+// just past the last complete line. Claude Code may be midway through
+// appending a line when it's read: a final line with no newline that isn't
+// valid JSON yet is left for a later parse, neither counted nor reported.
+func parseJSONL(path string, offset int64, opts ParseOptions, read func(n int64)) ([]model.UsageRecord, int64, error) {
 	file, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer file.Close()
 
-	var records []model.UsageRecord
-	scanner := bufio.NewScanner(file)
+	if offset > 0 {
+		var prev [1]byte
+		if _, err := file.ReadAt(prev[:], offset-1); err != nil || prev[0] != '\n' {
+			return nil, 0, errNotAppended
+		}
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return nil, 0, err
+		}
+	}
 
-	// Increase buffer size for large lines
-	buf := make([]byte, 0, 64*1024)
-	scanner.Buffer(buf, 1024*1024)
+	var records []model.UsageRecord
+	reader := bufio.NewReaderSize(withProgress(file, read), 64*1024)
+	end := offset
 
-	for scanner.Scan() {
-		line := scanner.Bytes()
-		if len(line) == 0 {
-			continue
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return records, end, err
 		}
-
-		var raw rawMessage
-		if err := json.Unmarshal(line, &raw); err != nil {
-			// Skip malformed lines
-			continue
+		if err == io.EOF && len(line) > 0 && !json.Valid(line) {
+			// Still being written
+			break
 		}
+		end += int64(len(line))
 
-		// Only process assistant messages with usage data
-		if raw.Type != "assistant" || raw.Message.Model == "" {
-			continue
+		if record, ok := parseLine(bytes.TrimSpace(line), opts); ok {
+			records = append(records, record)
 		}
-
-		// Skip if no actual usage
-		usage := raw.Message.Usage
-		if usage.InputTokens == 0 && usage.OutputTokens == 0 {
-			continue
+		if err == io.EOF {
+			break
 		}
+	}
 
-		timestamp, err := time.Parse(time.RFC3339, raw.Timestamp)
-		if err != nil {
-			continue
-		}
+	return records, end, nil
+}
 
-		records = append(records, model.UsageRecord{
-			Timestamp:   timestamp,
-			SessionID:   raw.SessionID,
-			ProjectPath: raw.CWD,
-			Model:       raw.Message.Model,
-			Usage: model.TokenUsage{
-				InputTokens:              usage.InputTokens,
-				OutputTokens:             usage.OutputTokens,
-				CacheCreationInputTokens: usage.CacheCreationInputTokens,
-				CacheReadInputTokens:     usage.CacheReadInputTokens,
-			},
-		})
+// parseLine returns the usage record a JSONL line holds, if any
+func parseLine(line []byte, opts ParseOptions) (model.UsageRecord, bool) {
+	if len(line) == 0 {
+		return model.UsageRecord{}, false
 	}
 
-	return records, scanner.Err()
-}
+	var raw rawMessage
+	if err := json.Unmarshal(line, &raw); err != nil {
+		// Skip malformed lines
+		return model.UsageRecord{}, false
+	}
+
+	// Only process assistant messages with usage data
+	modelName := raw.model()
+	if !raw.assistant() || modelName == "" {
+		return model.UsageRecord{}, false
+	}
+
+	// Skip if no actual usage, unless counting every turn
+	usage := raw.usage()
+	if usage.InputTokens == 0 && usage.OutputTokens == 0 && !opts.CountEmpty {
+		return model.UsageRecord{}, false
+	}
 
-// ParseAllFiles parses all Claude Code JSONL files and returns all records
-func ParseAllFiles() ([]model.UsageRecord, error) {
-	files, err := FindUsageFiles()
+	timestamp, err := time.Parse(time.RFC3339, raw.Timestamp)
 	if err != nil {
-		return nil, err
+		return model.UsageRecord{}, false
 	}
 
-	var allRecords []model.UsageRecord
-	for _, file := range files {
-		records, err := ParseFile(file)
+	return model.UsageRecord{
+		Timestamp:   timestamp,
+		SessionID:   raw.sessionID(),
+		ProjectPath: raw.CWD,
+		Model:       modelName,
+		Usage:       usage,
+		Version:     raw.Version,
+		LoggedCost:  raw.CostUSD,
+	}, true
+}
+
+// claudeCodeFormat reads Claude Code's JSONL transcripts
+type claudeCodeFormat struct{}
+
+// ClaudeCode is the Claude Code JSONL format
+var ClaudeCode Format = claudeCodeFormat{}
+
+func (claudeCodeFormat) FindFiles(dataDir string) ([]string, error) {
+	return FindUsageFiles(dataDir)
+}
+
+func (claudeCodeFormat) ParseFile(path string, opts ParseOptions, read func(n int64)) ([]model.UsageRecord, error) {
+	records, _, err := parseJSONL(path, 0, opts, read)
+	return records, err
+}
+
+func (claudeCodeFormat) parseFrom(path string, offset int64, opts ParseOptions, read func(n int64)) ([]model.UsageRecord, int64, error) {
+	return parseJSONL(path, offset, opts, read)
+}
+
+// ParseAllFiles parses all Claude Code JSONL files in the given data directories
+// (or DefaultDataDirs when none are given). Records are tagged with their directory.
+func ParseAllFiles(dataDirs ...string) ([]model.UsageRecord, error) {
+	if len(dataDirs) == 0 {
+		dirs, err := DefaultDataDirs()
 		if err != nil {
-			// Log error but continue with other files
-			continue
+			return nil, err
 		}
-		allRecords = append(allRecords, records...)
+		dataDirs = dirs
 	}
 
-	return allRecords, nil
+	return ParseWithOptions(ClaudeCode, ParseOptions{Cache: true}, nil, dataDirs...)
 }
@@ -0,0 +1,147 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/zhaobenny/cctop/internal/model"
+)
+
+// TestParseFileSchemas parses a fixture per Claude Code JSONL schema version
+func TestParseFileSchemas(t *testing.T) {
+	tests := []struct {
+		file string
+		want []model.UsageRecord
+	}{
+		// v1: model, usage and session_id at the top level, the type on the
+		// nested message or missing altogether, and a logged costUSD
+		{"v1.jsonl", []model.UsageRecord{
+			{
+				Timestamp:   time.Date(2025, 3, 1, 10, 0, 5, 0, time.UTC),
+				SessionID:   "s-v1",
+				ProjectPath: "/home/dev/app",
+				Model:       "claude-3-5-sonnet-20241022",
+				Usage:       model.TokenUsage{InputTokens: 1200, OutputTokens: 300, CacheCreationInputTokens: 50, CacheReadInputTokens: 400},
+				Version:     "0.2.9",
+				LoggedCost:  0.0125,
+			},
+			{
+				Timestamp:   time.Date(2025, 3, 1, 10, 1, 0, 0, time.UTC),
+				SessionID:   "s-v1",
+				ProjectPath: "/home/dev/app",
+				Model:       "claude-3-5-haiku-20241022",
+				Usage:       model.TokenUsage{InputTokens: 80, OutputTokens: 20},
+				Version:     "0.2.9",
+				LoggedCost:  0.002,
+			},
+		}},
+
+		// v2: type "assistant", sessionId, and model and usage nested in the
+		// message, with cache writes either totalled or split by TTL
+		{"v2.jsonl", []model.UsageRecord{
+			{
+				Timestamp:   time.Date(2025, 9, 1, 10, 0, 5, 123000000, time.UTC),
+				SessionID:   "s-v2",
+				ProjectPath: "/home/dev/app",
+				Model:       "claude-sonnet-4-5-20250929",
+				Usage:       model.TokenUsage{InputTokens: 10, OutputTokens: 500, CacheCreationInputTokens: 2000, CacheReadInputTokens: 30000, WebSearchRequests: 2},
+				Version:     "1.0.98",
+			},
+			{
+				Timestamp:   time.Date(2025, 9, 1, 10, 0, 9, 0, time.UTC),
+				SessionID:   "s-v2",
+				ProjectPath: "/home/dev/app",
+				Model:       "claude-sonnet-4-5-20250929",
+				Usage:       model.TokenUsage{InputTokens: 4, OutputTokens: 60, CacheCreationInputTokens: 800, CacheReadInputTokens: 32000},
+				Version:     "1.0.98",
+			},
+		}},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseFile(filepath.Join("testdata", tt.file))
+		if err != nil {
+			t.Errorf("ParseFile(%s): %v", tt.file, err)
+			continue
+		}
+		if !slices.EqualFunc(got, tt.want, recordsEqual) {
+			t.Errorf("ParseFile(%s) = %+v, want %+v", tt.file, got, tt.want)
+		}
+	}
+}
+
+// recordsEqual compares records, with timestamps compared as instants
+func recordsEqual(a, b model.UsageRecord) bool {
+	if !a.Timestamp.Equal(b.Timestamp) {
+		return false
+	}
+	a.Timestamp, b.Timestamp = time.Time{}, time.Time{}
+	return a == b
+}
+
+func TestDefaultDataDirs(t *testing.T) {
+	home := t.TempDir()
+
+	tests := []struct {
+		configDir  string // CLAUDE_CONFIG_DIR
+		claudeHome string // CLAUDE_HOME
+		want       []string
+	}{
+		{"", "", []string{filepath.Join(home, ".claude")}},
+		{"/data/claude", "", []string{"/data/claude"}},
+		{"/data/work, /data/personal,", "", []string{"/data/work", "/data/personal"}},
+		{"", "/data/home", []string{"/data/home"}},
+		{"/data/claude", "/data/home", []string{"/data/claude", "/data/home"}},
+		{" , ", "", []string{filepath.Join(home, ".claude")}},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("HOME", home)
+		t.Setenv("CLAUDE_CONFIG_DIR", tt.configDir)
+		t.Setenv("CLAUDE_HOME", tt.claudeHome)
+
+		got, err := DefaultDataDirs()
+		if err != nil {
+			t.Errorf("DefaultDataDirs() with CLAUDE_CONFIG_DIR=%q CLAUDE_HOME=%q: %v", tt.configDir, tt.claudeHome, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("DefaultDataDirs() with CLAUDE_CONFIG_DIR=%q CLAUDE_HOME=%q = %q, want %q", tt.configDir, tt.claudeHome, got, tt.want)
+		}
+	}
+}
+
+func TestFindUsageFilesProjectsDir(t *testing.T) {
+	configDir := t.TempDir()
+	projects := filepath.Join(configDir, "projects", "app")
+	if err := os.MkdirAll(projects, 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(projects, "session.jsonl")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Outside projects, so not read while projects exists
+	if err := os.WriteFile(filepath.Join(configDir, "history.jsonl"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("CLAUDE_CONFIG_DIR", configDir)
+	t.Setenv("CLAUDE_HOME", "")
+	dirs, err := DefaultDataDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{dirs[0], filepath.Join(configDir, "projects")} {
+		files, err := FindUsageFiles(dir)
+		if err != nil {
+			t.Errorf("FindUsageFiles(%s): %v", dir, err)
+		} else if !slices.Equal(files, []string{file}) {
+			t.Errorf("FindUsageFiles(%s) = %q, want %q", dir, files, []string{file})
+		}
+	}
+}
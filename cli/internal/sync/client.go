@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"time"
 
@@ -23,6 +24,8 @@ type SyncRequest struct {
 	ClientID   string       `json:"client_id"`
 	ClientName string       `json:"client_name"`
 	Records    []SyncRecord `json:"records"`
+	Partial    bool         `json:"partial,omitempty"` // Don't advance the client's last sync time
+	Tag        string       `json:"tag,omitempty"`     // Groups the records on the dashboard
 }
 
 // SyncRecord represents a single usage record
@@ -51,6 +54,32 @@ type SyncStatusResponse struct {
 	Error      string     `json:"error,omitempty"`
 }
 
+// ClientInfo describes a sync client registered with the server
+type ClientInfo struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	LastSyncAt *time.Time `json:"last_sync_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// UsagePeriod is one period of this machine's usage as stored by the server
+type UsagePeriod struct {
+	Period              string  `json:"period"`
+	InputTokens         int64   `json:"input_tokens"`
+	OutputTokens        int64   `json:"output_tokens"`
+	CacheCreationTokens int64   `json:"cache_creation_tokens"`
+	CacheReadTokens     int64   `json:"cache_read_tokens"`
+	Cost                float64 `json:"cost"`
+}
+
+// UsageResponse represents the usage API response
+type UsageResponse struct {
+	Timezone     string        `json:"timezone"`
+	PrunedBefore *time.Time    `json:"pruned_before,omitempty"`
+	Periods      []UsagePeriod `json:"periods"`
+	Error        string        `json:"error,omitempty"`
+}
+
 // NewClient creates a new sync client
 func NewClient(cfg *config.Config) *Client {
 	return &Client{
@@ -61,16 +90,27 @@ func NewClient(cfg *config.Config) *Client {
 	}
 }
 
+// setAuth adds the API key to a request in the configured header. Some
+// proxies strip non-standard headers, so Authorization can be used instead.
+func (c *Client) setAuth(req *http.Request) {
+	if c.cfg.AuthHeader == config.AuthHeaderBearer {
+		req.Header.Set("Authorization", "Bearer "+c.cfg.APIKey)
+		return
+	}
+	req.Header.Set("X-API-Key", c.cfg.APIKey)
+}
+
 // GetSyncStatus gets the last sync time from the server
 func (c *Client) GetSyncStatus() (*time.Time, error) {
-	url := fmt.Sprintf("%s/api/sync/status?client_id=%s", c.cfg.Server, c.cfg.ClientID)
+	query := url.Values{"client_id": {c.cfg.ClientID}}
+	endpoint := fmt.Sprintf("%s/api/sync/status?%s", c.cfg.Server, query.Encode())
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequest("GET", endpoint, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("X-API-Key", c.cfg.APIKey)
+	c.setAuth(req)
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
@@ -94,8 +134,105 @@ func (c *Client) GetSyncStatus() (*time.Time, error) {
 	return status.LastSyncAt, nil
 }
 
+// GetMonthlyUsage gets this machine's usage by month as stored by the
+// server, with months taken in timezone (empty for UTC)
+func (c *Client) GetMonthlyUsage(timezone string) (*UsageResponse, error) {
+	query := url.Values{"view": {"monthly"}, "client_id": {c.cfg.ClientID}}
+	if timezone != "" {
+		query.Set("timezone", timezone)
+	}
+	endpoint := fmt.Sprintf("%s/api/usage?%s", c.cfg.Server, query.Encode())
+
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c.setAuth(req)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var usage UsageResponse
+	if err := json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+		return nil, fmt.Errorf("server returned status %d", resp.StatusCode)
+	}
+	if usage.Error != "" {
+		return nil, fmt.Errorf("%s", usage.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned status %d", resp.StatusCode)
+	}
+
+	return &usage, nil
+}
+
+// GetClients lists the sync clients registered to the account
+func (c *Client) GetClients() ([]ClientInfo, error) {
+	url := fmt.Sprintf("%s/api/clients", c.cfg.Server)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c.setAuth(req)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned status %d", resp.StatusCode)
+	}
+
+	var clients []ClientInfo
+	if err := json.NewDecoder(resp.Body).Decode(&clients); err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
 // Sync sends usage records to the server
 func (c *Client) Sync(records []model.UsageRecord) (int64, error) {
+	return c.sendBatches(records, false)
+}
+
+// SyncPartial sends a selection of usage records, such as a date range,
+// without advancing the client's last sync time, so later syncs still
+// upload the records that were left out
+func (c *Client) SyncPartial(records []model.UsageRecord) (int64, error) {
+	return c.sendBatches(records, true)
+}
+
+// syncBatchSize is the most records sent in one request, keeping request
+// bodies (a few hundred bytes a record) well under the server's size limit
+const syncBatchSize = 5000
+
+// sendBatches sends records syncBatchSize at a time. Every batch but the
+// last is sent as partial, so the server only advances the client's last
+// sync time once all of them have arrived.
+func (c *Client) sendBatches(records []model.UsageRecord, partial bool) (int64, error) {
+	var inserted int64
+	for start := 0; start < len(records); start += syncBatchSize {
+		end := min(start+syncBatchSize, len(records))
+		n, err := c.send(records[start:end], partial || end < len(records))
+		inserted += n
+		if err != nil {
+			return inserted, err
+		}
+	}
+	return inserted, nil
+}
+
+// send posts usage records to the sync endpoint
+func (c *Client) send(records []model.UsageRecord, partial bool) (int64, error) {
 	// Get hostname for client name
 	hostname, _ := os.Hostname()
 	if hostname == "" {
@@ -121,6 +258,8 @@ func (c *Client) Sync(records []model.UsageRecord) (int64, error) {
 		ClientID:   c.cfg.ClientID,
 		ClientName: hostname,
 		Records:    syncRecords,
+		Partial:    partial,
+		Tag:        c.cfg.Tag,
 	}
 
 	data, err := json.Marshal(reqBody)
@@ -135,7 +274,7 @@ func (c *Client) Sync(records []model.UsageRecord) (int64, error) {
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-API-Key", c.cfg.APIKey)
+	c.setAuth(req)
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
@@ -0,0 +1,43 @@
+package sync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zhaobenny/cctop/cli/internal/config"
+)
+
+func TestGetSyncStatus(t *testing.T) {
+	const clientID = "laptop & desk=1 a"
+	lastSync := time.Date(2025, 9, 1, 10, 0, 0, 0, time.UTC)
+
+	var gotPath, gotClientID, gotKey string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotClientID = r.URL.Query().Get("client_id")
+		gotKey = r.Header.Get("X-API-Key")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"last_sync_at":"2025-09-01T10:00:00Z"}`))
+	}))
+	defer srv.Close()
+
+	client := NewClient(&config.Config{Server: srv.URL, APIKey: "key", ClientID: clientID})
+	got, err := client.GetSyncStatus()
+	if err != nil {
+		t.Fatalf("GetSyncStatus: %v", err)
+	}
+	if got == nil || !got.Equal(lastSync) {
+		t.Errorf("GetSyncStatus() = %v, want %v", got, lastSync)
+	}
+	if gotPath != "/api/sync/status" {
+		t.Errorf("request path = %q, want /api/sync/status", gotPath)
+	}
+	if gotClientID != clientID {
+		t.Errorf("server got client_id %q, want %q", gotClientID, clientID)
+	}
+	if gotKey != "key" {
+		t.Errorf("server got API key %q, want %q", gotKey, "key")
+	}
+}
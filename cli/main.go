@@ -1,280 +1,1554 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
 	"os"
 	"os/user"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/kardianos/service"
 	"github.com/zhaobenny/cctop/cli/internal/aggregator"
 	"github.com/zhaobenny/cctop/cli/internal/config"
+	"github.com/zhaobenny/cctop/cli/internal/importer"
+	"github.com/zhaobenny/cctop/cli/internal/lifetime"
+	"github.com/zhaobenny/cctop/cli/internal/notes"
 	"github.com/zhaobenny/cctop/cli/internal/output"
 	"github.com/zhaobenny/cctop/cli/internal/sync"
+	"github.com/zhaobenny/cctop/internal/billing"
 	"github.com/zhaobenny/cctop/internal/model"
+	"github.com/zhaobenny/cctop/internal/pricing"
 	"github.com/zhaobenny/cctop/cli/internal/parser"
 )
 
 var version = "dev"
 
-func main() {
-	// Detect subcommand first
-	command := "daily"
-	args := os.Args[1:]
-
-	// Find and extract the subcommand from args
-	var filteredArgs []string
-	for i, arg := range args {
-		switch arg {
-		case "daily", "monthly", "session", "blocks", "sync", "config":
-			command = arg
-			// Keep remaining args for flag parsing
-			filteredArgs = append(args[:i], args[i+1:]...)
-		}
-		if command != "daily" || arg == "daily" {
-			break
+// Exit codes, so scripts can tell failures apart
+const (
+	exitError   = 1 // Anything else, including invalid usage
+	exitNoData  = 2 // No usage to report
+	exitBudget  = 3 // The report's total cost is over --budget
+	exitConfig  = 4 // Sync isn't configured, or the config can't be read or saved
+	exitNetwork = 5 // The sync server couldn't be reached or returned an error
+)
+
+// stringList is a repeatable string flag
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// parseFlags parses args like flag.ExitOnError would, but exits with
+// exitError rather than 2, which means no data
+func parseFlags(fs *flag.FlagSet, args []string) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
 		}
+		os.Exit(exitError)
 	}
-	if filteredArgs == nil {
-		filteredArgs = args
+}
+
+// commands are the subcommands cctop accepts
+var commands = []string{"daily", "weekly", "monthly", "session", "blocks", "billing", "source", "client", "project", "sync", "config", "annotate", "import", "pricing", "allocate", "efficiency", "diff", "verify"}
+
+// splitCommand finds the subcommand in args and returns it with the other
+// args, leaving args unmodified. Values of fs's flags are skipped, so
+// "--timezone daily" isn't taken as the daily command. Defaults to daily.
+func splitCommand(fs *flag.FlagSet, args []string) (string, []string) {
+	if command, rest, ok := splitSubcommand(fs, args, commands); ok {
+		return command, rest
 	}
+	return "daily", args
+}
 
-	// Handle special commands
-	switch command {
-	case "sync":
-		runSync(filteredArgs)
-		return
-	case "config":
-		runConfig(filteredArgs)
-		return
+// splitSubcommand finds the first of names in args, skipping fs's flags and
+// their values, and returns it with the other args, leaving args unmodified.
+// Nothing after "--" is taken.
+func splitSubcommand(fs *flag.FlagSet, args, names []string) (string, []string, bool) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if strings.HasPrefix(arg, "-") {
+			if flagTakesValue(fs, arg) {
+				i++
+			}
+			continue
+		}
+		if slices.Contains(names, arg) {
+			rest := append(slices.Clip(args[:i]), args[i+1:]...)
+			return arg, rest, true
+		}
+	}
+	return "", args, false
+}
+
+// flagTakesValue reports whether arg is one of fs's non-boolean flags given
+// without an inline "=value", so the next arg is its value
+func flagTakesValue(fs *flag.FlagSet, arg string) bool {
+	name := strings.TrimLeft(arg, "-")
+	if strings.Contains(name, "=") {
+		return false
 	}
+	f := fs.Lookup(name)
+	if f == nil {
+		return false
+	}
+	if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+		return false
+	}
+	return true
+}
 
+func main() {
 	// Create a new FlagSet for clean parsing
-	fs := flag.NewFlagSet("cctop", flag.ExitOnError)
+	fs := flag.NewFlagSet("cctop", flag.ContinueOnError)
 
 	var (
 		since     string
 		until     string
 		timezone  string
+		displayTZ string
 		jsonOut   bool
 		breakdown bool
 		compact   bool
 		offline   bool
 		showHelp  bool
 		showVer   bool
+		smooth    int
+		tail      int
+		weekStart string
+		dayStart  int
+		whole     bool
+		width     int
+		threshold int
+		format    string
+		progress  bool
+		verbose   bool
+		depth     int
+		allTime   bool
+		strict    bool
+		withDays  bool
+		combine   bool
+		combineCR bool
+		countAll  bool
+		anonymize bool
+		noCache   bool
+		outFormat string
+		running   bool
+		priceURL  string
+		priceFile string
+		freeReads bool
+		logCost   bool
+		oneLine   bool
+		flatFee   bool
+		markup    float64
+		budget    float64
+		precision int
+
+		excludeModels stringList
+		onlyModels    stringList
+		skipSessions  stringList
+		aliases       stringList
+		dataDirs      stringList
 	)
 
 	fs.StringVar(&since, "since", "", "Start date filter (YYYYMMDD)")
 	fs.StringVar(&until, "until", "", "End date filter (YYYYMMDD)")
 	fs.StringVar(&timezone, "timezone", "", "Timezone for date grouping (e.g., America/New_York)")
+	fs.StringVar(&displayTZ, "display-timezone", "", "Timezone to show block start times in, e.g. Local, without changing grouping (blocks)")
 	fs.BoolVar(&jsonOut, "json", false, "Output as JSON")
+	fs.StringVar(&outFormat, "format", "table", "Output format: table, or influx for InfluxDB line protocol (daily, weekly, monthly, blocks)")
 	fs.BoolVar(&breakdown, "breakdown", false, "Show per-model breakdown")
 	fs.BoolVar(&compact, "compact", false, "Force compact table output")
 	fs.BoolVar(&compact, "c", false, "Force compact table output")
+	fs.IntVar(&width, "width", 0, "Table width to lay out for (default: $CCTOP_WIDTH, the terminal width, or unlimited when output isn't a terminal)")
+	fs.IntVar(&threshold, "compact-threshold", output.DefaultCompactThreshold, "Use compact tables below this width")
+	fs.BoolVar(&allTime, "lifetime", false, "Show total tokens and cost across all history (cached, ignores filters)")
+	fs.IntVar(&precision, "precision", output.DefaultCostPrecision, "Decimal places to show costs with (raised automatically when every cost would show as $0.00)")
+	fs.BoolVar(&combine, "combine-cache", false, "Count cache creation tokens as input in tables")
+	fs.BoolVar(&combineCR, "combine-cache-read", false, "Count cache read tokens as input in tables")
+	fs.BoolVar(&countAll, "count-empty", false, "Keep assistant turns with no input or output tokens and show a Turns column")
+	fs.BoolVar(&noCache, "no-cache", false, "Parse every log file instead of reusing records cached from unchanged files")
+	fs.BoolVar(&progress, "progress", false, "Print parsing progress to stderr")
+	fs.BoolVar(&verbose, "verbose", false, "Print diagnostics about the usage data, such as the Claude Code versions that wrote it and models without pricing, to stderr")
+	fs.BoolVar(&strict, "strict", false, "Exit with an error if any model has no known pricing")
 	fs.BoolVar(&offline, "offline", false, "Use embedded pricing data (no network)")
+	fs.StringVar(&priceURL, "pricing-url", "", "Fetch LiteLLM pricing JSON from this URL, e.g. an internal mirror (default: $CCTOP_PRICING_URL or LiteLLM on GitHub)")
+	fs.StringVar(&priceFile, "pricing-file", "", "Price models from this LiteLLM-format JSON file, ahead of online and embedded pricing (models it covers need no network)")
+	fs.BoolVar(&freeReads, "free-cache-reads", false, "Price cache reads at $0, for plans that don't bill them (displayed costs only; synced costs are unaffected)")
+	fs.BoolVar(&logCost, "prefer-logged-cost", false, "Use the cost Claude Code logged for a message (costUSD) when there is one, instead of pricing its tokens")
+	fs.BoolVar(&flatFee, "plan", false, "Show costs as included in a subscription, with the API-equivalent total below the table")
+	fs.StringVar(&weekStart, "week-start", "monday", "First day of the week for the weekly report (sunday or monday)")
+	fs.IntVar(&dayStart, "day-start", 0, "Hour (0-23) your day starts at; earlier usage counts towards the previous day (daily, weekly, monthly)")
+	fs.BoolVar(&anonymize, "anonymize-sessions", false, "Replace session IDs with session-1, session-2, ... (session report)")
+	fs.BoolVar(&whole, "whole-sessions", false, "Count all usage of sessions/blocks that overlap --since/--until, not just in-range usage")
+	fs.Float64Var(&markup, "rate-multiplier", 1, "Multiply project costs by this markup in the allocate report")
+	fs.Float64Var(&budget, "budget", 0, "Exit with code 3 if the report's total cost, after --since/--until and filters, is over this many USD (with --summary-only, the cost shown)")
+	fs.IntVar(&depth, "group-projects-by-depth", 0, "Group projects by the first N path segments below your home directory (default: basename)")
+	fs.BoolVar(&withDays, "with-days", false, "Nest each month's daily usage in monthly --json output")
+	fs.BoolVar(&oneLine, "summary-only", false, "Print one summary line instead of a table: the current period for daily, weekly, monthly, billing and blocks, otherwise the total")
+	fs.BoolVar(&running, "cumulative", false, "Show a running total cost column, summed oldest first (daily, weekly, monthly)")
+	fs.IntVar(&tail, "tail", 0, "Show only the N most recent periods (daily, weekly, monthly, blocks)")
+	fs.IntVar(&smooth, "smooth", 0, "Show an N-day trailing average cost column (daily only)")
+	fs.StringVar(&format, "source", "claude-code", "Usage log format: claude-code, console for Anthropic Console exports, or server-export for cctop server exports (read from --data-dir)")
+	fs.Var(&dataDirs, "data-dir", "Claude data directory to read, comma-separated or repeatable (default: $CLAUDE_CONFIG_DIR or ~/.claude)")
+	fs.Var(&aliases, "project-alias", "Group a moved project's old path with its new one, as old=new (repeatable)")
+	fs.Var(&onlyModels, "only-model", "Only include models containing this substring, applied before --exclude-model (repeatable)")
+	fs.Var(&excludeModels, "exclude-model", "Exclude models containing this substring before aggregation (repeatable)")
+	fs.Var(&skipSessions, "exclude-session", "Exclude sessions whose ID starts with this prefix, e.g. a shortened ID from the session report (repeatable)")
 	fs.BoolVar(&showHelp, "help", false, "Show help")
 	fs.BoolVar(&showHelp, "h", false, "Show help")
 	fs.BoolVar(&showVer, "version", false, "Show version")
 	fs.BoolVar(&showVer, "v", false, "Show version")
 
 	fs.Usage = func() {
-		fmt.Fprintf(os.Stderr, `cctop - Claude Code Token Overview Program
-
-Usage: cctop [command] [options]
+		fmt.Fprintf(os.Stderr, `cctop - Claude Code Token Overview Program
+
+Usage: cctop [command] [options]
+
+Commands:
+  daily       Show daily usage report (default)
+  weekly      Show weekly usage report
+  monthly     Show monthly usage report
+  session     Show usage by session
+  blocks      Show usage by 5-hour billing blocks
+  billing     Show usage by billing cycle (set the day with 'cctop config --billing-day')
+  source      Show usage by data directory (account)
+  client      Show usage by syncing machine (with --source server-export)
+  project     Show usage by project directory
+  allocate    Show cost per project with an optional markup, for invoicing
+  efficiency  Show the realized cost per million tokens of each model
+  diff        Compare two days (YYYY-MM-DD) or months (YYYY-MM) side by side
+  sync        Sync usage data to server
+  config      Configure sync settings
+  annotate    Attach a note to a session
+  import      Import usage from a cctop or ccusage JSON export
+  pricing     Refresh pricing or show the pricing used for a model
+  verify      Check the server's totals for this machine against local logs
+
+Options:
+`)
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, `
+Examples:
+  cctop                      Show daily usage
+  cctop daily --since 20250101
+  cctop weekly --week-start sunday
+  cctop daily --day-start 4
+  cctop monthly --json
+  cctop monthly --json --with-days
+  cctop daily --format influx | influx write
+  cctop --lifetime
+  cctop session --breakdown
+  cctop session --since 20250101 --whole-sessions
+  cctop session --anonymize-sessions
+  cctop daily --exclude-model haiku
+  cctop monthly --only-model opus
+  cctop daily --exclude-session 3f2a9c1e
+  cctop monthly --strict --offline
+  cctop daily --smooth 7
+  cctop daily --tail 7 --cumulative
+  cctop daily --since 20250101 --cumulative
+  cctop monthly --summary-only
+  cctop monthly --since 20250101 --budget 200
+  cctop monthly --plan
+  cctop daily --count-empty
+  cctop monthly --combine-cache --combine-cache-read
+  cctop blocks
+  cctop blocks --display-timezone Local
+  cctop project --group-projects-by-depth 2
+  cctop project --project-alias ~/old/api=~/work/api
+  cctop efficiency --since 20250101
+  cctop diff 2025-01 2025-02
+  cctop diff 2025-01-14 2025-01-15 --timezone America/New_York
+  cctop allocate --since 20250101 --until 20250131 --rate-multiplier 1.2 --json
+  cctop source --data-dir ~/.claude-work,~/.claude-personal
+  cctop monthly --source console --data-dir usage-export.csv
+  cctop client --source server-export --data-dir cctop-takeout.json
+  cctop annotate 3f2a9c1e "refactoring auth"
+  cctop import ccusage-daily.json --sync
+  cctop config --server https://example.com --api-key <key>
+  cctop sync
+
+Exit codes:
+  0  Success
+  1  Error, including invalid usage
+  2  No usage data found
+  3  Over --budget
+  4  Sync isn't configured, or the config can't be read or saved
+  5  The sync server couldn't be reached or returned an error
+`)
+	}
+
+	// Find the subcommand, which may come before or after flags
+	command, filteredArgs := splitCommand(fs, os.Args[1:])
+
+	// Handle special commands
+	switch command {
+	case "sync":
+		runSync(filteredArgs)
+		return
+	case "config":
+		runConfig(filteredArgs)
+		return
+	case "annotate":
+		runAnnotate(filteredArgs)
+		return
+	case "import":
+		runImport(filteredArgs)
+		return
+	case "pricing":
+		runPricing(filteredArgs)
+		return
+	case "verify":
+		runVerify(filteredArgs)
+		return
+	}
+
+	// Allow flags after positional args, such as the diff command's periods
+	var positional []string
+	for args := filteredArgs; len(args) > 0; {
+		parseFlags(fs, args)
+		args = fs.Args()
+		if len(args) > 0 {
+			positional = append(positional, args[0])
+			args = args[1:]
+		}
+	}
+
+	if showVer {
+		fmt.Printf("cctop version %s\n", version)
+		return
+	}
+
+	if showHelp {
+		fs.Usage()
+		return
+	}
+
+	if priceURL != "" {
+		pricing.SetPricingURL(priceURL)
+	}
+	loadPricingFile(priceFile)
+	if logCost && freeReads {
+		fmt.Fprintf(os.Stderr, "Error: --prefer-logged-cost can't be combined with --free-cache-reads, since logged costs include cache reads.\n")
+		os.Exit(exitError)
+	}
+	pricing.SetFreeCacheReads(freeReads)
+	pricing.SetPreferLoggedCost(logCost)
+
+	if precision < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --precision must be 0 or more.\n")
+		os.Exit(exitError)
+	}
+	output.SetCostPrecision(precision)
+
+	// Parse dates
+	opts := aggregator.Options{
+		Offline:         offline,
+		OnlyModels:      onlyModels,
+		ExcludeModels:   excludeModels,
+		ExcludeSessions: skipSessions,
+		WholeGroups:     whole,
+		WithDays:        withDays,
+	}
+
+	if markup != 1 && command != "allocate" {
+		fmt.Fprintf(os.Stderr, "Error: --rate-multiplier is only supported for the allocate report.\n")
+		os.Exit(exitError)
+	}
+	if markup <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: --rate-multiplier must be positive.\n")
+		os.Exit(exitError)
+	}
+
+	if oneLine && (jsonOut || outFormat != "table") {
+		fmt.Fprintf(os.Stderr, "Error: --summary-only can't be combined with --json or --format.\n")
+		os.Exit(exitError)
+	}
+	if oneLine && (command == "efficiency" || command == "allocate" || command == "diff") {
+		fmt.Fprintf(os.Stderr, "Error: --summary-only is not supported for the %s report.\n", command)
+		os.Exit(exitError)
+	}
+
+	if flatFee && (jsonOut || outFormat != "table" || oneLine) {
+		fmt.Fprintf(os.Stderr, "Error: --plan only changes tables, so it can't be combined with --json, --format or --summary-only.\n")
+		os.Exit(exitError)
+	}
+	if flatFee && (command == "efficiency" || command == "allocate" || command == "diff") {
+		fmt.Fprintf(os.Stderr, "Error: --plan is not supported for the %s report.\n", command)
+		os.Exit(exitError)
+	}
+	if flatFee && (running || smooth > 0) {
+		fmt.Fprintf(os.Stderr, "Error: --plan can't be combined with --cumulative or --smooth.\n")
+		os.Exit(exitError)
+	}
+
+	if budget < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --budget must be 0 or more.\n")
+		os.Exit(exitError)
+	}
+	if budget > 0 && (allTime || command == "efficiency" || command == "allocate" || command == "diff") {
+		fmt.Fprintf(os.Stderr, "Error: --budget is not supported for --lifetime or the efficiency, allocate and diff reports.\n")
+		os.Exit(exitError)
+	}
+
+	if tail < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --tail must be 0 or more.\n")
+		os.Exit(exitError)
+	}
+	if tail > 0 && command != "daily" && command != "weekly" && command != "monthly" && command != "blocks" {
+		fmt.Fprintf(os.Stderr, "Error: --tail is only supported for the daily, weekly, monthly and blocks reports.\n")
+		os.Exit(exitError)
+	}
+
+	if withDays && (command != "monthly" || !jsonOut) {
+		fmt.Fprintf(os.Stderr, "Error: --with-days is only supported for monthly --json.\n")
+		os.Exit(exitError)
+	}
+
+	// Layouts of the period keys influx output parses timestamps from
+	influxLayouts := map[string]string{"daily": "2006-01-02", "weekly": "2006-01-02", "monthly": "2006-01", "blocks": ""}
+	switch outFormat {
+	case "table":
+	case "influx":
+		if _, ok := influxLayouts[command]; !ok || jsonOut {
+			fmt.Fprintf(os.Stderr, "Error: --format influx is only supported for the daily, weekly, monthly and blocks reports, without --json.\n")
+			os.Exit(exitError)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Error: Unknown --format %q (expected table or influx)\n", outFormat)
+		os.Exit(exitError)
+	}
+
+	opts.Since, opts.Until = parseDateRange(since, until)
+
+	if command == "billing" {
+		opts.BillingDay = billingDay()
+	}
+
+	var diffLayout string
+	if command == "diff" {
+		diffLayout = parseDiffPeriods(positional)
+	}
+
+	day, ok := aggregator.ParseWeekday(weekStart)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: Invalid --week-start: %s. Use sunday or monday.\n", weekStart)
+		os.Exit(exitError)
+	}
+	opts.WeekStart = day
+
+	if dayStart < 0 || dayStart > 23 {
+		fmt.Fprintf(os.Stderr, "Error: --day-start must be an hour from 0 to 23.\n")
+		os.Exit(exitError)
+	}
+	opts.DayStart = dayStart
+
+	if depth < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --group-projects-by-depth must be 0 or more.\n")
+		os.Exit(exitError)
+	}
+	opts.ProjectDepth = depth
+	home, _ := os.UserHomeDir()
+	opts.ProjectRoot = home
+
+	for _, alias := range aliases {
+		from, to, ok := strings.Cut(alias, "=")
+		if !ok || from == "" || to == "" {
+			fmt.Fprintf(os.Stderr, "Error: Invalid --project-alias %q. Use old=new.\n", alias)
+			os.Exit(exitError)
+		}
+		if opts.ProjectAliases == nil {
+			opts.ProjectAliases = make(map[string]string)
+		}
+		opts.ProjectAliases[expandHome(from, home)] = expandHome(to, home)
+	}
+
+	if timezone != "" {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid timezone: %s\n", timezone)
+			os.Exit(exitError)
+		}
+		opts.Timezone = loc
+	}
+	if displayTZ != "" {
+		if command != "blocks" {
+			fmt.Fprintf(os.Stderr, "Error: --display-timezone is only supported for the blocks report.\n")
+			os.Exit(exitError)
+		}
+		loc, err := time.LoadLocation(displayTZ)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid display timezone: %s\n", displayTZ)
+			os.Exit(exitError)
+		}
+		output.SetDisplayLocation(loc)
+	}
+
+	logFormat, err := parser.LookupFormat(format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitError)
+	}
+
+	var dirs []string
+	for _, d := range dataDirs {
+		dirs = append(dirs, parser.SplitDirs(d)...)
+	}
+	if len(dirs) == 0 {
+		if logFormat != parser.ClaudeCode {
+			fmt.Fprintf(os.Stderr, "Error: --source %s needs --data-dir pointing at the export file(s).\n", format)
+			os.Exit(exitError)
+		}
+		defaults, err := parser.DefaultDataDirs()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading usage data: %v\n", err)
+			os.Exit(exitError)
+		}
+		dirs = defaults
+	}
+
+	if allTime {
+		runLifetime(logFormat, format, dirs, priceFile, priceURL, offline, freeReads, logCost, jsonOut)
+		return
+	}
+
+	// Load and parse all usage data
+	var reportProgress parser.ProgressFunc
+	if progress {
+		reportProgress = newProgressPrinter()
+	}
+	records, err := parser.ParseWithOptions(logFormat, parser.ParseOptions{CountEmpty: countAll, Cache: !noCache}, reportProgress, dirs...)
+	if progress {
+		fmt.Fprintln(os.Stderr)
+	}
+	// A missing data directory is reported below unless imported usage is found
+	missingErr := err
+	if logFormat != parser.ClaudeCode || !errors.Is(err, os.ErrNotExist) {
+		missingErr = nil
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading usage data: %v\n", err)
+			os.Exit(exitError)
+		}
+	}
+
+	// Include usage imported from other tools
+	imported, err := importer.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not read imported usage: %v\n", err)
+	}
+	records = append(records, imported...)
+
+	if len(records) == 0 {
+		if !reportMissingData(missingErr) {
+			fmt.Printf("No usage data found in %s\n", strings.Join(dirs, ", "))
+		}
+		os.Exit(exitNoData)
+	}
+
+	// Filter by date range and excluded models. Sessions and blocks are kept
+	// whole or flagged so they aren't silently cut at the range edges.
+	var partial map[string]bool
+	switch command {
+	case "session":
+		records, partial = aggregator.FilterGroups(records, opts, aggregator.SessionKey)
+	case "blocks":
+		records, partial = aggregator.FilterGroups(records, opts, aggregator.BlockKey)
+	default:
+		records = aggregator.FilterRecords(records, opts)
+	}
+
+	if len(records) == 0 {
+		fmt.Println("No usage data found for the specified filters.")
+		os.Exit(exitNoData)
+	}
+
+	if verbose {
+		printVersionSpan(records)
+		printUnpricedModels(records, opts)
+	}
+
+	if strict {
+		if unknown := pricing.UnknownModels(records, offline); len(unknown) > 0 {
+			fmt.Fprintf(os.Stderr, "Error: No pricing for models: %s\n", strings.Join(unknown, ", "))
+			os.Exit(exitError)
+		}
+	}
+
+	// Aggregate based on command
+	var results []model.AggregatedUsage
+	var title string
+
+	switch command {
+	case "daily":
+		results = aggregator.ByDay(records, opts)
+		title = "Date"
+	case "weekly":
+		results = aggregator.ByWeek(records, opts)
+		title = "Week"
+	case "billing":
+		results = aggregator.ByBillingCycle(records, opts)
+		title = "Cycle Start"
+	case "monthly":
+		results = aggregator.ByMonth(records, opts)
+		title = "Month"
+	case "session":
+		results = aggregator.BySession(records, opts)
+		title = "Session"
+		if sessionNotes, err := notes.Load(); err == nil {
+			for i := range results {
+				results[i].Note = sessionNotes.Lookup(results[i].Key)
+			}
+		}
+	case "blocks":
+		results = aggregator.ByBlock(records, opts)
+		title = "Block"
+	case "source":
+		results = aggregator.BySource(records, opts)
+		title = "Source"
+	case "client":
+		results = aggregator.ByClient(records, opts)
+		title = "Client"
+	case "project":
+		results = aggregator.ByProject(records, opts)
+		title = "Project"
+	case "efficiency":
+		rows := aggregator.Efficiency(aggregator.ByModel(records, opts), offline)
+		if jsonOut {
+			output.PrintEfficiencyJSON(rows)
+		} else {
+			output.PrintEfficiency(rows)
+		}
+		return
+	case "diff":
+		d := diffPeriods(records, positional[0], positional[1], diffLayout, opts)
+		if jsonOut {
+			output.PrintDiffJSON(d)
+		} else {
+			output.PrintDiff(d)
+		}
+		return
+	case "allocate":
+		allocation := output.NewAllocation(aggregator.ByProject(records, opts), markup, since, until)
+		if jsonOut {
+			output.PrintAllocationJSON(allocation)
+		} else {
+			output.PrintAllocation(allocation)
+		}
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", command)
+		fs.Usage()
+		os.Exit(exitError)
+	}
+
+	for i := range results {
+		results[i].Partial = partial[results[i].Key]
+	}
+	if anonymize && command == "session" {
+		aggregator.AnonymizeSessions(results)
+	}
+	// Before --tail, so every period counts
+	total := aggregator.CalculateTotal(results)
+
+	if oneLine {
+		checkBudget(printSummaryLine(results, command, opts), budget)
+		return
+	}
+
+	// Output results
+	opts2 := output.TableOptions{
+		ForceCompact:         compact,
+		Width:                width,
+		CompactThreshold:     threshold,
+		CombineCacheCreation: combine,
+		CombineCacheRead:     combineCR,
+		ShowTurns:            countAll,
+		Plan:                 flatFee,
+	}
+	if smooth > 0 {
+		if command != "daily" {
+			fmt.Fprintf(os.Stderr, "Error: --smooth is only supported for the daily report.\n")
+			os.Exit(exitError)
+		}
+		opts2.MovingAverage = aggregator.MovingAverage(results, smooth)
+		opts2.MovingAverageDays = smooth
+	}
+	if running {
+		if command != "daily" && command != "weekly" && command != "monthly" {
+			fmt.Fprintf(os.Stderr, "Error: --cumulative is only supported for the daily, weekly and monthly reports.\n")
+			os.Exit(exitError)
+		}
+		opts2.Cumulative = aggregator.CumulativeCost(results)
+	}
+
+	// Keep the newest periods only after the moving average and running
+	// total are worked out, so they still count the periods left out
+	if tail > 0 {
+		keep := aggregator.Newest(results, tail)
+		results = pick(results, keep)
+		if opts2.MovingAverage != nil {
+			opts2.MovingAverage = pick(opts2.MovingAverage, keep)
+		}
+		if opts2.Cumulative != nil {
+			opts2.Cumulative = pick(opts2.Cumulative, keep)
+		}
+	}
+
+	if outFormat == "influx" {
+		loc := opts.Timezone
+		if loc == nil {
+			loc = time.Local
+		}
+		if err := output.PrintInflux(results, command, influxLayouts[command], loc); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitError)
+		}
+		checkBudget(total.Cost, budget)
+		return
+	}
+
+	if jsonOut {
+		output.PrintJSON(results)
+	} else if breakdown {
+		output.PrintTableWithBreakdownOpts(results, title, opts2)
+	} else {
+		output.PrintTableWithOptions(results, title, true, opts2)
+	}
+
+	if !jsonOut && len(partial) > 0 {
+		if whole {
+			fmt.Println("* Includes usage outside the date range.")
+		} else {
+			fmt.Println("* Only usage within the date range is counted. Use --whole-sessions for full totals.")
+		}
+	}
+	checkBudget(total.Cost, budget)
+
+	if len(os.Args) == 1 {
+		printSyncTip()
+	}
+}
+
+// checkBudget exits with exitBudget, after saying so on stderr, if cost is
+// over budget. A budget of 0 is no budget.
+func checkBudget(cost, budget float64) {
+	if budget > 0 && cost > budget {
+		fmt.Fprintf(os.Stderr, "Over budget: %s spent of %s\n", output.FormatCost(cost), output.FormatCost(budget))
+		os.Exit(exitBudget)
+	}
+}
+
+// printSyncTip points new users at syncing after a bare `cctop`, once. It's
+// skipped when a server is already configured, and never shown again after
+// the first time.
+func printSyncTip() {
+	if cfg, err := config.Load(); err != nil || cfg.Server != "" {
+		return
+	}
+	state, err := config.LoadState()
+	if err != nil || state.SyncTipShown {
+		return
+	}
+
+	fmt.Fprintln(os.Stderr, "Tip: sync your usage to a server with `cctop config --server <url> --api-key <key>`, then `cctop sync`.")
+
+	state.SyncTipShown = true
+	config.SaveState(state)
+}
+
+// billingDay returns the billing day from the config, exiting if none is set
+func billingDay() int {
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	if cfg.BillingDay == 0 {
+		fmt.Fprintf(os.Stderr, "No billing day set. Run 'cctop config --billing-day <1-31>' first.\n")
+		os.Exit(exitConfig)
+	}
+	return cfg.BillingDay
+}
+
+// printVersionSpan prints which Claude Code versions wrote records to
+// stderr, for --verbose
+func printVersionSpan(records []model.UsageRecord) {
+	oldest, newest, missing := aggregator.VersionSpan(records)
+	switch {
+	case oldest == "":
+		fmt.Fprintf(os.Stderr, "Claude Code version: not logged\n")
+	case oldest == newest:
+		fmt.Fprintf(os.Stderr, "Claude Code version: %s\n", oldest)
+	default:
+		fmt.Fprintf(os.Stderr, "Claude Code versions: %s to %s\n", oldest, newest)
+	}
+	if oldest != "" && missing > 0 {
+		fmt.Fprintf(os.Stderr, "  %d of %d records have no version (older logs or imported usage)\n", missing, len(records))
+	}
+}
+
+// printUnpricedModels prints the models in records with no known pricing to
+// stderr, with their tokens and what they were estimated to cost at default
+// pricing, for --verbose
+func printUnpricedModels(records []model.UsageRecord, opts aggregator.Options) {
+	unknown := pricing.UnknownModels(records, opts.Offline)
+	if len(unknown) == 0 {
+		return
+	}
+	type modelEstimate struct {
+		tokens int64
+		cost   float64
+	}
+	unpriced := make(map[string]*modelEstimate, len(unknown))
+	for _, name := range unknown {
+		unpriced[name] = &modelEstimate{}
+	}
+
+	var total, estimated float64
+	for _, r := range records {
+		m, ok := unpriced[r.Model]
+		if !ok || pricing.UsesLoggedCost(r) {
+			total += pricing.RecordCost(r, opts.Offline)
+			continue
+		}
+		// What RecordCost charges, without repeating GetPricing's warning
+		cost := pricing.CalculateCost(r.Usage, pricing.DefaultPricing)
+		m.tokens += r.Usage.InputTokens + r.Usage.OutputTokens + r.Usage.CacheCreationInputTokens + r.Usage.CacheReadInputTokens
+		m.cost += cost
+		total += cost
+		estimated += cost
+	}
+
+	fmt.Fprintf(os.Stderr, "Models without pricing, costed at default pricing:\n")
+	for _, name := range unknown {
+		m := unpriced[name]
+		fmt.Fprintf(os.Stderr, "  %s: %s tokens, %s\n", name, output.FormatNumber(m.tokens), output.FormatCost(m.cost))
+	}
+	share := 0.0
+	if total > 0 {
+		share = estimated / total * 100
+	}
+	fmt.Fprintf(os.Stderr, "  %s of %s (%.1f%%) is estimated; pass --pricing-file to price them\n",
+		output.FormatCost(estimated), output.FormatCost(total), share)
+}
+
+// pick returns the elements of s at indices, in order
+func pick[T any](s []T, indices []int) []T {
+	out := make([]T, len(indices))
+	for i, j := range indices {
+		out[i] = s[j]
+	}
+	return out
+}
+
+// summaryLabels names the current period of reports grouped by time
+var summaryLabels = map[string]string{
+	"daily":   "Today",
+	"weekly":  "This week",
+	"monthly": "This month",
+	"billing": "This cycle",
+	"blocks":  "This block",
+}
+
+// printSummaryLine prints the --summary-only line: usage in the current
+// period for reports grouped by time, or the total of the others. It
+// returns the cost shown.
+func printSummaryLine(results []model.AggregatedUsage, command string, opts aggregator.Options) float64 {
+	// Records are grouped in UTC unless a timezone is given
+	key, ok := aggregator.PeriodKey(command, time.Now().UTC(), opts)
+	if !ok {
+		total := aggregator.CalculateTotal(results)
+		output.PrintSummary("Total", total)
+		return total.Cost
+	}
+
+	var current []model.AggregatedUsage
+	for _, r := range results {
+		if r.Key == key {
+			current = append(current, r)
+		}
+	}
+	total := aggregator.CalculateTotal(current)
+	output.PrintSummary(summaryLabels[command], total)
+	return total.Cost
+}
+
+// parseDiffPeriods checks the diff command's two period keys, which must
+// both be days or both be months, and returns their layout. Exits on error.
+func parseDiffPeriods(args []string) string {
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "Error: diff needs two periods, e.g. cctop diff 2025-01 2025-02\n")
+		os.Exit(exitError)
+	}
+
+	var layout string
+	for _, l := range []string{"2006-01-02", "2006-01"} {
+		if _, err := time.Parse(l, args[0]); err == nil {
+			layout = l
+			break
+		}
+	}
+	if layout == "" {
+		fmt.Fprintf(os.Stderr, "Error: Invalid period %q. Use YYYY-MM-DD or YYYY-MM.\n", args[0])
+		os.Exit(exitError)
+	}
+	if _, err := time.Parse(layout, args[1]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid period %q. Both periods must be days (YYYY-MM-DD) or months (YYYY-MM).\n", args[1])
+		os.Exit(exitError)
+	}
+	return layout
+}
+
+// diffPeriods compares usage in two periods of the daily or monthly report,
+// by key. A period without usage compares as zero.
+func diffPeriods(records []model.UsageRecord, from, to, layout string, opts aggregator.Options) output.Diff {
+	var results []model.AggregatedUsage
+	if layout == "2006-01" {
+		results = aggregator.ByMonth(records, opts)
+	} else {
+		results = aggregator.ByDay(records, opts)
+	}
+
+	var a, b model.AggregatedUsage
+	for _, r := range results {
+		if r.Key == from {
+			a = r
+		}
+		if r.Key == to {
+			b = r
+		}
+	}
+	return output.NewDiff(from, a, to, b)
+}
+
+// parseDateRange parses YYYYMMDD --since and --until values, exiting on a
+// bad date. Either may be empty, leaving that end of the range zero. The
+// until date is included in full.
+func parseDateRange(since, until string) (time.Time, time.Time) {
+	var start, end time.Time
+	if since != "" {
+		t, err := time.Parse("20060102", since)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid --since date format. Use YYYYMMDD.\n")
+			os.Exit(exitError)
+		}
+		start = t
+	}
+
+	if until != "" {
+		t, err := time.Parse("20060102", until)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid --until date format. Use YYYYMMDD.\n")
+			os.Exit(exitError)
+		}
+		// Include the entire day
+		end = t.Add(24*time.Hour - time.Second)
+	}
+	return start, end
+}
+
+// expandHome cleans path, replacing a leading ~ with home, since the shell
+// doesn't expand it after "="
+func expandHome(path, home string) string {
+	if home != "" && (path == "~" || strings.HasPrefix(path, "~/")) {
+		path = filepath.Join(home, path[1:])
+	}
+	return filepath.Clean(path)
+}
+
+// reportMissingData prints a friendly message if err is a Claude data
+// directory not existing, which usually means Claude Code hasn't been used
+// yet, and reports whether it was
+func reportMissingData(err error) bool {
+	var pathErr *os.PathError
+	if !errors.Is(err, os.ErrNotExist) || !errors.As(err, &pathErr) {
+		return false
+	}
+	fmt.Printf("No Claude Code usage found (expected logs in %s). Is Claude Code installed?\n", pathErr.Path)
+	return true
+}
+
+// runLifetime prints total usage across all history from the lifetime cache
+func runLifetime(logFormat parser.Format, format string, dirs []string, priceFile, priceURL string, offline, freeReads, logCost, jsonOut bool) {
+	key := format + ":" + strings.Join(dirs, ",")
+	if priceFile != "" {
+		// Cached costs were priced without the file
+		key += ":pricing-file=" + priceFile
+	}
+	if priceURL == "" {
+		priceURL = os.Getenv("CCTOP_PRICING_URL")
+	}
+	if priceURL != "" {
+		// Cached costs were priced from another source
+		key += ":pricing-url=" + priceURL
+	}
+	if freeReads {
+		// Cached costs priced cache reads differently
+		key += ":free-cache-reads"
+	}
+	if logCost {
+		key += ":prefer-logged-cost"
+	}
+	summary, err := lifetime.Update(logFormat, key, dirs, offline)
+	if logFormat == parser.ClaudeCode && reportMissingData(err) {
+		os.Exit(exitNoData)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading usage data: %v\n", err)
+		os.Exit(exitError)
+	}
+
+	// Imported usage is small, so it's added fresh rather than cached
+	imported, err := importer.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not read imported usage: %v\n", err)
+	}
+	for _, r := range imported {
+		summary.Add(r)
+	}
+
+	if jsonOut {
+		data, _ := json.MarshalIndent(map[string]interface{}{
+			"first":                       summary.First,
+			"last":                        summary.HighWater,
+			"records":                     summary.Records,
+			"input_tokens":                summary.Usage.InputTokens,
+			"output_tokens":               summary.Usage.OutputTokens,
+			"cache_creation_input_tokens": summary.Usage.CacheCreationInputTokens,
+			"cache_read_input_tokens":     summary.Usage.CacheReadInputTokens,
+			"total_tokens":                summary.Tokens(),
+			"cost":                        summary.Cost,
+		}, "", "  ")
+		fmt.Println(string(data))
+		if summary.Records == 0 {
+			os.Exit(exitNoData)
+		}
+		return
+	}
+
+	if summary.Records == 0 {
+		fmt.Printf("No usage data found in %s\n", strings.Join(dirs, ", "))
+		os.Exit(exitNoData)
+	}
+	fmt.Printf("Lifetime: %s tokens, %s across %s requests since %s\n",
+		output.FormatNumber(summary.Tokens()), output.FormatCost(summary.Cost),
+		output.FormatNumber(int64(summary.Records)), summary.First.Local().Format("2006-01-02"))
+}
+
+// newProgressPrinter returns a parse progress reporter that rewrites a
+// status line on stderr at most a few times per second
+func newProgressPrinter() parser.ProgressFunc {
+	var last time.Time
+	return func(p parser.ProgressStats) {
+		done := p.Files == p.TotalFiles
+		if !done && time.Since(last) < 200*time.Millisecond {
+			return
+		}
+		last = time.Now()
+		fmt.Fprintf(os.Stderr, "\rParsed %d records from %d/%d files (%.1f MB)",
+			p.Records, p.Files, p.TotalFiles, float64(p.Bytes)/(1024*1024))
+	}
+}
+
+func runConfig(args []string) {
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	var (
+		server     string
+		apiKey     string
+		authHeader string
+		show       bool
+		export     bool
+		importPath string
+		keepID     bool
+		tag        string
+		billDay    int
+	)
+	fs.StringVar(&server, "server", "", "Server URL")
+	fs.StringVar(&apiKey, "api-key", "", "API key for authentication")
+	fs.StringVar(&authHeader, "auth-header", "", "How to send the API key: x-api-key (default) or bearer")
+	fs.StringVar(&tag, "tag", "", "Tag this machine's syncs, e.g. work, to group its usage on the dashboard (empty to clear)")
+	fs.IntVar(&billDay, "billing-day", 0, "Day of month (1-31) billing cycles start on, for the billing report (0 to clear)")
+	fs.BoolVar(&show, "show", false, "Show current configuration")
+	fs.BoolVar(&export, "export", false, "Print the configuration as YAML, API key included, for --import on another machine")
+	fs.StringVar(&importPath, "import", "", "Use the server and API key from a file written by --export")
+	fs.BoolVar(&keepID, "keep-client-id", false, "With --import, also take the exported client ID, so both machines sync as one client")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: cctop config [options]
+
+Options:
+`)
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, `
+Examples:
+  cctop config --server https://example.com --api-key cctop_xxx
+  cctop config --auth-header bearer
+  cctop config --tag work
+  cctop config --billing-day 15
+  cctop config --show
+  cctop config --export > cctop.yaml
+  cctop config --import cctop.yaml
+`)
+	}
+
+	parseFlags(fs, args)
+
+	if keepID && importPath == "" {
+		fmt.Fprintf(os.Stderr, "Error: --keep-client-id only applies to --import\n")
+		os.Exit(exitError)
+	}
+
+	if export {
+		cfg, err := config.Load()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+			os.Exit(exitConfig)
+		}
+		if cfg.Server == "" {
+			fmt.Fprintf(os.Stderr, "No configuration to export. Run 'cctop config --server <url> --api-key <key>' first.\n")
+			os.Exit(exitConfig)
+		}
+		if err := config.Export(os.Stdout, cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Error exporting config: %v\n", err)
+			os.Exit(exitError)
+		}
+		return
+	}
+
+	if importPath != "" {
+		runConfigImport(importPath, keepID)
+		return
+	}
+
+	if show {
+		cfg, err := config.Load()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+			os.Exit(exitConfig)
+		}
+		if cfg.Server == "" && cfg.BillingDay == 0 {
+			fmt.Println("No configuration found. Run 'cctop config --server <url> --api-key <key>' to configure.")
+			return
+		}
+		if cfg.Server != "" {
+			fmt.Printf("Server: %s\n", cfg.Server)
+			fmt.Printf("API Key: %s\n", redactKey(cfg.APIKey))
+		}
+		if cfg.ClientID != "" {
+			fmt.Printf("Client ID: %s\n", cfg.ClientID)
+		}
+		if cfg.AuthHeader != "" {
+			fmt.Printf("Auth Header: %s\n", cfg.AuthHeader)
+		}
+		if cfg.Tag != "" {
+			fmt.Printf("Tag: %s\n", cfg.Tag)
+		}
+		if cfg.BillingDay != 0 {
+			fmt.Printf("Billing Day: %d\n", cfg.BillingDay)
+		}
+		return
+	}
+
+	// An empty --tag clears the tag and --billing-day 0 clears the billing
+	// day, so check whether they were given at all
+	tagSet, billDaySet := false, false
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "tag":
+			tagSet = true
+		case "billing-day":
+			billDaySet = true
+		}
+	})
+
+	if server == "" && apiKey == "" && authHeader == "" && !tagSet && !billDaySet {
+		fs.Usage()
+		return
+	}
+
+	if authHeader != "" && authHeader != config.AuthHeaderAPIKey && authHeader != config.AuthHeaderBearer {
+		fmt.Fprintf(os.Stderr, "Error: --auth-header must be %s or %s\n", config.AuthHeaderAPIKey, config.AuthHeaderBearer)
+		os.Exit(exitError)
+	}
+	if billDaySet && billDay != 0 && !billing.ValidDay(billDay) {
+		fmt.Fprintf(os.Stderr, "Error: --billing-day must be between 1 and 31, or 0 to clear it\n")
+		os.Exit(exitError)
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		cfg = &config.Config{}
+	}
+
+	if server != "" {
+		cfg.Server = server
+	}
+	if apiKey != "" {
+		cfg.APIKey = apiKey
+	}
+	if authHeader != "" {
+		cfg.AuthHeader = authHeader
+	}
+	if tagSet {
+		cfg.Tag = strings.TrimSpace(tag)
+	}
+	if billDaySet {
+		cfg.BillingDay = billDay
+	}
+
+	if err := config.Save(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
+		os.Exit(exitConfig)
+	}
+
+	fmt.Println("Configuration saved.")
+}
+
+// requireConfig loads the sync configuration, exiting if it can't be read
+// or has no server or API key
+func requireConfig() *config.Config {
+	cfg, err := config.Load()
+	if err != nil || cfg.Server == "" || cfg.APIKey == "" {
+		fmt.Fprintf(os.Stderr, "Error: Not configured. Run 'cctop config --server <url> --api-key <key>' first.\n")
+		os.Exit(exitConfig)
+	}
+	return cfg
+}
+
+// redactKey shows only the ends of an API key, or nothing of a short one
+func redactKey(key string) string {
+	if len(key) < 20 {
+		return "(set)"
+	}
+	return key[:10] + "..." + key[len(key)-4:]
+}
+
+// runConfigImport saves the configuration exported to path. This machine
+// keeps its own client ID, or gets a new one, unless keepID is set.
+func runConfigImport(path string, keepID bool) {
+	imported, err := config.Import(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", path, err)
+		os.Exit(exitConfig)
+	}
+	if imported.Server == "" || imported.APIKey == "" {
+		fmt.Fprintf(os.Stderr, "Error: %s has no server or API key. Create it with 'cctop config --export'.\n", path)
+		os.Exit(exitConfig)
+	}
+	if imported.AuthHeader != "" && imported.AuthHeader != config.AuthHeaderAPIKey && imported.AuthHeader != config.AuthHeaderBearer {
+		fmt.Fprintf(os.Stderr, "Error: %s has an unknown auth_header %q\n", path, imported.AuthHeader)
+		os.Exit(exitConfig)
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		cfg = &config.Config{}
+	}
+	if keepID {
+		cfg.ClientID = imported.ClientID
+	}
+	cfg.Server = imported.Server
+	cfg.APIKey = imported.APIKey
+	cfg.AuthHeader = imported.AuthHeader
+	cfg.Tag = imported.Tag
+
+	if err := config.Save(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
+		os.Exit(exitConfig)
+	}
+
+	fmt.Printf("Configuration imported. Client ID: %s\n", cfg.ClientID)
+}
+
+// pricingActions are the actions of the pricing command
+var pricingActions = []string{"refresh", "show", "list"}
+
+func runPricing(args []string) {
+	fs := flag.NewFlagSet("pricing", flag.ContinueOnError)
+	var (
+		offline   bool
+		priceURL  string
+		priceFile string
+	)
+	fs.BoolVar(&offline, "offline", false, "Use embedded pricing data (no network)")
+	fs.StringVar(&priceURL, "pricing-url", "", "Fetch LiteLLM pricing JSON from this URL (default: $CCTOP_PRICING_URL or LiteLLM on GitHub)")
+	fs.StringVar(&priceFile, "pricing-file", "", "Price models from this LiteLLM-format JSON file, ahead of online and embedded pricing")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: cctop pricing refresh [--pricing-url <url>]
+       cctop pricing show [--offline] [--pricing-url <url>] [--pricing-file <path>] <model>
+       cctop pricing list [--offline] [--pricing-url <url>] [--pricing-file <path>]
 
-Commands:
-  daily     Show daily usage report (default)
-  monthly   Show monthly usage report
-  session   Show usage by session
-  blocks    Show usage by 5-hour billing blocks
-  sync      Sync usage data to server
-  config    Configure sync settings
+refresh re-fetches pricing from LiteLLM and reports any failure, instead
+of silently falling back to embedded pricing.
+show prints the pricing a model name resolves to, per million tokens.
+list prints every model with known pricing, per million tokens, and
+whether its pricing is from --pricing-file (file), LiteLLM (online) or
+built in (embedded).
 
 Options:
 `)
 		fs.PrintDefaults()
 		fmt.Fprintf(os.Stderr, `
 Examples:
-  cctop                      Show daily usage
-  cctop daily --since 20250101
-  cctop monthly --json
-  cctop session --breakdown
-  cctop blocks
-  cctop config --server https://example.com --api-key <key>
-  cctop sync
+  cctop pricing refresh
+  cctop pricing show claude-sonnet-4-5-20250929
+  cctop pricing show --offline us.anthropic.claude-opus-4-1-20250805-v1:0
+  cctop pricing list
 `)
 	}
 
-	fs.Parse(filteredArgs)
-
-	if showVer {
-		fmt.Printf("cctop version %s\n", version)
-		return
-	}
-
-	if showHelp {
+	// Flags may come before the action, as in "cctop --offline pricing list"
+	action, rest, ok := splitSubcommand(fs, args, pricingActions)
+	if !ok {
 		fs.Usage()
-		return
+		os.Exit(exitError)
 	}
+	parseFlags(fs, rest)
 
-	// Parse dates
-	opts := aggregator.Options{
-		Offline: offline,
+	if priceURL != "" {
+		pricing.SetPricingURL(priceURL)
 	}
+	loadPricingFile(priceFile)
 
-	if since != "" {
-		t, err := time.Parse("20060102", since)
+	switch action {
+	case "refresh":
+		prices, err := pricing.RefreshPricing()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: Invalid --since date format. Use YYYYMMDD.\n")
-			os.Exit(1)
+			fmt.Fprintf(os.Stderr, "Error fetching pricing: %v\n", err)
+			os.Exit(exitNetwork)
+		}
+		fmt.Printf("Fetched pricing for %d models.\n", len(prices))
+	case "show":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(exitError)
+		}
+		modelName := fs.Arg(0)
+		name, p, ok := pricing.ResolvePricing(modelName, offline)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "No pricing for model %s (reports would use default pricing).\n", modelName)
+			os.Exit(exitError)
+		}
+		// Online lookups fall back to embedded pricing if LiteLLM is unreachable
+		source := "LiteLLM, or embedded if unreachable"
+		if pricing.InPricingFile(name) {
+			source = "pricing file"
+		} else if offline {
+			source = "embedded"
+		}
+		fmt.Printf("Model:        %s\n", modelName)
+		fmt.Printf("Matched:      %s (%s)\n", name, source)
+		fmt.Printf("Input:        $%g / MTok\n", p.InputCostPerToken*1e6)
+		fmt.Printf("Output:       $%g / MTok\n", p.OutputCostPerToken*1e6)
+		fmt.Printf("Cache Create: $%g / MTok\n", p.CacheCreationCostPerToken*1e6)
+		fmt.Printf("Cache Read:   $%g / MTok\n", p.CacheReadCostPerToken*1e6)
+	case "list":
+		if fs.NArg() != 0 {
+			fs.Usage()
+			os.Exit(exitError)
 		}
-		opts.Since = t
+		printPricingList(offline)
+	default:
+		fs.Usage()
+		os.Exit(exitError)
 	}
+}
 
-	if until != "" {
-		t, err := time.Parse("20060102", until)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: Invalid --until date format. Use YYYYMMDD.\n")
-			os.Exit(1)
-		}
-		// Include the entire day
-		opts.Until = t.Add(24*time.Hour - time.Second)
+// loadPricingFile loads --pricing-file, if given, exiting on failure
+func loadPricingFile(path string) {
+	if path == "" {
+		return
 	}
+	if err := pricing.LoadPricingFile(path); err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading pricing file: %v\n", err)
+		os.Exit(exitError)
+	}
+}
 
-	if timezone != "" {
-		loc, err := time.LoadLocation(timezone)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: Invalid timezone: %s\n", timezone)
-			os.Exit(1)
-		}
-		opts.Timezone = loc
+// printPricingList prints every model with known pricing, per million
+// tokens, and where its pricing came from
+func printPricingList(offline bool) {
+	models, online := pricing.ListPricing(offline)
+
+	nameWidth := len("Model")
+	for _, m := range models {
+		nameWidth = max(nameWidth, len(m.Name))
+	}
+	// Rounded to drop float noise such as $0.7999999999999999
+	perMTok := func(cost float64) string {
+		return fmt.Sprintf("$%g", math.Round(cost*1e12)/1e6)
 	}
 
-	// Load and parse all usage data
-	records, err := parser.ParseAllFiles()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading usage data: %v\n", err)
-		os.Exit(1)
+	fmt.Printf("%-*s  %10s  %10s  %12s  %10s  %s\n", nameWidth, "Model", "Input", "Output", "Cache Create", "Cache Read", "Source")
+	embedded := 0
+	for _, m := range models {
+		fmt.Printf("%-*s  %10s  %10s  %12s  %10s  %s\n", nameWidth, m.Name,
+			perMTok(m.Pricing.InputCostPerToken), perMTok(m.Pricing.OutputCostPerToken),
+			perMTok(m.Pricing.CacheCreationCostPerToken), perMTok(m.Pricing.CacheReadCostPerToken), m.Source)
+		if m.Source == pricing.SourceEmbedded {
+			embedded++
+		}
 	}
 
-	if len(records) == 0 {
-		fmt.Println("No usage data found in ~/.claude/projects/")
-		return
+	fmt.Printf("\n%d models, prices per million tokens.\n", len(models))
+	switch {
+	case offline:
+		fmt.Println("Using embedded pricing (--offline).")
+	case !online:
+		fmt.Println("LiteLLM couldn't be reached, so embedded pricing is used.")
+	case embedded > 0:
+		fmt.Printf("%d embedded models aren't listed by LiteLLM and are only used offline or when it can't be reached.\n", embedded)
 	}
+}
 
-	// Filter by date range
-	records = aggregator.FilterRecords(records, opts)
+func runAnnotate(args []string) {
+	fs := flag.NewFlagSet("annotate", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: cctop annotate <session-id> "<note>"
 
-	if len(records) == 0 {
-		fmt.Println("No usage data found for the specified date range.")
-		return
+Attaches a note to a session, shown in the session report.
+The session ID may be the shortened form shown in the table.
+An empty note removes the annotation.
+
+Examples:
+  cctop annotate 3f2a9c1e "refactoring auth"
+  cctop annotate 3f2a9c1e ""
+`)
 	}
 
-	// Aggregate based on command
-	var results []model.AggregatedUsage
-	var title string
+	parseFlags(fs, args)
 
-	switch command {
-	case "daily":
-		results = aggregator.ByDay(records, opts)
-		title = "Date"
-	case "monthly":
-		results = aggregator.ByMonth(records, opts)
-		title = "Month"
-	case "session":
-		results = aggregator.BySession(records, opts)
-		title = "Session"
-	case "blocks":
-		results = aggregator.ByBlock(records, opts)
-		title = "Block"
-	default:
-		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", command)
+	if fs.NArg() != 2 {
 		fs.Usage()
-		os.Exit(1)
+		os.Exit(exitError)
 	}
 
-	// Output results
-	opts2 := output.TableOptions{ForceCompact: compact}
+	sessionID := strings.TrimSpace(fs.Arg(0))
+	note := strings.TrimSpace(fs.Arg(1))
+	if sessionID == "" {
+		fs.Usage()
+		os.Exit(exitError)
+	}
 
-	if jsonOut {
-		output.PrintJSON(results)
-	} else if breakdown {
-		output.PrintTableWithBreakdownOpts(results, title, opts2)
+	sessionNotes, err := notes.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading notes: %v\n", err)
+		os.Exit(exitError)
+	}
+
+	sessionNotes.Set(sessionID, note)
+
+	if err := notes.Save(sessionNotes); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving notes: %v\n", err)
+		os.Exit(exitError)
+	}
+
+	if note == "" {
+		fmt.Println("Note removed.")
 	} else {
-		output.PrintTableWithOptions(results, title, true, opts2)
+		fmt.Println("Note saved.")
 	}
 }
 
-func runConfig(args []string) {
-	fs := flag.NewFlagSet("config", flag.ExitOnError)
-	var (
-		server string
-		apiKey string
-		show   bool
-	)
-	fs.StringVar(&server, "server", "", "Server URL")
-	fs.StringVar(&apiKey, "api-key", "", "API key for authentication")
-	fs.BoolVar(&show, "show", false, "Show current configuration")
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+
+	var syncToServer, yes bool
+	fs.BoolVar(&syncToServer, "sync", false, "Also upload the imported records to the sync server")
+	fs.BoolVar(&yes, "yes", false, "Skip the confirmation prompt when syncing")
+	fs.BoolVar(&yes, "y", false, "Skip the confirmation prompt when syncing")
 
 	fs.Usage = func() {
-		fmt.Fprintf(os.Stderr, `Usage: cctop config [options]
+		fmt.Fprintf(os.Stderr, `Usage: cctop import [options] <file>
+
+Imports historical usage from a JSON export so it shows up in local reports.
+Accepts the output of 'cctop <report> --json' and ccusage's
+'daily --json' / 'monthly --json' exports. Costs are recalculated
+from token counts. Re-importing the same file replaces earlier imports.
 
 Options:
 `)
 		fs.PrintDefaults()
 		fmt.Fprintf(os.Stderr, `
 Examples:
-  cctop config --server https://example.com --api-key cctop_xxx
-  cctop config --show
+  cctop import ccusage-daily.json
+  cctop import export.json --sync
 `)
 	}
 
-	fs.Parse(args)
-
-	if show {
-		cfg, err := config.Load()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
-			os.Exit(1)
-		}
-		if cfg.Server == "" {
-			fmt.Println("No configuration found. Run 'cctop config --server <url> --api-key <key>' to configure.")
-			return
-		}
-		fmt.Printf("Server: %s\n", cfg.Server)
-		fmt.Printf("API Key: %s...%s\n", cfg.APIKey[:10], cfg.APIKey[len(cfg.APIKey)-4:])
-		if cfg.ClientID != "" {
-			fmt.Printf("Client ID: %s\n", cfg.ClientID)
+	// Allow flags after the file name
+	var files []string
+	for len(args) > 0 {
+		parseFlags(fs, args)
+		args = fs.Args()
+		if len(args) > 0 {
+			files = append(files, args[0])
+			args = args[1:]
 		}
-		return
 	}
 
-	if server == "" && apiKey == "" {
+	if len(files) != 1 {
 		fs.Usage()
-		return
+		os.Exit(exitError)
 	}
 
-	cfg, err := config.Load()
+	records, err := importer.Read(files[0])
 	if err != nil {
-		cfg = &config.Config{}
+		fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", files[0], err)
+		os.Exit(exitError)
+	}
+	if len(records) == 0 {
+		fmt.Println("No usage found in import file.")
+		os.Exit(exitNoData)
 	}
 
-	if server != "" {
-		cfg.Server = server
+	total, err := importer.Merge(records)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving imported usage: %v\n", err)
+		os.Exit(exitError)
 	}
-	if apiKey != "" {
-		cfg.APIKey = apiKey
+	fmt.Printf("Imported %d records (%d imported in total).\n", len(records), total)
+
+	if !syncToServer {
+		return
 	}
 
-	if err := config.Save(cfg); err != nil {
-		fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
-		os.Exit(1)
+	cfg := requireConfig()
+
+	printSyncSummary(records)
+
+	if !yes {
+		confirmSync()
 	}
 
-	fmt.Println("Configuration saved.")
+	inserted, err := sync.NewClient(cfg).Sync(records)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error syncing: %v\n", err)
+		os.Exit(exitNetwork)
+	}
+
+	fmt.Printf("Sync complete. %d records inserted.\n", inserted)
 }
 
 // syncService implements service.Interface for background syncing
@@ -361,13 +1635,24 @@ func (s *syncService) doSync(client *sync.Client) {
 }
 
 func runSync(args []string) {
-	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
 	var (
 		dryRun   bool
+		yes      bool
 		interval time.Duration
+		since    string
+		until    string
+		tag      string
+		jsonOut  bool
 	)
 	fs.BoolVar(&dryRun, "dry-run", false, "Show what would be synced without sending")
+	fs.BoolVar(&yes, "yes", false, "Skip the confirmation prompt")
+	fs.BoolVar(&yes, "y", false, "Skip the confirmation prompt")
 	fs.DurationVar(&interval, "interval", time.Hour, "Sync interval for service mode (e.g., 1h, 30m)")
+	fs.StringVar(&since, "since", "", "Only sync records from this date (YYYYMMDD)")
+	fs.StringVar(&until, "until", "", "Only sync records up to this date (YYYYMMDD)")
+	fs.StringVar(&tag, "tag", "", "Tag the synced records, overriding the configured tag (set one with 'cctop config --tag')")
+	fs.BoolVar(&jsonOut, "json", false, "Print the outcome as JSON (needs --yes or --dry-run, since there's no prompt)")
 
 	fs.Usage = func() {
 		fmt.Fprintf(os.Stderr, `Usage: cctop sync [command] [options]
@@ -379,6 +1664,7 @@ Commands:
   stop        Stop the background service
   uninstall   Remove the background service
   status      Show service status
+  clients     List machines syncing to this account
 
 Options:
 `)
@@ -386,10 +1672,16 @@ Options:
 		fmt.Fprintf(os.Stderr, `
 Examples:
   cctop sync                       Sync once
+  cctop sync --yes                 Sync once without confirmation
+  cctop sync --since 20250101 --until 20250131
+                                   Sync (or re-sync) only January
+  cctop sync --tag work            Tag this sync's records as work
+  cctop sync --yes --json          Sync once and print the outcome as JSON
   cctop sync install               Install service (syncs every hour)
   cctop sync install --interval 30m
   cctop sync start                 Start the service
   cctop sync stop                  Stop the service
+  cctop sync clients               List syncing machines
 `)
 	}
 
@@ -400,10 +1692,32 @@ Examples:
 		case "install", "start", "stop", "uninstall", "status", "run":
 			svcCommand = args[0]
 			args = args[1:]
+		case "clients":
+			parseFlags(fs, args[1:])
+			runSyncClients()
+			return
 		}
 	}
 
-	fs.Parse(args)
+	parseFlags(fs, args)
+
+	if (since != "" || until != "") && svcCommand != "" {
+		fmt.Fprintf(os.Stderr, "Error: --since/--until only apply to a one-time sync.\n")
+		os.Exit(exitError)
+	}
+	if tag != "" && svcCommand != "" {
+		fmt.Fprintf(os.Stderr, "Error: --tag only applies to a one-time sync. Use 'cctop config --tag' for the service.\n")
+		os.Exit(exitError)
+	}
+	if jsonOut && svcCommand != "" {
+		fmt.Fprintf(os.Stderr, "Error: --json only applies to a one-time sync.\n")
+		os.Exit(exitError)
+	}
+	if jsonOut && !yes && !dryRun {
+		fmt.Fprintf(os.Stderr, "Error: --json doesn't prompt, so pass --yes to sync or --dry-run to preview.\n")
+		os.Exit(exitError)
+	}
+	start, end := parseDateRange(since, until)
 
 	// Get user for service to run as (use SUDO_USER if running with sudo)
 	userName := os.Getenv("SUDO_USER")
@@ -433,11 +1747,7 @@ Examples:
 	// Handle service commands
 	switch svcCommand {
 	case "install":
-		cfg, err := config.Load()
-		if err != nil || cfg.Server == "" || cfg.APIKey == "" {
-			fmt.Fprintf(os.Stderr, "Error: Not configured. Run 'cctop config --server <url> --api-key <key>' first.\n")
-			os.Exit(1)
-		}
+		requireConfig()
 		if err := s.Install(); err != nil {
 			log.Fatalf("Failed to install service: %v", err)
 		}
@@ -487,14 +1797,13 @@ Examples:
 		return
 
 	case "": // No service command - do a one-time sync
-		cfg, err := config.Load()
-		if err != nil || cfg.Server == "" || cfg.APIKey == "" {
-			fmt.Fprintf(os.Stderr, "Error: Not configured. Run 'cctop config --server <url> --api-key <key>' first.\n")
-			os.Exit(1)
+		cfg := requireConfig()
+		if tag != "" {
+			cfg.Tag = strings.TrimSpace(tag)
 		}
 
 		client := sync.NewClient(cfg)
-		doSyncOnce(client, dryRun)
+		doSyncOnce(client, dryRun, yes, jsonOut, start, end)
 		return
 
 	default:
@@ -509,23 +1818,227 @@ Examples:
 	}
 }
 
-func doSyncOnce(client *sync.Client, dryRun bool) {
+// runSyncClients lists the machines syncing to the configured account
+func runSyncClients() {
+	cfg := requireConfig()
+
+	clients, err := sync.NewClient(cfg).GetClients()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listing clients: %v\n", err)
+		os.Exit(exitNetwork)
+	}
+
+	if len(clients) == 0 {
+		fmt.Println("No clients have synced yet.")
+		return
+	}
+
+	fmt.Printf("%-24s  %-20s  %s\n", "Name", "Last Sync", "ID")
+	for _, c := range clients {
+		lastSync := "never"
+		if c.LastSyncAt != nil {
+			lastSync = c.LastSyncAt.Local().Format("2006-01-02 15:04")
+		}
+		name := c.Name
+		if c.ID == cfg.ClientID {
+			name += " (this machine)"
+		}
+		fmt.Printf("%-24s  %-20s  %s\n", name, lastSync, c.ID)
+	}
+}
+
+// runVerify reconciles the usage the server has stored for this machine
+// with its local logs, month by month, and exits 1 if any month differs
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	var timezone string
+	fs.StringVar(&timezone, "timezone", "", "Timezone to group months in (default: UTC)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: cctop verify [--timezone <zone>]
+
+Compares the usage the server has for this machine with the local logs,
+month by month. Only usage up to the last sync is compared.
+
+Options:
+`)
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	loc := time.UTC
+	if timezone != "" {
+		l, err := time.LoadLocation(timezone)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid timezone: %s\n", timezone)
+			os.Exit(exitError)
+		}
+		loc = l
+	}
+
+	cfg := requireConfig()
+	client := sync.NewClient(cfg)
+
 	lastSync, err := client.GetSyncStatus()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: Could not get sync status: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error getting sync status: %v\n", err)
+		os.Exit(exitNetwork)
+	}
+	if lastSync == nil {
+		fmt.Println("This machine hasn't synced yet.")
+		return
+	}
+	server, err := client.GetMonthlyUsage(timezone)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting server usage: %v\n", err)
+		os.Exit(exitNetwork)
+	}
+
+	records, err := parser.ParseAllFiles()
+	if reportMissingData(err) {
+		os.Exit(exitNoData)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading usage data: %v\n", err)
+		os.Exit(exitError)
+	}
+
+	// Compare only what could have been synced and hasn't been pruned
+	var synced []model.UsageRecord
+	for _, r := range records {
+		if r.Timestamp.After(*lastSync) {
+			continue
+		}
+		if server.PrunedBefore != nil && r.Timestamp.Before(*server.PrunedBefore) {
+			continue
+		}
+		synced = append(synced, r)
+	}
+	// The server prices usage with embedded pricing, and isn't sent web
+	// searches
+	local := make(map[string]model.AggregatedUsage)
+	for _, u := range aggregator.ByMonth(synced, aggregator.Options{Timezone: loc, Offline: true}) {
+		u.Cost -= float64(u.Usage.WebSearchRequests) * pricing.WebSearchCostPerRequest
+		local[u.Key] = u
+	}
+	remote := make(map[string]sync.UsagePeriod)
+	for _, p := range server.Periods {
+		remote[p.Period] = p
+	}
+
+	var months []string
+	for month := range local {
+		months = append(months, month)
+	}
+	for month := range remote {
+		if _, ok := local[month]; !ok {
+			months = append(months, month)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(months)))
+
+	if len(months) == 0 {
+		fmt.Println("No synced usage to compare.")
+		return
+	}
+
+	fmt.Printf("%-8s  %16s  %16s  %12s  %12s  %s\n", "Month", "Local Tokens", "Server Tokens", "Local Cost", "Server Cost", "Status")
+	differ := 0
+	for _, month := range months {
+		l, inLocal := local[month]
+		r, inRemote := remote[month]
+		localTokens := l.Usage.InputTokens + l.Usage.OutputTokens + l.Usage.CacheCreationInputTokens + l.Usage.CacheReadInputTokens
+		remoteTokens := r.InputTokens + r.OutputTokens + r.CacheCreationTokens + r.CacheReadTokens
+
+		status := "ok"
+		switch {
+		case !inRemote:
+			status = "missing on server"
+		case !inLocal:
+			status = "only on server"
+		case l.Usage.InputTokens != r.InputTokens || l.Usage.OutputTokens != r.OutputTokens ||
+			l.Usage.CacheCreationInputTokens != r.CacheCreationTokens || l.Usage.CacheReadInputTokens != r.CacheReadTokens:
+			status = "tokens differ"
+		case math.Abs(l.Cost-r.Cost) >= 0.005:
+			status = "cost differs"
+		}
+		if status != "ok" {
+			differ++
+		}
+		fmt.Printf("%-8s  %16s  %16s  %12s  %12s  %s\n", month,
+			output.FormatNumber(localTokens), output.FormatNumber(remoteTokens),
+			output.FormatCost(l.Cost), output.FormatCost(r.Cost), status)
+	}
+
+	fmt.Printf("\nCompared usage up to the last sync (%s), in %s.\n", lastSync.Local().Format("2006-01-02 15:04"), loc)
+	if differ > 0 {
+		fmt.Printf("%d of %d months differ.\n", differ, len(months))
+		os.Exit(exitError)
+	}
+	fmt.Printf("All %d months match.\n", len(months))
+}
+
+// syncResult is the --json output of a one-time sync
+type syncResult struct {
+	NewRecords int        `json:"new_records"`
+	Inserted   int64      `json:"inserted"`
+	DryRun     bool       `json:"dry_run"`
+	LastSyncAt *time.Time `json:"last_sync_at"` // As the server has it after the sync
+}
+
+// doSyncOnce uploads the records the server hasn't seen. Given a date range
+// (either end may be zero), it uploads every record in the range instead,
+// whether synced before or not: the server ignores records it already has,
+// so overlapping a previous sync doesn't count anything twice.
+// With jsonOut, the outcome is printed as a syncResult instead of text.
+func doSyncOnce(client *sync.Client, dryRun, yes, jsonOut bool, since, until time.Time) {
+	ranged := !since.IsZero() || !until.IsZero()
+
+	var lastSync *time.Time
+	if !ranged {
+		var err error
+		lastSync, err = client.GetSyncStatus()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Could not get sync status: %v\n", err)
+		}
 	}
 
 	records, err := parser.ParseAllFiles()
+	if reportMissingData(err) {
+		os.Exit(exitNoData)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error reading usage data: %v\n", err)
-		os.Exit(1)
+		os.Exit(exitError)
 	}
 
 	var toSync []model.UsageRecord
 	for _, r := range records {
-		if lastSync == nil || r.Timestamp.After(*lastSync) {
-			toSync = append(toSync, r)
+		if lastSync != nil && !r.Timestamp.After(*lastSync) {
+			continue
+		}
+		if !since.IsZero() && r.Timestamp.Before(since) {
+			continue
+		}
+		if !until.IsZero() && r.Timestamp.After(until) {
+			continue
 		}
+		toSync = append(toSync, r)
+	}
+
+	if jsonOut {
+		result := syncResult{NewRecords: len(toSync), DryRun: dryRun}
+		if len(toSync) > 0 && !dryRun {
+			result.Inserted = sendRecords(client, toSync, ranged)
+		}
+		// Asked after sending, so a real sync reports its own time
+		lastSync, err := client.GetSyncStatus()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Could not get sync status: %v\n", err)
+		}
+		result.LastSyncAt = lastSync
+		data, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(data))
+		return
 	}
 
 	if len(toSync) == 0 {
@@ -533,18 +2046,95 @@ func doSyncOnce(client *sync.Client, dryRun bool) {
 		return
 	}
 
-	fmt.Printf("Found %d new records to sync.\n", len(toSync))
+	printSyncSummary(toSync)
 
 	if dryRun {
 		fmt.Println("Dry run - no data sent.")
 		return
 	}
 
-	inserted, err := client.Sync(toSync)
+	if !yes {
+		confirmSync()
+	}
+
+	inserted := sendRecords(client, toSync, ranged)
+	fmt.Printf("Sync complete. %d records inserted.\n", inserted)
+}
+
+// sendRecords uploads records and returns how many the server inserted. A
+// ranged sync may resend records, so it's sent as a partial sync.
+func sendRecords(client *sync.Client, records []model.UsageRecord, ranged bool) int64 {
+	send := client.Sync
+	if ranged {
+		send = client.SyncPartial
+	}
+	inserted, err := send(records)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error syncing: %v\n", err)
-		os.Exit(1)
+		os.Exit(exitNetwork)
 	}
+	return inserted
+}
 
-	fmt.Printf("Sync complete. %d records inserted.\n", inserted)
+// printSyncSummary prints what a sync would upload
+func printSyncSummary(records []model.UsageRecord) {
+	first, last := records[0].Timestamp, records[0].Timestamp
+	models := make(map[string]bool)
+	var cost float64
+	for _, r := range records {
+		if r.Timestamp.Before(first) {
+			first = r.Timestamp
+		}
+		if r.Timestamp.After(last) {
+			last = r.Timestamp
+		}
+		models[r.Model] = true
+		// Embedded pricing matches what the server uses
+		cost += pricing.CalculateCost(r.Usage, pricing.GetPricing(r.Model, true))
+	}
+
+	var names []string
+	for m := range models {
+		names = append(names, m)
+	}
+	sort.Strings(names)
+
+	fmt.Printf("Found %d new records to sync.\n", len(records))
+	fmt.Printf("  Date range:     %s to %s\n", first.Local().Format("2006-01-02"), last.Local().Format("2006-01-02"))
+	fmt.Printf("  Models:         %s\n", strings.Join(names, ", "))
+	fmt.Printf("  Estimated cost: %s\n", output.FormatCost(cost))
+}
+
+// confirmSync asks whether to go ahead with a sync, exiting with exitError
+// unless the answer is yes. Without a terminal to ask on, as under cron, it
+// exits straight away, so an unattended sync that sent nothing fails rather
+// than looking like it succeeded.
+func confirmSync() {
+	if !stdinIsTerminal() {
+		fmt.Fprintf(os.Stderr, "Error: Can't ask to confirm the sync without a terminal. Pass --yes to sync anyway.\n")
+		os.Exit(exitError)
+	}
+	if !confirm("Proceed with sync?") {
+		fmt.Fprintf(os.Stderr, "Sync cancelled. Use --yes to skip this prompt.\n")
+		os.Exit(exitError)
+	}
+}
+
+// stdinIsTerminal reports whether stdin looks like a terminal rather than a
+// pipe or file
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// confirm asks a yes/no question on stdin, defaulting to no
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		fmt.Println()
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
 }
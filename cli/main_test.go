@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	fs := flag.NewFlagSet("cctop", flag.ContinueOnError)
+	fs.Bool("json", false, "")
+	fs.Bool("offline", false, "")
+	fs.String("timezone", "", "")
+	fs.Int("days", 0, "")
+
+	tests := []struct {
+		args    string
+		command string
+		rest    string
+	}{
+		{"", "daily", ""},
+		{"monthly", "monthly", ""},
+		{"--json", "daily", "--json"},
+
+		// Flags before, after and around the subcommand
+		{"--json daily", "daily", "--json"},
+		{"daily --json", "daily", "--json"},
+		{"--offline monthly --json", "monthly", "--offline --json"},
+		{"-json session --days 7", "session", "-json --days 7"},
+
+		// Flag values aren't taken as the subcommand
+		{"--timezone daily", "daily", "--timezone daily"},
+		{"--timezone daily monthly", "monthly", "--timezone daily"},
+		{"--days 7 --timezone UTC weekly --json", "weekly", "--days 7 --timezone UTC --json"},
+		{"--timezone=UTC monthly", "monthly", "--timezone=UTC"},
+		{"--json=true monthly", "monthly", "--json=true"},
+
+		// Only the first subcommand is taken; later ones are positional
+		{"diff monthly 2025-01 2025-02", "diff", "monthly 2025-01 2025-02"},
+		{"--json diff 2025-01 2025-02 --offline", "diff", "--json 2025-01 2025-02 --offline"},
+
+		// Unknown flags are assumed to be boolean
+		{"--unknown sync", "sync", "--unknown"},
+
+		// Nothing after "--" is a subcommand
+		{"--json -- monthly", "daily", "--json -- monthly"},
+		{"sync -- daily", "sync", "-- daily"},
+	}
+
+	for _, tt := range tests {
+		args := strings.Fields(tt.args)
+		orig := slices.Clone(args)
+
+		command, rest := splitCommand(fs, args)
+		if command != tt.command || strings.Join(rest, " ") != tt.rest {
+			t.Errorf("splitCommand(%q) = %q, %q, want %q, %q", tt.args, command, strings.Join(rest, " "), tt.command, tt.rest)
+		}
+		if !slices.Equal(args, orig) {
+			t.Errorf("splitCommand(%q) modified its args to %q", tt.args, args)
+		}
+	}
+}
+
+func TestSplitSubcommandPricing(t *testing.T) {
+	fs := flag.NewFlagSet("pricing", flag.ContinueOnError)
+	fs.Bool("offline", false, "")
+	fs.String("pricing-file", "", "")
+
+	tests := []struct {
+		args   string
+		action string
+		rest   string
+		ok     bool
+	}{
+		{"list", "list", "", true},
+		{"--offline list", "list", "--offline", true},
+		{"--pricing-file list.json --offline show list", "show", "--pricing-file list.json --offline list", true},
+		{"--offline", "", "--offline", false},
+		{"unknown --offline", "", "unknown --offline", false},
+	}
+
+	for _, tt := range tests {
+		action, rest, ok := splitSubcommand(fs, strings.Fields(tt.args), pricingActions)
+		if action != tt.action || strings.Join(rest, " ") != tt.rest || ok != tt.ok {
+			t.Errorf("splitSubcommand(%q) = %q, %q, %v, want %q, %q, %v", tt.args, action, strings.Join(rest, " "), ok, tt.action, tt.rest, tt.ok)
+		}
+	}
+}
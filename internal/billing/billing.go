@@ -0,0 +1,69 @@
+package billing
+
+import "time"
+
+// ClampDay returns the billing day clamped to the last day of the given month
+func ClampDay(year int, month time.Month, day int) int {
+	// Get last day of month by going to next month day 0
+	lastDay := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	if day > lastDay {
+		return lastDay
+	}
+	return day
+}
+
+// ValidDay reports whether day is a billing day: 1 to 31. 0 means no billing
+// day is set.
+func ValidDay(day int) bool {
+	return day >= 1 && day <= 31
+}
+
+// PeriodFor returns the billing period containing t, in t's location: its
+// start, and the start of the next period (exclusive). Periods start on
+// billingDay, clamped in months with fewer days (e.g., day 31 in Feb becomes
+// Feb 28/29). Returns zero times if billingDay isn't valid.
+func PeriodFor(billingDay int, t time.Time) (time.Time, time.Time) {
+	if !ValidDay(billingDay) {
+		return time.Time{}, time.Time{}
+	}
+
+	loc := t.Location()
+	year, month, day := t.Date()
+
+	// The period started this month if its billing day has been reached,
+	// otherwise last month
+	var start time.Time
+	if clamped := ClampDay(year, month, billingDay); day >= clamped {
+		start = time.Date(year, month, clamped, 0, 0, 0, 0, loc)
+	} else {
+		prevMonth := month - 1
+		prevYear := year
+		if prevMonth < 1 {
+			prevMonth = 12
+			prevYear--
+		}
+		start = time.Date(prevYear, prevMonth, ClampDay(prevYear, prevMonth, billingDay), 0, 0, 0, 0, loc)
+	}
+
+	// The next period starts on the billing day a month later, also clamped
+	nextMonth := start.Month() + 1
+	nextYear := start.Year()
+	if nextMonth > 12 {
+		nextMonth = 1
+		nextYear++
+	}
+	end := time.Date(nextYear, nextMonth, ClampDay(nextYear, nextMonth, billingDay), 0, 0, 0, 0, loc)
+
+	return start, end
+}
+
+// CurrentPeriod returns the billing period containing now, in now's
+// location, as it's displayed: its start and its last second. Returns zero
+// times if billingDay isn't valid.
+func CurrentPeriod(billingDay int, now time.Time) (time.Time, time.Time) {
+	start, end := PeriodFor(billingDay, now)
+	if start.IsZero() {
+		return start, end
+	}
+	return start, end.Add(-time.Second)
+}
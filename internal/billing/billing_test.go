@@ -0,0 +1,205 @@
+package billing
+
+import (
+	"testing"
+	"time"
+)
+
+// date parses a YYYY-MM-DD date at midnight in loc
+func date(t *testing.T, s string, loc *time.Location) time.Time {
+	t.Helper()
+	d, err := time.ParseInLocation("2006-01-02", s, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestCurrentPeriod(t *testing.T) {
+	tests := []struct {
+		billingDay int
+		now        string
+		start      string
+		last       string // Last day of the period
+	}{
+		// Day 1: periods are calendar months
+		{1, "2025-01-01", "2025-01-01", "2025-01-31"},
+		{1, "2025-01-31", "2025-01-01", "2025-01-31"},
+		{1, "2025-02-15", "2025-02-01", "2025-02-28"},
+		{1, "2024-02-29", "2024-02-01", "2024-02-29"},
+		{1, "2025-12-31", "2025-12-01", "2025-12-31"},
+
+		// Day 15, including today being the billing day
+		{15, "2025-01-15", "2025-01-15", "2025-02-14"},
+		{15, "2025-01-14", "2024-12-15", "2025-01-14"},
+		{15, "2024-02-20", "2024-02-15", "2024-03-14"},
+		{15, "2025-12-15", "2025-12-15", "2026-01-14"},
+		{15, "2025-12-14", "2025-11-15", "2025-12-14"},
+
+		// Day 28 exists in every month
+		{28, "2025-02-28", "2025-02-28", "2025-03-27"},
+		{28, "2025-02-27", "2025-01-28", "2025-02-27"},
+		{28, "2024-02-28", "2024-02-28", "2024-03-27"},
+		{28, "2024-02-29", "2024-02-28", "2024-03-27"},
+		{28, "2025-12-28", "2025-12-28", "2026-01-27"},
+		{28, "2026-01-10", "2025-12-28", "2026-01-27"},
+
+		// Days 29 and 30 are clamped in February, except 29 in leap years
+		{29, "2024-02-29", "2024-02-29", "2024-03-28"},
+		{29, "2024-02-28", "2024-01-29", "2024-02-28"},
+		{29, "2025-02-28", "2025-02-28", "2025-03-28"},
+		{29, "2025-02-27", "2025-01-29", "2025-02-27"},
+		{30, "2024-02-29", "2024-02-29", "2024-03-29"},
+		{30, "2025-02-28", "2025-02-28", "2025-03-29"},
+		{30, "2025-02-27", "2025-01-30", "2025-02-27"},
+		{30, "2025-12-30", "2025-12-30", "2026-01-29"},
+		{30, "2026-01-29", "2025-12-30", "2026-01-29"},
+
+		// Day 31 is clamped to the end of shorter months
+		{31, "2025-01-31", "2025-01-31", "2025-02-27"},
+		{31, "2025-01-30", "2024-12-31", "2025-01-30"},
+		{31, "2025-02-27", "2025-01-31", "2025-02-27"},
+		{31, "2025-02-28", "2025-02-28", "2025-03-30"},
+		{31, "2024-02-28", "2024-01-31", "2024-02-28"},
+		{31, "2024-02-29", "2024-02-29", "2024-03-30"},
+		{31, "2025-04-30", "2025-04-30", "2025-05-30"},
+		{31, "2025-12-31", "2025-12-31", "2026-01-30"},
+		{31, "2026-01-01", "2025-12-31", "2026-01-30"},
+	}
+
+	for _, tt := range tests {
+		now := date(t, tt.now, time.UTC).Add(12 * time.Hour)
+		start, end := CurrentPeriod(tt.billingDay, now)
+
+		wantStart := date(t, tt.start, time.UTC)
+		wantEnd := date(t, tt.last, time.UTC).Add(24*time.Hour - time.Second)
+		if !start.Equal(wantStart) || !end.Equal(wantEnd) {
+			t.Errorf("CurrentPeriod(%d, %s) = %s to %s, want %s to %s", tt.billingDay, tt.now,
+				start.Format(time.DateTime), end.Format(time.DateTime),
+				wantStart.Format(time.DateTime), wantEnd.Format(time.DateTime))
+		}
+	}
+}
+
+func TestCurrentPeriodNoBillingDay(t *testing.T) {
+	now := time.Date(2025, 6, 15, 12, 0, 0, 0, time.UTC)
+	for _, day := range []int{0, -1, 32} {
+		if start, end := CurrentPeriod(day, now); !start.IsZero() || !end.IsZero() {
+			t.Errorf("CurrentPeriod(%d) = %s to %s, want zero times", day, start, end)
+		}
+	}
+}
+
+func TestPeriodFor(t *testing.T) {
+	tests := []struct {
+		billingDay int
+		t          string
+		start      string
+		end        string // Start of the next period
+	}{
+		// Day 29 exists in February only in leap years
+		{29, "2024-02-29", "2024-02-29", "2024-03-29"},
+		{29, "2024-02-28", "2024-01-29", "2024-02-29"},
+		{29, "2025-02-28", "2025-02-28", "2025-03-29"},
+		{29, "2025-02-27", "2025-01-29", "2025-02-28"},
+		{29, "2025-03-28", "2025-02-28", "2025-03-29"},
+
+		// Day 30 never exists in February
+		{30, "2024-02-29", "2024-02-29", "2024-03-30"},
+		{30, "2024-02-28", "2024-01-30", "2024-02-29"},
+		{30, "2025-02-28", "2025-02-28", "2025-03-30"},
+		{30, "2025-03-29", "2025-02-28", "2025-03-30"},
+		{30, "2025-03-30", "2025-03-30", "2025-04-30"},
+
+		// Day 31 is clamped in every shorter month
+		{31, "2024-02-29", "2024-02-29", "2024-03-31"},
+		{31, "2024-02-28", "2024-01-31", "2024-02-29"},
+		{31, "2025-02-28", "2025-02-28", "2025-03-31"},
+		{31, "2025-03-31", "2025-03-31", "2025-04-30"},
+		{31, "2025-04-30", "2025-04-30", "2025-05-31"},
+		{31, "2025-01-30", "2024-12-31", "2025-01-31"},
+
+		// December to January
+		{1, "2025-12-31", "2025-12-01", "2026-01-01"},
+		{1, "2026-01-01", "2026-01-01", "2026-02-01"},
+		{15, "2025-12-31", "2025-12-15", "2026-01-15"},
+		{15, "2026-01-01", "2025-12-15", "2026-01-15"},
+		{31, "2025-12-31", "2025-12-31", "2026-01-31"},
+		{31, "2026-01-15", "2025-12-31", "2026-01-31"},
+	}
+
+	for _, tt := range tests {
+		for _, hour := range []time.Duration{0, 23*time.Hour + 59*time.Minute} {
+			at := date(t, tt.t, time.UTC).Add(hour)
+			start, end := PeriodFor(tt.billingDay, at)
+
+			wantStart, wantEnd := date(t, tt.start, time.UTC), date(t, tt.end, time.UTC)
+			if !start.Equal(wantStart) || !end.Equal(wantEnd) {
+				t.Errorf("PeriodFor(%d, %s) = %s to %s, want %s to %s", tt.billingDay, at.Format(time.DateTime),
+					start.Format(time.DateOnly), end.Format(time.DateOnly), tt.start, tt.end)
+			}
+		}
+	}
+
+	for _, day := range []int{0, -1, 32} {
+		if start, end := PeriodFor(day, time.Now()); !start.IsZero() || !end.IsZero() {
+			t.Errorf("PeriodFor(%d) = %s to %s, want zero times", day, start, end)
+		}
+	}
+}
+
+func TestPeriodForDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no tzdata:", err)
+	}
+
+	tests := []struct {
+		billingDay int
+		t          time.Time
+		start      string // Local times
+		end        string
+		length     time.Duration
+	}{
+		// Clocks go forward at 2am on 9 March 2025, so that period is an hour short
+		{9, time.Date(2025, 3, 9, 12, 0, 0, 0, ny), "2025-03-09 00:00:00 EST", "2025-04-09 00:00:00 EDT", 31*24*time.Hour - time.Hour},
+		{9, time.Date(2025, 3, 9, 6, 30, 0, 0, time.UTC).In(ny), "2025-03-09 00:00:00 EST", "2025-04-09 00:00:00 EDT", 31*24*time.Hour - time.Hour}, // 01:30 EST
+		{9, time.Date(2025, 3, 9, 4, 59, 0, 0, time.UTC).In(ny), "2025-02-09 00:00:00 EST", "2025-03-09 00:00:00 EST", 28 * 24 * time.Hour},         // 23:59 EST
+		{10, time.Date(2025, 3, 9, 12, 0, 0, 0, ny), "2025-02-10 00:00:00 EST", "2025-03-10 00:00:00 EDT", 28*24*time.Hour - time.Hour},
+
+		// Clocks go back at 2am on 2 November 2025, so that period is an hour long
+		{2, time.Date(2025, 11, 2, 5, 30, 0, 0, time.UTC).In(ny), "2025-11-02 00:00:00 EDT", "2025-12-02 00:00:00 EST", 30*24*time.Hour + time.Hour}, // 01:30 EDT
+		{2, time.Date(2025, 11, 2, 6, 30, 0, 0, time.UTC).In(ny), "2025-11-02 00:00:00 EDT", "2025-12-02 00:00:00 EST", 30*24*time.Hour + time.Hour}, // 01:30 EST
+		{2, time.Date(2025, 11, 2, 3, 59, 0, 0, time.UTC).In(ny), "2025-10-02 00:00:00 EDT", "2025-11-02 00:00:00 EDT", 31 * 24 * time.Hour},         // 23:59 EDT
+	}
+
+	const layout = "2006-01-02 15:04:05 MST"
+	for _, tt := range tests {
+		start, end := PeriodFor(tt.billingDay, tt.t)
+		if got := start.Format(layout); got != tt.start {
+			t.Errorf("PeriodFor(%d, %s) starts %s, want %s", tt.billingDay, tt.t.Format(layout), got, tt.start)
+		}
+		if got := end.Format(layout); got != tt.end {
+			t.Errorf("PeriodFor(%d, %s) ends %s, want %s", tt.billingDay, tt.t.Format(layout), got, tt.end)
+		}
+		if got := end.Sub(start); got != tt.length {
+			t.Errorf("PeriodFor(%d, %s) lasts %s, want %s", tt.billingDay, tt.t.Format(layout), got, tt.length)
+		}
+	}
+
+	// The displayed end is the last second of the period's last local day
+	start, end := CurrentPeriod(9, time.Date(2025, 3, 20, 12, 0, 0, 0, ny))
+	if got, want := start.Format(layout), "2025-03-09 00:00:00 EST"; got != want {
+		t.Errorf("CurrentPeriod(9) in March 2025 starts %s, want %s", got, want)
+	}
+	if got, want := end.Format(layout), "2025-04-08 23:59:59 EDT"; got != want {
+		t.Errorf("CurrentPeriod(9) in March 2025 ends %s, want %s", got, want)
+	}
+	start, end = CurrentPeriod(2, time.Date(2025, 11, 20, 12, 0, 0, 0, ny))
+	if got, want := start.Format(layout), "2025-11-02 00:00:00 EDT"; got != want {
+		t.Errorf("CurrentPeriod(2) in November 2025 starts %s, want %s", got, want)
+	}
+	if got, want := end.Format(layout), "2025-12-01 23:59:59 EST"; got != want {
+		t.Errorf("CurrentPeriod(2) in November 2025 ends %s, want %s", got, want)
+	}
+}
@@ -9,6 +9,10 @@ type UsageRecord struct {
 	ProjectPath string
 	Model       string
 	Usage       TokenUsage
+	Source      string  // Data directory the record was read from
+	Version     string  // Claude Code version that wrote the record, if logged
+	LoggedCost  float64 // Cost in USD Claude Code logged for the record, if any
+	ClientID    string  // Machine that synced the record, for usage read from a server export
 }
 
 // TokenUsage contains token counts from a Claude API response
@@ -17,15 +21,32 @@ type TokenUsage struct {
 	OutputTokens             int64
 	CacheCreationInputTokens int64
 	CacheReadInputTokens     int64
+	WebSearchRequests        int64 // Server-side web searches, billed per request
 }
 
 // AggregatedUsage represents usage aggregated by some key (day, month, session, etc.)
 type AggregatedUsage struct {
-	Key         string     // The grouping key (date, session ID, etc.)
-	Usage       TokenUsage // Aggregated token counts
-	Cost        float64    // Total cost in USD
-	Models      []string   // Models used in this period
-	RecordCount int        // Number of records aggregated
+	Key         string            // The grouping key (date, session ID, etc.)
+	Usage       TokenUsage        // Aggregated token counts
+	Cost        float64           // Total cost in USD
+	Models      []string          // Models used in this period
+	RecordCount int               // Number of records aggregated
+	Note        string            // Optional user annotation (session view)
+	Partial     bool              // Some of the group's records fall outside the date range
+	Days        []AggregatedUsage // Daily usage within the period (monthly --with-days)
+	Start       time.Time         // Start of the period, if it is a fixed window (blocks)
+	End         time.Time         // End of the period (exclusive), if Start is set
+}
+
+// ModelEfficiency is what a model's usage actually cost per token, which is
+// below list price to the extent cached input is read cheaply
+type ModelEfficiency struct {
+	Model            string
+	Tokens           int64   // Tokens of all kinds
+	Cost             float64 // Total cost in USD
+	RealizedPerMTok  float64 // Cost per million tokens of all kinds
+	ListInputPerMTok float64 // List price per million uncached input tokens (0 if unknown)
+	CacheHitRatio    float64 // Share of input-side tokens read from cache
 }
 
 // ModelPricing contains pricing info for a model (per token, not per million)
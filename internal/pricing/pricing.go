@@ -2,20 +2,42 @@ package pricing
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/zhaobenny/cctop/internal/model"
 )
 
-const liteLLMPricingURL = "https://raw.githubusercontent.com/BerriAI/litellm/main/model_prices_and_context_window.json"
+// DefaultPricingURL is where LiteLLM publishes model pricing
+const DefaultPricingURL = "https://raw.githubusercontent.com/BerriAI/litellm/main/model_prices_and_context_window.json"
+
+// pricingURLOverride is set by SetPricingURL, guarded by fetchMu
+var pricingURLOverride string
+
+// freeCacheReads is set by SetFreeCacheReads
+var freeCacheReads bool
+
+// preferLoggedCost is set by SetPreferLoggedCost
+var preferLoggedCost bool
+
+// filePricing is loaded by LoadPricingFile and takes precedence over online
+// and embedded pricing
+var filePricing map[string]model.ModelPricing
 
 var modelDateSuffixPattern = regexp.MustCompile(`[-_]?20\d{6}$`)
 
+// Bedrock IDs look like "us.anthropic.claude-sonnet-4-20250514-v1:0"
+var bedrockPrefixPattern = regexp.MustCompile(`^(?:(?:us|eu|apac|global)\.)?anthropic\.`)
+var bedrockVersionSuffixPattern = regexp.MustCompile(`-v\d+(?::\d+)?$`)
+
 // liteLLMModel represents the pricing structure from LiteLLM
 type liteLLMModel struct {
 	InputCostPerToken  float64 `json:"input_cost_per_token"`
@@ -25,45 +47,172 @@ type liteLLMModel struct {
 	LiteLLMProvider    string  `json:"litellm_provider"`
 }
 
-// pricingCache caches the pricing data
-var pricingCache map[string]model.ModelPricing
-var cacheTime time.Time
-var cacheDuration = 1 * time.Hour
+// pricingCache caches the pricing data, guarded by cacheMu. fetchMu
+// serializes fetches so concurrent callers don't all hit the network.
+var (
+	cacheMu       sync.RWMutex
+	fetchMu       sync.Mutex
+	pricingCache  map[string]model.ModelPricing
+	cacheTime     time.Time
+	cacheDuration = 1 * time.Hour
+
+	// rejectedTime is when fetched pricing was last rejected as implausible.
+	// It isn't fetched again until cacheDuration has passed.
+	rejectedTime time.Time
+)
+
+// minOnlineModels is the fewest Anthropic models LiteLLM's pricing can list
+// and be believed. Fewer means the file changed shape or was truncated.
+const minOnlineModels = 3
+
+// errImplausiblePricing is returned when LiteLLM's pricing parses but can't
+// be right, so embedded pricing is used rather than caching it
+var errImplausiblePricing = errors.New("implausible pricing data")
 
-// FetchPricing fetches pricing data from LiteLLM
+// cachedPricing returns the cached pricing data if it is fresh
+func cachedPricing() (map[string]model.ModelPricing, bool) {
+	cacheMu.RLock()
+	defer cacheMu.RUnlock()
+	if pricingCache != nil && time.Since(cacheTime) < cacheDuration {
+		return pricingCache, true
+	}
+	return nil, false
+}
+
+// FetchPricing fetches pricing data from LiteLLM. It is safe to call
+// concurrently; the returned map is shared and must not be modified.
 func FetchPricing() (map[string]model.ModelPricing, error) {
+	pricing, err := onlinePricing()
+	if err != nil {
+		return GetEmbeddedPricing(), nil
+	}
+	return pricing, nil
+}
+
+// onlinePricing returns LiteLLM pricing, cached or freshly fetched, or the
+// error fetching it
+func onlinePricing() (map[string]model.ModelPricing, error) {
 	// Return cached data if fresh
-	if pricingCache != nil && time.Since(cacheTime) < cacheDuration {
-		return pricingCache, nil
+	if pricing, ok := cachedPricing(); ok {
+		return pricing, nil
+	}
+
+	fetchMu.Lock()
+	defer fetchMu.Unlock()
+
+	// Another caller may have fetched while we waited
+	if pricing, ok := cachedPricing(); ok {
+		return pricing, nil
+	}
+
+	cacheMu.RLock()
+	rejected := time.Since(rejectedTime) < cacheDuration
+	cacheMu.RUnlock()
+	if rejected {
+		return nil, errImplausiblePricing
+	}
+
+	pricing, err := fetchLiteLLM()
+	if errors.Is(err, errImplausiblePricing) {
+		fmt.Fprintf(os.Stderr, "Warning: Ignoring online pricing (%v), using embedded pricing\n", err)
+	}
+	return pricing, err
+}
+
+// Where a model's pricing came from, in ListPricing
+const (
+	SourceFile     = "file"
+	SourceOnline   = "online"
+	SourceEmbedded = "embedded"
+)
+
+// PricedModel is a model with known pricing
+type PricedModel struct {
+	Name    string
+	Pricing model.ModelPricing
+	Source  string // SourceFile, SourceOnline or SourceEmbedded
+}
+
+// ListPricing returns every model with known pricing, sorted by name: the
+// models in the pricing file, then online models, then any embedded models
+// LiteLLM doesn't list. Offline, or if LiteLLM can't be reached, every model
+// not in the pricing file is embedded. It also reports whether online
+// pricing was used, since lookups then ignore embedded-only models.
+func ListPricing(offline bool) ([]PricedModel, bool) {
+	var online map[string]model.ModelPricing
+	if !offline {
+		online, _ = onlinePricing()
+	}
+
+	var models []PricedModel
+	for name, p := range filePricing {
+		models = append(models, PricedModel{Name: name, Pricing: p, Source: SourceFile})
+	}
+	for name, p := range online {
+		if _, ok := filePricing[name]; !ok {
+			models = append(models, PricedModel{Name: name, Pricing: p, Source: SourceOnline})
+		}
 	}
+	for name, p := range GetEmbeddedPricing() {
+		_, inFile := filePricing[name]
+		_, inOnline := online[name]
+		if !inFile && !inOnline {
+			models = append(models, PricedModel{Name: name, Pricing: p, Source: SourceEmbedded})
+		}
+	}
+
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].Name < models[j].Name
+	})
+	return models, online != nil
+}
 
+// RefreshPricing re-fetches pricing from LiteLLM even if the cached data is
+// fresh. Unlike FetchPricing it reports failures rather than falling back
+// to embedded pricing.
+func RefreshPricing() (map[string]model.ModelPricing, error) {
+	fetchMu.Lock()
+	defer fetchMu.Unlock()
+	return fetchLiteLLM()
+}
+
+// fetchLiteLLM downloads LiteLLM's Anthropic pricing and caches it. Models
+// without an input cost are left out; if too few remain, nothing is cached
+// and it returns errImplausiblePricing. Callers must hold fetchMu.
+func fetchLiteLLM() (map[string]model.ModelPricing, error) {
 	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Get(liteLLMPricingURL)
+	resp, err := client.Get(pricingURL())
 	if err != nil {
-		return GetEmbeddedPricing(), nil
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return GetEmbeddedPricing(), nil
+		return nil, fmt.Errorf("pricing server returned status %d", resp.StatusCode)
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return GetEmbeddedPricing(), nil
+		return nil, err
 	}
 
 	var rawPricing map[string]liteLLMModel
 	if err := json.Unmarshal(body, &rawPricing); err != nil {
-		return GetEmbeddedPricing(), nil
+		return nil, fmt.Errorf("invalid pricing data: %w", err)
 	}
 
 	pricing := make(map[string]model.ModelPricing)
+	var unpriced []string
 	for name, data := range rawPricing {
 		// Only include Anthropic provider models
 		if data.LiteLLMProvider != "anthropic" {
 			continue
 		}
+		// A model without an input cost would silently cost nothing
+		if data.InputCostPerToken <= 0 {
+			unpriced = append(unpriced, name)
+			continue
+		}
 		pricing[name] = model.ModelPricing{
 			InputCostPerToken:         data.InputCostPerToken,
 			OutputCostPerToken:        data.OutputCostPerToken,
@@ -72,11 +221,102 @@ func FetchPricing() (map[string]model.ModelPricing, error) {
 		}
 	}
 
+	if len(pricing) < minOnlineModels {
+		cacheMu.Lock()
+		rejectedTime = time.Now()
+		cacheMu.Unlock()
+		return nil, fmt.Errorf("%w: only %d Anthropic models priced", errImplausiblePricing, len(pricing))
+	}
+	if len(unpriced) > 0 {
+		sort.Strings(unpriced)
+		fmt.Fprintf(os.Stderr, "Warning: Ignoring online pricing without an input cost for %s\n", strings.Join(unpriced, ", "))
+	}
+
+	cacheMu.Lock()
 	pricingCache = pricing
 	cacheTime = time.Now()
+	rejectedTime = time.Time{}
+	cacheMu.Unlock()
 	return pricing, nil
 }
 
+// SetPricingURL fetches pricing from url instead, such as an internal mirror
+// of LiteLLM's file. An empty url restores the default. Cached pricing is
+// discarded.
+func SetPricingURL(url string) {
+	fetchMu.Lock()
+	defer fetchMu.Unlock()
+	pricingURLOverride = url
+
+	cacheMu.Lock()
+	pricingCache = nil
+	rejectedTime = time.Time{}
+	cacheMu.Unlock()
+}
+
+// LoadPricingFile prices models from a local JSON file in LiteLLM's format,
+// a map of model names to per-token costs. Models in the file are priced
+// from it without any network access; other models still use online or
+// embedded pricing. Unlike LiteLLM's file, entries needn't name a provider.
+// Load it before calculating any costs.
+func LoadPricingFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var rawPricing map[string]liteLLMModel
+	if err := json.Unmarshal(data, &rawPricing); err != nil {
+		return fmt.Errorf("invalid pricing file: %w", err)
+	}
+	if len(rawPricing) == 0 {
+		return fmt.Errorf("pricing file has no models")
+	}
+
+	filePricing = make(map[string]model.ModelPricing, len(rawPricing))
+	for name, data := range rawPricing {
+		filePricing[name] = model.ModelPricing{
+			InputCostPerToken:         data.InputCostPerToken,
+			OutputCostPerToken:        data.OutputCostPerToken,
+			CacheCreationCostPerToken: data.CacheCreationCost,
+			CacheReadCostPerToken:     data.CacheReadCost,
+		}
+	}
+	return nil
+}
+
+// InPricingFile reports whether name is a model in the pricing file, such as
+// a name returned by ResolvePricing
+func InPricingFile(name string) bool {
+	_, ok := filePricing[name]
+	return ok
+}
+
+// SetFreeCacheReads makes CalculateCost price cache reads at zero, for plans
+// that don't bill them. Set it before calculating any costs.
+func SetFreeCacheReads(free bool) {
+	freeCacheReads = free
+}
+
+// SetPreferLoggedCost makes RecordCost use the cost a record was logged with,
+// where there is one, rather than pricing its tokens. Set it before
+// calculating any costs.
+func SetPreferLoggedCost(prefer bool) {
+	preferLoggedCost = prefer
+}
+
+// pricingURL returns the URL to fetch pricing from: the SetPricingURL
+// override, $CCTOP_PRICING_URL, or DefaultPricingURL. Callers must hold fetchMu.
+func pricingURL() string {
+	if pricingURLOverride != "" {
+		return pricingURLOverride
+	}
+	if url := os.Getenv("CCTOP_PRICING_URL"); url != "" {
+		return url
+	}
+	return DefaultPricingURL
+}
+
 // GetEmbeddedPricing returns fallback embedded pricing data
 func GetEmbeddedPricing() map[string]model.ModelPricing {
 	return map[string]model.ModelPricing{
@@ -202,8 +442,42 @@ func GetEmbeddedPricing() map[string]model.ModelPricing {
 	}
 }
 
-// GetPricing returns pricing for a model, trying online first then falling back to embedded
+// GetPricing returns pricing for a model from the pricing file, then online,
+// falling back to embedded
 func GetPricing(modelName string, offline bool) model.ModelPricing {
+	if p, ok := LookupPricing(modelName, offline); ok {
+		return p
+	}
+
+	fmt.Fprintf(os.Stderr, "Warning: Unknown model %s, using default pricing\n", modelName)
+	return DefaultPricing
+}
+
+// DefaultPricing is what GetPricing prices unknown models at (Sonnet 4
+// pricing as a reasonable default)
+var DefaultPricing = model.ModelPricing{
+	InputCostPerToken:         3e-06,
+	OutputCostPerToken:        1.5e-05,
+	CacheCreationCostPerToken: 3.75e-06,
+	CacheReadCostPerToken:     3e-07,
+}
+
+// LookupPricing returns pricing for a model like GetPricing, but reports
+// unknown models instead of falling back to default pricing
+func LookupPricing(modelName string, offline bool) (model.ModelPricing, bool) {
+	_, p, ok := ResolvePricing(modelName, offline)
+	return p, ok
+}
+
+// ResolvePricing is LookupPricing that also returns the name of the pricing
+// entry the model matched, which may differ after normalization. The pricing
+// file is checked first, so models it covers never fetch online pricing;
+// offline only decides what's used for models it doesn't.
+func ResolvePricing(modelName string, offline bool) (string, model.ModelPricing, bool) {
+	if name, p, ok := matchPricing(filePricing, modelName); ok {
+		return name, p, true
+	}
+
 	var pricing map[string]model.ModelPricing
 	var err error
 
@@ -215,28 +489,43 @@ func GetPricing(modelName string, offline bool) model.ModelPricing {
 			pricing = GetEmbeddedPricing()
 		}
 	}
+	return matchPricing(pricing, modelName)
+}
 
+// matchPricing finds modelName in pricing, exactly or by normalized name
+func matchPricing(pricing map[string]model.ModelPricing, modelName string) (string, model.ModelPricing, bool) {
 	// Try exact match first
 	if p, ok := pricing[modelName]; ok {
-		return p
+		return modelName, p, true
 	}
 
 	// Try to find a matching model by normalizing the name
 	normalized := normalizeModelName(modelName)
 	for name, p := range pricing {
 		if normalizeModelName(name) == normalized {
-			return p
+			return name, p, true
 		}
 	}
 
-	// Fall back to a default pricing (Sonnet 4 pricing as a reasonable default)
-	fmt.Printf("Warning: Unknown model %s, using default pricing\n", modelName)
-	return model.ModelPricing{
-		InputCostPerToken:         3e-06,
-		OutputCostPerToken:        1.5e-05,
-		CacheCreationCostPerToken: 3.75e-06,
-		CacheReadCostPerToken:     3e-07,
+	return "", model.ModelPricing{}, false
+}
+
+// UnknownModels returns the distinct models in records that have no known
+// pricing, sorted by name
+func UnknownModels(records []model.UsageRecord, offline bool) []string {
+	seen := make(map[string]bool)
+	var unknown []string
+	for _, r := range records {
+		if seen[r.Model] {
+			continue
+		}
+		seen[r.Model] = true
+		if _, ok := LookupPricing(r.Model, offline); !ok {
+			unknown = append(unknown, r.Model)
+		}
 	}
+	sort.Strings(unknown)
+	return unknown
 }
 
 // normalizeModelName normalizes model names for matching
@@ -249,6 +538,17 @@ func normalizeModelName(name string) string {
 		name = name[idx+1:]
 	}
 
+	// Strip Bedrock region/provider prefix like "us.anthropic.".
+	name = bedrockPrefixPattern.ReplaceAllString(name, "")
+
+	// Strip Vertex version tag like "@20241022".
+	if idx := strings.Index(name, "@"); idx >= 0 {
+		name = name[:idx]
+	}
+
+	// Strip Bedrock/Vertex revision suffix like "-v2:0" or "-v2".
+	name = bedrockVersionSuffixPattern.ReplaceAllString(name, "")
+
 	// Strip common tags.
 	name = strings.TrimSuffix(name, "-latest")
 	if idx := strings.LastIndex(name, ":"); idx >= 0 {
@@ -268,11 +568,31 @@ func normalizeModelName(name string) string {
 	return name
 }
 
+// WebSearchCostPerRequest is what a server-side web search costs, on every model
+const WebSearchCostPerRequest = 10.0 / 1000
+
 // CalculateCost calculates the cost for a usage record
 func CalculateCost(usage model.TokenUsage, pricing model.ModelPricing) float64 {
-	cost := float64(usage.InputTokens) * pricing.InputCostPerToken
+	cost := float64(usage.WebSearchRequests) * WebSearchCostPerRequest
+	cost += float64(usage.InputTokens) * pricing.InputCostPerToken
 	cost += float64(usage.OutputTokens) * pricing.OutputCostPerToken
 	cost += float64(usage.CacheCreationInputTokens) * pricing.CacheCreationCostPerToken
-	cost += float64(usage.CacheReadInputTokens) * pricing.CacheReadCostPerToken
+	if !freeCacheReads {
+		cost += float64(usage.CacheReadInputTokens) * pricing.CacheReadCostPerToken
+	}
 	return cost
 }
+
+// UsesLoggedCost reports whether RecordCost prices r at its logged cost
+func UsesLoggedCost(r model.UsageRecord) bool {
+	return preferLoggedCost && r.LoggedCost > 0
+}
+
+// RecordCost returns what a record cost: its logged cost if SetPreferLoggedCost
+// is on and it has one, otherwise its tokens priced by CalculateCost
+func RecordCost(r model.UsageRecord, offline bool) float64 {
+	if UsesLoggedCost(r) {
+		return r.LoggedCost
+	}
+	return CalculateCost(r.Usage, GetPricing(r.Model, offline))
+}
@@ -0,0 +1,214 @@
+package pricing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNormalizeModelNameBedrockVertex(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		// Anthropic API
+		{"claude-3-5-sonnet-20241022", "claude35sonnet"},
+		{"claude-sonnet-4-5", "claudesonnet45"},
+		{"anthropic/claude-sonnet-4-20250514", "claudesonnet4"},
+
+		// Bedrock, with and without a cross-region inference prefix
+		{"anthropic.claude-3-5-sonnet-20241022-v2:0", "claude35sonnet"},
+		{"anthropic.claude-3-haiku-20240307-v1:0", "claude3haiku"},
+		{"us.anthropic.claude-sonnet-4-20250514-v1:0", "claudesonnet4"},
+		{"eu.anthropic.claude-3-7-sonnet-20250219-v1:0", "claude37sonnet"},
+		{"apac.anthropic.claude-3-5-haiku-20241022-v1:0", "claude35haiku"},
+		{"global.anthropic.claude-sonnet-4-5-20250929-v1:0", "claudesonnet45"},
+		{"US.Anthropic.Claude-Opus-4-1-20250805-V1:0", "claudeopus41"},
+		{"anthropic.claude-opus-4-20250514-v1", "claudeopus4"},
+
+		// Vertex
+		{"claude-3-5-sonnet-v2@20241022", "claude35sonnet"},
+		{"claude-opus-4-1@20250805", "claudeopus41"},
+		{"claude-haiku-4-5@20251001", "claudehaiku45"},
+		{"publishers/anthropic/models/claude-3-5-haiku@20241022", "claude35haiku"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeModelName(tt.name); got != tt.want {
+			t.Errorf("normalizeModelName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResolvePricingBedrockVertex(t *testing.T) {
+	embedded := GetEmbeddedPricing()
+	tests := []struct {
+		model string
+		like  string // Embedded model priced the same
+	}{
+		{"anthropic.claude-3-5-sonnet-20241022-v2:0", "claude-3-5-sonnet-20241022"},
+		{"us.anthropic.claude-sonnet-4-20250514-v1:0", "claude-sonnet-4-20250514"},
+		{"eu.anthropic.claude-3-7-sonnet-20250219-v1:0", "claude-3-7-sonnet-20250219"},
+		{"us.anthropic.claude-opus-4-1-20250805-v1:0", "claude-opus-4-1-20250805"},
+		{"global.anthropic.claude-haiku-4-5-20251001-v1:0", "claude-haiku-4-5-20251001"},
+		{"anthropic.claude-3-haiku-20240307-v1:0", "claude-3-haiku-20240307"},
+		{"claude-3-5-sonnet-v2@20241022", "claude-3-5-sonnet-20241022"},
+		{"claude-opus-4@20250514", "claude-opus-4-20250514"},
+		{"claude-3-5-haiku@20241022", "claude-3-5-haiku-20241022"},
+		{"claude-sonnet-4-5@20250929", "claude-sonnet-4-5-20250929"},
+	}
+
+	for _, tt := range tests {
+		_, got, ok := ResolvePricing(tt.model, true)
+		if !ok {
+			t.Errorf("ResolvePricing(%q) found no pricing", tt.model)
+			continue
+		}
+		if want := embedded[tt.like]; got != want {
+			t.Errorf("ResolvePricing(%q) = %+v, want %s pricing %+v", tt.model, got, tt.like, want)
+		}
+	}
+
+	if _, _, ok := ResolvePricing("anthropic.titan-text-express-v1", true); ok {
+		t.Errorf("ResolvePricing found pricing for a non-Claude Bedrock model")
+	}
+}
+
+// liteLLMPricing is a LiteLLM pricing file with a few Anthropic models,
+// priced so they're told apart from embedded pricing
+const liteLLMPricing = `{
+	"claude-sonnet-4-5": {"input_cost_per_token": 1e-05, "output_cost_per_token": 2e-05, "litellm_provider": "anthropic"},
+	"claude-opus-4-1": {"input_cost_per_token": 3e-05, "output_cost_per_token": 4e-05, "litellm_provider": "anthropic"},
+	"claude-haiku-4-5": {"input_cost_per_token": 5e-06, "output_cost_per_token": 6e-06, "litellm_provider": "anthropic"},
+	"gpt-4o": {"input_cost_per_token": 1e-06, "output_cost_per_token": 1e-06, "litellm_provider": "openai"}
+}`
+
+// servePricing serves body as the online pricing for the rest of the test,
+// or fails with a server error if body is empty. It returns the number of
+// requests served so far.
+func servePricing(t *testing.T, body string) *atomic.Int64 {
+	t.Helper()
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if body == "" {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	SetPricingURL(srv.URL)
+	t.Cleanup(func() { SetPricingURL("") })
+	return &hits
+}
+
+// Run with -race: lookups, fetches and refreshes share the pricing cache
+func TestPricingConcurrentAccess(t *testing.T) {
+	servePricing(t, liteLLMPricing)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			switch i % 4 {
+			case 0:
+				if p := GetPricing("claude-sonnet-4-5-20250929", false); p.InputCostPerToken != 1e-05 {
+					t.Errorf("GetPricing = %+v, want online pricing", p)
+				}
+			case 1:
+				if _, err := FetchPricing(); err != nil {
+					t.Errorf("FetchPricing: %v", err)
+				}
+			case 2:
+				if _, err := RefreshPricing(); err != nil {
+					t.Errorf("RefreshPricing: %v", err)
+				}
+			case 3:
+				if _, online := ListPricing(false); !online {
+					t.Errorf("ListPricing didn't use online pricing")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestPricingFilePrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pricing.json")
+	err := os.WriteFile(path, []byte(`{
+		"claude-sonnet-4-5": {"input_cost_per_token": 7e-06, "output_cost_per_token": 8e-06},
+		"my-custom-model": {"input_cost_per_token": 9e-06, "output_cost_per_token": 9e-06}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { filePricing = nil })
+
+	tests := []struct {
+		model   string
+		file    bool // --pricing-file given
+		offline bool
+		down    bool    // Online pricing can't be fetched
+		want    float64 // Input cost per token; 0 to expect embedded pricing
+		fetches int64
+	}{
+		// Models in the file never need the network
+		{"claude-sonnet-4-5-20250929", true, false, false, 7e-06, 0},
+		{"claude-sonnet-4-5-20250929", true, true, false, 7e-06, 0},
+		{"claude-sonnet-4-5-20250929", true, false, true, 7e-06, 0},
+		{"my-custom-model", true, false, false, 9e-06, 0},
+		{"my-custom-model", true, true, false, 9e-06, 0},
+
+		// Other models are priced online, or embedded offline or when online fails
+		{"claude-opus-4-1-20250805", true, false, false, 3e-05, 1},
+		{"claude-opus-4-1-20250805", true, true, false, 0, 0},
+		{"claude-opus-4-1-20250805", true, false, true, 0, 1},
+
+		// Without a file
+		{"claude-sonnet-4-5-20250929", false, false, false, 1e-05, 1},
+		{"claude-sonnet-4-5-20250929", false, true, false, 0, 0},
+		{"claude-sonnet-4-5-20250929", false, false, true, 0, 1},
+	}
+
+	for _, tt := range tests {
+		body := liteLLMPricing
+		if tt.down {
+			body = ""
+		}
+		fetches := servePricing(t, body)
+
+		filePricing = nil
+		if tt.file {
+			if err := LoadPricingFile(path); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		want := tt.want
+		if want == 0 {
+			_, p, _ := matchPricing(GetEmbeddedPricing(), tt.model)
+			want = p.InputCostPerToken
+		}
+
+		_, p, ok := ResolvePricing(tt.model, tt.offline)
+		if !ok || p.InputCostPerToken != want {
+			t.Errorf("ResolvePricing(%q) with file %v, offline %v, down %v = %+v, %v, want input cost %g",
+				tt.model, tt.file, tt.offline, tt.down, p, ok, want)
+		}
+		if n := fetches.Load(); n != tt.fetches {
+			t.Errorf("ResolvePricing(%q) with file %v, offline %v, down %v fetched online pricing %d times, want %d",
+				tt.model, tt.file, tt.offline, tt.down, n, tt.fetches)
+		}
+	}
+
+	// A model the file doesn't know is still unknown
+	if _, _, ok := ResolvePricing("my-other-model", true); ok {
+		t.Errorf("ResolvePricing found pricing for a model in no pricing")
+	}
+}
@@ -3,9 +3,13 @@ package auth
 import (
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/hex"
+	"fmt"
 	"net/http"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/alexedwards/scs/v2"
 	"github.com/zhaobenny/cctop/server/internal/database"
@@ -34,6 +38,67 @@ func CheckPassword(password, hash string) bool {
 	return err == nil
 }
 
+// MinPasswordLength is the floor for any password policy
+const MinPasswordLength = 8
+
+// PasswordPolicy describes the requirements for new passwords
+type PasswordPolicy struct {
+	MinLength  int // Minimum length, never below MinPasswordLength
+	MinClasses int // Character classes required (lowercase, uppercase, digits, symbols), 0-4
+}
+
+// Length returns the effective minimum password length
+func (p PasswordPolicy) Length() int {
+	return max(p.MinLength, MinPasswordLength)
+}
+
+// Hint describes the policy for the registration form
+func (p PasswordPolicy) Hint() string {
+	hint := fmt.Sprintf("min %d characters", p.Length())
+	if p.MinClasses > 0 {
+		hint += fmt.Sprintf(", %d of lowercase, uppercase, digits, symbols", min(p.MinClasses, 4))
+	}
+	return hint
+}
+
+// Check returns a user-facing error if the password doesn't meet the policy
+func (p PasswordPolicy) Check(password string) error {
+	minLength := p.Length()
+	if len(password) < minLength {
+		return fmt.Errorf("Password must be at least %d characters", minLength)
+	}
+
+	if p.MinClasses <= 0 {
+		return nil
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	classes := 0
+	for _, has := range []bool{lower, upper, digit, symbol} {
+		if has {
+			classes++
+		}
+	}
+	if classes < min(p.MinClasses, 4) {
+		return fmt.Errorf("Password must contain at least %d of: lowercase letters, uppercase letters, digits, symbols", min(p.MinClasses, 4))
+	}
+
+	return nil
+}
+
 // GenerateAPIKey generates a random API key
 func GenerateAPIKey() (string, error) {
 	bytes := make([]byte, 16)
@@ -56,13 +121,15 @@ func GenerateID() (string, error) {
 type Middleware struct {
 	db         *database.DB
 	sessionMgr *scs.SessionManager
+	basePath   string // Path prefix the dashboard is served under, e.g. "/cctop"
 }
 
 // NewMiddleware creates a new auth middleware
-func NewMiddleware(db *database.DB, sessionMgr *scs.SessionManager) *Middleware {
+func NewMiddleware(db *database.DB, sessionMgr *scs.SessionManager, basePath string) *Middleware {
 	return &Middleware{
 		db:         db,
 		sessionMgr: sessionMgr,
+		basePath:   basePath,
 	}
 }
 
@@ -73,18 +140,18 @@ func (m *Middleware) RequireAuth(next http.Handler) http.Handler {
 		if userID == "" {
 			// For HTMX requests, return the auth fragment
 			if r.Header.Get("HX-Request") == "true" {
-				w.Header().Set("HX-Redirect", "/")
+				w.Header().Set("HX-Redirect", m.basePath+"/")
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
-			http.Redirect(w, r, "/", http.StatusSeeOther)
+			http.Redirect(w, r, m.basePath+"/", http.StatusSeeOther)
 			return
 		}
 
 		user, err := m.db.GetUserByID(userID)
 		if err != nil || user == nil {
 			m.sessionMgr.Destroy(r.Context())
-			http.Redirect(w, r, "/", http.StatusSeeOther)
+			http.Redirect(w, r, m.basePath+"/", http.StatusSeeOther)
 			return
 		}
 
@@ -117,12 +184,52 @@ func (m *Middleware) RequireAPIKey(next http.Handler) http.Handler {
 			return
 		}
 
+		// Best effort: a failure to record the key's use shouldn't fail the request
+		if user.LastAPIUseAt == nil || time.Since(*user.LastAPIUseAt) >= database.APIKeyUseInterval {
+			m.db.TouchAPIKeyUse(user.ID, time.Now())
+		}
+
+		ctx := context.WithValue(r.Context(), userIDKey, user.ID)
+		ctx = context.WithValue(ctx, userKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireShareToken middleware requires a share link's token as the {token}
+// path value, acting as the user who shared it. Unknown or revoked tokens are
+// not found rather than unauthorized, so links don't reveal they ever existed.
+func (m *Middleware) RequireShareToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.PathValue("token")
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		user, err := m.db.GetUserByShareToken(token)
+		if err != nil || user == nil {
+			http.NotFound(w, r)
+			return
+		}
+
 		ctx := context.WithValue(r.Context(), userIDKey, user.ID)
 		ctx = context.WithValue(ctx, userKey, user)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// RequireAdminToken middleware requires the operator's admin token as a bearer token
+func RequireAdminToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // GetUserID returns the user ID from context
 func GetUserID(ctx context.Context) string {
 	if id, ok := ctx.Value(userIDKey).(string); ok {
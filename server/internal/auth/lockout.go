@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// LoginLockout locks an account after repeated failed logins, regardless of
+// which IP the attempts come from
+type LoginLockout struct {
+	mu          sync.Mutex
+	maxFailures int
+	window      time.Duration
+	duration    time.Duration
+	accounts    map[string]*loginAttempts
+}
+
+type loginAttempts struct {
+	failures    int
+	firstFailed time.Time
+	lockedUntil time.Time
+}
+
+// NewLoginLockout creates a lockout that triggers after maxFailures failed
+// logins within window and lasts for duration. maxFailures 0 disables it.
+func NewLoginLockout(maxFailures int, window, duration time.Duration) *LoginLockout {
+	return &LoginLockout{
+		maxFailures: maxFailures,
+		window:      window,
+		duration:    duration,
+		accounts:    make(map[string]*loginAttempts),
+	}
+}
+
+// Locked returns how much longer an account is locked, or 0 if it isn't
+func (l *LoginLockout) Locked(username string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	a, exists := l.accounts[username]
+	if !exists {
+		return 0
+	}
+	return max(time.Until(a.lockedUntil), 0)
+}
+
+// Fail records a failed login, locking the account once the threshold is hit
+func (l *LoginLockout) Fail(username string) {
+	if l.maxFailures <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	a, exists := l.accounts[username]
+	if !exists || now.Sub(a.firstFailed) > l.window {
+		a = &loginAttempts{firstFailed: now}
+		l.accounts[username] = a
+	}
+
+	a.failures++
+	if a.failures >= l.maxFailures {
+		a.lockedUntil = now.Add(l.duration)
+	}
+}
+
+// Reset clears the failed login count after a successful login
+func (l *LoginLockout) Reset(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.accounts, username)
+}
+
+// sweep forgets accounts whose window and lockout have both expired
+func (l *LoginLockout) sweep(now time.Time) {
+	for username, a := range l.accounts {
+		if now.Sub(a.firstFailed) > l.window && now.After(a.lockedUntil) {
+			delete(l.accounts, username)
+		}
+	}
+}
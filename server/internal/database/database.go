@@ -1,11 +1,16 @@
 package database
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/zhaobenny/cctop/internal/billing"
 	"github.com/zhaobenny/cctop/internal/model"
 	"github.com/zhaobenny/cctop/internal/pricing"
 )
@@ -21,8 +26,25 @@ type User struct {
 	Username     string
 	PasswordHash string
 	APIKey       string
-	BillingDay   int // Day of month (1-31), 0 = disabled
+	BillingDay   int    // Day of month (1-31), 0 = disabled
+	Timezone     string // IANA timezone name, "" = server local time
+	DefaultView  string // Dashboard view shown first, "" = monthly
 	CreatedAt    time.Time
+	LastAPIUseAt *time.Time // When the API key was last used, to within APIKeyUseInterval; nil if never
+}
+
+// APIKeyUseInterval is how often an API key's last use is recorded at most,
+// so busy clients don't write on every request
+const APIKeyUseInterval = time.Minute
+
+// Location returns the user's timezone, falling back to the server's local time
+func (u *User) Location() *time.Location {
+	if u.Timezone != "" {
+		if loc, err := time.LoadLocation(u.Timezone); err == nil {
+			return loc
+		}
+	}
+	return time.Local
 }
 
 // Client represents a sync client
@@ -34,6 +56,13 @@ type Client struct {
 	CreatedAt  time.Time
 }
 
+// ShareLink is a revocable token granting read-only access to a user's usage
+type ShareLink struct {
+	Token     string
+	UserID    string
+	CreatedAt time.Time
+}
+
 // UsageRecord represents a usage record from Claude Code
 type UsageRecord struct {
 	ID                  int64
@@ -47,11 +76,35 @@ type UsageRecord struct {
 	OutputTokens        int64
 	CacheCreationTokens int64
 	CacheReadTokens     int64
+	Tag                 string // Set by the client when syncing, e.g. "work"; empty if untagged
+}
+
+// UnknownSessionPrefix starts the session ID given to records synced without one
+const UnknownSessionPrefix = "unknown-"
+
+// SessionIDOrDerived returns the record's session ID or, if it has none, an
+// ID derived from its contents. The session ID is part of what makes a record
+// unique, so records without one at the same time and model would otherwise
+// collapse into one, while a record synced again must still match itself.
+func (r UsageRecord) SessionIDOrDerived() string {
+	if r.SessionID != "" {
+		return r.SessionID
+	}
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s\x00%d\x00%d\x00%d\x00%d",
+		r.ProjectPath, r.InputTokens, r.OutputTokens, r.CacheCreationTokens, r.CacheReadTokens))
+	return UnknownSessionPrefix + hex.EncodeToString(sum[:8])
 }
 
 // Open opens a SQLite database connection
 func Open(dbPath string) (*DB, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	// Transactions take the write lock when they begin, so one that reads
+	// before writing waits for other writers rather than failing once they
+	// commit. Every transaction here writes.
+	dsn := dbPath + "?_txlock=immediate"
+	if strings.Contains(dbPath, "?") {
+		dsn = dbPath + "&_txlock=immediate"
+	}
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -81,9 +134,32 @@ func Open(dbPath string) (*DB, error) {
 	return &DB{db}, nil
 }
 
-// Migrate creates the database schema
-func (db *DB) Migrate() error {
-	schema := `
+// migrations are the schema changes applied in order, each once and in its
+// own transaction. A migration's version is its position in the list,
+// starting at 1. Append new migrations; never edit or reorder applied ones.
+var migrations = []func(tx *sql.Tx) error{
+	migrateInitialSchema,
+	migrateAddTimezone,
+	migrateCycleKeys,
+	migrateAddPrunedBefore,
+	migrateAddModelSummaries,
+	migrateAddDefaultView,
+	migrateAddRecordTags,
+	migrateAddWeekSummaries,
+	migrateAddAPIKeyLastUsed,
+	migrateFillSessionIDs,
+	migrateAddShareLinks,
+}
+
+// LatestSchemaVersion returns the schema version this build expects
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+// migrateInitialSchema creates the original tables. Databases created before
+// versioned migrations already have them, possibly without the cost column.
+func migrateInitialSchema(tx *sql.Tx) error {
+	_, err := tx.Exec(`
 	CREATE TABLE IF NOT EXISTS users (
 		id TEXT PRIMARY KEY,
 		username TEXT UNIQUE NOT NULL,
@@ -146,654 +222,1959 @@ func (db *DB) Migrate() error {
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_summary_user_type ON usage_summary(user_id, period_type);
-	`
-
-	_, err := db.Exec(schema)
+	`)
 	if err != nil {
 		return err
 	}
-
-	// Run migrations for existing databases
-	db.migrate_addCostColumn()
-
-	return nil
-}
-
-// migrate_addCostColumn adds cost column to usage_records if missing (added in later version)
-func (db *DB) migrate_addCostColumn() {
-	// Check if column exists by querying pragma
-	var count int
-	db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('usage_records') WHERE name='cost'").Scan(&count)
-	if count == 0 {
-		db.Exec("ALTER TABLE usage_records ADD COLUMN cost REAL DEFAULT 0")
-	}
+	return addColumn(tx, "usage_records", "cost", "REAL DEFAULT 0")
 }
 
-// CreateUser creates a new user
-func (db *DB) CreateUser(user *User) error {
-	_, err := db.Exec(
-		`INSERT INTO users (id, username, password_hash, api_key, billing_day, created_at)
-		 VALUES (?, ?, ?, ?, ?, ?)`,
-		user.ID, user.Username, user.PasswordHash, user.APIKey, user.BillingDay, user.CreatedAt,
-	)
-	return err
+// migrateAddTimezone adds the per-user timezone
+func migrateAddTimezone(tx *sql.Tx) error {
+	return addColumn(tx, "users", "timezone", "TEXT NOT NULL DEFAULT ''")
 }
 
-// GetUserByUsername retrieves a user by username
-func (db *DB) GetUserByUsername(username string) (*User, error) {
-	user := &User{}
-	err := db.QueryRow(
-		`SELECT id, username, password_hash, api_key, billing_day, created_at
-		 FROM users WHERE username = ?`,
-		username,
-	).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.APIKey, &user.BillingDay, &user.CreatedAt)
-	if err == sql.ErrNoRows {
-		return nil, nil
-	}
+// migrateCycleKeys rebuilds cycle summaries stored under the old year-less
+// "Jan 2 – Feb 1" keys, which collided across years
+func migrateCycleKeys(tx *sql.Tx) error {
+	rows, err := tx.Query(`
+		SELECT DISTINCT u.id, u.billing_day, u.timezone
+		FROM usage_summary s JOIN users u ON u.id = s.user_id
+		WHERE s.period_type = 'cycle' AND s.period_key LIKE '% – %'
+	`)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return user, nil
-}
 
-// GetUserByID retrieves a user by ID
-func (db *DB) GetUserByID(id string) (*User, error) {
-	user := &User{}
-	err := db.QueryRow(
-		`SELECT id, username, password_hash, api_key, billing_day, created_at
-		 FROM users WHERE id = ?`,
-		id,
-	).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.APIKey, &user.BillingDay, &user.CreatedAt)
-	if err == sql.ErrNoRows {
-		return nil, nil
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.BillingDay, &u.Timezone); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, u)
 	}
-	if err != nil {
-		return nil, err
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
 	}
-	return user, nil
+
+	for _, u := range users {
+		if err := migrateCycleKeysRebuild(tx, u.ID, u.BillingDay, u.Location()); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// GetUserByAPIKey retrieves a user by API key
-func (db *DB) GetUserByAPIKey(apiKey string) (*User, error) {
-	user := &User{}
-	err := db.QueryRow(
-		`SELECT id, username, password_hash, api_key, billing_day, created_at
-		 FROM users WHERE api_key = ?`,
-		apiKey,
-	).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.APIKey, &user.BillingDay, &user.CreatedAt)
-	if err == sql.ErrNoRows {
-		return nil, nil
+// migrateCycleKeysRebuild rebuilds a user's cycle summaries from their day
+// summaries for migrateCycleKeys. It's a copy of the rebuild as it was then:
+// migrations run against the schema of their time, so they mustn't call
+// code that later grows to use newer tables.
+func migrateCycleKeysRebuild(tx *sql.Tx, userID string, billingDay int, loc *time.Location) error {
+	if _, err := tx.Exec(`DELETE FROM usage_summary WHERE user_id = ? AND period_type = 'cycle'`, userID); err != nil {
+		return err
+	}
+	if !billing.ValidDay(billingDay) {
+		return nil
 	}
+
+	rows, err := tx.Query(`
+		SELECT period_key, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost
+		FROM usage_summary
+		WHERE user_id = ? AND period_type = 'day'
+	`, userID)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return user, nil
-}
 
-// UpdateUserBillingDay updates a user's billing day
-func (db *DB) UpdateUserBillingDay(userID string, billingDay int) error {
-	_, err := db.Exec(`UPDATE users SET billing_day = ? WHERE id = ?`, billingDay, userID)
-	return err
-}
+	type cycle struct {
+		start, end                              time.Time
+		input, output, cacheCreation, cacheRead int64
+		cost                                    float64
+	}
+	cycles := make(map[string]cycle)
+	for rows.Next() {
+		var day string
+		var input, output, cacheCreation, cacheRead int64
+		var cost float64
+		if err := rows.Scan(&day, &input, &output, &cacheCreation, &cacheRead, &cost); err != nil {
+			rows.Close()
+			return err
+		}
 
-// GetOrCreateClient gets an existing client or creates a new one
-func (db *DB) GetOrCreateClient(userID, clientID, clientName string) (*Client, error) {
-	// Try to get existing client
-	client := &Client{}
-	var lastSyncAt sql.NullTime
-	err := db.QueryRow(
-		`SELECT id, user_id, name, last_sync_at, created_at FROM clients WHERE id = ? AND user_id = ?`,
-		clientID, userID,
-	).Scan(&client.ID, &client.UserID, &client.Name, &lastSyncAt, &client.CreatedAt)
+		t, _ := time.ParseInLocation("2006-01-02", day, loc)
+		start, end := billing.PeriodFor(billingDay, t)
+		key := start.Format("2006-01-02")
 
-	if err == nil {
-		if lastSyncAt.Valid {
-			client.LastSyncAt = &lastSyncAt.Time
-		}
-		return client, nil
+		c := cycles[key]
+		c.start = start
+		c.end = end.Add(-time.Second)
+		c.input += input
+		c.output += output
+		c.cacheCreation += cacheCreation
+		c.cacheRead += cacheRead
+		c.cost += cost
+		cycles[key] = c
 	}
-
-	if err != sql.ErrNoRows {
-		return nil, err
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
 	}
 
-	// Create new client
-	now := time.Now()
-	_, err = db.Exec(
-		`INSERT INTO clients (id, user_id, name, created_at) VALUES (?, ?, ?, ?)`,
-		clientID, userID, clientName, now,
-	)
-	if err != nil {
-		return nil, err
+	for key, c := range cycles {
+		if _, err := tx.Exec(`
+			INSERT INTO usage_summary
+			(user_id, period_type, period_key, period_start, period_end, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost)
+			VALUES (?, 'cycle', ?, ?, ?, ?, ?, ?, ?, ?)
+		`, userID, key, c.start.UTC(), c.end.UTC(), c.input, c.output, c.cacheCreation, c.cacheRead, c.cost); err != nil {
+			return err
+		}
 	}
-
-	return &Client{
-		ID:        clientID,
-		UserID:    userID,
-		Name:      clientName,
-		CreatedAt: now,
-	}, nil
+	return nil
 }
 
-// UpdateClientLastSync updates the last sync time for a client
-func (db *DB) UpdateClientLastSync(clientID string, lastSyncAt time.Time) error {
-	_, err := db.Exec(`UPDATE clients SET last_sync_at = ? WHERE id = ?`, lastSyncAt, clientID)
-	return err
+// migrateAddPrunedBefore adds the per-user retention boundary
+func migrateAddPrunedBefore(tx *sql.Tx) error {
+	return addColumn(tx, "users", "pruned_before", "TIMESTAMP")
 }
 
-// InsertUsageRecords inserts multiple usage records, ignoring duplicates
-func (db *DB) InsertUsageRecords(records []UsageRecord) (int64, error) {
-	tx, err := db.Begin()
+// migrateAddModelSummaries adds per-model summaries and fills them in from
+// raw records. Pruned periods have no records left, so they get none.
+func migrateAddModelSummaries(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS usage_summary_by_model (
+		user_id TEXT NOT NULL,
+		period_type TEXT NOT NULL,
+		period_key TEXT NOT NULL,
+		model TEXT NOT NULL,
+		period_start TIMESTAMP NOT NULL,
+		period_end TIMESTAMP NOT NULL,
+		input_tokens INTEGER NOT NULL,
+		output_tokens INTEGER NOT NULL,
+		cache_creation_tokens INTEGER NOT NULL,
+		cache_read_tokens INTEGER NOT NULL,
+		cost REAL DEFAULT 0,
+		PRIMARY KEY (user_id, period_type, period_key, model),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	`)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	defer tx.Rollback()
 
-	stmt, err := tx.Prepare(`
-		INSERT OR IGNORE INTO usage_records
-		(user_id, client_id, timestamp, session_id, project_path, model,
-		 input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`)
+	rows, err := tx.Query(`SELECT id, billing_day, timezone, pruned_before FROM users`)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	defer stmt.Close()
 
-	var inserted int64
-	for _, r := range records {
-		// Calculate cost using shared pricing module
-		modelPricing := pricing.GetPricing(r.Model, true) // offline mode for server
-		cost := pricing.CalculateCost(model.TokenUsage{
-			InputTokens:              r.InputTokens,
-			OutputTokens:             r.OutputTokens,
-			CacheCreationInputTokens: r.CacheCreationTokens,
-			CacheReadInputTokens:     r.CacheReadTokens,
-		}, modelPricing)
-		result, err := stmt.Exec(
-			r.UserID, r.ClientID, r.Timestamp, r.SessionID, r.ProjectPath, r.Model,
-			r.InputTokens, r.OutputTokens, r.CacheCreationTokens, r.CacheReadTokens, cost,
-		)
-		if err != nil {
-			return 0, err
+	type user struct {
+		User
+		prunedBefore sql.NullTime
+	}
+	var users []user
+	for rows.Next() {
+		var u user
+		if err := rows.Scan(&u.ID, &u.BillingDay, &u.Timezone, &u.prunedBefore); err != nil {
+			rows.Close()
+			return err
 		}
-		n, _ := result.RowsAffected()
-		inserted += n
+		users = append(users, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
 	}
 
-	return inserted, tx.Commit()
-}
-
-// AggregatedUsage represents aggregated usage data
-type AggregatedUsage struct {
-	Period              string
-	InputTokens         int64
-	OutputTokens        int64
-	CacheCreationTokens int64
-	CacheReadTokens     int64
-	Cost                float64
-}
-
-// clampDay returns the billing day clamped to the last day of the given month
-func clampDay(year int, month time.Month, day int) int {
-	// Get last day of month by going to next month day 0
-	lastDay := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
-	if day > lastDay {
-		return lastDay
+	for _, u := range users {
+		if err := migrateModelSummariesFill(tx, u.ID, u.BillingDay, u.Location(), u.prunedBefore.Time); err != nil {
+			return err
+		}
 	}
-	return day
+	return nil
 }
 
-// GetBillingPeriod calculates the current billing period based on billing day
-// Returns (periodStart, periodEnd) dates. If billingDay is 0, returns zero times.
-// Handles months with fewer days by clamping (e.g., day 31 in Feb becomes Feb 28/29)
-func GetBillingPeriod(billingDay int) (time.Time, time.Time) {
-	if billingDay <= 0 || billingDay > 31 {
-		return time.Time{}, time.Time{}
+// migrateModelSummariesFill fills in a user's day, month and cycle model
+// summaries from raw records for migrateAddModelSummaries, with keys as they
+// were then. Like migrateCycleKeysRebuild, it doesn't call the live summary
+// code. Periods starting before prunedBefore are skipped: part of their
+// records are gone, so their model totals would fall short of their summary.
+func migrateModelSummariesFill(tx *sql.Tx, userID string, billingDay int, loc *time.Location, prunedBefore time.Time) error {
+	rows, err := tx.Query(`
+		SELECT timestamp, model, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, COALESCE(cost, 0)
+		FROM usage_records
+		WHERE user_id = ?
+	`, userID)
+	if err != nil {
+		return err
 	}
 
-	now := time.Now()
-	year, month, day := now.Date()
+	type period struct {
+		periodType, key, model                  string
+		start, end                              time.Time
+		input, output, cacheCreation, cacheRead int64
+		cost                                    float64
+	}
+	periods := make(map[[3]string]*period)
+	for rows.Next() {
+		var ts time.Time
+		var model string
+		var input, output, cacheCreation, cacheRead int64
+		var cost float64
+		if err := rows.Scan(&ts, &model, &input, &output, &cacheCreation, &cacheRead, &cost); err != nil {
+			rows.Close()
+			return err
+		}
 
-	// Calculate period start - clamp to valid day for the month
-	var periodStart time.Time
-	if day >= clampDay(year, month, billingDay) {
-		// Current period started this month
-		clampedDay := clampDay(year, month, billingDay)
-		periodStart = time.Date(year, month, clampedDay, 0, 0, 0, 0, now.Location())
-	} else {
-		// Current period started last month
-		prevMonth := month - 1
-		prevYear := year
-		if prevMonth < 1 {
-			prevMonth = 12
-			prevYear--
+		t := ts.In(loc)
+		dayStart := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		monthStart := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+		candidates := []period{
+			{periodType: "day", key: t.Format("2006-01-02"), start: dayStart, end: dayStart.AddDate(0, 0, 1)},
+			{periodType: "month", key: t.Format("2006-01"), start: monthStart, end: monthStart.AddDate(0, 1, 0)},
+		}
+		if billing.ValidDay(billingDay) {
+			cycleStart, cycleEnd := billing.PeriodFor(billingDay, t)
+			candidates = append(candidates, period{periodType: "cycle", key: cycleStart.Format("2006-01-02"), start: cycleStart, end: cycleEnd})
 		}
-		clampedDay := clampDay(prevYear, prevMonth, billingDay)
-		periodStart = time.Date(prevYear, prevMonth, clampedDay, 0, 0, 0, 0, now.Location())
-	}
 
-	// Period end is one month after start, also clamped
-	endYear, endMonth := year, month+1
-	if day < clampDay(year, month, billingDay) {
-		endMonth = month
+		for _, c := range candidates {
+			if c.start.Before(prunedBefore) {
+				continue
+			}
+			k := [3]string{c.periodType, c.key, model}
+			p := periods[k]
+			if p == nil {
+				c.model = model
+				p = &c
+				periods[k] = p
+			}
+			p.input += input
+			p.output += output
+			p.cacheCreation += cacheCreation
+			p.cacheRead += cacheRead
+			p.cost += cost
+		}
 	}
-	if endMonth > 12 {
-		endMonth = 1
-		endYear++
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
 	}
-	clampedEndDay := clampDay(endYear, endMonth, billingDay)
-	periodEnd := time.Date(endYear, endMonth, clampedEndDay, 0, 0, 0, 0, now.Location()).Add(-time.Second)
 
-	return periodStart, periodEnd
+	for _, p := range periods {
+		if _, err := tx.Exec(`
+			INSERT INTO usage_summary_by_model
+			(user_id, period_type, period_key, model, period_start, period_end, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, userID, p.periodType, p.key, p.model, p.start.UTC(), p.end.Add(-time.Second).UTC(),
+			p.input, p.output, p.cacheCreation, p.cacheRead, p.cost); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// GetUsageByDay returns daily usage for a user, optionally filtered by billing period
-func (db *DB) GetUsageByDay(userID string, billingDay int) ([]AggregatedUsage, error) {
-	now := time.Now()
-	today := now.Format("2006-01-02")
-	periodStart, _ := GetBillingPeriod(billingDay)
+// migrateAddDefaultView adds the per-user default dashboard view
+func migrateAddDefaultView(tx *sql.Tx) error {
+	return addColumn(tx, "users", "default_view", "TEXT NOT NULL DEFAULT ''")
+}
 
-	var results []AggregatedUsage
+// migrateAddRecordTags adds the tag a client synced each record under
+func migrateAddRecordTags(tx *sql.Tx) error {
+	return addColumn(tx, "usage_records", "tag", "TEXT NOT NULL DEFAULT ''")
+}
 
-	// Get completed days from summary table
-	summaryQuery := `
-		SELECT period_key, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost
-		FROM usage_summary
-		WHERE user_id = ? AND period_type = 'day' AND period_key != ?
-	`
-	args := []interface{}{userID, today}
-	if !periodStart.IsZero() {
-		summaryQuery += ` AND period_start >= ?`
-		args = append(args, periodStart)
-	}
-	summaryQuery += ` ORDER BY period_key DESC LIMIT 30`
+// migrateAddAPIKeyLastUsed adds when each user's API key was last used
+func migrateAddAPIKeyLastUsed(tx *sql.Tx) error {
+	return addColumn(tx, "users", "last_api_use_at", "TIMESTAMP")
+}
 
-	rows, err := db.Query(summaryQuery, args...)
+// migrateFillSessionIDs gives records stored without a session ID the ID
+// they're now synced under, so syncing them again doesn't add them twice
+func migrateFillSessionIDs(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, project_path, input_tokens, output_tokens,
+		cache_creation_tokens, cache_read_tokens FROM usage_records WHERE session_id = ''`)
+	if err != nil {
+		return err
+	}
+	var records []UsageRecord
+	for rows.Next() {
+		var r UsageRecord
+		if err := rows.Scan(&r.ID, &r.ProjectPath, &r.InputTokens, &r.OutputTokens, &r.CacheCreationTokens, &r.CacheReadTokens); err != nil {
+			rows.Close()
+			return err
+		}
+		records = append(records, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		if _, err := tx.Exec(`UPDATE usage_records SET session_id = ? WHERE id = ?`, r.SessionIDOrDerived(), r.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateAddShareLinks adds the tokens for read-only shared dashboards
+func migrateAddShareLinks(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS share_links (
+		token TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_share_links_user ON share_links(user_id);
+	`)
+	return err
+}
+
+// migrateAddWeekSummaries fills in week summaries, which earlier versions
+// didn't keep, for every week not wholly pruned
+func migrateAddWeekSummaries(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, timezone, pruned_before FROM users`)
+	if err != nil {
+		return err
+	}
+
+	type user struct {
+		User
+		prunedBefore sql.NullTime
+	}
+	var users []user
+	for rows.Next() {
+		var u user
+		if err := rows.Scan(&u.ID, &u.Timezone, &u.prunedBefore); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		for _, table := range []string{"usage_summary", "usage_summary_by_model"} {
+			if err := migrateWeekSummariesFill(tx, table, u.ID, u.Location(), u.prunedBefore.Time); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateWeekSummariesFill sums a user's day summaries in table into week
+// summaries for migrateAddWeekSummaries. Pruned days keep their summaries,
+// so this covers weeks straddling the pruned boundary too. Like
+// migrateCycleKeysRebuild, it doesn't call the live summary code.
+func migrateWeekSummariesFill(tx *sql.Tx, table, userID string, loc *time.Location, prunedBefore time.Time) error {
+	// Both tables have the same columns but for the model
+	modelColumn := "''"
+	if table == "usage_summary_by_model" {
+		modelColumn = "model"
+	}
+
+	rows, err := tx.Query(fmt.Sprintf(`
+		SELECT period_key, %s, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, COALESCE(cost, 0)
+		FROM %s
+		WHERE user_id = ? AND period_type = 'day'
+	`, modelColumn, table), userID)
+	if err != nil {
+		return err
+	}
+
+	type week struct {
+		start                                   time.Time
+		model                                   string
+		input, output, cacheCreation, cacheRead int64
+		cost                                    float64
+	}
+	weeks := make(map[[2]string]*week)
+	for rows.Next() {
+		var day, model string
+		var input, output, cacheCreation, cacheRead int64
+		var cost float64
+		if err := rows.Scan(&day, &model, &input, &output, &cacheCreation, &cacheRead, &cost); err != nil {
+			rows.Close()
+			return err
+		}
+
+		t, err := time.ParseInLocation("2006-01-02", day, loc)
+		if err != nil {
+			continue
+		}
+		start := t.AddDate(0, 0, -((int(t.Weekday()) + 6) % 7)) // Monday
+		if !start.AddDate(0, 0, 7).After(prunedBefore) {
+			continue
+		}
+
+		k := [2]string{start.Format("2006-01-02"), model}
+		w := weeks[k]
+		if w == nil {
+			w = &week{start: start, model: model}
+			weeks[k] = w
+		}
+		w.input += input
+		w.output += output
+		w.cacheCreation += cacheCreation
+		w.cacheRead += cacheRead
+		w.cost += cost
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for k, w := range weeks {
+		end := w.start.AddDate(0, 0, 7).Add(-time.Second)
+		var err error
+		if table == "usage_summary_by_model" {
+			_, err = tx.Exec(`
+				INSERT INTO usage_summary_by_model
+				(user_id, period_type, period_key, model, period_start, period_end, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost)
+				VALUES (?, 'week', ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			`, userID, k[0], w.model, w.start.UTC(), end.UTC(), w.input, w.output, w.cacheCreation, w.cacheRead, w.cost)
+		} else {
+			_, err = tx.Exec(`
+				INSERT INTO usage_summary
+				(user_id, period_type, period_key, period_start, period_end, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost)
+				VALUES (?, 'week', ?, ?, ?, ?, ?, ?, ?, ?)
+			`, userID, k[0], w.start.UTC(), end.UTC(), w.input, w.output, w.cacheCreation, w.cacheRead, w.cost)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumn adds a column unless it already exists, which it may for
+// databases upgraded before versioned migrations
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	var count int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// Migrate applies pending migrations, recording each in schema_migrations
+func (db *DB) Migrate() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	current, err := db.AppliedSchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for version := current + 1; version <= len(migrations); version++ {
+		if err := db.applyMigration(version); err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+	}
+
+	return nil
+}
+
+// applyMigration runs a single migration and records it in one transaction
+func (db *DB) applyMigration(version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := migrations[version-1](tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AppliedSchemaVersion returns the latest migration applied to the database
+func (db *DB) AppliedSchemaVersion() (int, error) {
+	var version int
+	err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// CreateUser creates a new user
+func (db *DB) CreateUser(user *User) error {
+	_, err := db.Exec(
+		`INSERT INTO users (id, username, password_hash, api_key, billing_day, timezone, default_view, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.ID, user.Username, user.PasswordHash, user.APIKey, user.BillingDay, user.Timezone, user.DefaultView, user.CreatedAt,
+	)
+	return err
+}
+
+// userColumns are the users columns scanUser reads, in order
+const userColumns = `id, username, password_hash, api_key, billing_day, timezone, default_view, created_at, last_api_use_at`
+
+// scanUser reads a user selected with userColumns, or nil if there's no such
+// user
+func scanUser(row *sql.Row) (*User, error) {
+	user := &User{}
+	var lastAPIUse sql.NullTime
+	err := row.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.APIKey, &user.BillingDay, &user.Timezone, &user.DefaultView, &user.CreatedAt, &lastAPIUse)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if lastAPIUse.Valid {
+		user.LastAPIUseAt = &lastAPIUse.Time
+	}
+	return user, nil
+}
+
+// GetUserByUsername retrieves a user by username
+func (db *DB) GetUserByUsername(username string) (*User, error) {
+	return scanUser(db.QueryRow(
+		`SELECT `+userColumns+` FROM users WHERE username = ?`,
+		username,
+	))
+}
+
+// GetUserByID retrieves a user by ID
+func (db *DB) GetUserByID(id string) (*User, error) {
+	return scanUser(db.QueryRow(
+		`SELECT `+userColumns+` FROM users WHERE id = ?`,
+		id,
+	))
+}
+
+// GetUserByAPIKey retrieves a user by API key
+func (db *DB) GetUserByAPIKey(apiKey string) (*User, error) {
+	return scanUser(db.QueryRow(
+		`SELECT `+userColumns+` FROM users WHERE api_key = ?`,
+		apiKey,
+	))
+}
+
+// TouchAPIKeyUse records that a user's API key was used at now, unless that
+// was already recorded within APIKeyUseInterval
+func (db *DB) TouchAPIKeyUse(userID string, now time.Time) error {
+	_, err := db.Exec(
+		`UPDATE users SET last_api_use_at = ? WHERE id = ? AND (last_api_use_at IS NULL OR last_api_use_at <= ?)`,
+		now.UTC(), userID, now.Add(-APIKeyUseInterval).UTC(),
+	)
+	return err
+}
+
+// UpdateUserBillingDay updates a user's billing day
+func (db *DB) UpdateUserBillingDay(userID string, billingDay int) error {
+	_, err := db.Exec(`UPDATE users SET billing_day = ? WHERE id = ?`, billingDay, userID)
+	return err
+}
+
+// UpdateUserTimezone updates a user's timezone
+func (db *DB) UpdateUserTimezone(userID, timezone string) error {
+	_, err := db.Exec(`UPDATE users SET timezone = ? WHERE id = ?`, timezone, userID)
+	return err
+}
+
+// UpdateUserDefaultView updates a user's default dashboard view
+func (db *DB) UpdateUserDefaultView(userID, view string) error {
+	_, err := db.Exec(`UPDATE users SET default_view = ? WHERE id = ?`, view, userID)
+	return err
+}
+
+// GetOrCreateClient gets an existing client or creates a new one
+func (db *DB) GetOrCreateClient(userID, clientID, clientName string) (*Client, error) {
+	// Try to get existing client
+	client := &Client{}
+	var lastSyncAt sql.NullTime
+	err := db.QueryRow(
+		`SELECT id, user_id, name, last_sync_at, created_at FROM clients WHERE id = ? AND user_id = ?`,
+		clientID, userID,
+	).Scan(&client.ID, &client.UserID, &client.Name, &lastSyncAt, &client.CreatedAt)
+
+	if err == nil {
+		if lastSyncAt.Valid {
+			client.LastSyncAt = &lastSyncAt.Time
+		}
+		return client, nil
+	}
+
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	// Create new client
+	now := time.Now()
+	_, err = db.Exec(
+		`INSERT INTO clients (id, user_id, name, created_at) VALUES (?, ?, ?, ?)`,
+		clientID, userID, clientName, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		ID:        clientID,
+		UserID:    userID,
+		Name:      clientName,
+		CreatedAt: now,
+	}, nil
+}
+
+// GetClients returns a user's sync clients, most recently synced first
+func (db *DB) GetClients(userID string) ([]Client, error) {
+	rows, err := db.Query(`
+		SELECT id, user_id, name, last_sync_at, created_at
+		FROM clients
+		WHERE user_id = ?
+		ORDER BY last_sync_at IS NULL, last_sync_at DESC, created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clients []Client
+	for rows.Next() {
+		var c Client
+		var lastSyncAt sql.NullTime
+		if err := rows.Scan(&c.ID, &c.UserID, &c.Name, &lastSyncAt, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		if lastSyncAt.Valid {
+			c.LastSyncAt = &lastSyncAt.Time
+		}
+		clients = append(clients, c)
+	}
+	return clients, rows.Err()
+}
+
+// UpdateClientLastSync updates the last sync time for a client
+func (db *DB) UpdateClientLastSync(clientID string, lastSyncAt time.Time) error {
+	_, err := db.Exec(`UPDATE clients SET last_sync_at = ? WHERE id = ?`, lastSyncAt, clientID)
+	return err
+}
+
+// CreateShareLink adds a share link for a user
+func (db *DB) CreateShareLink(userID, token string) error {
+	_, err := db.Exec(`INSERT INTO share_links (token, user_id, created_at) VALUES (?, ?, ?)`, token, userID, time.Now())
+	return err
+}
+
+// GetShareLinks returns a user's share links, newest first
+func (db *DB) GetShareLinks(userID string) ([]ShareLink, error) {
+	rows, err := db.Query(`
+		SELECT token, user_id, created_at
+		FROM share_links
+		WHERE user_id = ?
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []ShareLink
+	for rows.Next() {
+		var l ShareLink
+		if err := rows.Scan(&l.Token, &l.UserID, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+// DeleteShareLink revokes one of a user's share links, reporting whether it existed
+func (db *DB) DeleteShareLink(userID, token string) (bool, error) {
+	result, err := db.Exec(`DELETE FROM share_links WHERE token = ? AND user_id = ?`, token, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// GetUserByShareToken retrieves the user a share link belongs to, or nil if
+// the link doesn't exist or was revoked
+func (db *DB) GetUserByShareToken(token string) (*User, error) {
+	return scanUser(db.QueryRow(
+		`SELECT `+userColumns+` FROM users WHERE id = (SELECT user_id FROM share_links WHERE token = ?)`,
+		token,
+	))
+}
+
+// InsertUsageRecords inserts multiple usage records, ignoring duplicates
+func (db *DB) InsertUsageRecords(records []UsageRecord) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT OR IGNORE INTO usage_records
+		(user_id, client_id, timestamp, session_id, project_path, model,
+		 input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost, tag)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	// Records older than a user's pruned boundary would only be counted
+	// twice, since their periods are already summarized. It's read in tx, so
+	// a prune can't move it before the records are inserted.
+	cutoffs := make(map[string]time.Time)
+
+	var inserted int64
+	for _, r := range records {
+		cutoff, ok := cutoffs[r.UserID]
+		if !ok {
+			cutoff = prunedBefore(tx, r.UserID)
+			cutoffs[r.UserID] = cutoff
+		}
+		if r.Timestamp.Before(cutoff) {
+			continue
+		}
+
+		// Calculate cost using shared pricing module
+		modelPricing := pricing.GetPricing(r.Model, true) // offline mode for server
+		cost := pricing.CalculateCost(model.TokenUsage{
+			InputTokens:              r.InputTokens,
+			OutputTokens:             r.OutputTokens,
+			CacheCreationInputTokens: r.CacheCreationTokens,
+			CacheReadInputTokens:     r.CacheReadTokens,
+		}, modelPricing)
+		// Store UTC so timestamps compare correctly as text
+		result, err := stmt.Exec(
+			r.UserID, r.ClientID, r.Timestamp.UTC(), r.SessionID, r.ProjectPath, r.Model,
+			r.InputTokens, r.OutputTokens, r.CacheCreationTokens, r.CacheReadTokens, cost, r.Tag,
+		)
+		if err != nil {
+			return 0, err
+		}
+		n, _ := result.RowsAffected()
+		inserted += n
+	}
+
+	return inserted, tx.Commit()
+}
+
+// AdjustmentModel and AdjustmentClientID mark a manual cost adjustment, such
+// as a credit. It's stored as a usage record with no tokens and the adjusted
+// cost, so every summary nets it in.
+const (
+	AdjustmentModel    = "adjustment"
+	AdjustmentClientID = "adjustment"
+)
+
+// InsertAdjustment records a manual cost adjustment for a user at t, negative
+// for a credit, and updates the summaries of the periods containing it. id
+// tells adjustments at the same time apart.
+func (db *DB) InsertAdjustment(userID, id string, t time.Time, amount float64) error {
+	user, err := db.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("user not found")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	record := UsageRecord{UserID: userID, ClientID: AdjustmentClientID, Timestamp: t, SessionID: id, Model: AdjustmentModel}
+	_, err = tx.Exec(`
+		INSERT INTO usage_records
+		(user_id, client_id, timestamp, session_id, project_path, model,
+		 input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost, tag)
+		VALUES (?, ?, ?, ?, '', ?, 0, 0, 0, 0, ?, '')
+	`, record.UserID, record.ClientID, record.Timestamp.UTC(), record.SessionID, record.Model, amount)
+	if err != nil {
+		return err
+	}
+
+	if err := updateSummaries(tx, userID, user.Location(), prunedBefore(tx, userID), []UsageRecord{record}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AggregatedUsage represents aggregated usage data
+type AggregatedUsage struct {
+	Period              string
+	Model               string // Set for per-model usage
+	Tag                 string // Set for per-tag usage; UntaggedLabel for untagged records
+	InputTokens         int64
+	OutputTokens        int64
+	CacheCreationTokens int64
+	CacheReadTokens     int64
+	Cost                float64
+	CacheSavings        float64 // What cache reads would have cost as input, less what they cost; set on totals
+}
+
+// cycleKey returns the summary key for a billing cycle. It includes the year so
+// the same cycle dates in different years don't overwrite each other.
+func cycleKey(start time.Time) string {
+	return start.Format("2006-01-02")
+}
+
+// cycleLabel formats a billing cycle for display
+func cycleLabel(start, end time.Time) string {
+	return start.Format("Jan 2") + " – " + end.Format("Jan 2")
+}
+
+// dayBounds returns the start of t's day and the start of the next day, in t's location
+func dayBounds(t time.Time) (time.Time, time.Time) {
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return start, start.AddDate(0, 0, 1)
+}
+
+// weekBounds returns the start of t's week (Monday, as in ISO weeks) and the
+// start of the next week, in t's location
+func weekBounds(t time.Time) (time.Time, time.Time) {
+	offset := (int(t.Weekday()) + 6) % 7
+	start := time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, t.Location())
+	return start, start.AddDate(0, 0, 7)
+}
+
+// monthBounds returns the start of t's month and the start of the next month, in t's location
+func monthBounds(t time.Time) (time.Time, time.Time) {
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	return start, start.AddDate(0, 1, 0)
+}
+
+// execer is implemented by both *DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// sumRecords sums raw usage records in [from, to). Timestamps are stored in UTC,
+// so bounds are converted to UTC for the (string) comparison.
+func sumRecords(q execer, userID string, from, to time.Time) (AggregatedUsage, error) {
+	var u AggregatedUsage
+	err := q.QueryRow(`
+		SELECT COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0),
+		       COALESCE(SUM(cache_creation_tokens), 0), COALESCE(SUM(cache_read_tokens), 0),
+		       COALESCE(SUM(cost), 0)
+		FROM usage_records
+		WHERE user_id = ? AND timestamp >= ? AND timestamp < ?
+	`, userID, from.UTC(), to.UTC()).Scan(&u.InputTokens, &u.OutputTokens, &u.CacheCreationTokens, &u.CacheReadTokens, &u.Cost)
+	return u, err
+}
+
+// Limits on how many completed days and months usage queries return
+const (
+	DefaultDayLimit   = 30
+	MaxDayLimit       = 366
+	DefaultWeekLimit  = 12
+	MaxWeekLimit      = 260
+	DefaultMonthLimit = 12
+	MaxMonthLimit     = 120
+)
+
+// hasUsage reports whether u has any tokens or cost, including an adjustment
+// with no tokens
+func (u AggregatedUsage) hasUsage() bool {
+	return u.InputTokens > 0 || u.OutputTokens > 0 || u.Cost != 0
+}
+
+// clampLimit returns limit bounded to ceiling, or def if limit isn't positive
+func clampLimit(limit, def, ceiling int) int {
+	if limit <= 0 {
+		return def
+	}
+	return min(limit, ceiling)
+}
+
+// GetUsageByDay returns daily usage for a user in their timezone, optionally filtered by billing period.
+// At most limit completed days are returned besides today (0 = DefaultDayLimit, capped at MaxDayLimit).
+func (db *DB) GetUsageByDay(userID string, billingDay int, loc *time.Location, limit int) ([]AggregatedUsage, error) {
+	now := time.Now().In(loc)
+	today := now.Format("2006-01-02")
+	periodStart, _ := billing.CurrentPeriod(billingDay, now)
+
+	var results []AggregatedUsage
+
+	// Get completed days from summary table
+	summaryQuery := `
+		SELECT period_key, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost
+		FROM usage_summary
+		WHERE user_id = ? AND period_type = 'day' AND period_key != ?
+	`
+	args := []interface{}{userID, today}
+	if !periodStart.IsZero() {
+		summaryQuery += ` AND period_start >= ?`
+		args = append(args, periodStart.UTC())
+	}
+	summaryQuery += ` ORDER BY period_key DESC LIMIT ?`
+	args = append(args, clampLimit(limit, DefaultDayLimit, MaxDayLimit))
+
+	rows, err := db.Query(summaryQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u AggregatedUsage
+		if err := rows.Scan(&u.Period, &u.InputTokens, &u.OutputTokens, &u.CacheCreationTokens, &u.CacheReadTokens, &u.Cost); err != nil {
+			return nil, err
+		}
+		results = append(results, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Get today's data from raw records
+	dayStart, dayEnd := dayBounds(now)
+	todayUsage, err := sumRecords(db, userID, dayStart, dayEnd)
+	if err != nil {
+		return nil, err
+	}
+	todayUsage.Period = today
+
+	// Only include today if there's data
+	if todayUsage.hasUsage() {
+		results = append([]AggregatedUsage{todayUsage}, results...)
+	}
+
+	return results, nil
+}
+
+// GetUsageByWeek returns weekly usage for a user in their timezone, keyed by
+// the Monday each week starts on. At most limit completed weeks are returned
+// besides the current one (0 = DefaultWeekLimit, capped at MaxWeekLimit).
+func (db *DB) GetUsageByWeek(userID string, loc *time.Location, limit int) ([]AggregatedUsage, error) {
+	now := time.Now().In(loc)
+	weekStart, weekEnd := weekBounds(now)
+	currentWeek := weekStart.Format("2006-01-02")
+
+	var results []AggregatedUsage
+
+	// Get completed weeks from summary table
+	rows, err := db.Query(`
+		SELECT period_key, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost
+		FROM usage_summary
+		WHERE user_id = ? AND period_type = 'week' AND period_key != ?
+		ORDER BY period_key DESC
+		LIMIT ?
+	`, userID, currentWeek, clampLimit(limit, DefaultWeekLimit, MaxWeekLimit))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u AggregatedUsage
+		if err := rows.Scan(&u.Period, &u.InputTokens, &u.OutputTokens, &u.CacheCreationTokens, &u.CacheReadTokens, &u.Cost); err != nil {
+			return nil, err
+		}
+		results = append(results, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Get current week's data from raw records
+	currentUsage, err := sumRecords(db, userID, weekStart, weekEnd)
+	if err != nil {
+		return nil, err
+	}
+	currentUsage.Period = currentWeek
+
+	// Only include current week if there's data
+	if currentUsage.hasUsage() {
+		results = append([]AggregatedUsage{currentUsage}, results...)
+	}
+
+	return results, nil
+}
+
+// GetUsageByBillingCycle returns usage grouped by billing cycles in the user's timezone
+func (db *DB) GetUsageByBillingCycle(userID string, billingDay int, loc *time.Location) ([]AggregatedUsage, error) {
+	if !billing.ValidDay(billingDay) {
+		return nil, nil
+	}
+
+	// Get current cycle info
+	cycleStart, cycleEnd := billing.PeriodFor(billingDay, time.Now().In(loc))
+	currentCycleKey := cycleKey(cycleStart)
+
+	var results []AggregatedUsage
+
+	// Get completed cycles from summary table (where period_end < now)
+	rows, err := db.Query(`
+		SELECT period_start, period_end, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost
+		FROM usage_summary
+		WHERE user_id = ? AND period_type = 'cycle' AND period_key != ?
+		ORDER BY period_start DESC
+	`, userID, currentCycleKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u AggregatedUsage
+		var start, end time.Time
+		if err := rows.Scan(&start, &end, &u.InputTokens, &u.OutputTokens, &u.CacheCreationTokens, &u.CacheReadTokens, &u.Cost); err != nil {
+			return nil, err
+		}
+		u.Period = cycleLabel(start.In(loc), end.In(loc))
+		results = append(results, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Get current cycle's data from raw records
+	currentUsage, err := sumRecords(db, userID, cycleStart, cycleEnd)
+	if err != nil {
+		return nil, err
+	}
+	currentUsage.Period = cycleLabel(cycleStart, cycleEnd.Add(-time.Second))
+
+	// Only include current cycle if there's data
+	if currentUsage.hasUsage() {
+		results = append([]AggregatedUsage{currentUsage}, results...)
+	}
+
+	return results, nil
+}
+
+// GetUsageByMonth returns monthly usage for a user in their timezone. At most
+// limit completed months are returned besides the current one
+// (0 = DefaultMonthLimit, capped at MaxMonthLimit).
+func (db *DB) GetUsageByMonth(userID string, loc *time.Location, limit int) ([]AggregatedUsage, error) {
+	now := time.Now().In(loc)
+	currentMonth := now.Format("2006-01")
+
+	var results []AggregatedUsage
+
+	// Get completed months from summary table
+	rows, err := db.Query(`
+		SELECT period_key, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost
+		FROM usage_summary
+		WHERE user_id = ? AND period_type = 'month' AND period_key != ?
+		ORDER BY period_key DESC
+		LIMIT ?
+	`, userID, currentMonth, clampLimit(limit, DefaultMonthLimit, MaxMonthLimit))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u AggregatedUsage
+		if err := rows.Scan(&u.Period, &u.InputTokens, &u.OutputTokens, &u.CacheCreationTokens, &u.CacheReadTokens, &u.Cost); err != nil {
+			return nil, err
+		}
+		results = append(results, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Get current month's data from raw records
+	monthStart, monthEnd := monthBounds(now)
+	currentUsage, err := sumRecords(db, userID, monthStart, monthEnd)
+	if err != nil {
+		return nil, err
+	}
+	currentUsage.Period = currentMonth
+
+	// Only include current month if there's data
+	if currentUsage.hasUsage() {
+		results = append([]AggregatedUsage{currentUsage}, results...)
+	}
+
+	return results, nil
+}
+
+// GetUsageInRange returns a user's usage per day, week or month (periodType
+// "day", "week" or "month") in their timezone, for every period overlapping
+// [from, to], oldest first. A zero from or to leaves that end open. Unlike
+// GetUsageByDay and friends, there's no limit on how many periods are
+// returned. The current period is summed from raw records, as elsewhere.
+func (db *DB) GetUsageInRange(userID, periodType string, loc *time.Location, from, to time.Time) ([]AggregatedUsage, error) {
+	now := time.Now().In(loc)
+	var currentStart, currentEnd time.Time
+	var currentKey string
+	switch periodType {
+	case "day":
+		currentStart, currentEnd = dayBounds(now)
+		currentKey = currentStart.Format("2006-01-02")
+	case "week":
+		currentStart, currentEnd = weekBounds(now)
+		currentKey = currentStart.Format("2006-01-02")
+	case "month":
+		currentStart, currentEnd = monthBounds(now)
+		currentKey = currentStart.Format("2006-01")
+	default:
+		return nil, fmt.Errorf("unknown period type %q", periodType)
+	}
+
+	// Completed periods from the summary table. period_end is a period's
+	// last second.
+	query := `
+		SELECT period_key, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost
+		FROM usage_summary
+		WHERE user_id = ? AND period_type = ? AND period_key != ?
+	`
+	args := []interface{}{userID, periodType, currentKey}
+	if !from.IsZero() {
+		query += ` AND period_end >= ?`
+		args = append(args, from.UTC())
+	}
+	if !to.IsZero() {
+		query += ` AND period_start <= ?`
+		args = append(args, to.UTC())
+	}
+	query += ` ORDER BY period_start`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []AggregatedUsage
+	for rows.Next() {
+		var u AggregatedUsage
+		if err := rows.Scan(&u.Period, &u.InputTokens, &u.OutputTokens, &u.CacheCreationTokens, &u.CacheReadTokens, &u.Cost); err != nil {
+			return nil, err
+		}
+		results = append(results, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The current period, if it overlaps the range
+	if (!from.IsZero() && !currentEnd.After(from)) || (!to.IsZero() && currentStart.After(to)) {
+		return results, nil
+	}
+	currentUsage, err := sumRecords(db, userID, currentStart, currentEnd)
+	if err != nil {
+		return nil, err
+	}
+	currentUsage.Period = currentKey
+	if currentUsage.hasUsage() {
+		results = append(results, currentUsage)
+	}
+
+	return results, nil
+}
+
+// GetUsageByModel returns per-model usage for the current billing cycle in
+// the user's timezone, or the current month if no billing day is set.
+// Period holds the cycle or month label; rows are sorted by cost.
+func (db *DB) GetUsageByModel(userID string, billingDay int, loc *time.Location) ([]AggregatedUsage, error) {
+	now := time.Now().In(loc)
+
+	periodType, key, label := "month", now.Format("2006-01"), now.Format("2006-01")
+	if billing.ValidDay(billingDay) {
+		start, end := billing.CurrentPeriod(billingDay, now)
+		periodType, key, label = "cycle", cycleKey(start), cycleLabel(start, end)
+	}
+
+	rows, err := db.Query(`
+		SELECT model, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost
+		FROM usage_summary_by_model
+		WHERE user_id = ? AND period_type = ? AND period_key = ?
+		ORDER BY cost DESC, model
+	`, userID, periodType, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []AggregatedUsage
+	for rows.Next() {
+		u := AggregatedUsage{Period: label}
+		if err := rows.Scan(&u.Model, &u.InputTokens, &u.OutputTokens, &u.CacheCreationTokens, &u.CacheReadTokens, &u.Cost); err != nil {
+			return nil, err
+		}
+		results = append(results, u)
+	}
+	return results, rows.Err()
+}
+
+// UntaggedLabel is the tag shown for records synced without one
+const UntaggedLabel = "(untagged)"
+
+// GetUsageByTag returns usage per sync tag in the current month, or the
+// current billing cycle if a billing day is set, ordered by cost. It's
+// summed from raw records, which retention never prunes from the current
+// period.
+func (db *DB) GetUsageByTag(userID string, billingDay int, loc *time.Location) ([]AggregatedUsage, error) {
+	now := time.Now().In(loc)
+
+	start, end := monthBounds(now)
+	label := now.Format("2006-01")
+	if billing.ValidDay(billingDay) {
+		start, end = billing.PeriodFor(billingDay, now)
+		label = cycleLabel(start, end.Add(-time.Second))
+	}
+
+	rows, err := db.Query(`
+		SELECT tag, SUM(input_tokens), SUM(output_tokens), SUM(cache_creation_tokens), SUM(cache_read_tokens), SUM(cost)
+		FROM usage_records
+		WHERE user_id = ? AND timestamp >= ? AND timestamp < ?
+		GROUP BY tag
+		ORDER BY SUM(cost) DESC, tag
+	`, userID, start.UTC(), end.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []AggregatedUsage
+	for rows.Next() {
+		u := AggregatedUsage{Period: label}
+		if err := rows.Scan(&u.Tag, &u.InputTokens, &u.OutputTokens, &u.CacheCreationTokens, &u.CacheReadTokens, &u.Cost); err != nil {
+			return nil, err
+		}
+		if u.Tag == "" {
+			u.Tag = UntaggedLabel
+		}
+		results = append(results, u)
+	}
+	return results, rows.Err()
+}
+
+// GetMonthlyModelBreakdown returns per-model usage for every month in the
+// user's timezone, including the current one. Rows are ordered newest month
+// first, then by cost; Period holds the month.
+func (db *DB) GetMonthlyModelBreakdown(userID string) ([]AggregatedUsage, error) {
+	rows, err := db.Query(`
+		SELECT period_key, model, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost
+		FROM usage_summary_by_model
+		WHERE user_id = ? AND period_type = 'month'
+		ORDER BY period_key DESC, cost DESC, model
+	`, userID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	var results []AggregatedUsage
 	for rows.Next() {
 		var u AggregatedUsage
-		if err := rows.Scan(&u.Period, &u.InputTokens, &u.OutputTokens, &u.CacheCreationTokens, &u.CacheReadTokens, &u.Cost); err != nil {
+		if err := rows.Scan(&u.Period, &u.Model, &u.InputTokens, &u.OutputTokens, &u.CacheCreationTokens, &u.CacheReadTokens, &u.Cost); err != nil {
 			return nil, err
 		}
 		results = append(results, u)
 	}
+	return results, rows.Err()
+}
+
+// GetClientUsageByMonth returns one client's usage by month in loc, newest
+// first, summed from raw records, so it can be reconciled with the client's
+// own logs. Months before PrunedBefore only count records that remain.
+func (db *DB) GetClientUsageByMonth(userID, clientID string, loc *time.Location) ([]AggregatedUsage, error) {
+	rows, err := db.Query(`
+		SELECT timestamp, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost
+		FROM usage_records
+		WHERE user_id = ? AND client_id = ?
+	`, userID, clientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byMonth := make(map[string]*AggregatedUsage)
+	for rows.Next() {
+		var ts time.Time
+		var r AggregatedUsage
+		if err := rows.Scan(&ts, &r.InputTokens, &r.OutputTokens, &r.CacheCreationTokens, &r.CacheReadTokens, &r.Cost); err != nil {
+			return nil, err
+		}
+		key := ts.In(loc).Format("2006-01")
+		u, ok := byMonth[key]
+		if !ok {
+			u = &AggregatedUsage{Period: key}
+			byMonth[key] = u
+		}
+		u.InputTokens += r.InputTokens
+		u.OutputTokens += r.OutputTokens
+		u.CacheCreationTokens += r.CacheCreationTokens
+		u.CacheReadTokens += r.CacheReadTokens
+		u.Cost += r.Cost
+	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
-	// Get today's data from raw records
-	var todayUsage AggregatedUsage
-	todayUsage.Period = today
-	err = db.QueryRow(`
+	results := make([]AggregatedUsage, 0, len(byMonth))
+	for _, u := range byMonth {
+		results = append(results, *u)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Period > results[j].Period
+	})
+	return results, nil
+}
+
+// HasSummaries checks if a user has any summaries
+func (db *DB) HasSummaries(userID string) bool {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM usage_summary WHERE user_id = ? LIMIT 1", userID).Scan(&count)
+	return count > 0
+}
+
+// GetTotalUsage returns total usage for a user, optionally filtered by billing period
+func (db *DB) GetTotalUsage(userID string, billingDay int, loc *time.Location) (*AggregatedUsage, error) {
+	now := time.Now().In(loc)
+	today := now.Format("2006-01-02")
+	periodStart, _ := billing.CurrentPeriod(billingDay, now)
+
+	var u AggregatedUsage
+	u.Period = "Total"
+
+	// Sum completed days from summaries
+	summaryQuery := `
 		SELECT COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0),
 		       COALESCE(SUM(cache_creation_tokens), 0), COALESCE(SUM(cache_read_tokens), 0),
 		       COALESCE(SUM(cost), 0)
-		FROM usage_records
-		WHERE user_id = ? AND DATE(timestamp) = ?
-	`, userID, today).Scan(&todayUsage.InputTokens, &todayUsage.OutputTokens, &todayUsage.CacheCreationTokens, &todayUsage.CacheReadTokens, &todayUsage.Cost)
+		FROM usage_summary
+		WHERE user_id = ? AND period_type = 'day' AND period_key != ?
+	`
+	args := []interface{}{userID, today}
+	if !periodStart.IsZero() {
+		summaryQuery += ` AND period_start >= ?`
+		args = append(args, periodStart.UTC())
+	}
+
+	err := db.QueryRow(summaryQuery, args...).Scan(&u.InputTokens, &u.OutputTokens, &u.CacheCreationTokens, &u.CacheReadTokens, &u.Cost)
 	if err != nil {
 		return nil, err
 	}
 
-	// Only include today if there's data
-	if todayUsage.InputTokens > 0 || todayUsage.OutputTokens > 0 {
-		results = append([]AggregatedUsage{todayUsage}, results...)
+	// Add today's data from raw records
+	dayStart, dayEnd := dayBounds(now)
+	todayUsage, err := sumRecords(db, userID, dayStart, dayEnd)
+	if err != nil {
+		return nil, err
 	}
 
-	return results, nil
-}
+	u.InputTokens += todayUsage.InputTokens
+	u.OutputTokens += todayUsage.OutputTokens
+	u.CacheCreationTokens += todayUsage.CacheCreationTokens
+	u.CacheReadTokens += todayUsage.CacheReadTokens
+	u.Cost += todayUsage.Cost
 
-// GetUsageByBillingCycle returns usage grouped by billing cycles
-func (db *DB) GetUsageByBillingCycle(userID string, billingDay int) ([]AggregatedUsage, error) {
-	if billingDay <= 0 || billingDay > 31 {
-		return nil, nil
+	u.CacheSavings, err = db.cacheSavings(userID, today, periodStart, dayStart, dayEnd)
+	if err != nil {
+		return nil, err
 	}
 
-	// Get current cycle info
-	cycleStart, cycleEnd := GetBillingPeriod(billingDay)
-	currentCycleKey := cycleStart.Format("Jan 2") + " – " + cycleEnd.Format("Jan 2")
+	return &u, nil
+}
 
-	var results []AggregatedUsage
+// cacheSavings returns what a user's cache reads saved over paying full
+// input price for them, over the same span as GetTotalUsage: completed days
+// from the per-model day summaries plus today's raw records. Each model is
+// priced from the server's pricing map.
+func (db *DB) cacheSavings(userID, today string, periodStart, dayStart, dayEnd time.Time) (float64, error) {
+	query := `
+		SELECT model, SUM(cache_read_tokens) FROM (
+			SELECT model, cache_read_tokens
+			FROM usage_summary_by_model
+			WHERE user_id = ? AND period_type = 'day' AND period_key != ?`
+	args := []interface{}{userID, today}
+	if !periodStart.IsZero() {
+		query += ` AND period_start >= ?`
+		args = append(args, periodStart.UTC())
+	}
+	query += `
+			UNION ALL
+			SELECT model, cache_read_tokens
+			FROM usage_records
+			WHERE user_id = ? AND timestamp >= ? AND timestamp < ?
+		)
+		GROUP BY model
+	`
+	args = append(args, userID, dayStart.UTC(), dayEnd.UTC())
 
-	// Get completed cycles from summary table (where period_end < now)
-	rows, err := db.Query(`
-		SELECT period_key, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost
-		FROM usage_summary
-		WHERE user_id = ? AND period_type = 'cycle' AND period_key != ?
-		ORDER BY period_start DESC
-	`, userID, currentCycleKey)
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	defer rows.Close()
 
+	var savings float64
 	for rows.Next() {
-		var u AggregatedUsage
-		if err := rows.Scan(&u.Period, &u.InputTokens, &u.OutputTokens, &u.CacheCreationTokens, &u.CacheReadTokens, &u.Cost); err != nil {
-			return nil, err
+		var modelName string
+		var cacheRead int64
+		if err := rows.Scan(&modelName, &cacheRead); err != nil {
+			return 0, err
 		}
-		results = append(results, u)
+		if cacheRead == 0 {
+			continue // Nothing saved, e.g. adjustments, which have no pricing
+		}
+		p := pricing.GetPricing(modelName, true) // offline mode for server
+		savings += float64(cacheRead) * (p.InputCostPerToken - p.CacheReadCostPerToken)
 	}
-	if err := rows.Err(); err != nil {
+	return savings, rows.Err()
+}
+
+// GetClientSyncStatus returns the last sync time for a client
+func (db *DB) GetClientSyncStatus(userID, clientID string) (*time.Time, error) {
+	var lastSyncAt sql.NullTime
+	err := db.QueryRow(
+		`SELECT last_sync_at FROM clients WHERE id = ? AND user_id = ?`,
+		clientID, userID,
+	).Scan(&lastSyncAt)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
 		return nil, err
 	}
+	if !lastSyncAt.Valid {
+		return nil, nil
+	}
+	return &lastSyncAt.Time, nil
+}
 
-	// Get current cycle's data from raw records
-	var currentUsage AggregatedUsage
-	currentUsage.Period = currentCycleKey
-	err = db.QueryRow(`
-		SELECT COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0),
-		       COALESCE(SUM(cache_creation_tokens), 0), COALESCE(SUM(cache_read_tokens), 0),
-		       COALESCE(SUM(cost), 0)
-		FROM usage_records
-		WHERE user_id = ? AND timestamp >= ? AND timestamp <= ?
-	`, userID, cycleStart, cycleEnd).Scan(&currentUsage.InputTokens, &currentUsage.OutputTokens, &currentUsage.CacheCreationTokens, &currentUsage.CacheReadTokens, &currentUsage.Cost)
+// summaryPeriod is a day, week, month or billing cycle with a summary row
+type summaryPeriod struct {
+	periodType string
+	key        string
+	start, end time.Time // end is exclusive
+}
+
+// affectedPeriods returns the periods containing the given records, with
+// keys computed in loc. Cycles are only included if billingDay is set.
+func affectedPeriods(records []UsageRecord, billingDay int, loc *time.Location) []summaryPeriod {
+	seen := make(map[[2]string]bool)
+	var periods []summaryPeriod
+	add := func(p summaryPeriod) {
+		if k := [2]string{p.periodType, p.key}; !seen[k] {
+			seen[k] = true
+			periods = append(periods, p)
+		}
+	}
+
+	for _, r := range records {
+		t := r.Timestamp.In(loc)
+
+		dayStart, dayEnd := dayBounds(t)
+		add(summaryPeriod{"day", t.Format("2006-01-02"), dayStart, dayEnd})
+
+		weekStart, weekEnd := weekBounds(t)
+		add(summaryPeriod{"week", weekStart.Format("2006-01-02"), weekStart, weekEnd})
+
+		monthStart, monthEnd := monthBounds(t)
+		add(summaryPeriod{"month", t.Format("2006-01"), monthStart, monthEnd})
+
+		if billing.ValidDay(billingDay) {
+			cycleStart, cycleEnd := billing.PeriodFor(billingDay, t)
+			add(summaryPeriod{"cycle", cycleKey(cycleStart), cycleStart, cycleEnd})
+		}
+	}
+	return periods
+}
+
+// UpdateSummaries updates only the summaries affected by the given records.
+// Period keys are computed in the user's timezone.
+// Much more efficient than rebuilding all summaries.
+func (db *DB) UpdateSummaries(userID string, loc *time.Location, records []UsageRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer tx.Rollback()
 
-	// Only include current cycle if there's data
-	if currentUsage.InputTokens > 0 || currentUsage.OutputTokens > 0 {
-		results = append([]AggregatedUsage{currentUsage}, results...)
+	// Periods starting before the pruned boundary can't be recomputed from
+	// raw records. It's read in tx, so a prune can't move it meanwhile.
+	if err := updateSummaries(tx, userID, loc, prunedBefore(tx, userID), records); err != nil {
+		return err
 	}
+	return tx.Commit()
+}
 
-	return results, nil
+// updateSummaries recomputes the summaries of every period containing one of
+// records within tx. Periods left without records lose their summary.
+func updateSummaries(tx *sql.Tx, userID string, loc *time.Location, prunedBefore time.Time, records []UsageRecord) error {
+	// Upsert statement
+	stmt, err := tx.Prepare(`
+		INSERT INTO usage_summary
+		(user_id, period_type, period_key, period_start, period_end, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, period_type, period_key) DO UPDATE SET
+			period_start = excluded.period_start,
+			period_end = excluded.period_end,
+			input_tokens = excluded.input_tokens,
+			output_tokens = excluded.output_tokens,
+			cache_creation_tokens = excluded.cache_creation_tokens,
+			cache_read_tokens = excluded.cache_read_tokens,
+			cost = excluded.cost
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	// Calendar periods go first (billing day 0 leaves out cycles). Writing
+	// their summaries takes the write lock, so the billing day read for
+	// cycles can't change before commit.
+	if err := updatePeriods(tx, stmt, userID, prunedBefore, affectedPeriods(records, 0, loc)); err != nil {
+		return err
+	}
+
+	billingDay, err := storedBillingDay(tx, userID)
+	if err != nil {
+		return err
+	}
+	var cycles []summaryPeriod
+	for _, p := range affectedPeriods(records, billingDay, loc) {
+		if p.periodType == "cycle" {
+			cycles = append(cycles, p)
+		}
+	}
+	return updatePeriods(tx, stmt, userID, prunedBefore, cycles)
 }
 
-// GetUsageByMonth returns monthly usage for a user
-func (db *DB) GetUsageByMonth(userID string) ([]AggregatedUsage, error) {
-	now := time.Now()
-	currentMonth := now.Format("2006-01")
+// updatePeriods recomputes the summaries of periods within tx, upserting
+// them with stmt
+func updatePeriods(tx *sql.Tx, stmt *sql.Stmt, userID string, prunedBefore time.Time, periods []summaryPeriod) error {
+	for _, p := range periods {
+		if p.start.Before(prunedBefore) {
+			// Periods that end by prunedBefore have no records left to
+			// recompute them from, so they're kept as they are
+			if p.periodType == "day" || !p.end.After(prunedBefore) {
+				continue
+			}
+			if err := updatePrunedPeriod(tx, stmt, userID, prunedBefore, p); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := updateModelSummaries(tx, userID, p); err != nil {
+			return err
+		}
 
-	var results []AggregatedUsage
+		var count int
+		if err := tx.QueryRow(
+			`SELECT COUNT(*) FROM usage_records WHERE user_id = ? AND timestamp >= ? AND timestamp < ?`,
+			userID, p.start.UTC(), p.end.UTC(),
+		).Scan(&count); err != nil {
+			return err
+		}
+		if count == 0 {
+			if _, err := tx.Exec(
+				`DELETE FROM usage_summary WHERE user_id = ? AND period_type = ? AND period_key = ?`,
+				userID, p.periodType, p.key,
+			); err != nil {
+				return err
+			}
+			continue
+		}
 
-	// Get completed months from summary table
-	rows, err := db.Query(`
-		SELECT period_key, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost
-		FROM usage_summary
-		WHERE user_id = ? AND period_type = 'month' AND period_key != ?
-		ORDER BY period_key DESC
-		LIMIT 12
-	`, userID, currentMonth)
+		u, err := sumRecords(tx, userID, p.start, p.end)
+		if err != nil {
+			return err
+		}
+		_, err = stmt.Exec(userID, p.periodType, p.key, p.start.UTC(), p.end.Add(-time.Second).UTC(),
+			u.InputTokens, u.OutputTokens, u.CacheCreationTokens, u.CacheReadTokens, u.Cost)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updatePrunedPeriod recomputes the summaries of a period that started
+// before prunedBefore and ends after it. Its records before prunedBefore are
+// gone, so that part is summed from its day summaries, which pruning keeps,
+// and the rest from raw records.
+func updatePrunedPeriod(tx *sql.Tx, stmt *sql.Stmt, userID string, prunedBefore time.Time, p summaryPeriod) error {
+	// Arguments for the pruned days, then the records after them
+	parts := []any{userID, p.start.UTC(), prunedBefore.UTC(), userID, prunedBefore.UTC(), p.end.UTC()}
+
+	if _, err := tx.Exec(
+		`DELETE FROM usage_summary_by_model WHERE user_id = ? AND period_type = ? AND period_key = ?`,
+		userID, p.periodType, p.key,
+	); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		INSERT INTO usage_summary_by_model
+		(user_id, period_type, period_key, model, period_start, period_end, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost)
+		SELECT ?, ?, ?, model, ?, ?, SUM(input_tokens), SUM(output_tokens),
+		       SUM(cache_creation_tokens), SUM(cache_read_tokens), SUM(cost)
+		FROM (
+			SELECT model, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost
+			FROM usage_summary_by_model
+			WHERE user_id = ? AND period_type = 'day' AND period_start >= ? AND period_end < ?
+			UNION ALL
+			SELECT model, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost
+			FROM usage_records
+			WHERE user_id = ? AND timestamp >= ? AND timestamp < ?
+		)
+		GROUP BY model
+	`, append([]any{userID, p.periodType, p.key, p.start.UTC(), p.end.Add(-time.Second).UTC()}, parts...)...)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	var u AggregatedUsage
+	if err := tx.QueryRow(`
+		SELECT COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0),
+		       COALESCE(SUM(cache_creation_tokens), 0), COALESCE(SUM(cache_read_tokens), 0),
+		       COALESCE(SUM(cost), 0)
+		FROM (
+			SELECT input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost
+			FROM usage_summary
+			WHERE user_id = ? AND period_type = 'day' AND period_start >= ? AND period_end < ?
+			UNION ALL
+			SELECT input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost
+			FROM usage_records
+			WHERE user_id = ? AND timestamp >= ? AND timestamp < ?
+		)
+	`, parts...).Scan(&u.InputTokens, &u.OutputTokens, &u.CacheCreationTokens, &u.CacheReadTokens, &u.Cost); err != nil {
+		return err
+	}
+
+	if !u.hasUsage() {
+		_, err := tx.Exec(
+			`DELETE FROM usage_summary WHERE user_id = ? AND period_type = ? AND period_key = ?`,
+			userID, p.periodType, p.key,
+		)
+		return err
+	}
+	_, err = stmt.Exec(userID, p.periodType, p.key, p.start.UTC(), p.end.Add(-time.Second).UTC(),
+		u.InputTokens, u.OutputTokens, u.CacheCreationTokens, u.CacheReadTokens, u.Cost)
+	return err
+}
+
+// EachRecord calls fn with each of a user's raw records with timestamps in
+// [from, to), oldest first, along with its stored cost. A zero from or to
+// leaves that end open. Rows are scanned one at a time, so memory stays flat
+// however many records there are. Iteration stops at fn's first error.
+func (db *DB) EachRecord(userID string, from, to time.Time, fn func(r UsageRecord, cost float64) error) error {
+	query := `SELECT id, client_id, timestamp, session_id, project_path, model,
+		input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost, tag
+		FROM usage_records WHERE user_id = ?`
+	args := []any{userID}
+	if !from.IsZero() {
+		query += ` AND timestamp >= ?`
+		args = append(args, from.UTC())
+	}
+	if !to.IsZero() {
+		query += ` AND timestamp < ?`
+		args = append(args, to.UTC())
+	}
+	query += ` ORDER BY timestamp, id`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var u AggregatedUsage
-		if err := rows.Scan(&u.Period, &u.InputTokens, &u.OutputTokens, &u.CacheCreationTokens, &u.CacheReadTokens, &u.Cost); err != nil {
-			return nil, err
+		r := UsageRecord{UserID: userID}
+		var cost float64
+		if err := rows.Scan(&r.ID, &r.ClientID, &r.Timestamp, &r.SessionID, &r.ProjectPath, &r.Model,
+			&r.InputTokens, &r.OutputTokens, &r.CacheCreationTokens, &r.CacheReadTokens, &cost, &r.Tag); err != nil {
+			return err
 		}
-		results = append(results, u)
+		if err := fn(r, cost); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// DeleteRecordsInRange deletes a user's raw records with timestamps in
+// [from, to) and updates the summaries of the affected periods, all in one
+// transaction. Returns the number of records deleted.
+func (db *DB) DeleteRecordsInRange(userID string, from, to time.Time) (int64, error) {
+	user, err := db.GetUserByID(userID)
+	if err != nil {
+		return 0, err
+	}
+	if user == nil {
+		return 0, fmt.Errorf("user not found")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	pruned := prunedBefore(tx, userID)
+
+	rows, err := tx.Query(
+		`SELECT timestamp FROM usage_records WHERE user_id = ? AND timestamp >= ? AND timestamp < ?`,
+		userID, from.UTC(), to.UTC(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	var records []UsageRecord
+	for rows.Next() {
+		var r UsageRecord
+		if err := rows.Scan(&r.Timestamp); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		records = append(records, r)
 	}
+	rows.Close()
 	if err := rows.Err(); err != nil {
-		return nil, err
+		return 0, err
+	}
+	if len(records) == 0 {
+		return 0, nil
 	}
 
-	// Get current month's data from raw records
-	var currentUsage AggregatedUsage
-	currentUsage.Period = currentMonth
-	err = db.QueryRow(`
-		SELECT COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0),
-		       COALESCE(SUM(cache_creation_tokens), 0), COALESCE(SUM(cache_read_tokens), 0),
-		       COALESCE(SUM(cost), 0)
-		FROM usage_records
-		WHERE user_id = ? AND strftime('%Y-%m', timestamp) = ?
-	`, userID, currentMonth).Scan(&currentUsage.InputTokens, &currentUsage.OutputTokens, &currentUsage.CacheCreationTokens, &currentUsage.CacheReadTokens, &currentUsage.Cost)
+	result, err := tx.Exec(
+		`DELETE FROM usage_records WHERE user_id = ? AND timestamp >= ? AND timestamp < ?`,
+		userID, from.UTC(), to.UTC(),
+	)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	// Only include current month if there's data
-	if currentUsage.InputTokens > 0 || currentUsage.OutputTokens > 0 {
-		results = append([]AggregatedUsage{currentUsage}, results...)
+	if err := updateSummaries(tx, userID, user.Location(), pruned, records); err != nil {
+		return 0, err
 	}
 
-	return results, nil
-}
-
-// HasSummaries checks if a user has any summaries
-func (db *DB) HasSummaries(userID string) bool {
-	var count int
-	db.QueryRow("SELECT COUNT(*) FROM usage_summary WHERE user_id = ? LIMIT 1", userID).Scan(&count)
-	return count > 0
+	n, _ := result.RowsAffected()
+	return n, tx.Commit()
 }
 
-// GetTotalUsage returns total usage for a user, optionally filtered by billing period
-func (db *DB) GetTotalUsage(userID string, billingDay int) (*AggregatedUsage, error) {
-	now := time.Now()
-	today := now.Format("2006-01-02")
-	periodStart, _ := GetBillingPeriod(billingDay)
-
-	var u AggregatedUsage
-	u.Period = "Total"
-
-	// Sum completed days from summaries
-	summaryQuery := `
-		SELECT COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0),
-		       COALESCE(SUM(cache_creation_tokens), 0), COALESCE(SUM(cache_read_tokens), 0),
-		       COALESCE(SUM(cost), 0)
-		FROM usage_summary
-		WHERE user_id = ? AND period_type = 'day' AND period_key != ?
-	`
-	args := []interface{}{userID, today}
-	if !periodStart.IsZero() {
-		summaryQuery += ` AND period_start >= ?`
-		args = append(args, periodStart)
-	}
-
-	err := db.QueryRow(summaryQuery, args...).Scan(&u.InputTokens, &u.OutputTokens, &u.CacheCreationTokens, &u.CacheReadTokens, &u.Cost)
+// updateModelSummaries replaces a period's per-model summaries with sums of
+// its raw records
+func updateModelSummaries(q execer, userID string, p summaryPeriod) error {
+	_, err := q.Exec(
+		`DELETE FROM usage_summary_by_model WHERE user_id = ? AND period_type = ? AND period_key = ?`,
+		userID, p.periodType, p.key,
+	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// Add today's data from raw records
-	var todayInput, todayOutput, todayCacheCreation, todayCacheRead int64
-	var todayCost float64
-	err = db.QueryRow(`
-		SELECT COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0),
-		       COALESCE(SUM(cache_creation_tokens), 0), COALESCE(SUM(cache_read_tokens), 0),
-		       COALESCE(SUM(cost), 0)
+	_, err = q.Exec(`
+		INSERT INTO usage_summary_by_model
+		(user_id, period_type, period_key, model, period_start, period_end, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost)
+		SELECT ?, ?, ?, model, ?, ?, SUM(input_tokens), SUM(output_tokens),
+		       SUM(cache_creation_tokens), SUM(cache_read_tokens), SUM(cost)
 		FROM usage_records
-		WHERE user_id = ? AND DATE(timestamp) = ?
-	`, userID, today).Scan(&todayInput, &todayOutput, &todayCacheCreation, &todayCacheRead, &todayCost)
+		WHERE user_id = ? AND timestamp >= ? AND timestamp < ?
+		GROUP BY model
+	`, userID, p.periodType, p.key, p.start.UTC(), p.end.Add(-time.Second).UTC(),
+		userID, p.start.UTC(), p.end.UTC())
+	return err
+}
+
+// recordTimestamps returns a user's raw records with only the timestamp set,
+// which is all that's needed to find the periods they fall in
+func recordTimestamps(q execer, userID string) ([]UsageRecord, error) {
+	rows, err := q.Query(`SELECT timestamp FROM usage_records WHERE user_id = ?`, userID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	u.InputTokens += todayInput
-	u.OutputTokens += todayOutput
-	u.CacheCreationTokens += todayCacheCreation
-	u.CacheReadTokens += todayCacheRead
-	u.Cost += todayCost
-
-	return &u, nil
+	var records []UsageRecord
+	for rows.Next() {
+		var r UsageRecord
+		if err := rows.Scan(&r.Timestamp); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
 }
 
-// GetClientSyncStatus returns the last sync time for a client
-func (db *DB) GetClientSyncStatus(userID, clientID string) (*time.Time, error) {
-	var lastSyncAt sql.NullTime
-	err := db.QueryRow(
-		`SELECT last_sync_at FROM clients WHERE id = ? AND user_id = ?`,
-		clientID, userID,
-	).Scan(&lastSyncAt)
+// RebuildSummaries rebuilds all summaries for a user from raw records.
+// Use this when the user's timezone changes, since every period key shifts.
+// Summaries of pruned periods are kept as they are. It runs in one
+// transaction, so the dashboard never sees summaries cleared but not yet
+// rebuilt, and a failure leaves the old ones in place.
+func (db *DB) RebuildSummaries(userID string, loc *time.Location) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	pruned := prunedBefore(tx, userID)
 
-	if err == sql.ErrNoRows {
-		return nil, nil
+	for _, table := range []string{"usage_summary", "usage_summary_by_model"} {
+		if _, err := tx.Exec(
+			`DELETE FROM `+table+` WHERE user_id = ? AND period_start >= ?`,
+			userID, pruned.UTC(),
+		); err != nil {
+			return err
+		}
 	}
+
+	records, err := recordTimestamps(tx, userID)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if !lastSyncAt.Valid {
-		return nil, nil
+
+	if err := updateSummaries(tx, userID, loc, pruned, records); err != nil {
+		return err
 	}
-	return &lastSyncAt.Time, nil
+	return tx.Commit()
 }
 
-// UpdateSummaries updates only the summaries affected by the given records.
-// Much more efficient than rebuilding all summaries.
-func (db *DB) UpdateSummaries(userID string, billingDay int, records []UsageRecord) error {
-	if len(records) == 0 {
-		return nil
+// RebuildCycleSummaries rebuilds only cycle summaries for a user, for their
+// billing day as stored when the rebuild runs. Use this when billing day
+// changes. It runs in one transaction, so syncs meanwhile never see cycle
+// summaries half rebuilt.
+func (db *DB) RebuildCycleSummaries(userID string, loc *time.Location) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	// Collect affected periods
-	affectedDays := make(map[string]bool)
-	affectedMonths := make(map[string]bool)
-	affectedCycles := make(map[string]struct{ start, end time.Time })
+	if err := rebuildCycleSummaries(tx, userID, loc); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-	for _, r := range records {
-		t := r.Timestamp
-		dayKey := t.Format("2006-01-02")
-		monthKey := t.Format("2006-01")
-
-		affectedDays[dayKey] = true
-		affectedMonths[monthKey] = true
-
-		// Calculate affected cycle if billing day is set
-		if billingDay > 0 && billingDay <= 31 {
-			year, month, dayNum := t.Date()
-			var cycleStart time.Time
-			clampedDay := clampDay(year, month, billingDay)
-			if dayNum >= clampedDay {
-				cycleStart = time.Date(year, month, clampedDay, 0, 0, 0, 0, time.Local)
-			} else {
-				prevMonth := month - 1
-				prevYear := year
-				if prevMonth < 1 {
-					prevMonth = 12
-					prevYear--
-				}
-				cycleStart = time.Date(prevYear, prevMonth, clampDay(prevYear, prevMonth, billingDay), 0, 0, 0, 0, time.Local)
-			}
+// storedBillingDay reads a user's billing day within q. Summaries are keyed
+// by the day as stored when they're written, rather than as a caller loaded
+// it, so a billing day change during a sync can't leave cycles keyed to the
+// old day.
+func storedBillingDay(q execer, userID string) (int, error) {
+	var day int
+	err := q.QueryRow(`SELECT billing_day FROM users WHERE id = ?`, userID).Scan(&day)
+	return day, err
+}
 
-			nextMonth := cycleStart.Month() + 1
-			nextYear := cycleStart.Year()
-			if nextMonth > 12 {
-				nextMonth = 1
-				nextYear++
-			}
-			cycleEnd := time.Date(nextYear, nextMonth, clampDay(nextYear, nextMonth, billingDay), 0, 0, 0, 0, time.Local).Add(-time.Second)
-			cycleKey := cycleStart.Format("Jan 2") + " – " + cycleEnd.Format("Jan 2")
-			affectedCycles[cycleKey] = struct{ start, end time.Time }{cycleStart, cycleEnd}
-		}
+// rebuildCycleSummaries rebuilds a user's cycle summaries from day summaries
+func rebuildCycleSummaries(q execer, userID string, loc *time.Location) error {
+	// Clear existing cycle summaries
+	if _, err := q.Exec(`DELETE FROM usage_summary WHERE user_id = ? AND period_type = 'cycle'`, userID); err != nil {
+		return err
 	}
 
-	tx, err := db.Begin()
+	billingDay, err := storedBillingDay(q, userID)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
 
-	// Upsert statement
-	stmt, err := tx.Prepare(`
-		INSERT INTO usage_summary
-		(user_id, period_type, period_key, period_start, period_end, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		ON CONFLICT(user_id, period_type, period_key) DO UPDATE SET
-			input_tokens = excluded.input_tokens,
-			output_tokens = excluded.output_tokens,
-			cache_creation_tokens = excluded.cache_creation_tokens,
-			cache_read_tokens = excluded.cache_read_tokens,
-			cost = excluded.cost
-	`)
+	if !billing.ValidDay(billingDay) {
+		return nil
+	}
+
+	// Read from day summaries (much faster than raw records)
+	rows, err := q.Query(`
+		SELECT period_key, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost
+		FROM usage_summary
+		WHERE user_id = ? AND period_type = 'day'
+	`, userID)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
+	defer rows.Close()
 
-	// Update day summaries
-	for dayKey := range affectedDays {
-		dayStart, _ := time.ParseInLocation("2006-01-02", dayKey, time.Local)
-		dayEnd := dayStart.Add(24*time.Hour - time.Second)
+	cycles := make(map[string]struct {
+		start, end                              time.Time
+		input, output, cacheCreation, cacheRead int64
+		cost                                    float64
+	})
 
+	for rows.Next() {
+		var day string
 		var input, output, cacheCreation, cacheRead int64
 		var cost float64
-		err := tx.QueryRow(`
-			SELECT COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0),
-			       COALESCE(SUM(cache_creation_tokens), 0), COALESCE(SUM(cache_read_tokens), 0),
-			       COALESCE(SUM(cost), 0)
-			FROM usage_records
-			WHERE user_id = ? AND DATE(timestamp) = ?
-		`, userID, dayKey).Scan(&input, &output, &cacheCreation, &cacheRead, &cost)
-		if err != nil {
-			return err
-		}
-
-		if _, err := stmt.Exec(userID, "day", dayKey, dayStart, dayEnd, input, output, cacheCreation, cacheRead, cost); err != nil {
+		if err := rows.Scan(&day, &input, &output, &cacheCreation, &cacheRead, &cost); err != nil {
 			return err
 		}
-	}
 
-	// Update month summaries
-	for monthKey := range affectedMonths {
-		t, _ := time.ParseInLocation("2006-01", monthKey, time.Local)
-		monthStart := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.Local)
-		monthEnd := time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.Local).Add(-time.Second)
+		// Day keys are already in the user's timezone
+		t, _ := time.ParseInLocation("2006-01-02", day, loc)
+		cycleStart, cycleEnd := billing.PeriodFor(billingDay, t)
+		key := cycleKey(cycleStart)
 
-		var input, output, cacheCreation, cacheRead int64
-		var cost float64
-		err := tx.QueryRow(`
-			SELECT COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0),
-			       COALESCE(SUM(cache_creation_tokens), 0), COALESCE(SUM(cache_read_tokens), 0),
-			       COALESCE(SUM(cost), 0)
-			FROM usage_records
-			WHERE user_id = ? AND strftime('%Y-%m', timestamp) = ?
-		`, userID, monthKey).Scan(&input, &output, &cacheCreation, &cacheRead, &cost)
-		if err != nil {
-			return err
-		}
-
-		if _, err := stmt.Exec(userID, "month", monthKey, monthStart, monthEnd, input, output, cacheCreation, cacheRead, cost); err != nil {
-			return err
-		}
+		c := cycles[key]
+		c.start = cycleStart
+		c.end = cycleEnd.Add(-time.Second) // Stored as the cycle's last second
+		c.input += input
+		c.output += output
+		c.cacheCreation += cacheCreation
+		c.cacheRead += cacheRead
+		c.cost += cost
+		cycles[key] = c
+	}
+	if err := rows.Err(); err != nil {
+		return err
 	}
 
-	// Update cycle summaries
-	for cycleKey, period := range affectedCycles {
-		var input, output, cacheCreation, cacheRead int64
-		var cost float64
-		err := tx.QueryRow(`
-			SELECT COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0),
-			       COALESCE(SUM(cache_creation_tokens), 0), COALESCE(SUM(cache_read_tokens), 0),
-			       COALESCE(SUM(cost), 0)
-			FROM usage_records
-			WHERE user_id = ? AND timestamp >= ? AND timestamp <= ?
-		`, userID, period.start, period.end).Scan(&input, &output, &cacheCreation, &cacheRead, &cost)
+	// Insert cycle summaries
+	for key, c := range cycles {
+		_, err := q.Exec(`
+			INSERT INTO usage_summary
+			(user_id, period_type, period_key, period_start, period_end, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost)
+			VALUES (?, 'cycle', ?, ?, ?, ?, ?, ?, ?, ?)
+		`, userID, key, c.start.UTC(), c.end.UTC(), c.input, c.output, c.cacheCreation, c.cacheRead, c.cost)
 		if err != nil {
 			return err
 		}
-
-		if _, err := stmt.Exec(userID, "cycle", cycleKey, period.start, period.end, input, output, cacheCreation, cacheRead, cost); err != nil {
-			return err
-		}
 	}
 
-	return tx.Commit()
+	return rebuildModelCycleSummaries(q, userID, billingDay, loc)
 }
 
-// RebuildCycleSummaries rebuilds only cycle summaries for a user.
-// Use this when billing day changes.
-func (db *DB) RebuildCycleSummaries(userID string, billingDay int) error {
-	// Clear existing cycle summaries
-	if _, err := db.Exec(`DELETE FROM usage_summary WHERE user_id = ? AND period_type = 'cycle'`, userID); err != nil {
+// rebuildModelCycleSummaries rebuilds a user's per-model cycle summaries
+// from their per-model day summaries
+func rebuildModelCycleSummaries(q execer, userID string, billingDay int, loc *time.Location) error {
+	if _, err := q.Exec(`DELETE FROM usage_summary_by_model WHERE user_id = ? AND period_type = 'cycle'`, userID); err != nil {
 		return err
 	}
 
-	if billingDay <= 0 || billingDay > 31 {
+	if !billing.ValidDay(billingDay) {
 		return nil
 	}
 
-	// Read from day summaries (much faster than raw records)
-	rows, err := db.Query(`
-		SELECT period_key, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost
-		FROM usage_summary
+	rows, err := q.Query(`
+		SELECT period_key, model, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost
+		FROM usage_summary_by_model
 		WHERE user_id = ? AND period_type = 'day'
 	`, userID)
 	if err != nil {
@@ -801,67 +2182,45 @@ func (db *DB) RebuildCycleSummaries(userID string, billingDay int) error {
 	}
 	defer rows.Close()
 
-	cycles := make(map[string]struct {
+	type cycleModel struct{ key, model string }
+	cycles := make(map[cycleModel]struct {
 		start, end                              time.Time
 		input, output, cacheCreation, cacheRead int64
 		cost                                    float64
 	})
 
 	for rows.Next() {
-		var day string
+		var day, modelName string
 		var input, output, cacheCreation, cacheRead int64
 		var cost float64
-		if err := rows.Scan(&day, &input, &output, &cacheCreation, &cacheRead, &cost); err != nil {
+		if err := rows.Scan(&day, &modelName, &input, &output, &cacheCreation, &cacheRead, &cost); err != nil {
 			return err
 		}
 
-		t, _ := time.Parse("2006-01-02", day)
-		year, month, dayNum := t.Date()
-
-		var cycleStart time.Time
-		clampedDay := clampDay(year, month, billingDay)
-		if dayNum >= clampedDay {
-			cycleStart = time.Date(year, month, clampedDay, 0, 0, 0, 0, time.Local)
-		} else {
-			prevMonth := month - 1
-			prevYear := year
-			if prevMonth < 1 {
-				prevMonth = 12
-				prevYear--
-			}
-			cycleStart = time.Date(prevYear, prevMonth, clampDay(prevYear, prevMonth, billingDay), 0, 0, 0, 0, time.Local)
-		}
-
-		nextMonth := cycleStart.Month() + 1
-		nextYear := cycleStart.Year()
-		if nextMonth > 12 {
-			nextMonth = 1
-			nextYear++
-		}
-		cycleEnd := time.Date(nextYear, nextMonth, clampDay(nextYear, nextMonth, billingDay), 0, 0, 0, 0, time.Local).Add(-time.Second)
-		cycleKey := cycleStart.Format("Jan 2") + " – " + cycleEnd.Format("Jan 2")
+		t, _ := time.ParseInLocation("2006-01-02", day, loc)
+		cycleStart, cycleEnd := billing.PeriodFor(billingDay, t)
+		key := cycleModel{cycleKey(cycleStart), modelName}
 
-		c := cycles[cycleKey]
+		c := cycles[key]
 		c.start = cycleStart
-		c.end = cycleEnd
+		c.end = cycleEnd.Add(-time.Second) // Stored as the cycle's last second
 		c.input += input
 		c.output += output
 		c.cacheCreation += cacheCreation
 		c.cacheRead += cacheRead
 		c.cost += cost
-		cycles[cycleKey] = c
+		cycles[key] = c
 	}
 	if err := rows.Err(); err != nil {
 		return err
 	}
 
-	// Insert cycle summaries
-	for cycleKey, c := range cycles {
-		_, err := db.Exec(`
-			INSERT INTO usage_summary
-			(user_id, period_type, period_key, period_start, period_end, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost)
-			VALUES (?, 'cycle', ?, ?, ?, ?, ?, ?, ?, ?)
-		`, userID, cycleKey, c.start, c.end, c.input, c.output, c.cacheCreation, c.cacheRead, c.cost)
+	for key, c := range cycles {
+		_, err := q.Exec(`
+			INSERT INTO usage_summary_by_model
+			(user_id, period_type, period_key, model, period_start, period_end, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens, cost)
+			VALUES (?, 'cycle', ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, userID, key.key, key.model, c.start.UTC(), c.end.UTC(), c.input, c.output, c.cacheCreation, c.cacheRead, c.cost)
 		if err != nil {
 			return err
 		}
@@ -869,3 +2228,141 @@ func (db *DB) RebuildCycleSummaries(userID string, billingDay int) error {
 
 	return nil
 }
+
+// Backup writes a consistent copy of the database to path using VACUUM INTO.
+// Safe to run while the server is handling requests. path must not exist.
+func (db *DB) Backup(path string) error {
+	_, err := db.Exec(`VACUUM INTO ?`, path)
+	return err
+}
+
+// PrunedBefore returns the time before which a user's raw records have been
+// pruned, or the zero time if nothing has been pruned
+func (db *DB) PrunedBefore(userID string) time.Time {
+	return prunedBefore(db, userID)
+}
+
+// prunedBefore is PrunedBefore, read through q
+func prunedBefore(q execer, userID string) time.Time {
+	var t sql.NullTime
+	q.QueryRow(`SELECT pruned_before FROM users WHERE id = ?`, userID).Scan(&t)
+	return t.Time
+}
+
+// pruneBoundary returns where pruning stops for cutoff: the earliest start of
+// the week, month and (if set) billing cycle containing cutoff, in cutoff's
+// location. That's always the start of a day, so no day is split between
+// summaries and raw records, and neither are the periods containing cutoff.
+// Earlier periods can be, such as January when a cycle starts on the 15th;
+// updatePrunedPeriod recomputes those from the day summaries before the
+// boundary and the records after it.
+func pruneBoundary(cutoff time.Time, billingDay int) time.Time {
+	boundary, _ := monthBounds(cutoff)
+	if weekStart, _ := weekBounds(cutoff); weekStart.Before(boundary) {
+		boundary = weekStart
+	}
+	if billing.ValidDay(billingDay) {
+		if cycleStart, _ := billing.PeriodFor(billingDay, cutoff); cycleStart.Before(boundary) {
+			boundary = cycleStart
+		}
+	}
+	return boundary
+}
+
+// PruneRecordsOlderThan deletes raw usage records older than cutoff. Their
+// usage stays in the summary tables. Each user's cutoff is rounded back to
+// the start of a day and of the periods containing it (see pruneBoundary).
+// Returns the number of records deleted.
+func (db *DB) PruneRecordsOlderThan(cutoff time.Time) (int64, error) {
+	rows, err := db.Query(`SELECT id, billing_day, timezone FROM users`)
+	if err != nil {
+		return 0, err
+	}
+
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.BillingDay, &u.Timezone); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var deleted int64
+	for _, u := range users {
+		n, err := db.pruneUserRecords(&u, cutoff)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+// pruneUserRecords prunes a single user's records before the period boundary
+// at or before cutoff. Summarizing the records, deleting them and moving the
+// user's pruned boundary happen in one transaction, so a sync can't insert
+// records before the boundary that are deleted without being summarized.
+func (db *DB) pruneUserRecords(u *User, cutoff time.Time) (int64, error) {
+	loc := u.Location()
+	boundary := pruneBoundary(cutoff.In(loc), u.BillingDay)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	pruned := prunedBefore(tx, u.ID)
+	if !boundary.After(pruned) {
+		return 0, nil
+	}
+
+	if _, err := tx.Exec(`UPDATE users SET pruned_before = ? WHERE id = ?`, boundary.UTC(), u.ID); err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.Query(
+		`SELECT timestamp FROM usage_records WHERE user_id = ? AND timestamp < ?`,
+		u.ID, boundary.UTC(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	var records []UsageRecord
+	for rows.Next() {
+		var r UsageRecord
+		if err := rows.Scan(&r.Timestamp); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		records = append(records, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+
+	// Make sure every affected period is summarized before its records go
+	// away, as it was before this prune
+	if err := updateSummaries(tx, u.ID, loc, pruned, records); err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec(`DELETE FROM usage_records WHERE user_id = ? AND timestamp < ?`, u.ID, boundary.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	n, _ := result.RowsAffected()
+	return n, tx.Commit()
+}
@@ -0,0 +1,512 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestDB opens a migrated database in a temporary directory
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := Open(filepath.Join(t.TempDir(), "cctop.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// createTestUser creates user "u1" in UTC with a sync client "c1"
+func createTestUser(t *testing.T, db *DB, billingDay int) {
+	t.Helper()
+	user := &User{ID: "u1", Username: "u1", PasswordHash: "x", APIKey: "k1", BillingDay: billingDay, Timezone: "UTC", CreatedAt: time.Now()}
+	if err := db.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetOrCreateClient("u1", "c1", "c1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testRecord returns a record for u1 at ts with input tokens
+func testRecord(ts time.Time, input int64) UsageRecord {
+	return UsageRecord{
+		UserID:      "u1",
+		ClientID:    "c1",
+		Timestamp:   ts,
+		SessionID:   fmt.Sprintf("s-%d-%d", ts.Unix(), input),
+		Model:       "claude-sonnet-4-5",
+		InputTokens: input,
+	}
+}
+
+// syncRecords inserts records and updates their summaries, as a sync does
+func syncRecords(t *testing.T, db *DB, records []UsageRecord) {
+	t.Helper()
+	if _, err := db.InsertUsageRecords(records); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateSummaries("u1", time.UTC, records); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// summaryInput returns the input tokens summarized for a period, in total
+// and summed across its per-model summaries
+func summaryInput(t *testing.T, db *DB, periodType, key string) (total, byModel int64) {
+	t.Helper()
+	if err := db.QueryRow(
+		`SELECT COALESCE(SUM(input_tokens), 0) FROM usage_summary WHERE user_id = 'u1' AND period_type = ? AND period_key = ?`,
+		periodType, key,
+	).Scan(&total); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(
+		`SELECT COALESCE(SUM(input_tokens), 0) FROM usage_summary_by_model WHERE user_id = 'u1' AND period_type = ? AND period_key = ?`,
+		periodType, key,
+	).Scan(&byModel); err != nil {
+		t.Fatal(err)
+	}
+	return total, byModel
+}
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestPruneBoundary(t *testing.T) {
+	tests := []struct {
+		cutoff     time.Time
+		billingDay int
+		want       time.Time
+	}{
+		{date(2025, 2, 10), 0, date(2025, 2, 1)},
+		{date(2025, 2, 10), 1, date(2025, 2, 1)},
+		{date(2025, 2, 10), 15, date(2025, 1, 15)},
+		{date(2025, 2, 20), 15, date(2025, 2, 1)},
+		{date(2025, 1, 10), 15, date(2024, 12, 15)},
+		{date(2025, 3, 5), 31, date(2025, 2, 28)},
+
+		// Weeks starting in the month before
+		{date(2025, 3, 2), 0, date(2025, 2, 24)},
+		{date(2025, 2, 2), 1, date(2025, 1, 27)},
+		{date(2025, 2, 2), 31, date(2025, 1, 27)},
+		{date(2025, 6, 3), 1, date(2025, 6, 1)},
+	}
+
+	for _, tt := range tests {
+		if got := pruneBoundary(tt.cutoff, tt.billingDay); !got.Equal(tt.want) {
+			t.Errorf("pruneBoundary(%s, %d) = %s, want %s", tt.cutoff.Format(time.DateOnly), tt.billingDay,
+				got.Format(time.DateOnly), tt.want.Format(time.DateOnly))
+		}
+	}
+}
+
+// A billing day after the 1st puts the prune boundary inside a month. That
+// month's summary must still follow later syncs and deletions in the part
+// of it that wasn't pruned.
+func TestPruneKeepsStraddlingPeriodsCurrent(t *testing.T) {
+	db := openTestDB(t)
+	createTestUser(t, db, 15)
+
+	// 100 input tokens at noon each day, December through March
+	var records []UsageRecord
+	for d := date(2024, 12, 1); d.Before(date(2025, 4, 1)); d = d.AddDate(0, 0, 1) {
+		records = append(records, testRecord(d.Add(12*time.Hour), 100))
+	}
+	syncRecords(t, db, records)
+
+	// February's cycle started on January 15, so pruning stops there
+	if _, err := db.PruneRecordsOlderThan(date(2025, 2, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := db.PrunedBefore("u1"), date(2025, 1, 15); !got.Equal(want) {
+		t.Fatalf("PrunedBefore = %s, want %s", got, want)
+	}
+
+	// A late sync and a deletion in the rest of January
+	syncRecords(t, db, []UsageRecord{
+		testRecord(date(2025, 1, 16).Add(18*time.Hour), 5),
+		testRecord(date(2025, 1, 20).Add(18*time.Hour), 7),
+	})
+	if _, err := db.DeleteRecordsInRange("u1", date(2025, 1, 25), date(2025, 1, 27)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		periodType string
+		key        string
+		want       int64
+	}{
+		{"month", "2025-01", 31*100 + 12 - 200},
+		{"month", "2024-12", 31 * 100},
+		{"cycle", "2024-12-15", 31 * 100},
+		{"cycle", "2025-01-15", 31*100 + 12 - 200},
+		{"week", "2025-01-13", 7*100 + 5},
+		{"day", "2025-01-10", 100},
+		{"day", "2025-01-16", 105},
+		{"day", "2025-01-20", 107},
+		{"day", "2025-01-25", 0},
+	}
+	for _, tt := range tests {
+		total, byModel := summaryInput(t, db, tt.periodType, tt.key)
+		if total != tt.want || byModel != tt.want {
+			t.Errorf("%s %s: input tokens = %d (by model %d), want %d", tt.periodType, tt.key, total, byModel, tt.want)
+		}
+	}
+
+	// Rebuilding, as a timezone change does, recomputes them the same way
+	if err := db.RebuildSummaries("u1", time.UTC); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		total, byModel := summaryInput(t, db, tt.periodType, tt.key)
+		if total != tt.want || byModel != tt.want {
+			t.Errorf("after rebuild, %s %s: input tokens = %d (by model %d), want %d", tt.periodType, tt.key, total, byModel, tt.want)
+		}
+	}
+}
+
+// Syncs of old records racing a prune must either be summarized or be
+// dropped, never inserted and then deleted unsummarized
+func TestPruneDuringSyncs(t *testing.T) {
+	db := openTestDB(t)
+	createTestUser(t, db, 0)
+
+	pruned := make(chan error)
+	start := make(chan struct{})
+	go func() {
+		<-start
+		_, err := db.PruneRecordsOlderThan(date(2025, 3, 10))
+		pruned <- err
+	}()
+
+	// One input token per record, synced one at a time through January
+	var inserted int64
+	for i := 0; i < 200; i++ {
+		if i == 50 {
+			close(start)
+		}
+		records := []UsageRecord{testRecord(date(2025, 1, 1).Add(time.Duration(i)*time.Hour), 1)}
+		n, err := db.InsertUsageRecords(records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inserted += n
+		if err := db.UpdateSummaries("u1", time.UTC, records); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-pruned; err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := db.PrunedBefore("u1"), date(2025, 3, 1); !got.Equal(want) {
+		t.Fatalf("PrunedBefore = %s, want %s", got, want)
+	}
+	if total, byModel := summaryInput(t, db, "month", "2025-01"); total != inserted || byModel != inserted {
+		t.Errorf("January input tokens = %d (by model %d), want %d inserted", total, byModel, inserted)
+	}
+}
+
+// baselineSchema is the schema of databases created before versioned
+// migrations. Migrating one must reach the latest version.
+const baselineSchema = `
+CREATE TABLE users (
+	id TEXT PRIMARY KEY,
+	username TEXT UNIQUE NOT NULL,
+	password_hash TEXT NOT NULL,
+	api_key TEXT UNIQUE NOT NULL,
+	billing_day INTEGER DEFAULT 0,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE clients (
+	id TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	last_sync_at TIMESTAMP,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE usage_records (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id TEXT NOT NULL,
+	client_id TEXT NOT NULL,
+	timestamp TIMESTAMP NOT NULL,
+	session_id TEXT NOT NULL,
+	project_path TEXT,
+	model TEXT NOT NULL,
+	input_tokens INTEGER NOT NULL,
+	output_tokens INTEGER NOT NULL,
+	cache_creation_tokens INTEGER DEFAULT 0,
+	cache_read_tokens INTEGER DEFAULT 0,
+	cost REAL DEFAULT 0,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	UNIQUE(user_id, client_id, timestamp, session_id, model)
+);
+
+CREATE INDEX idx_usage_user_timestamp ON usage_records(user_id, timestamp);
+CREATE INDEX idx_clients_user ON clients(user_id);
+
+CREATE TABLE sessions (
+	token TEXT PRIMARY KEY,
+	data BLOB NOT NULL,
+	expiry REAL NOT NULL
+);
+
+CREATE INDEX idx_sessions_expiry ON sessions(expiry);
+
+CREATE TABLE usage_summary (
+	user_id TEXT NOT NULL,
+	period_type TEXT NOT NULL,
+	period_key TEXT NOT NULL,
+	period_start TIMESTAMP NOT NULL,
+	period_end TIMESTAMP NOT NULL,
+	input_tokens INTEGER NOT NULL,
+	output_tokens INTEGER NOT NULL,
+	cache_creation_tokens INTEGER NOT NULL,
+	cache_read_tokens INTEGER NOT NULL,
+	cost REAL DEFAULT 0,
+	PRIMARY KEY (user_id, period_type, period_key),
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_summary_user_type ON usage_summary(user_id, period_type);
+`
+
+// An existing user with a billing day has cycle summaries under the old
+// year-less keys, which migration 3 rebuilds before later migrations add
+// the tables the live rebuild uses
+func TestMigrateFromBaseline(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "cctop.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(baselineSchema); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO users (id, username, password_hash, api_key, billing_day) VALUES ('u1', 'u1', 'x', 'k1', 15)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO clients (id, user_id, name) VALUES ('c1', 'u1', 'c1')`); err != nil {
+		t.Fatal(err)
+	}
+
+	records := []struct {
+		ts      time.Time
+		session string
+		input   int64
+	}{
+		{date(2024, 12, 20).Add(12 * time.Hour), "s1", 100},
+		{date(2025, 1, 10).Add(12 * time.Hour), "", 200},
+		{date(2025, 1, 20).Add(12 * time.Hour), "s3", 300},
+	}
+	for _, r := range records {
+		if _, err := db.Exec(
+			`INSERT INTO usage_records (user_id, client_id, timestamp, session_id, project_path, model, input_tokens, output_tokens) VALUES ('u1', 'c1', ?, ?, '/p', 'claude-sonnet-4-5', ?, 0)`,
+			r.ts, r.session, r.input,
+		); err != nil {
+			t.Fatal(err)
+		}
+		day := r.ts.Truncate(24 * time.Hour)
+		if _, err := db.Exec(
+			`INSERT INTO usage_summary (user_id, period_type, period_key, period_start, period_end, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens)
+			 VALUES ('u1', 'day', ?, ?, ?, ?, 0, 0, 0)`,
+			day.Format("2006-01-02"), day, day.Add(24*time.Hour-time.Second), r.input,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []struct {
+		periodType string
+		key        string
+		start, end time.Time
+		input      int64
+	}{
+		{"month", "2024-12", date(2024, 12, 1), date(2025, 1, 1), 100},
+		{"month", "2025-01", date(2025, 1, 1), date(2025, 2, 1), 500},
+		{"cycle", "Dec 15 – Jan 14", date(2024, 12, 15), date(2025, 1, 15), 300},
+		{"cycle", "Jan 15 – Feb 14", date(2025, 1, 15), date(2025, 2, 15), 300},
+	} {
+		if _, err := db.Exec(
+			`INSERT INTO usage_summary (user_id, period_type, period_key, period_start, period_end, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens)
+			 VALUES ('u1', ?, ?, ?, ?, ?, 0, 0, 0)`,
+			p.periodType, p.key, p.start, p.end.Add(-time.Second), p.input,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if version, err := db.AppliedSchemaVersion(); err != nil || version != LatestSchemaVersion() {
+		t.Fatalf("schema version = %d (%v), want %d", version, err, LatestSchemaVersion())
+	}
+
+	var oldKeys int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM usage_summary WHERE period_type = 'cycle' AND period_key LIKE '% – %'`).Scan(&oldKeys); err != nil {
+		t.Fatal(err)
+	}
+	if oldKeys != 0 {
+		t.Errorf("%d cycle summaries still have year-less keys", oldKeys)
+	}
+
+	tests := []struct {
+		periodType string
+		key        string
+		want       int64
+	}{
+		{"cycle", "2024-12-15", 300},
+		{"cycle", "2025-01-15", 300},
+		{"week", "2024-12-16", 100},
+		{"month", "2025-01", 500},
+	}
+	for _, tt := range tests {
+		total, byModel := summaryInput(t, db, tt.periodType, tt.key)
+		if total != tt.want || byModel != tt.want {
+			t.Errorf("%s %s: input tokens = %d (by model %d), want %d", tt.periodType, tt.key, total, byModel, tt.want)
+		}
+	}
+
+	var unnamed int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM usage_records WHERE session_id = ''`).Scan(&unnamed); err != nil {
+		t.Fatal(err)
+	}
+	if unnamed != 0 {
+		t.Errorf("%d records still have no session ID", unnamed)
+	}
+}
+
+// migrateTo applies migrations up to version to a fresh database
+func migrateTo(t *testing.T, db *DB, version int) {
+	t.Helper()
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`); err != nil {
+		t.Fatal(err)
+	}
+	current, err := db.AppliedSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for v := current + 1; v <= version; v++ {
+		if err := db.applyMigration(v); err != nil {
+			t.Fatalf("migration %d: %v", v, err)
+		}
+	}
+}
+
+func TestMigrateModelSummariesSkipsPruned(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "cctop.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	migrateTo(t, db, 4)
+
+	// Pruned before Jan 10, when Jan 5's record went
+	if _, err := db.Exec(`INSERT INTO users (id, username, password_hash, api_key, billing_day, timezone, pruned_before) VALUES ('u1', 'u1', 'x', 'k1', 15, 'UTC', ?)`, date(2025, 1, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO clients (id, user_id, name) VALUES ('c1', 'u1', 'c1')`); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []struct {
+		day   time.Time
+		input int64
+	}{
+		{date(2025, 1, 10), 200},
+		{date(2025, 1, 20), 300},
+	} {
+		if _, err := db.Exec(
+			`INSERT INTO usage_records (user_id, client_id, timestamp, session_id, project_path, model, input_tokens, output_tokens) VALUES ('u1', 'c1', ?, 's', '/p', 'claude-sonnet-4-5', ?, 0)`,
+			r.day.Add(12*time.Hour), r.input,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	migrateTo(t, db, 5)
+
+	tests := []struct {
+		periodType string
+		key        string
+		want       int64
+	}{
+		{"day", "2025-01-10", 200},
+		{"day", "2025-01-20", 300},
+		{"cycle", "2025-01-15", 300},
+
+		// Straddling the boundary, so Jan 5's usage is gone from the records
+		{"month", "2025-01", 0},
+		{"cycle", "2024-12-15", 0},
+	}
+	for _, tt := range tests {
+		if _, byModel := summaryInput(t, db, tt.periodType, tt.key); byModel != tt.want {
+			t.Errorf("%s %s: input tokens by model = %d, want %d", tt.periodType, tt.key, byModel, tt.want)
+		}
+	}
+}
+
+func TestMigrateWeekSummaries(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "cctop.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	migrateTo(t, db, 7)
+
+	if _, err := db.Exec(`INSERT INTO users (id, username, password_hash, api_key, timezone, pruned_before) VALUES ('u1', 'u1', 'x', 'k1', 'UTC', ?)`, date(2025, 1, 10)); err != nil {
+		t.Fatal(err)
+	}
+	// Day summaries, both total and by model, for pruned days and for days
+	// with records, which the week fill reads alone
+	for _, d := range []struct {
+		day   time.Time
+		input int64
+	}{
+		{date(2025, 1, 1), 50},
+		{date(2025, 1, 8), 100},
+		{date(2025, 1, 10), 200},
+		{date(2025, 1, 20), 300},
+	} {
+		for _, table := range []string{"usage_summary", "usage_summary_by_model"} {
+			model, value := "", ""
+			if table == "usage_summary_by_model" {
+				model, value = "model, ", "'claude-sonnet-4-5', "
+			}
+			if _, err := db.Exec(
+				fmt.Sprintf(`INSERT INTO %s (user_id, period_type, period_key, %speriod_start, period_end, input_tokens, output_tokens, cache_creation_tokens, cache_read_tokens)
+				 VALUES ('u1', 'day', ?, %s?, ?, ?, 0, 0, 0)`, table, model, value),
+				d.day.Format("2006-01-02"), d.day, d.day.Add(24*time.Hour-time.Second), d.input,
+			); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	migrateTo(t, db, 8)
+
+	tests := []struct {
+		key  string
+		want int64
+	}{
+		{"2024-12-30", 0},   // Wholly pruned
+		{"2025-01-06", 300}, // Straddling the boundary
+		{"2025-01-20", 300},
+	}
+	for _, tt := range tests {
+		total, byModel := summaryInput(t, db, "week", tt.key)
+		if total != tt.want || byModel != tt.want {
+			t.Errorf("week %s: input tokens = %d (by model %d), want %d", tt.key, total, byModel, tt.want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"slices"
+
+	"github.com/zhaobenny/cctop/server/internal/auth"
+	"github.com/zhaobenny/cctop/server/internal/database"
+)
+
+// Chart layout, in pixels
+const (
+	chartWidth   = 800
+	chartHeight  = 400
+	chartMargin  = 40
+	chartBarGap  = 12
+	glyphScale   = 2
+	glyphSpacing = 1 // Columns between glyphs, before scaling
+)
+
+var (
+	chartBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	chartBar        = color.RGBA{0x26, 0x26, 0x26, 0xff}
+	chartAxis       = color.RGBA{0xa3, 0xa3, 0xa3, 0xff}
+	chartText       = color.RGBA{0x52, 0x52, 0x52, 0xff}
+)
+
+// glyphs is a 3x5 bitmap font covering the characters chart labels use
+var glyphs = map[rune][5]string{
+	'0': {"###", "#.#", "#.#", "#.#", "###"},
+	'1': {".#.", "##.", ".#.", ".#.", "###"},
+	'2': {"###", "..#", "###", "#..", "###"},
+	'3': {"###", "..#", "###", "..#", "###"},
+	'4': {"#.#", "#.#", "###", "..#", "..#"},
+	'5': {"###", "#..", "###", "..#", "###"},
+	'6': {"###", "#..", "###", "#.#", "###"},
+	'7': {"###", "..#", "..#", "..#", "..#"},
+	'8': {"###", "#.#", "###", "#.#", "###"},
+	'9': {"###", "#.#", "###", "..#", "###"},
+	'-': {"...", "...", "###", "...", "..."},
+	'.': {"...", "...", "...", "...", ".#."},
+	',': {"...", "...", "...", ".#.", "#.."},
+	'$': {".##", "##.", ".#.", ".##", "##."},
+}
+
+// UsageChart renders the user's monthly cost as a PNG bar chart, oldest
+// month first. It's rendered on demand from the same data as the monthly view.
+func (h *Handler) UsageChart(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	usage, err := h.db.GetUsageByMonth(user.ID, user.Location(), 0)
+	if err != nil {
+		h.log(r).Error("Failed to get monthly usage", "error", err)
+		http.Error(w, "Failed to load usage", http.StatusInternalServerError)
+		return
+	}
+	slices.Reverse(usage)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, renderUsageChart(usage)); err != nil {
+		h.log(r).Error("Failed to encode chart", "error", err)
+		http.Error(w, "Failed to render chart", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Disposition", `attachment; filename="cctop-monthly.png"`)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buf.Bytes())
+}
+
+// renderUsageChart draws a bar per period, labelled with its period below
+// and its cost beyond the end of the bar. Negative costs, from adjustments,
+// are drawn below a zero line. Labels are thinned out, keeping the latest
+// period's, when there are too many periods for all of them to fit.
+func renderUsageChart(usage []database.AggregatedUsage) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(chartBackground), image.Point{}, draw.Src)
+
+	textHeight := 5 * glyphScale
+	bottom := chartHeight - chartMargin
+	top := chartMargin + textHeight + 4
+
+	var maxCost, minCost float64
+	labelWidth := 0
+	for _, u := range usage {
+		maxCost = max(maxCost, u.Cost)
+		minCost = min(minCost, u.Cost)
+		labelWidth = max(labelWidth, textWidth(u.Period), textWidth(costLabel(u.Cost)))
+	}
+
+	// Leave room below the lowest bar for its cost when there are negative bars
+	low := bottom
+	if minCost < 0 {
+		low -= textHeight + 4
+	}
+	zero := bottom
+	if maxCost > minCost {
+		zero = top + int(maxCost/(maxCost-minCost)*float64(low-top))
+	}
+	fill(img, image.Rect(chartMargin, zero, chartWidth-chartMargin, zero+1), chartAxis)
+
+	if len(usage) == 0 {
+		return img
+	}
+
+	slot := (chartWidth - 2*chartMargin) / len(usage)
+	barWidth := max(slot-chartBarGap, 1)
+	labelEvery := (labelWidth + chartBarGap + slot - 1) / slot
+	for i, u := range usage {
+		x := chartMargin + i*slot + (slot-barWidth)/2
+		height := 0
+		if maxCost > minCost {
+			height = int(u.Cost / (maxCost - minCost) * float64(low-top))
+		}
+		if height >= 0 {
+			fill(img, image.Rect(x, zero-height, x+barWidth, zero), chartBar)
+		} else {
+			fill(img, image.Rect(x, zero, x+barWidth, zero-height), chartBar)
+		}
+
+		if (len(usage)-1-i)%labelEvery != 0 {
+			continue
+		}
+		center := x + barWidth/2
+		drawText(img, u.Period, center, bottom+6)
+		if height >= 0 {
+			drawText(img, costLabel(u.Cost), center, zero-height-textHeight-4)
+		} else {
+			drawText(img, costLabel(u.Cost), center, zero-height+4)
+		}
+	}
+	return img
+}
+
+// costLabel formats a cost for the chart, such as $1.50 or -$1.50
+func costLabel(cost float64) string {
+	if cost < 0 {
+		return fmt.Sprintf("-$%.2f", -cost)
+	}
+	return fmt.Sprintf("$%.2f", cost)
+}
+
+// fill paints rect in c
+func fill(img *image.RGBA, rect image.Rectangle, c color.Color) {
+	draw.Draw(img, rect, image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+// drawText draws s centered on x with its top at y. Characters without a
+// glyph are left blank.
+func drawText(img *image.RGBA, s string, x, y int) {
+	advance := (3 + glyphSpacing) * glyphScale
+	x -= textWidth(s) / 2
+
+	for _, ch := range s {
+		glyph := glyphs[ch]
+		for row, line := range glyph {
+			for col, bit := range line {
+				if bit != '#' {
+					continue
+				}
+				px, py := x+col*glyphScale, y+row*glyphScale
+				fill(img, image.Rect(px, py, px+glyphScale, py+glyphScale), chartText)
+			}
+		}
+		x += advance
+	}
+}
+
+// textWidth returns the width of s as drawText draws it, in pixels
+func textWidth(s string) int {
+	if s == "" {
+		return 0
+	}
+	return len(s)*(3+glyphSpacing)*glyphScale - glyphSpacing*glyphScale
+}
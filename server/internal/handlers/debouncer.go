@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"log/slog"
 	"sync"
 	"time"
 
@@ -11,34 +12,37 @@ import (
 type SummaryDebouncer struct {
 	db      *database.DB
 	delay   time.Duration
+	done    func(userID string)
 	mu      sync.Mutex
 	pending map[string]*pendingUpdate
 }
 
 type pendingUpdate struct {
 	generation int
-	billingDay int
+	loc        *time.Location
 	records    []database.UsageRecord
 }
 
-// NewSummaryDebouncer creates a debouncer with the specified delay
-func NewSummaryDebouncer(db *database.DB, delay time.Duration) *SummaryDebouncer {
+// NewSummaryDebouncer creates a debouncer with the specified delay that calls
+// done after each user's summaries are updated
+func NewSummaryDebouncer(db *database.DB, delay time.Duration, done func(userID string)) *SummaryDebouncer {
 	return &SummaryDebouncer{
 		db:      db,
 		delay:   delay,
+		done:    done,
 		pending: make(map[string]*pendingUpdate),
 	}
 }
 
 // Schedule queues a summary update for a user, resetting the timer if already pending
-func (d *SummaryDebouncer) Schedule(userID string, billingDay int, records []database.UsageRecord) {
+func (d *SummaryDebouncer) Schedule(userID string, loc *time.Location, records []database.UsageRecord) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
 	if p, exists := d.pending[userID]; exists {
 		// Append records and bump generation (invalidates old timer)
 		p.records = append(p.records, records...)
-		p.billingDay = billingDay
+		p.loc = loc
 		p.generation++
 		gen := p.generation
 		time.AfterFunc(d.delay, func() {
@@ -50,7 +54,7 @@ func (d *SummaryDebouncer) Schedule(userID string, billingDay int, records []dat
 	// Create new pending update
 	d.pending[userID] = &pendingUpdate{
 		generation: 1,
-		billingDay: billingDay,
+		loc:        loc,
 		records:    records,
 	}
 	time.AfterFunc(d.delay, func() {
@@ -70,5 +74,62 @@ func (d *SummaryDebouncer) flush(userID string, generation int) {
 	d.mu.Unlock()
 
 	// Run the actual summary update
-	d.db.UpdateSummaries(userID, p.billingDay, p.records)
+	if err := d.db.UpdateSummaries(userID, p.loc, p.records); err != nil {
+		slog.Error("Failed to update summaries", "user_id", userID, "error", err)
+	}
+	d.done(userID)
+}
+
+// CycleRebuilder rebuilds users' cycle summaries in the background. A rebuild
+// requested while one is running for the same user runs once it finishes,
+// rather than alongside it, so rapid billing day changes coalesce.
+type CycleRebuilder struct {
+	db      *database.DB
+	done    func(userID string)
+	mu      sync.Mutex
+	pending map[string]*time.Location // Users with a rebuild running, and the location to rebuild in again if requested since
+}
+
+// NewCycleRebuilder creates a rebuilder that calls done after each user's
+// rebuilds finish
+func NewCycleRebuilder(db *database.DB, done func(userID string)) *CycleRebuilder {
+	return &CycleRebuilder{
+		db:      db,
+		done:    done,
+		pending: make(map[string]*time.Location),
+	}
+}
+
+// Schedule rebuilds a user's cycle summaries for their billing day as stored
+// when the rebuild runs
+func (c *CycleRebuilder) Schedule(userID string, loc *time.Location) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, running := c.pending[userID]; running {
+		c.pending[userID] = loc
+		return
+	}
+	c.pending[userID] = nil
+	go c.run(userID, loc)
+}
+
+func (c *CycleRebuilder) run(userID string, loc *time.Location) {
+	for {
+		if err := c.db.RebuildCycleSummaries(userID, loc); err != nil {
+			slog.Error("Failed to rebuild cycle summaries", "user_id", userID, "error", err)
+		}
+
+		c.mu.Lock()
+		next := c.pending[userID]
+		if next == nil {
+			delete(c.pending, userID)
+			c.mu.Unlock()
+			break
+		}
+		c.pending[userID] = nil
+		c.mu.Unlock()
+		loc = next
+	}
+	c.done(userID)
 }
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zhaobenny/cctop/server/internal/auth"
+)
+
+// eventKeepalive is how often an idle event stream gets a comment, so
+// proxies don't close it
+const eventKeepalive = 30 * time.Second
+
+// UsageEvents notifies a user's open dashboards when their usage changes
+type UsageEvents struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan struct{}]struct{}
+}
+
+// NewUsageEvents creates an empty subscriber registry
+func NewUsageEvents() *UsageEvents {
+	return &UsageEvents{subscribers: make(map[string]map[chan struct{}]struct{})}
+}
+
+// Subscribe registers for a user's notifications. Call the returned
+// function to unsubscribe.
+func (e *UsageEvents) Subscribe(userID string) (<-chan struct{}, func()) {
+	// Buffered so a notification sent while the subscriber is busy isn't lost;
+	// further ones coalesce into it
+	ch := make(chan struct{}, 1)
+
+	e.mu.Lock()
+	if e.subscribers[userID] == nil {
+		e.subscribers[userID] = make(map[chan struct{}]struct{})
+	}
+	e.subscribers[userID][ch] = struct{}{}
+	e.mu.Unlock()
+
+	return ch, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(e.subscribers[userID], ch)
+		if len(e.subscribers[userID]) == 0 {
+			delete(e.subscribers, userID)
+		}
+	}
+}
+
+// Publish notifies all of a user's subscribers without blocking
+func (e *UsageEvents) Publish(userID string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for ch := range e.subscribers[userID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Events streams Server-Sent Events to the dashboard. A "usage" event is
+// sent whenever the user's usage records change.
+func (h *Handler) Events(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		h.log(r).Error("Event stream not supported", "error", err)
+		return
+	}
+
+	updates, unsubscribe := h.events.Subscribe(user.ID)
+	defer unsubscribe()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-updates:
+			fmt.Fprint(w, "event: usage\ndata: {}\n\n")
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zhaobenny/cctop/server/internal/auth"
+	"github.com/zhaobenny/cctop/server/internal/database"
+)
+
+// Grafana SimpleJSON datasource endpoints. Targets are named
+// "<period>.<metric>", e.g. "daily.cost" or "monthly.tokens".
+
+// grafanaPeriods maps a target period to its summary period type and key
+// layout
+var grafanaPeriods = map[string]struct {
+	periodType string
+	layout     string
+}{
+	"daily":   {"day", "2006-01-02"},
+	"weekly":  {"week", "2006-01-02"},
+	"monthly": {"month", "2006-01"},
+}
+
+// grafanaMetrics maps a target metric to the value it plots
+var grafanaMetrics = map[string]func(u database.AggregatedUsage) float64{
+	"cost":                  func(u database.AggregatedUsage) float64 { return u.Cost },
+	"input_tokens":          func(u database.AggregatedUsage) float64 { return float64(u.InputTokens) },
+	"output_tokens":         func(u database.AggregatedUsage) float64 { return float64(u.OutputTokens) },
+	"cache_creation_tokens": func(u database.AggregatedUsage) float64 { return float64(u.CacheCreationTokens) },
+	"cache_read_tokens":     func(u database.AggregatedUsage) float64 { return float64(u.CacheReadTokens) },
+	"tokens": func(u database.AggregatedUsage) float64 {
+		return float64(u.InputTokens + u.OutputTokens + u.CacheCreationTokens + u.CacheReadTokens)
+	},
+}
+
+// GrafanaQueryRequest is the body of a SimpleJSON /query request
+type GrafanaQueryRequest struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	Targets []struct {
+		Target string `json:"target"`
+	} `json:"targets"`
+}
+
+// GrafanaSeries is one time series in a SimpleJSON /query response
+type GrafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"` // [value, unix ms]
+}
+
+// GrafanaTest answers the datasource connection test
+func (h *Handler) GrafanaTest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// GrafanaSearch lists the available targets
+func (h *Handler) GrafanaSearch(w http.ResponseWriter, r *http.Request) {
+	var targets []string
+	for period := range grafanaPeriods {
+		for metric := range grafanaMetrics {
+			targets = append(targets, period+"."+metric)
+		}
+	}
+	sort.Strings(targets)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targets)
+}
+
+// GrafanaQuery returns time series for the requested targets, with a point
+// for each period overlapping the range however long it is
+func (h *Handler) GrafanaQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := auth.GetUser(r.Context())
+
+	var req GrafanaQueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Each period is queried at most once however many targets use it
+	usageByPeriod := make(map[string][]database.AggregatedUsage)
+
+	series := []GrafanaSeries{}
+	for _, t := range req.Targets {
+		periodName, metricName, _ := strings.Cut(t.Target, ".")
+		period, ok := grafanaPeriods[periodName]
+		metric, ok2 := grafanaMetrics[metricName]
+		if !ok || !ok2 {
+			h.jsonError(w, "Unknown target: "+t.Target, http.StatusBadRequest)
+			return
+		}
+
+		usage, ok := usageByPeriod[periodName]
+		if !ok {
+			var err error
+			usage, err = h.db.GetUsageInRange(user.ID, period.periodType, user.Location(), req.Range.From, req.Range.To)
+			if err != nil {
+				h.log(r).Error("Failed to load usage for Grafana", "target", t.Target, "error", err)
+				h.jsonError(w, "Failed to load usage", http.StatusInternalServerError)
+				return
+			}
+			usageByPeriod[periodName] = usage
+		}
+
+		s := GrafanaSeries{Target: t.Target, Datapoints: [][2]float64{}}
+		for _, u := range usage {
+			ts, err := time.ParseInLocation(period.layout, u.Period, user.Location())
+			if err != nil {
+				continue
+			}
+			s.Datapoints = append(s.Datapoints, [2]float64{metric(u), float64(ts.UnixMilli())})
+		}
+
+		series = append(series, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(series)
+}
+
+// GrafanaAnnotations returns no annotations; cctop has no events to plot
+func (h *Handler) GrafanaAnnotations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("[]"))
+}
@@ -1,16 +1,26 @@
 package handlers
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
+	"io"
+	"log/slog"
 	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/alexedwards/scs/v2"
+	"github.com/zhaobenny/cctop/internal/billing"
 	"github.com/zhaobenny/cctop/server/internal/auth"
 	"github.com/zhaobenny/cctop/server/internal/database"
+	"github.com/zhaobenny/cctop/server/internal/middleware"
 )
 
 // Handler holds dependencies for HTTP handlers
@@ -19,17 +29,30 @@ type Handler struct {
 	sessionMgr          *scs.SessionManager
 	templates           *template.Template
 	disableRegistration bool
+	inviteCode          string // Required to register, if set
+	passwordPolicy      auth.PasswordPolicy
+	lockout             *auth.LoginLockout
 	debouncer           *SummaryDebouncer
+	cycleRebuilder      *CycleRebuilder
+	events              *UsageEvents
+	basePath            string // Path prefix the dashboard is served under, e.g. "/cctop"
 }
 
 // New creates a new Handler
-func New(db *database.DB, sessionMgr *scs.SessionManager, templates *template.Template, disableRegistration bool) *Handler {
+func New(db *database.DB, sessionMgr *scs.SessionManager, templates *template.Template, disableRegistration bool, inviteCode string, passwordPolicy auth.PasswordPolicy, lockout *auth.LoginLockout, basePath string) *Handler {
+	events := NewUsageEvents()
 	return &Handler{
 		db:                  db,
 		sessionMgr:          sessionMgr,
 		templates:           templates,
 		disableRegistration: disableRegistration,
-		debouncer:           NewSummaryDebouncer(db, time.Minute),
+		inviteCode:          inviteCode,
+		passwordPolicy:      passwordPolicy,
+		lockout:             lockout,
+		debouncer:           NewSummaryDebouncer(db, SummaryDebounceDelay, events.Publish),
+		cycleRebuilder:      NewCycleRebuilder(db, events.Publish),
+		events:              events,
+		basePath:            basePath,
 	}
 }
 
@@ -42,6 +65,8 @@ func (h *Handler) Index(w http.ResponseWriter, r *http.Request) {
 		h.templates.ExecuteTemplate(w, "index.html", map[string]interface{}{
 			"Content":             "auth",
 			"DisableRegistration": h.disableRegistration,
+			"InviteRequired":      h.inviteCode != "",
+			"PasswordPolicy":      h.passwordPolicy,
 		})
 		return
 	}
@@ -53,36 +78,51 @@ func (h *Handler) Index(w http.ResponseWriter, r *http.Request) {
 		h.templates.ExecuteTemplate(w, "index.html", map[string]interface{}{
 			"Content":             "auth",
 			"DisableRegistration": h.disableRegistration,
+			"InviteRequired":      h.inviteCode != "",
+			"PasswordPolicy":      h.passwordPolicy,
 		})
 		return
 	}
 
-	// Default view is monthly
-	view := "monthly"
-	usage, _ := h.db.GetUsageByMonth(userID)
-	total, _ := h.db.GetTotalUsage(userID, 0)
+	view := defaultView(user)
+	loc := user.Location()
+	usage, total := h.usageForView(user, view, 0)
 
-	// Build server URL from request
-	scheme := "http"
-	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
-		scheme = "https"
+	// Calculate billing period
+	periodStart, periodEnd := billing.CurrentPeriod(user.BillingDay, time.Now().In(loc))
+
+	clients, err := h.db.GetClients(userID)
+	if err != nil {
+		h.log(r).Error("Failed to load clients", "error", err)
+	}
+	for i := range clients {
+		if t := clients[i].LastSyncAt; t != nil {
+			local := t.In(loc)
+			clients[i].LastSyncAt = &local
+		}
 	}
-	serverURL := scheme + "://" + r.Host
 
-	// Calculate billing period
-	periodStart, periodEnd := database.GetBillingPeriod(user.BillingDay)
+	shareLinks, err := h.db.GetShareLinks(userID)
+	if err != nil {
+		h.log(r).Error("Failed to load share links", "error", err)
+	}
 
 	h.templates.ExecuteTemplate(w, "index.html", map[string]interface{}{
 		"Content":     "dashboard",
 		"User":        user,
 		"Usage":       usage,
 		"Total":       total,
-		"ServerURL":   serverURL,
-		"HasData":     len(usage) > 0,
+		"ServerURL":   h.serverURL(r),
+		"HasData":     len(usage) > 0 || h.db.HasSummaries(userID),
 		"View":        view,
+		"TablePath":   "/partial/usage-table",
+		"DefaultView": view,
 		"BillingDay":  user.BillingDay,
+		"Timezone":    user.Timezone,
 		"PeriodStart": periodStart,
 		"PeriodEnd":   periodEnd,
+		"Clients":     clients,
+		"ShareLinks":  shareLinks,
 	})
 }
 
@@ -90,6 +130,8 @@ func (h *Handler) Index(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) PartialAuth(w http.ResponseWriter, r *http.Request) {
 	h.templates.ExecuteTemplate(w, "auth.html", map[string]interface{}{
 		"DisableRegistration": h.disableRegistration,
+		"InviteRequired":      h.inviteCode != "",
+		"PasswordPolicy":      h.passwordPolicy,
 	})
 }
 
@@ -108,16 +150,27 @@ func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if remaining := h.lockout.Locked(username); remaining > 0 {
+		h.log(r).Info("Login attempt on locked account", "username", username)
+		minutes := int(remaining.Minutes()) + 1
+		h.renderError(w, fmt.Sprintf("Too many failed login attempts. Try again in %d min.", minutes))
+		return
+	}
+
 	user, err := h.db.GetUserByUsername(username)
 	if err != nil {
+		h.log(r).Error("Failed to look up user", "error", err)
 		h.renderError(w, "An error occurred")
 		return
 	}
 
 	if user == nil || !auth.CheckPassword(password, user.PasswordHash) {
+		h.log(r).Info("Failed login attempt", "username", username)
+		h.lockout.Fail(username)
 		h.renderError(w, "Invalid username or password")
 		return
 	}
+	h.lockout.Reset(username)
 
 	// Create session
 	h.sessionMgr.Put(r.Context(), "userID", user.ID)
@@ -138,6 +191,15 @@ func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.inviteCode != "" {
+		code := strings.TrimSpace(r.FormValue("invite_code"))
+		if subtle.ConstantTimeCompare([]byte(code), []byte(h.inviteCode)) != 1 {
+			h.log(r).Warn("Registration with invalid invite code")
+			h.renderError(w, "Invalid invite code")
+			return
+		}
+	}
+
 	username := strings.TrimSpace(r.FormValue("username"))
 	password := r.FormValue("password")
 
@@ -151,8 +213,8 @@ func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(password) < 8 {
-		h.renderError(w, "Password must be at least 8 characters")
+	if err := h.passwordPolicy.Check(password); err != nil {
+		h.renderError(w, err.Error())
 		return
 	}
 
@@ -166,18 +228,21 @@ func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
 	// Create user
 	passwordHash, err := auth.HashPassword(password)
 	if err != nil {
+		h.log(r).Error("Failed to hash password", "error", err)
 		h.renderError(w, "An error occurred")
 		return
 	}
 
 	userID, err := auth.GenerateID()
 	if err != nil {
+		h.log(r).Error("Failed to generate user ID", "error", err)
 		h.renderError(w, "An error occurred")
 		return
 	}
 
 	apiKey, err := auth.GenerateAPIKey()
 	if err != nil {
+		h.log(r).Error("Failed to generate API key", "error", err)
 		h.renderError(w, "An error occurred")
 		return
 	}
@@ -191,10 +256,13 @@ func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := h.db.CreateUser(user); err != nil {
+		h.log(r).Error("Failed to create user", "username", username, "error", err)
 		h.renderError(w, "Failed to create account")
 		return
 	}
 
+	h.log(r).Info("User registered", "user_id", user.ID, "username", username)
+
 	// Create session
 	h.sessionMgr.Put(r.Context(), "userID", user.ID)
 
@@ -206,7 +274,7 @@ func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
 	h.sessionMgr.Destroy(r.Context())
 	// Redirect to refresh the full page (header needs to hide username/logout)
-	w.Header().Set("HX-Redirect", "/")
+	w.Header().Set("HX-Redirect", h.basePath+"/")
 }
 
 // PartialDashboard returns the dashboard fragment
@@ -226,28 +294,29 @@ func (h *Handler) PartialUsageTable(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	h.renderUsageTable(w, r, user)
+}
 
+// renderUsageTable renders the usage table fragment for the view requested
+func (h *Handler) renderUsageTable(w http.ResponseWriter, r *http.Request, user *database.User) {
 	view := r.URL.Query().Get("view")
 	if view == "" {
-		view = "monthly" // default
+		view = defaultView(user)
 	}
 
-	var usage []database.AggregatedUsage
-	var total *database.AggregatedUsage
-
+	// Optional row limits; the database applies defaults and caps
+	limit := 0
 	switch view {
+	case "daily":
+		limit, _ = strconv.Atoi(r.URL.Query().Get("days"))
+	case "weekly":
+		limit, _ = strconv.Atoi(r.URL.Query().Get("weeks"))
 	case "monthly":
-		usage, _ = h.db.GetUsageByMonth(user.ID)
-		total, _ = h.db.GetTotalUsage(user.ID, 0)
-	case "billing":
-		usage, _ = h.db.GetUsageByBillingCycle(user.ID, user.BillingDay)
-		total, _ = h.db.GetTotalUsage(user.ID, 0)
-	default: // daily
-		usage, _ = h.db.GetUsageByDay(user.ID, 0)
-		total, _ = h.db.GetTotalUsage(user.ID, 0)
+		limit, _ = strconv.Atoi(r.URL.Query().Get("months"))
 	}
 
-	periodStart, periodEnd := database.GetBillingPeriod(user.BillingDay)
+	usage, total := h.usageForView(user, view, limit)
+	periodStart, periodEnd := billing.CurrentPeriod(user.BillingDay, time.Now().In(user.Location()))
 
 	h.templates.ExecuteTemplate(w, "usage-table.html", map[string]interface{}{
 		"Usage":       usage,
@@ -259,6 +328,97 @@ func (h *Handler) PartialUsageTable(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// dashboardViews are the usage table views a user can pick as their default
+var dashboardViews = []string{"monthly", "weekly", "daily", "billing", "models", "tags"}
+
+// defaultView returns the user's preferred dashboard view. Billing falls
+// back to monthly when no billing day is set, since it has no tab then.
+func defaultView(user *database.User) string {
+	switch user.DefaultView {
+	case "":
+		return "monthly"
+	case "billing":
+		if user.BillingDay == 0 {
+			return "monthly"
+		}
+	}
+	return user.DefaultView
+}
+
+// usageForView loads the usage rows and total shown by a usage table view.
+// limit bounds the number of past days, weeks or months listed (0 = default).
+func (h *Handler) usageForView(user *database.User, view string, limit int) ([]database.AggregatedUsage, *database.AggregatedUsage) {
+	var usage []database.AggregatedUsage
+	var total *database.AggregatedUsage
+	loc := user.Location()
+
+	switch view {
+	case "monthly":
+		usage, _ = h.db.GetUsageByMonth(user.ID, loc, limit)
+		total, _ = h.db.GetTotalUsage(user.ID, 0, loc)
+	case "weekly":
+		usage, _ = h.db.GetUsageByWeek(user.ID, loc, limit)
+		total, _ = h.db.GetTotalUsage(user.ID, 0, loc)
+	case "billing":
+		usage, _ = h.db.GetUsageByBillingCycle(user.ID, user.BillingDay, loc)
+		total, _ = h.db.GetTotalUsage(user.ID, 0, loc)
+	case "models":
+		usage, _ = h.db.GetUsageByModel(user.ID, user.BillingDay, loc)
+		total = sumUsage(usage)
+	case "tags":
+		usage, _ = h.db.GetUsageByTag(user.ID, user.BillingDay, loc)
+		total = sumUsage(usage)
+	default: // daily
+		usage, _ = h.db.GetUsageByDay(user.ID, 0, loc, limit)
+		total, _ = h.db.GetTotalUsage(user.ID, 0, loc)
+	}
+	return usage, total
+}
+
+// sumUsage totals the rows of views that only cover the current period
+func sumUsage(usage []database.AggregatedUsage) *database.AggregatedUsage {
+	total := &database.AggregatedUsage{Period: "Total"}
+	for _, u := range usage {
+		total.InputTokens += u.InputTokens
+		total.OutputTokens += u.OutputTokens
+		total.CacheCreationTokens += u.CacheCreationTokens
+		total.CacheReadTokens += u.CacheReadTokens
+		total.Cost += u.Cost
+	}
+	return total
+}
+
+// UpdateDefaultView handles default dashboard view updates
+func (h *Handler) UpdateDefaultView(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		h.renderError(w, "Invalid form data")
+		return
+	}
+
+	view := r.FormValue("default_view")
+	if !slices.Contains(dashboardViews, view) {
+		h.renderError(w, "Unknown view")
+		return
+	}
+
+	if err := h.db.UpdateUserDefaultView(user.ID, view); err != nil {
+		h.log(r).Error("Failed to update default view", "error", err)
+		h.renderError(w, "Failed to update default view")
+		return
+	}
+
+	h.templates.ExecuteTemplate(w, "view-section.html", map[string]interface{}{
+		"DefaultView": view,
+		"BillingDay":  user.BillingDay,
+	})
+}
+
 // UpdateBillingDay handles billing day updates
 func (h *Handler) UpdateBillingDay(w http.ResponseWriter, r *http.Request) {
 	user := auth.GetUser(r.Context())
@@ -291,13 +451,15 @@ func (h *Handler) UpdateBillingDay(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := h.db.UpdateUserBillingDay(user.ID, billingDay); err != nil {
+		h.log(r).Error("Failed to update billing day", "error", err)
 		h.renderError(w, "Failed to update billing day")
 		return
 	}
 
-	// Update user object and rebuild cycle summaries (cycle periods changed)
-	user.BillingDay = billingDay
-	h.db.RebuildCycleSummaries(user.ID, billingDay)
+	// Cycle periods changed. Rebuilding their summaries can take a while
+	// with years of usage, so it happens in the background; the dashboard
+	// reloads its view when it's done.
+	h.cycleRebuilder.Schedule(user.ID, user.Location())
 
 	// Return updated billing section
 	h.templates.ExecuteTemplate(w, "billing-section.html", map[string]interface{}{
@@ -305,13 +467,57 @@ func (h *Handler) UpdateBillingDay(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// UpdateTimezone handles timezone updates
+func (h *Handler) UpdateTimezone(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		h.renderError(w, "Invalid form data")
+		return
+	}
+
+	timezone := strings.TrimSpace(r.FormValue("timezone"))
+	if timezone != "" {
+		if _, err := time.LoadLocation(timezone); err != nil {
+			h.renderError(w, "Unknown timezone")
+			return
+		}
+	}
+
+	if err := h.db.UpdateUserTimezone(user.ID, timezone); err != nil {
+		h.log(r).Error("Failed to update timezone", "error", err)
+		h.renderError(w, "Failed to update timezone")
+		return
+	}
+
+	// Day, month and cycle boundaries all move with the timezone
+	user.Timezone = timezone
+	if err := h.db.RebuildSummaries(user.ID, user.Location()); err != nil {
+		h.log(r).Error("Failed to rebuild summaries", "error", err)
+	}
+
+	h.templates.ExecuteTemplate(w, "timezone-section.html", map[string]interface{}{
+		"Timezone": timezone,
+		"Updated":  true,
+	})
+}
+
 // SyncRequest represents the incoming sync data
 type SyncRequest struct {
 	ClientID   string       `json:"client_id"`
 	ClientName string       `json:"client_name"`
 	Records    []SyncRecord `json:"records"`
+	Partial    bool         `json:"partial,omitempty"` // A selection, e.g. a date range; leaves last sync time alone
+	Tag        string       `json:"tag,omitempty"`     // Groups the records on the dashboard, e.g. "work"
 }
 
+// maxTagLength bounds a sync tag, which is shown as a dashboard row label
+const maxTagLength = 64
+
 // SyncRecord represents a single usage record in the sync request
 type SyncRecord struct {
 	Timestamp           string `json:"timestamp"`
@@ -340,7 +546,14 @@ func (h *Handler) APISync(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req SyncRequest
+	r.Body = http.MaxBytesReader(w, r.Body, MaxSyncBytes)
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			h.log(r).Warn("Sync request too large", "limit", tooLarge.Limit)
+			h.jsonError(w, fmt.Sprintf("Sync request is larger than the server's %d byte limit; sync fewer records at a time", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
 		h.jsonError(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
@@ -349,6 +562,17 @@ func (h *Handler) APISync(w http.ResponseWriter, r *http.Request) {
 		h.jsonError(w, "client_id is required", http.StatusBadRequest)
 		return
 	}
+	// Records under this ID are taken for manual adjustments
+	if req.ClientID == database.AdjustmentClientID {
+		h.jsonError(w, fmt.Sprintf("client_id %q is reserved", database.AdjustmentClientID), http.StatusBadRequest)
+		return
+	}
+
+	req.Tag = strings.TrimSpace(req.Tag)
+	if len(req.Tag) > maxTagLength {
+		h.jsonError(w, fmt.Sprintf("tag must be at most %d bytes", maxTagLength), http.StatusBadRequest)
+		return
+	}
 
 	if len(req.Records) == 0 {
 		w.Header().Set("Content-Type", "application/json")
@@ -367,6 +591,7 @@ func (h *Handler) APISync(w http.ResponseWriter, r *http.Request) {
 	}
 	_, err := h.db.GetOrCreateClient(user.ID, req.ClientID, clientName)
 	if err != nil {
+		h.log(r).Error("Failed to create client", "client_id", req.ClientID, "error", err)
 		h.jsonError(w, "Failed to create client", http.StatusInternalServerError)
 		return
 	}
@@ -379,7 +604,7 @@ func (h *Handler) APISync(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		records = append(records, database.UsageRecord{
+		record := database.UsageRecord{
 			UserID:              user.ID,
 			ClientID:            req.ClientID,
 			Timestamp:           ts,
@@ -390,26 +615,40 @@ func (h *Handler) APISync(w http.ResponseWriter, r *http.Request) {
 			OutputTokens:        r.OutputTokens,
 			CacheCreationTokens: r.CacheCreationTokens,
 			CacheReadTokens:     r.CacheReadTokens,
-		})
+			Tag:                 req.Tag,
+		}
+		record.SessionID = record.SessionIDOrDerived()
+		records = append(records, record)
 	}
 
 	inserted, err := h.db.InsertUsageRecords(records)
 	if err != nil {
+		h.log(r).Error("Failed to insert records", "client_id", req.ClientID, "error", err)
 		h.jsonError(w, "Failed to insert records", http.StatusInternalServerError)
 		return
 	}
 
-	// Update summaries - immediate if no existing summaries, debounced otherwise
+	// Update summaries - immediate in sync mode or if no existing summaries,
+	// debounced otherwise. Debounced updates are published once they run.
 	if inserted > 0 {
-		if h.db.HasSummaries(user.ID) {
-			h.debouncer.Schedule(user.ID, user.BillingDay, records)
+		if SummaryMode == SummaryModeDebounce && h.db.HasSummaries(user.ID) {
+			h.debouncer.Schedule(user.ID, user.Location(), records)
 		} else {
-			h.db.UpdateSummaries(user.ID, user.BillingDay, records)
+			if err := h.db.UpdateSummaries(user.ID, user.Location(), records); err != nil {
+				h.log(r).Error("Failed to update summaries", "error", err)
+			}
+			h.events.Publish(user.ID)
 		}
 	}
 
-	// Update last sync time
-	h.db.UpdateClientLastSync(req.ClientID, time.Now())
+	// Update last sync time, unless records after it may have been left out
+	if !req.Partial {
+		if err := h.db.UpdateClientLastSync(req.ClientID, time.Now()); err != nil {
+			h.log(r).Error("Failed to update last sync time", "client_id", req.ClientID, "error", err)
+		}
+	}
+
+	h.log(r).Info("Sync completed", "client_id", req.ClientID, "received", len(req.Records), "inserted", inserted)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(SyncResponse{
@@ -419,6 +658,402 @@ func (h *Handler) APISync(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// DeleteRecordsResponse represents the delete records API response
+type DeleteRecordsResponse struct {
+	Success bool  `json:"success"`
+	Deleted int64 `json:"deleted"`
+}
+
+// APIDeleteRecords deletes the user's records between the from and to query
+// parameters, which are RFC 3339 timestamps or dates in the user's timezone.
+// The range includes from and excludes to.
+func (h *Handler) APIDeleteRecords(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := auth.GetUser(r.Context())
+	loc := user.Location()
+
+	from, err := parseRangeTime(r.URL.Query().Get("from"), loc)
+	if err != nil {
+		h.jsonError(w, "Invalid from: use an RFC 3339 timestamp or YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	to, err := parseRangeTime(r.URL.Query().Get("to"), loc)
+	if err != nil {
+		h.jsonError(w, "Invalid to: use an RFC 3339 timestamp or YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	if !from.Before(to) {
+		h.jsonError(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := h.db.DeleteRecordsInRange(user.ID, from, to)
+	if err != nil {
+		h.log(r).Error("Failed to delete records", "from", from, "to", to, "error", err)
+		h.jsonError(w, "Failed to delete records", http.StatusInternalServerError)
+		return
+	}
+
+	h.log(r).Info("Records deleted", "from", from, "to", to, "deleted", deleted)
+	if deleted > 0 {
+		h.events.Publish(user.ID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DeleteRecordsResponse{Success: true, Deleted: deleted})
+}
+
+// AdjustmentRequest is a manual cost adjustment, such as a credit
+type AdjustmentRequest struct {
+	Amount    float64 `json:"amount"`              // In USD, negative for a credit
+	Timestamp string  `json:"timestamp,omitempty"` // RFC 3339 timestamp or date in the user's timezone; defaults to now
+}
+
+// AdjustmentResponse represents the adjustment API response
+type AdjustmentResponse struct {
+	Success bool   `json:"success"`
+	ID      string `json:"id"`
+}
+
+// APIAdjustment records a manual cost adjustment. It has no tokens, but its
+// cost is netted into every total and summary containing it.
+func (h *Handler) APIAdjustment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := auth.GetUser(r.Context())
+	loc := user.Location()
+
+	var req AdjustmentRequest
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<10)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Amount == 0 {
+		h.jsonError(w, "amount is required and must not be zero", http.StatusBadRequest)
+		return
+	}
+
+	t := time.Now()
+	if req.Timestamp != "" {
+		var err error
+		if t, err = parseRangeTime(req.Timestamp, loc); err != nil {
+			h.jsonError(w, "Invalid timestamp: use an RFC 3339 timestamp or YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	if prunedBefore := h.db.PrunedBefore(user.ID); t.Before(prunedBefore) {
+		h.jsonError(w, fmt.Sprintf("timestamp must not be before %s, where older usage was pruned", prunedBefore.In(loc).Format(time.RFC3339)), http.StatusBadRequest)
+		return
+	}
+
+	id, err := auth.GenerateID()
+	if err != nil {
+		h.log(r).Error("Failed to generate adjustment ID", "error", err)
+		h.jsonError(w, "Failed to record adjustment", http.StatusInternalServerError)
+		return
+	}
+	if err := h.db.InsertAdjustment(user.ID, id, t, req.Amount); err != nil {
+		h.log(r).Error("Failed to record adjustment", "error", err)
+		h.jsonError(w, "Failed to record adjustment", http.StatusInternalServerError)
+		return
+	}
+
+	h.log(r).Info("Adjustment recorded", "id", id, "amount", req.Amount, "timestamp", t)
+	h.events.Publish(user.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AdjustmentResponse{Success: true, ID: id})
+}
+
+// parseRangeTime parses an RFC 3339 timestamp, or a date as midnight in loc
+func parseRangeTime(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, loc)
+}
+
+// ClientResponse describes a sync client in the clients API
+type ClientResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	LastSyncAt *time.Time `json:"last_sync_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// APIClients lists the user's sync clients
+func (h *Handler) APIClients(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r.Context())
+
+	clients, err := h.db.GetClients(user.ID)
+	if err != nil {
+		h.log(r).Error("Failed to load clients", "error", err)
+		h.jsonError(w, "Failed to load clients", http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]ClientResponse, len(clients))
+	for i, c := range clients {
+		resp[i] = ClientResponse{
+			ID:         c.ID,
+			Name:       c.Name,
+			LastSyncAt: c.LastSyncAt,
+			CreatedAt:  c.CreatedAt,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// BreakdownModel is one model's usage within a breakdown period
+type BreakdownModel struct {
+	Model               string  `json:"model"`
+	InputTokens         int64   `json:"input_tokens"`
+	OutputTokens        int64   `json:"output_tokens"`
+	CacheCreationTokens int64   `json:"cache_creation_tokens"`
+	CacheReadTokens     int64   `json:"cache_read_tokens"`
+	Cost                float64 `json:"cost"`
+}
+
+// BreakdownPeriod is a period's total cost and its per-model usage
+type BreakdownPeriod struct {
+	Period string           `json:"period"`
+	Cost   float64          `json:"cost"`
+	Models []BreakdownModel `json:"models"`
+}
+
+// BreakdownResponse represents the breakdown API response
+type BreakdownResponse struct {
+	View    string            `json:"view"`
+	Periods []BreakdownPeriod `json:"periods"`
+}
+
+// APIBreakdown returns the user's cost by period and model, newest period
+// first. Only view=monthly (the default) is supported.
+func (h *Handler) APIBreakdown(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r.Context())
+
+	view := r.URL.Query().Get("view")
+	if view == "" {
+		view = "monthly"
+	}
+	if view != "monthly" {
+		h.jsonError(w, "Unsupported view: use monthly", http.StatusBadRequest)
+		return
+	}
+
+	usage, err := h.db.GetMonthlyModelBreakdown(user.ID)
+	if err != nil {
+		h.log(r).Error("Failed to load breakdown", "view", view, "error", err)
+		h.jsonError(w, "Failed to load breakdown", http.StatusInternalServerError)
+		return
+	}
+
+	// Rows arrive grouped by period
+	resp := BreakdownResponse{View: view, Periods: []BreakdownPeriod{}}
+	for _, u := range usage {
+		if n := len(resp.Periods); n == 0 || resp.Periods[n-1].Period != u.Period {
+			resp.Periods = append(resp.Periods, BreakdownPeriod{Period: u.Period})
+		}
+		p := &resp.Periods[len(resp.Periods)-1]
+		p.Cost += u.Cost
+		p.Models = append(p.Models, BreakdownModel{
+			Model:               u.Model,
+			InputTokens:         u.InputTokens,
+			OutputTokens:        u.OutputTokens,
+			CacheCreationTokens: u.CacheCreationTokens,
+			CacheReadTokens:     u.CacheReadTokens,
+			Cost:                u.Cost,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// UsagePeriod is one period's usage in the usage API
+type UsagePeriod struct {
+	Period              string  `json:"period"`
+	InputTokens         int64   `json:"input_tokens"`
+	OutputTokens        int64   `json:"output_tokens"`
+	CacheCreationTokens int64   `json:"cache_creation_tokens"`
+	CacheReadTokens     int64   `json:"cache_read_tokens"`
+	Cost                float64 `json:"cost"`
+}
+
+// UsageResponse represents the usage API response
+type UsageResponse struct {
+	View         string        `json:"view"`
+	ClientID     string        `json:"client_id"`
+	Timezone     string        `json:"timezone"`
+	PrunedBefore *time.Time    `json:"pruned_before,omitempty"` // Raw records before this were pruned
+	Periods      []UsagePeriod `json:"periods"`
+}
+
+// APIUsage returns one client's usage by month, newest first, summed from
+// raw records, for reconciling with the client's logs. Months are taken in
+// the timezone query parameter (default UTC). Only view=monthly (the
+// default) is supported.
+func (h *Handler) APIUsage(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r.Context())
+	query := r.URL.Query()
+
+	view := query.Get("view")
+	if view == "" {
+		view = "monthly"
+	}
+	if view != "monthly" {
+		h.jsonError(w, "Unsupported view: use monthly", http.StatusBadRequest)
+		return
+	}
+
+	clientID := query.Get("client_id")
+	if clientID == "" {
+		h.jsonError(w, "client_id is required", http.StatusBadRequest)
+		return
+	}
+
+	loc := time.UTC
+	if name := query.Get("timezone"); name != "" {
+		l, err := time.LoadLocation(name)
+		if err != nil {
+			h.jsonError(w, "Invalid timezone", http.StatusBadRequest)
+			return
+		}
+		loc = l
+	}
+
+	usage, err := h.db.GetClientUsageByMonth(user.ID, clientID, loc)
+	if err != nil {
+		h.log(r).Error("Failed to load client usage", "client_id", clientID, "error", err)
+		h.jsonError(w, "Failed to load usage", http.StatusInternalServerError)
+		return
+	}
+
+	resp := UsageResponse{View: view, ClientID: clientID, Timezone: loc.String(), Periods: []UsagePeriod{}}
+	if t := h.db.PrunedBefore(user.ID); !t.IsZero() {
+		resp.PrunedBefore = &t
+	}
+	for _, u := range usage {
+		resp.Periods = append(resp.Periods, UsagePeriod{
+			Period:              u.Period,
+			InputTokens:         u.InputTokens,
+			OutputTokens:        u.OutputTokens,
+			CacheCreationTokens: u.CacheCreationTokens,
+			CacheReadTokens:     u.CacheReadTokens,
+			Cost:                u.Cost,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// exportFlushEvery is how many exported records are written between flushes
+const exportFlushEvery = 1000
+
+// ExportRecord is one line of the export API's NDJSON output
+type ExportRecord struct {
+	Timestamp           time.Time `json:"timestamp"`
+	ClientID            string    `json:"client_id"`
+	SessionID           string    `json:"session_id"`
+	ProjectPath         string    `json:"project_path"`
+	Model               string    `json:"model"`
+	InputTokens         int64     `json:"input_tokens"`
+	OutputTokens        int64     `json:"output_tokens"`
+	CacheCreationTokens int64     `json:"cache_creation_tokens"`
+	CacheReadTokens     int64     `json:"cache_read_tokens"`
+	Cost                float64   `json:"cost"`
+	Tag                 string    `json:"tag,omitempty"`
+}
+
+// exportRecord converts a stored record for export, in the user's timezone
+func exportRecord(rec database.UsageRecord, cost float64, loc *time.Location) ExportRecord {
+	return ExportRecord{
+		Timestamp:           rec.Timestamp.In(loc),
+		ClientID:            rec.ClientID,
+		SessionID:           rec.SessionID,
+		ProjectPath:         rec.ProjectPath,
+		Model:               rec.Model,
+		InputTokens:         rec.InputTokens,
+		OutputTokens:        rec.OutputTokens,
+		CacheCreationTokens: rec.CacheCreationTokens,
+		CacheReadTokens:     rec.CacheReadTokens,
+		Cost:                cost,
+		Tag:                 rec.Tag,
+	}
+}
+
+// APIExport streams the user's raw records as JSON Lines, oldest first,
+// optionally limited to the from and to query parameters as in
+// APIDeleteRecords. Records are written as they're read from the database,
+// so large exports don't build up in memory. Only format=ndjson (the
+// default) is supported.
+func (h *Handler) APIExport(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r.Context())
+	loc := user.Location()
+	query := r.URL.Query()
+
+	if format := query.Get("format"); format != "" && format != "ndjson" {
+		h.jsonError(w, "Unsupported format: use ndjson", http.StatusBadRequest)
+		return
+	}
+
+	var from, to time.Time
+	if value := query.Get("from"); value != "" {
+		t, err := parseRangeTime(value, loc)
+		if err != nil {
+			h.jsonError(w, "Invalid from: use an RFC 3339 timestamp or YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+	if value := query.Get("to"); value != "" {
+		t, err := parseRangeTime(value, loc)
+		if err != nil {
+			h.jsonError(w, "Invalid to: use an RFC 3339 timestamp or YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	// Once a record is written the status is sent, so later errors can
+	// only cut the stream short
+	encoder := json.NewEncoder(w)
+	var written int
+	err := h.db.EachRecord(user.ID, from, to, func(rec database.UsageRecord, cost float64) error {
+		if err := encoder.Encode(exportRecord(rec, cost, loc)); err != nil {
+			return err
+		}
+		written++
+		if written%exportFlushEvery == 0 {
+			return rc.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		h.log(r).Error("Failed to export records", "written", written, "error", err)
+		if written == 0 {
+			h.jsonError(w, "Failed to export records", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	h.log(r).Info("Records exported", "records", written)
+}
+
 // SyncStatusResponse represents the sync status response
 type SyncStatusResponse struct {
 	LastSyncAt *time.Time `json:"last_sync_at,omitempty"`
@@ -440,6 +1075,7 @@ func (h *Handler) APISyncStatus(w http.ResponseWriter, r *http.Request) {
 
 	lastSync, err := h.db.GetClientSyncStatus(user.ID, clientID)
 	if err != nil {
+		h.log(r).Error("Failed to get sync status", "client_id", clientID, "error", err)
 		h.jsonError(w, "Failed to get sync status", http.StatusInternalServerError)
 		return
 	}
@@ -450,9 +1086,28 @@ func (h *Handler) APISyncStatus(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// log returns a logger annotated with the request ID and, when authenticated, the user ID
+func (h *Handler) log(r *http.Request) *slog.Logger {
+	logger := slog.With("request_id", middleware.GetRequestID(r.Context()))
+	if user := auth.GetUser(r.Context()); user != nil {
+		logger = logger.With("user_id", user.ID)
+	}
+	return logger
+}
+
+// serverURL returns the URL the dashboard is served at, as the request
+// reached it
+func (h *Handler) serverURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + h.basePath
+}
+
 func (h *Handler) renderDashboard(w http.ResponseWriter, user *database.User) {
 	// Redirect to refresh the full page (header needs to update with username/logout)
-	w.Header().Set("HX-Redirect", "/")
+	w.Header().Set("HX-Redirect", h.basePath+"/")
 }
 
 func (h *Handler) renderError(w http.ResponseWriter, message string) {
@@ -467,16 +1122,113 @@ func (h *Handler) jsonError(w http.ResponseWriter, message string, status int) {
 	json.NewEncoder(w).Encode(map[string]string{"error": message})
 }
 
-// Health handles the health check endpoint
+// Version is the server version reported by the health check
+var Version = "dev"
+
+// DefaultMaxSyncBytes is the default limit on a sync request's body
+const DefaultMaxSyncBytes = 32 << 20
+
+// MaxSyncBytes limits the size of a sync request's body
+var MaxSyncBytes int64 = DefaultMaxSyncBytes
+
+// Summary update modes: sync updates summaries inline on every sync, while
+// debounce batches a user's syncs together once their first summaries exist
+const (
+	SummaryModeSync     = "sync"
+	SummaryModeDebounce = "debounce"
+)
+
+// SummaryMode is how syncs update summaries
+var SummaryMode = SummaryModeDebounce
+
+// SummaryDebounceDelay is how long the debouncer waits for more syncs before
+// updating summaries. It's read when the Handler is created.
+var SummaryDebounceDelay = time.Minute
+
+// HealthResponse represents the health check response
+type HealthResponse struct {
+	Status                string `json:"status"`
+	Error                 string `json:"error,omitempty"`
+	Version               string `json:"version"`
+	SchemaVersion         int    `json:"schema_version"`
+	ExpectedSchemaVersion int    `json:"expected_schema_version"`
+}
+
+// Livez reports that the process is up. Unlike Health it never touches the
+// database, so a database blip doesn't get the server restarted.
+func (h *Handler) Livez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "alive", "version": Version})
+}
+
+// Health handles the readiness check: the database is reachable and its
+// schema is up to date
 func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
-	// Check database connectivity
-	if err := h.db.Ping(); err != nil {
-		w.Header().Set("Content-Type", "application/json")
+	resp := HealthResponse{
+		Status:                "healthy",
+		Version:               Version,
+		ExpectedSchemaVersion: database.LatestSchemaVersion(),
+	}
+
+	// Check database connectivity and schema
+	schemaVersion, err := h.db.AppliedSchemaVersion()
+	if err != nil {
+		h.log(r).Error("Health check failed", "error", err)
+		resp.Status = "unhealthy"
+		resp.Error = "database unavailable"
+	} else if schemaVersion != resp.ExpectedSchemaVersion {
+		resp.Status = "unhealthy"
+		resp.Error = "schema version mismatch"
+	}
+	resp.SchemaVersion = schemaVersion
+
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status != "healthy" {
 		w.WriteHeader(http.StatusServiceUnavailable)
-		json.NewEncoder(w).Encode(map[string]string{"status": "unhealthy", "error": "database unavailable"})
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// AdminBackup streams a snapshot of the whole database as a download
+func (h *Handler) AdminBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
+	dir, err := os.MkdirTemp("", "cctop-backup-")
+	if err != nil {
+		h.log(r).Error("Failed to create backup directory", "error", err)
+		http.Error(w, "Backup failed", http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cctop.db")
+	if err := h.db.Backup(path); err != nil {
+		h.log(r).Error("Failed to back up database", "error", err)
+		http.Error(w, "Backup failed", http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		h.log(r).Error("Failed to open backup", "error", err)
+		http.Error(w, "Backup failed", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	}
+	filename := "cctop-" + time.Now().Format("20060102-150405") + ".db"
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	if _, err := io.Copy(w, f); err != nil {
+		h.log(r).Error("Failed to stream backup", "error", err)
+		return
+	}
+
+	h.log(r).Info("Database backup downloaded")
 }
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zhaobenny/cctop/internal/billing"
+	"github.com/zhaobenny/cctop/server/internal/auth"
+	"github.com/zhaobenny/cctop/server/internal/database"
+)
+
+// CreateShareLink creates a read-only link to the user's usage
+func (h *Handler) CreateShareLink(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	token, err := auth.GenerateID()
+	if err != nil {
+		h.log(r).Error("Failed to generate share token", "error", err)
+		h.renderError(w, "Failed to create link")
+		return
+	}
+	if err := h.db.CreateShareLink(user.ID, token); err != nil {
+		h.log(r).Error("Failed to create share link", "error", err)
+		h.renderError(w, "Failed to create link")
+		return
+	}
+
+	h.log(r).Info("Share link created")
+	h.renderShareSection(w, r, user)
+}
+
+// RevokeShareLink deletes one of the user's share links, so it stops working
+func (h *Handler) RevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		h.renderError(w, "Invalid form data")
+		return
+	}
+
+	token := strings.TrimSpace(r.FormValue("token"))
+	if _, err := h.db.DeleteShareLink(user.ID, token); err != nil {
+		h.log(r).Error("Failed to revoke share link", "error", err)
+		h.renderError(w, "Failed to revoke link")
+		return
+	}
+
+	h.log(r).Info("Share link revoked")
+	h.renderShareSection(w, r, user)
+}
+
+func (h *Handler) renderShareSection(w http.ResponseWriter, r *http.Request, user *database.User) {
+	links, err := h.db.GetShareLinks(user.ID)
+	if err != nil {
+		h.log(r).Error("Failed to load share links", "error", err)
+	}
+	h.templates.ExecuteTemplate(w, "share-section.html", map[string]interface{}{
+		"ShareLinks": links,
+		"ServerURL":  h.serverURL(r),
+	})
+}
+
+// SharedDashboard shows a read-only dashboard of the usage of the user who
+// shared the link: the usage table views, without settings or clients
+func (h *Handler) SharedDashboard(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r.Context())
+	if user == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	view := defaultView(user)
+	usage, total := h.usageForView(user, view, 0)
+	periodStart, periodEnd := billing.CurrentPeriod(user.BillingDay, time.Now().In(user.Location()))
+
+	w.Header().Set("Cache-Control", "no-store")
+	h.templates.ExecuteTemplate(w, "index.html", map[string]interface{}{
+		"Content":     "shared",
+		"User":        user,
+		"Usage":       usage,
+		"Total":       total,
+		"View":        view,
+		"TablePath":   "/shared/" + r.PathValue("token") + "/usage-table",
+		"BillingDay":  user.BillingDay,
+		"PeriodStart": periodStart,
+		"PeriodEnd":   periodEnd,
+	})
+}
+
+// SharedUsageTable returns the usage table fragment for a shared dashboard
+func (h *Handler) SharedUsageTable(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r.Context())
+	if user == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	h.renderUsageTable(w, r, user)
+}
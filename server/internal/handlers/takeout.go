@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/zhaobenny/cctop/server/internal/auth"
+	"github.com/zhaobenny/cctop/server/internal/database"
+)
+
+// TakeoutUser is the account part of a takeout. Credentials (the password
+// hash and API key) are left out.
+type TakeoutUser struct {
+	ID          string    `json:"id"`
+	Username    string    `json:"username"`
+	BillingDay  int       `json:"billing_day"`
+	Timezone    string    `json:"timezone,omitempty"`
+	DefaultView string    `json:"default_view,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// TakeoutClient is a sync client in a takeout
+type TakeoutClient struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	LastSyncAt *time.Time `json:"last_sync_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// takeoutHeader is everything in a takeout before its records, which are
+// streamed after it
+type takeoutHeader struct {
+	ExportedAt   time.Time       `json:"exported_at"`
+	User         TakeoutUser     `json:"user"`
+	Clients      []TakeoutClient `json:"clients"`
+	PrunedBefore *time.Time      `json:"pruned_before,omitempty"` // Records before this were pruned; only summaries remain
+}
+
+// Takeout downloads everything stored for the user as one JSON document:
+// the account, its sync clients and every raw record, in the ExportRecord
+// format. Records are streamed as they're read, like APIExport.
+func (h *Handler) Takeout(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	loc := user.Location()
+
+	clients, err := h.db.GetClients(user.ID)
+	if err != nil {
+		h.log(r).Error("Failed to load clients", "error", err)
+		http.Error(w, "Failed to export data", http.StatusInternalServerError)
+		return
+	}
+
+	header := takeoutHeader{
+		ExportedAt: time.Now().In(loc),
+		User: TakeoutUser{
+			ID:          user.ID,
+			Username:    user.Username,
+			BillingDay:  user.BillingDay,
+			Timezone:    user.Timezone,
+			DefaultView: user.DefaultView,
+			CreatedAt:   user.CreatedAt.In(loc),
+		},
+		Clients: make([]TakeoutClient, 0, len(clients)),
+	}
+	for _, c := range clients {
+		tc := TakeoutClient{ID: c.ID, Name: c.Name, CreatedAt: c.CreatedAt.In(loc)}
+		if c.LastSyncAt != nil {
+			t := c.LastSyncAt.In(loc)
+			tc.LastSyncAt = &t
+		}
+		header.Clients = append(header.Clients, tc)
+	}
+	if t := h.db.PrunedBefore(user.ID); !t.IsZero() {
+		t = t.In(loc)
+		header.PrunedBefore = &t
+	}
+
+	head, err := json.Marshal(header)
+	if err != nil {
+		h.log(r).Error("Failed to encode takeout", "error", err)
+		http.Error(w, "Failed to export data", http.StatusInternalServerError)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="cctop-takeout.json"`)
+	w.Header().Set("Cache-Control", "no-store")
+
+	// Splice the records array into the header object. Once anything is
+	// written the status is sent, so a later error leaves the document
+	// unterminated, which a reader sees as invalid JSON.
+	w.Write(head[:len(head)-1])
+	w.Write([]byte(`,"records":[`))
+
+	var written int
+	err = h.db.EachRecord(user.ID, time.Time{}, time.Time{}, func(rec database.UsageRecord, cost float64) error {
+		data, err := json.Marshal(exportRecord(rec, cost, loc))
+		if err != nil {
+			return err
+		}
+		if written > 0 {
+			w.Write([]byte{','})
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		written++
+		if written%exportFlushEvery == 0 {
+			return rc.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		h.log(r).Error("Failed to export takeout", "written", written, "error", err)
+		return
+	}
+	w.Write([]byte("]}\n"))
+
+	h.log(r).Info("Takeout exported", "records", written)
+}
@@ -1,12 +1,41 @@
 package middleware
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"net/http"
 	"sync"
 
 	"golang.org/x/time/rate"
 )
 
+type contextKey string
+
+const requestIDKey contextKey = "requestID"
+
+// RequestID assigns each request a random ID, exposed via the X-Request-ID
+// response header and GetRequestID for log correlation
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bytes := make([]byte, 8)
+		rand.Read(bytes)
+		id := hex.EncodeToString(bytes)
+
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// GetRequestID returns the request ID from context
+func GetRequestID(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		return id
+	}
+	return ""
+}
+
 // SecurityHeaders adds security headers to all responses
 func SecurityHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -11,12 +11,16 @@ import (
 //go:embed *.html partials/*.html
 var FS embed.FS
 
-// Parse returns the parsed templates with custom functions
-func Parse() (*template.Template, error) {
+// Parse returns the parsed templates with custom functions. Links made with
+// url are prefixed with basePath, the path the dashboard is served under.
+func Parse(basePath string) (*template.Template, error) {
 	funcMap := template.FuncMap{
+		"url":          func(path string) string { return basePath + path },
 		"formatNumber": formatNumber,
 		"formatCost":   formatCost,
 		"formatDate":   formatDate,
+		"formatTime":   formatTime,
+		"timeAgo":      timeAgo,
 		"seq":          seq,
 	}
 
@@ -58,6 +62,10 @@ func formatNumber(n int64) string {
 }
 
 func formatCost(cost float64) string {
+	// Credits show as -$5.00 rather than $-5.00
+	if cost < 0 {
+		return fmt.Sprintf("-$%.2f", -cost)
+	}
 	return fmt.Sprintf("$%.2f", cost)
 }
 
@@ -67,3 +75,25 @@ func formatDate(t time.Time) string {
 	}
 	return t.Format("Jan 2")
 }
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("Jan 2, 15:04")
+}
+
+// timeAgo formats how long ago t was, e.g. "2h ago"
+func timeAgo(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+	}
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"io/fs"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
+	_ "time/tzdata" // Embedded zoneinfo for per-user timezones (scratch image has none)
 
 	"github.com/alexedwards/scs/sqlite3store"
 	"github.com/alexedwards/scs/v2"
@@ -16,57 +18,104 @@ import (
 	"github.com/zhaobenny/cctop/server/internal/handlers"
 	"github.com/zhaobenny/cctop/server/internal/middleware"
 	"github.com/zhaobenny/cctop/server/internal/templates"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 var version = "dev"
 
 func main() {
+	setupLogger()
+
 	// Load configuration from environment
-	port := getEnv("PORT", "8080")
 	dbPath := getDBPath()
+	basePath := getBasePath()
+	tlsCert, tlsKey, tlsDomain := getTLSConfig()
+	useTLS := tlsDomain != "" || tlsCert != ""
+
+	// Let's Encrypt only validates on the standard ports
+	defaultPort := "8080"
+	if tlsDomain != "" {
+		defaultPort = "443"
+	}
+	port := getEnv("PORT", defaultPort)
 
 	// Ensure database directory exists
 	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
-		log.Fatalf("Failed to create database directory: %v", err)
+		fatal("Failed to create database directory", "error", err)
 	}
 
 	// Open database
 	db, err := database.Open(dbPath)
 	if err != nil {
-		log.Fatalf("Failed to open database: %v", err)
+		fatal("Failed to open database", "error", err)
 	}
 	defer db.Close()
 
 	// Run migrations
 	if err := db.Migrate(); err != nil {
-		log.Fatalf("Failed to run migrations: %v", err)
+		fatal("Failed to run migrations", "error", err)
+	}
+
+	// Prune old raw records if a retention period is configured
+	if days := getEnvInt("RETENTION_DAYS", 0); days > 0 {
+		go pruneLoop(db, days)
 	}
 
 	// Setup session manager with SQLite store
 	sessionMgr := scs.New()
 	sessionMgr.Store = sqlite3store.New(db.DB)
 	sessionMgr.Lifetime = 6 * 30 * 24 * time.Hour // ~6 months
-	sessionMgr.Cookie.Secure = !isDevelopment()
+	sessionMgr.Cookie.Secure = useTLS || !isDevelopment()
 	sessionMgr.Cookie.SameSite = http.SameSiteLaxMode
+	sessionMgr.Cookie.Path = basePath + "/"
 
 	// Setup rate limiter for auth endpoints (5 requests per minute, burst of 5)
 	authLimiter := middleware.NewIPRateLimiter(5.0/60.0, 5)
 
 	// Parse templates
-	tmpl, err := templates.Parse()
+	tmpl, err := templates.Parse(basePath)
 	if err != nil {
-		log.Fatalf("Failed to parse templates: %v", err)
+		fatal("Failed to parse templates", "error", err)
 	}
 
 	// Create handlers
-	disableRegistration := isEnvTrue("DISABLE_REGISTRATION")
-	h := handlers.New(db, sessionMgr, tmpl, disableRegistration)
-	authMiddleware := auth.NewMiddleware(db, sessionMgr)
+	handlers.Version = version
+	if n := getEnvInt("MAX_SYNC_BYTES", 0); n > 0 {
+		handlers.MaxSyncBytes = int64(n)
+	}
+	switch mode := strings.ToLower(getEnv("SUMMARY_MODE", handlers.SummaryModeDebounce)); mode {
+	case handlers.SummaryModeSync, handlers.SummaryModeDebounce:
+		handlers.SummaryMode = mode
+	default:
+		fatal("Invalid SUMMARY_MODE", "value", mode)
+	}
+	if ms := getEnvInt("SUMMARY_DEBOUNCE_MS", 0); ms > 0 {
+		handlers.SummaryDebounceDelay = time.Duration(ms) * time.Millisecond
+	}
+	registrationEnabled := getEnvBool("REGISTRATION_ENABLED", true)
+	if isEnvTrue("DISABLE_REGISTRATION") {
+		slog.Warn("DISABLE_REGISTRATION is deprecated, set REGISTRATION_ENABLED=false instead")
+		registrationEnabled = false
+	}
+	inviteCode := strings.TrimSpace(os.Getenv("REGISTRATION_INVITE_CODE"))
+	passwordPolicy := auth.PasswordPolicy{
+		MinLength:  getEnvInt("PASSWORD_MIN_LENGTH", auth.MinPasswordLength),
+		MinClasses: getEnvInt("PASSWORD_MIN_CLASSES", 0),
+	}
+	lockout := auth.NewLoginLockout(
+		getEnvInt("LOGIN_MAX_FAILURES", 5),
+		time.Duration(getEnvInt("LOGIN_FAILURE_WINDOW_MINUTES", 15))*time.Minute,
+		time.Duration(getEnvInt("LOGIN_LOCKOUT_MINUTES", 15))*time.Minute,
+	)
+	h := handlers.New(db, sessionMgr, tmpl, !registrationEnabled, inviteCode, passwordPolicy, lockout, basePath)
+	authMiddleware := auth.NewMiddleware(db, sessionMgr, basePath)
 
 	// Setup routes
 	mux := http.NewServeMux()
 
-	// Health check (for orchestrators)
+	// Health checks (for orchestrators): liveness, and readiness under both names
+	mux.HandleFunc("/livez", h.Livez)
+	mux.HandleFunc("/readyz", h.Health)
 	mux.HandleFunc("/health", h.Health)
 
 	// Static files (embedded)
@@ -83,22 +132,127 @@ func main() {
 	mux.Handle("/logout", authMiddleware.RequireAuth(http.HandlerFunc(h.Logout)))
 	mux.Handle("/partial/dashboard", authMiddleware.RequireAuth(http.HandlerFunc(h.PartialDashboard)))
 	mux.Handle("/partial/usage-table", authMiddleware.RequireAuth(http.HandlerFunc(h.PartialUsageTable)))
+	mux.Handle("/events", authMiddleware.RequireAuth(http.HandlerFunc(h.Events)))
+	mux.Handle("/chart/monthly.png", authMiddleware.RequireAuth(http.HandlerFunc(h.UsageChart)))
+	mux.Handle("/api/takeout", authMiddleware.RequireAuth(http.HandlerFunc(h.Takeout)))
 	mux.Handle("/settings/billing-day", authMiddleware.RequireAuth(http.HandlerFunc(h.UpdateBillingDay)))
+	mux.Handle("/settings/timezone", authMiddleware.RequireAuth(http.HandlerFunc(h.UpdateTimezone)))
+	mux.Handle("/settings/default-view", authMiddleware.RequireAuth(http.HandlerFunc(h.UpdateDefaultView)))
+	mux.Handle("/settings/share-links", authMiddleware.RequireAuth(http.HandlerFunc(h.CreateShareLink)))
+	mux.Handle("/settings/share-links/revoke", authMiddleware.RequireAuth(http.HandlerFunc(h.RevokeShareLink)))
+
+	// Shared dashboards (share link token-based, read-only)
+	mux.Handle("GET /shared/{token}", authMiddleware.RequireShareToken(http.HandlerFunc(h.SharedDashboard)))
+	mux.Handle("GET /shared/{token}/usage-table", authMiddleware.RequireShareToken(http.HandlerFunc(h.SharedUsageTable)))
 
 	// API routes (API key-based)
 	mux.Handle("/api/sync", authMiddleware.RequireAPIKey(http.HandlerFunc(h.APISync)))
 	mux.Handle("/api/sync/status", authMiddleware.RequireAPIKey(http.HandlerFunc(h.APISyncStatus)))
+	mux.Handle("/api/clients", authMiddleware.RequireAPIKey(http.HandlerFunc(h.APIClients)))
+	mux.Handle("/api/records", authMiddleware.RequireAPIKey(http.HandlerFunc(h.APIDeleteRecords)))
+	mux.Handle("/api/adjustment", authMiddleware.RequireAPIKey(http.HandlerFunc(h.APIAdjustment)))
+	mux.Handle("/api/breakdown", authMiddleware.RequireAPIKey(http.HandlerFunc(h.APIBreakdown)))
+	mux.Handle("/api/usage", authMiddleware.RequireAPIKey(http.HandlerFunc(h.APIUsage)))
+	mux.Handle("/api/export", authMiddleware.RequireAPIKey(http.HandlerFunc(h.APIExport)))
 
-	// Wrap with session middleware and security headers
-	handler := middleware.SecurityHeaders(sessionMgr.LoadAndSave(mux))
+	// Grafana SimpleJSON datasource (API key-based)
+	mux.Handle("/grafana/", authMiddleware.RequireAPIKey(http.HandlerFunc(h.GrafanaTest)))
+	mux.Handle("/grafana/search", authMiddleware.RequireAPIKey(http.HandlerFunc(h.GrafanaSearch)))
+	mux.Handle("/grafana/query", authMiddleware.RequireAPIKey(http.HandlerFunc(h.GrafanaQuery)))
+	mux.Handle("/grafana/annotations", authMiddleware.RequireAPIKey(http.HandlerFunc(h.GrafanaAnnotations)))
+
+	// Admin routes (admin token, only when configured)
+	if adminToken := os.Getenv("ADMIN_TOKEN"); adminToken != "" {
+		mux.Handle("/admin/backup", auth.RequireAdminToken(adminToken, http.HandlerFunc(h.AdminBackup)))
+	}
+
+	// Wrap with session middleware, security headers and request IDs
+	handler := middleware.RequestID(middleware.SecurityHeaders(sessionMgr.LoadAndSave(withBasePath(basePath, mux))))
 
 	// Start server
 	addr := ":" + port
-	log.Printf("Starting cctop-server %s on %s", version, addr)
-	log.Printf("Database: %s", dbPath)
+	slog.Info("Starting cctop-server", "version", version, "addr", addr, "database", dbPath, "base_path", basePath, "tls", useTLS, "summary_mode", handlers.SummaryMode)
 
-	if err := http.ListenAndServe(addr, handler); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	switch {
+	case tlsDomain != "":
+		httpAddr := ":" + getEnv("HTTP_PORT", "80")
+		err = serveAutocert(addr, httpAddr, handler, tlsDomain, filepath.Join(filepath.Dir(dbPath), "autocert"))
+	case tlsCert != "":
+		err = http.ListenAndServeTLS(addr, tlsCert, tlsKey, handler)
+	default:
+		err = http.ListenAndServe(addr, handler)
+	}
+	if err != nil {
+		fatal("Server failed", "error", err)
+	}
+}
+
+// getTLSConfig returns TLS_CERT and TLS_KEY, certificate and key files to
+// serve HTTPS with, or TLS_DOMAIN, a domain to get a Let's Encrypt
+// certificate for. All are empty to serve plain HTTP.
+func getTLSConfig() (cert, key, domain string) {
+	cert, key, domain = os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY"), os.Getenv("TLS_DOMAIN")
+	if (cert == "") != (key == "") {
+		fatal("TLS_CERT and TLS_KEY must be set together")
+	}
+	if domain != "" && cert != "" {
+		fatal("Set either TLS_DOMAIN or TLS_CERT and TLS_KEY, not both")
+	}
+	return cert, key, domain
+}
+
+// serveAutocert serves HTTPS on addr with a certificate for domain from
+// Let's Encrypt, cached in cacheDir. Let's Encrypt validates the domain on
+// port 443 (the TLS-ALPN challenge, answered on addr) or port 80 (the
+// HTTP challenge, answered on httpAddr, which otherwise redirects to
+// HTTPS), so one of them must reach the server from the internet.
+func serveAutocert(addr, httpAddr string, handler http.Handler, domain, cacheDir string) error {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domain),
+		Cache:      autocert.DirCache(cacheDir),
+	}
+	go func() {
+		// The TLS-ALPN challenge still works without it
+		if err := http.ListenAndServe(httpAddr, m.HTTPHandler(nil)); err != nil {
+			slog.Error("Failed to serve the HTTP challenge", "addr", httpAddr, "error", err)
+		}
+	}()
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: m.TLSConfig(),
+	}
+	return server.ListenAndServeTLS("", "")
+}
+
+// setupLogger installs a JSON logger in production and a text logger otherwise
+func setupLogger() {
+	var handler slog.Handler
+	if strings.ToLower(os.Getenv("ENV")) == "production" {
+		handler = slog.NewJSONHandler(os.Stderr, nil)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, nil)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// pruneLoop deletes raw records older than the retention period once a day
+func pruneLoop(db *database.DB, retentionDays int) {
+	for {
+		cutoff := time.Now().AddDate(0, 0, -retentionDays)
+		if n, err := db.PruneRecordsOlderThan(cutoff); err != nil {
+			slog.Error("Failed to prune records", "error", err)
+		} else if n > 0 {
+			slog.Info("Pruned old records", "deleted", n, "retention_days", retentionDays)
+		}
+		time.Sleep(24 * time.Hour)
 	}
 }
 
@@ -109,6 +263,34 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvInt returns an integer env var, exiting if it is set but invalid
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		fatal("Invalid "+key, "value", value)
+	}
+	return n
+}
+
+// getEnvBool returns a boolean env var, exiting if it is set but invalid
+func getEnvBool(key string, defaultValue bool) bool {
+	switch value := strings.ToLower(os.Getenv(key)); value {
+	case "":
+		return defaultValue
+	case "true", "1", "yes":
+		return true
+	case "false", "0", "no":
+		return false
+	default:
+		fatal("Invalid "+key, "value", value)
+		return false
+	}
+}
+
 func getDBPath() string {
 	// Env var takes precedence (for Docker, custom deployments)
 	if path := os.Getenv("DB_PATH"); path != "" {
@@ -124,6 +306,29 @@ func getDBPath() string {
 	return filepath.Join(configDir, "cctop-server", "cctop.db")
 }
 
+// getBasePath returns BASE_PATH, the path prefix to serve everything under
+// when behind a reverse proxy (e.g. "/cctop"), without a trailing slash.
+// It's empty when serving from the root.
+func getBasePath() string {
+	path := strings.Trim(os.Getenv("BASE_PATH"), "/")
+	if path == "" {
+		return ""
+	}
+	return "/" + path
+}
+
+// withBasePath serves mux under basePath, redirecting the bare prefix to
+// the dashboard
+func withBasePath(basePath string, mux http.Handler) http.Handler {
+	if basePath == "" {
+		return mux
+	}
+	root := http.NewServeMux()
+	root.Handle(basePath+"/", http.StripPrefix(basePath, mux))
+	root.Handle(basePath, http.RedirectHandler(basePath+"/", http.StatusMovedPermanently))
+	return root
+}
+
 func isDevelopment() bool {
 	env := strings.ToLower(os.Getenv("ENV"))
 	return env == "development" || env == "dev"